@@ -0,0 +1,306 @@
+package iocap
+
+import (
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestBank(t *testing.T) {
+	clock := newFakeClock()
+	w := NewWriter(ioutil.Discard, RateOpts{
+		Interval: 100 * time.Millisecond,
+		Size:     100,
+		MaxBank:  1000,
+	})
+	w.bucket.clock = clock
+
+	// Use up the first interval, then go idle for a second.
+	w.Write(make([]byte, 100))
+	clock.Advance(time.Second)
+
+	// The nine idle intervals were banked. Along with the quota of the
+	// current interval, the burst completes without waiting.
+	start := clock.Now()
+	if _, err := w.Write(make([]byte, 1000)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d := clock.Now().Sub(start); d != 0 {
+		t.Fatalf("burst should not wait, took %s", d)
+	}
+
+	// The credit is spent, so sustained traffic goes at the base rate.
+	start = clock.Now()
+	if _, err := w.Write(make([]byte, 1000)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d := clock.Now().Sub(start); d != time.Second {
+		t.Fatalf("expect 1s, took %s", d)
+	}
+}
+
+func TestBank_Average(t *testing.T) {
+	clock := newFakeClock()
+	rate := RateOpts{
+		Interval: 100 * time.Millisecond,
+		Size:     100,
+		MaxBank:  500,
+	}
+	w := NewWriter(ioutil.Discard, rate)
+	w.SetClock(clock)
+
+	// Alternate idle periods with bursts larger than the bank.
+	start := clock.Now()
+	var total int
+	for i := 0; i < 20; i++ {
+		clock.Advance(time.Duration(i%4) * 300 * time.Millisecond)
+		n, err := w.Write(make([]byte, 800))
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		total += n
+	}
+
+	// Bursts never beat the base rate over the long run, beyond the
+	// initial quota and credit.
+	intervals := int(clock.Now().Sub(start) / rate.Interval)
+	if max := intervals*rate.Size + rate.Size + rate.MaxBank; total > max {
+		t.Fatalf("expect at most %d bytes in %d intervals, got: %d", max, intervals, total)
+	}
+}
+
+func TestBank_Cap(t *testing.T) {
+	clock := newFakeClock()
+	w := NewWriter(ioutil.Discard, RateOpts{
+		Interval: 100 * time.Millisecond,
+		Size:     100,
+		MaxBank:  300,
+	})
+	w.bucket.clock = clock
+
+	// A long idle period only banks up to the cap.
+	w.Write(make([]byte, 100))
+	clock.Advance(time.Hour)
+
+	start := clock.Now()
+	if _, err := w.Write(make([]byte, 600)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// 100 bytes of quota and 300 of credit go immediately, and the rest
+	// takes two more intervals.
+	if d := clock.Now().Sub(start); d != 200*time.Millisecond {
+		t.Fatalf("expect 200ms, took %s", d)
+	}
+}
+
+func TestBank_Disabled(t *testing.T) {
+	clock := newFakeClock()
+	w := NewWriter(ioutil.Discard, RateOpts{Interval: 100 * time.Millisecond, Size: 100})
+	w.bucket.clock = clock
+
+	// Without banking, idleness is simply lost.
+	w.Write(make([]byte, 100))
+	clock.Advance(time.Second)
+
+	start := clock.Now()
+	w.Write(make([]byte, 300))
+	if d := clock.Now().Sub(start); d != 200*time.Millisecond {
+		t.Fatalf("expect 200ms, took %s", d)
+	}
+}
+
+func TestBurst(t *testing.T) {
+	clock := newFakeClock()
+	g := NewGroup(RateOpts{
+		Interval: 100 * time.Millisecond,
+		Size:     100,
+		Burst:    1000,
+	})
+	g.bucket.clock = clock
+	w := g.NewWriter(ioutil.Discard)
+
+	// A new limiter allows the full burst at once.
+	start := clock.Now()
+	if _, err := w.Write(make([]byte, 1000)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d := clock.Now().Sub(start); d != 0 {
+		t.Fatalf("burst should not wait, took %s", d)
+	}
+
+	// Then settles into the sustained rate.
+	start = clock.Now()
+	if _, err := w.Write(make([]byte, 1000)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d := clock.Now().Sub(start); d != time.Second {
+		t.Fatalf("expect 1s, took %s", d)
+	}
+
+	// Going idle replenishes the burst.
+	clock.Advance(time.Second)
+	start = clock.Now()
+	if _, err := w.Write(make([]byte, 1000)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d := clock.Now().Sub(start); d != 0 {
+		t.Fatalf("burst should not wait, took %s", d)
+	}
+
+	// Lowering the burst at runtime caps the credit.
+	clock.Advance(time.Second)
+	g.SetRate(RateOpts{Interval: 100 * time.Millisecond, Size: 100, Burst: 300})
+	start = clock.Now()
+	if _, err := w.Write(make([]byte, 600)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d := clock.Now().Sub(start); d != 300*time.Millisecond {
+		t.Fatalf("expect 300ms, took %s", d)
+	}
+}
+
+func TestBurst_Smooth(t *testing.T) {
+	clock := newFakeClock()
+	r := NewReader(zeroReader{}, RateOpts{
+		Interval: 100 * time.Millisecond,
+		Size:     100,
+		Burst:    500,
+	})
+	r.bucket.clock = clock
+
+	// The smooth limiter holds the burst, then leaks at the base rate.
+	start := clock.Now()
+	if _, err := r.Read(make([]byte, 500)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d := clock.Now().Sub(start); d != 0 {
+		t.Fatalf("burst should not wait, took %s", d)
+	}
+	if _, err := r.Read(make([]byte, 100)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d := clock.Now().Sub(start); d != 100*time.Millisecond {
+		t.Fatalf("expect 100ms, took %s", d)
+	}
+}
+
+// zeroReader is an endless source of zero bytes.
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func TestOverhead(t *testing.T) {
+	rate := RateOpts{Interval: 100 * time.Millisecond, Size: 100}
+	clock := newFakeClock()
+
+	// 10000 bytes at the base rate take 99 drains.
+	w := NewWriter(ioutil.Discard, rate)
+	w.SetClock(clock)
+	start := clock.Now()
+	if _, err := w.Write(make([]byte, 10000)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	base := clock.Now().Sub(start)
+	if base != 9900*time.Millisecond {
+		t.Fatalf("expect 9.9s, took %s", base)
+	}
+
+	// Charging 10% more per byte takes 10% longer.
+	rate.Weight = 1.1
+	w = NewWriter(ioutil.Discard, rate)
+	w.SetClock(clock)
+	start = clock.Now()
+	n, err := w.Write(make([]byte, 10000))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if n != 10000 {
+		t.Fatalf("expect 10000, got: %d", n)
+	}
+	if d := clock.Now().Sub(start); d < 10800*time.Millisecond || d > 11100*time.Millisecond {
+		t.Fatalf("expect ~10.9s, took %s", d)
+	}
+
+	// Reads are charged the same, plus a fixed overhead per read of 10
+	// bytes.
+	rate.Weight = 0
+	rate.Overhead = 10
+	r := NewReader(byteReader{zeroReader{}}, rate)
+	r.SetClock(clock)
+	start = clock.Now()
+	if n, err = io.ReadFull(r, make([]byte, 100)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if n != 100 {
+		t.Fatalf("expect 100, got: %d", n)
+	}
+	if d := clock.Now().Sub(start); d != time.Second {
+		t.Fatalf("expect 1s, took %s", d)
+	}
+}
+
+func TestStartFull(t *testing.T) {
+	clock := newFakeClock()
+	rate := RateOpts{Interval: 100 * time.Millisecond, Size: 128}
+
+	cases := []struct {
+		name   string
+		rate   RateOpts
+		expect time.Duration
+	}{
+		{"empty", rate, 0},
+		{"full", RateOpts{Interval: rate.Interval, Size: rate.Size, Coarse: true, StartFull: true}, 100 * time.Millisecond},
+		{"burst", RateOpts{Interval: rate.Interval, Size: rate.Size, Burst: 256, Coarse: true, StartFull: true}, 100 * time.Millisecond},
+		{"smooth", RateOpts{Interval: rate.Interval, Size: rate.Size, StartFull: true}, 9375 * time.Microsecond},
+	}
+	for _, c := range cases {
+		w := NewWriter(ioutil.Discard, c.rate)
+		w.SetClock(clock)
+		start := clock.Now()
+		if _, err := w.Write(make([]byte, 12)); err != nil {
+			t.Fatalf("%s: err: %v", c.name, err)
+		}
+		if d := clock.Now().Sub(start); d != c.expect {
+			t.Fatalf("%s: expect %s, took %s", c.name, c.expect, d)
+		}
+	}
+}
+
+func TestStartFull_SetRate(t *testing.T) {
+	clock := newFakeClock()
+	rate := RateOpts{Interval: 100 * time.Millisecond, Size: 128, StartFull: true, Coarse: true}
+
+	// A rate set before first use still starts out full.
+	w := NewWriter(ioutil.Discard, Unlimited)
+	w.SetClock(clock)
+	w.SetRate(rate)
+	start := clock.Now()
+	w.Write(make([]byte, 128))
+	if d := clock.Now().Sub(start); d != 100*time.Millisecond {
+		t.Fatalf("expect 100ms, took %s", d)
+	}
+
+	// Changing the rate later keeps the consumed quota.
+	rate.Size = 256
+	w.SetRate(rate)
+	start = clock.Now()
+	w.Write(make([]byte, 128))
+	if d := clock.Now().Sub(start); d != 0 {
+		t.Fatalf("expect no wait, took %s", d)
+	}
+
+	// A reset starts out full again.
+	w.Reset()
+	start = clock.Now()
+	w.Write(make([]byte, 1))
+	if d := clock.Now().Sub(start); d != 100*time.Millisecond {
+		t.Fatalf("expect 100ms, took %s", d)
+	}
+}
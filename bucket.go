@@ -2,6 +2,7 @@ package iocap
 
 import (
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -9,16 +10,71 @@ import (
 // limit the number of operations (in this case, byte reads/writes)
 // allowed within a given interval.
 type bucket struct {
-	opts    RateOpts
-	drained time.Time
-
 	// Tokens is the number of tokens present in the bucket. A simple int is
 	// used to allow for faster token acquisition, rather than a channel.
 	// Arguably, due to the blocking nature of iocap, a channel may be
 	// theoretically more appropriate for this use. The reality pitfall is
 	// that billions of channel reads are far more expensive than taking a
 	// lock and doing basic math.
-	tokens int
+	//
+	// Inserts which fit take tokens with a compare-and-swap while holding
+	// only the read lock, so tokens must be accessed atomically while the
+	// read lock is held. Holding the write lock excludes those inserts. It
+	// is kept first in the struct for 64-bit alignment.
+	tokens int64
+
+	// gen is incremented on every change to the bucket, allowing a pacing
+	// schedule to detect that it has been invalidated. Like tokens, it is
+	// updated atomically under the read lock.
+	gen uint64
+
+	opts    RateOpts
+	drained time.Time
+
+	// credit is the banked quota available for spending once the bucket is
+	// full, if banking is enabled by the rate.
+	credit int
+
+	// debt is the number of tokens reserved beyond a full bucket, which
+	// take the quota of the following drains.
+	debt int
+
+	// clock is the source of time for draining.
+	clock Clock
+
+	// saturation is an optional utilization monitor, evaluated whenever
+	// the bucket drains or leaks.
+	saturation *saturation
+
+	// ramp is an in-progress rate transition, stepped whenever the bucket
+	// drains.
+	ramp *ramp
+
+	// waiting is the number of inserts blocked on a full bucket, accessed
+	// atomically. Pacing schedules are abandoned while others are waiting.
+	waiting int32
+
+	// pacing is the number of operations sleeping on a pacing schedule,
+	// accessed atomically. Like waiting inserts, they are served before
+	// inserts which don't block.
+	pacing int32
+
+	// waiters is the queue of blocked inserts, served in order. Only the
+	// insert at the head waits for the bucket to drain; the others wait for
+	// their channel to be closed when they reach the head.
+	waiters []chan struct{}
+
+	// trace holds the *Trace recording acquisitions, if enabled.
+	trace atomic.Value
+
+	// changed is closed and replaced whenever the rate is changed, waking
+	// any operations waiting on the bucket to re-evaluate it.
+	changed chan struct{}
+
+	// windows are further buckets, each limiting the same operations at a
+	// rate of its own, which are charged along with this one. See
+	// newMultiBucket.
+	windows []*bucket
 
 	l sync.RWMutex
 }
@@ -26,7 +82,9 @@ type bucket struct {
 // newBucket creates a new bucket to use for readers and writers.
 func newBucket(opts RateOpts) *bucket {
 	return &bucket{
-		opts: opts,
+		opts:    opts,
+		clock:   realClock{},
+		changed: make(chan struct{}),
 	}
 }
 
@@ -34,98 +92,828 @@ func newBucket(opts RateOpts) *bucket {
 // the number of tokens inserted, which will differ from n if the
 // bucket overflows. insert will block until at least one token is
 // successfully inserted.
-func (b *bucket) insert(n int) (v int) {
+func (b *bucket) insert(n int) int {
+	v, _ := b.acquire(n, new(schedule), nil)
+	return v
+}
+
+// insertUntil is like insert, but gives up waiting for the bucket once done
+// is closed, returning false without inserting any tokens.
+//
+// Inserts which find the bucket full queue up, and are served in the order
+// they arrived. The insert at the head of the queue sleeps until the next
+// drain, takes its tokens and then hands the head over to the next one, so
+// that no insert is starved by others repeatedly winning the race for the
+// drained bucket.
+func (b *bucket) insertUntil(n int, done <-chan struct{}) (int, bool) {
+	// Nothing is inserted for an empty operation, so it never waits, even
+	// on a full bucket.
+	if n <= 0 {
+		return 0, true
+	}
+	if v, ok := b.insertFast(n); ok {
+		return v, true
+	}
+
 	// Call a non-blocking drain up-front to make room for tokens.
 	b.drain(false)
 
-INSERT:
-	var remain int
+	// w is the place of the insert in the queue, once it is waiting.
+	var w chan struct{}
+	defer func() {
+		if w != nil {
+			b.dequeue(w)
+		}
+	}()
 
+	for {
+		b.l.Lock()
+		if b.opts.IsUnlimited() {
+			// No limit should be applied.
+			b.l.Unlock()
+			return n, true
+		}
+
+		// Take what the bucket has room for, unless others are ahead in
+		// the queue.
+		if len(b.waiters) == 0 || b.waiters[0] == w {
+			if v := b.takeLocked(n); v > 0 {
+				b.l.Unlock()
+				return v, true
+			}
+		}
+
+		if w == nil {
+			w = make(chan struct{})
+			b.waiters = append(b.waiters, w)
+			atomic.AddInt32(&b.waiting, 1)
+		}
+		head := b.waiters[0] == w
+		changed := b.changed
+		b.l.Unlock()
+
+		if head {
+			// Wait for the next drain interval (earliest we can insert
+			// more tokens).
+			if !b.drainUntil(done) {
+				return 0, false
+			}
+			continue
+		}
+
+		// Wait to reach the head of the queue. A change of the rate is
+		// re-evaluated right away, as the bucket may now be unlimited.
+		select {
+		case <-w:
+		case <-changed:
+		case <-done:
+			return 0, false
+		}
+	}
+}
+
+// insertFast inserts as many of n tokens as the bucket has room for while
+// holding only the read lock, so that concurrent inserts don't contend on
+// the write lock. It gives up, returning false, whenever the bucket needs
+// more than a compare-and-swap of the token count: if it is full, due to
+// drain, or others are waiting on it.
+//
+// Smooth buckets are not leaked here, so the room is that left at the last
+// leak. That only holds while the tokens held outnumber those due to leak
+// since: an insert then leaves the same tokens behind whether it comes
+// before or after the leak. Otherwise the slow path leaks first.
+func (b *bucket) insertFast(n int) (int, bool) {
 	b.l.RLock()
-	tokens := b.tokens
-	opts := b.opts
-	b.l.RUnlock()
+	defer b.l.RUnlock()
 
-	switch {
-	case opts == Unlimited:
-		// No limit should be applied.
-		return n
+	if b.opts.IsUnlimited() {
+		return n, true
+	}
+	if len(b.waiters) > 0 {
+		return 0, false
+	}
 
-	case tokens == opts.Size:
-		// Bucket is full. Call a blocking drain to wait for the next
-		// drain interval (earliest we can insert more tokens).
-		b.drain(true)
-		goto INSERT
+	smooth := b.opts.smooth()
+	var leak float64
+	elapsed := b.clock.Now().Sub(b.drained)
+	switch {
+	case !smooth && elapsed >= b.opts.Interval:
+		return 0, false
+	case smooth:
+		if b.drained.IsZero() || b.opts.Size <= 0 || b.opts.Interval <= 0 {
+			return 0, false
+		}
+		leak = float64(b.opts.Size) * float64(elapsed) / float64(b.opts.Interval)
+	}
 
-	case tokens+n > opts.Size:
-		// Some tokens, but not all, were inserted. The bucket is now
-		// full and subsequent inserts will overflow and block.
-		v = opts.Size - tokens
-		remain = opts.Size
+	capacity := int64(b.opts.capacity())
+	for {
+		tokens := atomic.LoadInt64(&b.tokens)
+		if smooth && leak >= float64(tokens) {
+			return 0, false
+		}
+		v := capacity - tokens
+		switch {
+		case v <= 0:
+			return 0, false
+		case v > int64(n):
+			v = int64(n)
+		case smooth && v < int64(b.stepLocked()):
+			return 0, false
+		}
+		if atomic.CompareAndSwapInt64(&b.tokens, tokens, tokens+v) {
+			atomic.AddUint64(&b.gen, 1)
+			return int(v), true
+		}
+	}
+}
 
-	default:
-		// All tokens inserted successfully.
+// takeLocked inserts as many of n tokens as the bucket has room for,
+// spending banked credit once it is full. It returns the number of tokens
+// taken, which is zero if the bucket is full and has no credit. Must be
+// called with the lock held.
+func (b *bucket) takeLocked(n int) int {
+	// The room left is compared against rather than summing, so that huge
+	// inserts into huge buckets cannot wrap around. The bucket may also be
+	// over-full after the rate was lowered.
+	v := b.opts.capacity() - int(b.tokens)
+	switch {
+	case v <= 0:
+		return b.spendLocked(n)
+	case v >= n:
 		v = n
-		remain = tokens + n
+	case b.opts.smooth() && v < b.stepLocked():
+		// Smooth buckets make room a step at a time, rather than handing
+		// out every few tokens leaked.
+		return 0
 	}
+	b.tokens += int64(v)
+	b.gen++
+	return v
+}
 
+// dequeue removes w from the queue of waiting inserts. If w was at the
+// head, the next insert in the queue takes over.
+func (b *bucket) dequeue(w chan struct{}) {
 	b.l.Lock()
+	defer b.l.Unlock()
 
-	// Check if the token count was modified before the lock
-	// was acquired.
-	if b.tokens != tokens {
-		b.l.Unlock()
-		goto INSERT
+	for i, v := range b.waiters {
+		if v != w {
+			continue
+		}
+		b.waiters = append(b.waiters[:i], b.waiters[i+1:]...)
+		if i == 0 && len(b.waiters) > 0 {
+			close(b.waiters[0])
+		}
+		atomic.AddInt32(&b.waiting, -1)
+		return
 	}
+}
 
-	b.tokens = remain
-	b.l.Unlock()
-	return
+// wait blocks until the bucket has room for at least one token, without
+// inserting any.
+func (b *bucket) wait() {
+	for {
+		b.drain(false)
+
+		b.l.RLock()
+		ready := b.opts.IsUnlimited() || int(atomic.LoadInt64(&b.tokens)) < b.opts.capacity() || b.credit > 0
+		b.l.RUnlock()
+
+		if ready {
+			return
+		}
+		b.drain(true)
+	}
+}
+
+// tryInsert is like insert, but never blocks. If the bucket is full and has
+// no banked credit, zero is returned and no tokens are inserted. Inserts
+// already waiting on the bucket are served first, so zero is also returned
+// while any are queued or pacing.
+func (b *bucket) tryInsert(n int) int {
+	v := b.tryTake(n)
+	if v > 0 && len(b.windows) > 0 {
+		v, _ = b.takeWindows(v)
+	}
+	return v
+}
+
+// tryTake implements tryInsert for this bucket alone, regardless of its
+// windows.
+func (b *bucket) tryTake(n int) int {
+	if n <= 0 {
+		return 0
+	}
+	b.drain(false)
+
+	b.l.Lock()
+	defer b.l.Unlock()
+
+	if b.opts.IsUnlimited() {
+		return n
+	}
+	if len(b.waiters) > 0 || atomic.LoadInt32(&b.pacing) > 0 {
+		return 0
+	}
+	return b.takeLocked(n)
 }
 
 // drain is used to drain the bucket of tokens. If wait is true, drain
 // will wait until the next drain cycle and then continue. Otherwise,
 // drain only drains the bucket if it is due.
 //
-// This implementation is heavy-handed in that it brackets "leaking" tokens
-// to the full duration of the configured interval. In other words, the
-// bucket leaks not in single drops, but rather multiples, and only when the
-// token drain window has elapsed. This side-steps near-hot-looping with
-// dense token expiration (short interval + high size) and heavy lock
-// contention. A possible enhancement would be to make this more granular.
+// Smooth rates, the default, leak on every call; see leakLocked. Coarse
+// rates bracket "leaking" tokens to the full duration of the configured
+// interval. In other words, the bucket leaks not in single drops, but rather
+// multiples, and only when the token drain window has elapsed. This
+// side-steps near-hot-looping with dense token expiration (short interval +
+// high size) and heavy lock contention.
 func (b *bucket) drain(wait bool) {
 	b.l.RLock()
 	last := b.drained
 	interval := b.opts.Interval
+	smooth := b.opts.smooth()
 	b.l.RUnlock()
 
+	now := b.clock.Now()
+
+	if smooth {
+		if wait {
+			b.drainUntil(nil)
+			return
+		}
+
+		b.l.Lock()
+		var notify func(Stats)
+		var stats Stats
+		if b.drained.Equal(last) {
+			notify, stats = b.leakLocked(now)
+		}
+		b.l.Unlock()
+
+		if notify != nil {
+			notify(stats)
+		}
+		return
+	}
+
 	switch {
-	case time.Since(last) >= interval:
+	case now.Sub(last) >= interval:
 		b.l.Lock()
-		defer b.l.Unlock()
 
 		// Make sure the timestamp was not updated; prevents a time-of-
 		// check vs. time-of-use error.
 		if !b.drained.Equal(last) {
+			b.l.Unlock()
 			return
 		}
 
-		// Drain the bucket.
-		b.tokens = 0
+		notify, stats := b.drainLocked(last, now)
+		b.l.Unlock()
 
-		// Update the drain timestamp.
-		b.drained = time.Now()
+		// Notify outside of the lock so the callback may use the bucket.
+		if notify != nil {
+			notify(stats)
+		}
 
 	case wait:
-		delay := last.Add(interval).Sub(time.Now())
-		time.Sleep(delay)
-		b.drain(false)
+		b.drainUntil(nil)
+	}
+}
+
+// drainUntil waits for the next drain cycle and then drains the bucket,
+// like drain(true). It gives up if done is closed first, returning false.
+// A change of the rate cuts the wait short, without draining.
+func (b *bucket) drainUntil(done <-chan struct{}) bool {
+	b.l.RLock()
+	due := b.due()
+	changed := b.changed
+	b.l.RUnlock()
+
+	if !b.sleep(due.Sub(b.clock.Now()), changed, done) {
+		select {
+		case <-changed:
+			return true
+		default:
+			return false
+		}
+	}
+	b.drain(false)
+	return true
+}
+
+// sleep sleeps for d, or until either changed or done is closed, reporting
+// whether the full duration passed.
+func (b *bucket) sleep(d time.Duration, changed, done <-chan struct{}) bool {
+	if done == nil {
+		return b.clock.Sleep(d, changed)
+	}
+
+	// The real clock can wait on both channels at once.
+	if _, ok := b.clock.(realClock); ok && loadPacer() == nil {
+		return sleepEither(d, changed, done)
+	}
+
+	// Merge the channels for other clocks. Waits only happen once per
+	// interval, so the extra goroutine is cheap enough.
+	either := make(chan struct{})
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-changed:
+		case <-done:
+		case <-stop:
+			return
+		}
+		close(either)
+	}()
+	return b.clock.Sleep(d, either)
+}
+
+// notifyLocked wakes any operations waiting on the bucket after a change
+// of the rate. Must be called with the lock held.
+func (b *bucket) notifyLocked() {
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+// smoothSteps is the number of steps a smooth bucket leaks its size in
+// while it is full, to avoid waking up for every few tokens.
+const smoothSteps = 10
+
+// stepLocked returns the number of tokens a full smooth bucket waits to
+// leak before making room. Must be called with the lock held.
+func (b *bucket) stepLocked() int {
+	if step := b.opts.Size / smoothSteps; step > 1 {
+		return step
+	}
+	return 1
+}
+
+// due returns the time at which a full bucket next makes room for more
+// tokens. Must be called with the lock held.
+func (b *bucket) due() time.Time {
+	if !b.opts.smooth() || b.opts.Size <= 0 {
+		return b.drained.Add(b.opts.Interval)
+	}
+
+	need := int(atomic.LoadInt64(&b.tokens)) - b.opts.capacity() + b.stepLocked()
+	if need <= 0 {
+		return b.drained
+	}
+	return b.drained.Add(time.Duration(float64(need) * float64(b.opts.Interval) / float64(b.opts.Size)))
+}
+
+// leakLocked leaks tokens from a smooth bucket in proportion to the time
+// passed since the last leak, like drainLocked does for coarse ones. It
+// returns the saturation callback to notify, if any, which must be called
+// after releasing the lock. Must be called with the lock held.
+func (b *bucket) leakLocked(now time.Time) (func(Stats), Stats) {
+	b.advanceRamp(now)
+	if b.opts.Size <= 0 || b.opts.Interval <= 0 {
+		return nil, Stats{}
+	}
+
+	n := b.leakTokensLocked(now)
+	if b.saturation == nil {
+		return nil, Stats{}
+	}
+	return b.saturation.leak(b.opts, int(b.tokens), n, now)
+}
+
+// leakTokensLocked implements leakLocked, returning the number of tokens
+// leaked. The leak time only advances by the time worth of the tokens
+// leaked, so that fractions of tokens carry over to later calls. Must be
+// called with the lock held.
+func (b *bucket) leakTokensLocked(now time.Time) int {
+	if b.drained.IsZero() && b.opts.StartFull {
+		b.tokens = int64(b.opts.capacity())
+		b.drained = now
+		b.gen++
+		return 0
+	}
+
+	elapsed := now.Sub(b.drained)
+	leaked := float64(b.opts.Size) * float64(elapsed) / float64(b.opts.Interval)
+	var n int64
+	switch {
+	case leaked >= float64(b.tokens):
+		n = b.tokens
+		b.tokens = 0
+		b.drained = now
+	case leaked >= 1:
+		// Only leak the tokens worth the whole nanoseconds advanced, so
+		// that fast rates don't leak a token without advancing at all.
+		d := time.Duration(float64(int64(leaked)) * float64(b.opts.Interval) / float64(b.opts.Size))
+		if n = int64(float64(d) * float64(b.opts.Size) / float64(b.opts.Interval)); n <= 0 {
+			return 0
+		}
+		b.tokens -= n
+		b.drained = b.drained.Add(d)
+	default:
+		return 0
+	}
+	b.gen++
+	return int(n)
+}
+
+// chargeOverhead inserts the extra tokens charged by the rate for an
+// operation on n bytes, blocking until all of them are inserted. Charging
+// invalidates the schedule s. It gives up once done is closed, returning
+// false.
+func (b *bucket) chargeOverhead(n int, s *schedule, done <-chan struct{}) bool {
+	b.l.RLock()
+	extra := b.opts.overhead(n)
+	b.l.RUnlock()
+
+	if extra > 0 {
+		s.valid = false
+	}
+	for extra > 0 {
+		v, ok := b.insertUntil(extra, done)
+		if !ok {
+			return false
+		}
+		extra -= v
+	}
+	for _, w := range b.windows {
+		w.chargeOverheadNow(n)
+	}
+	return true
+}
+
+// chargeOverheadNow is like chargeOverhead, but never blocks. Overhead
+// beyond the room left in the bucket overfills it, holding back later
+// operations until it drains.
+func (b *bucket) chargeOverheadNow(n int) {
+	for _, w := range b.windows {
+		w.chargeOverheadNow(n)
+	}
+
+	b.l.Lock()
+	defer b.l.Unlock()
+
+	if extra := b.opts.overhead(n); extra > 0 && !b.opts.IsUnlimited() {
+		b.tokens += int64(extra)
+		b.gen++
+	}
+}
+
+// allowance blocks until up to n tokens could be inserted, like insertUntil,
+// and returns their number without keeping them. It gives up once done is
+// closed, returning false.
+func (b *bucket) allowance(n int, done <-chan struct{}) (int, bool) {
+	v, ok := b.insertUntil(n, done)
+	if !ok {
+		return 0, false
+	}
+	b.giveBack(v)
+
+	// The allowance is the smallest of those of the windows.
+	for _, w := range b.windows {
+		if v, ok = w.allowance(v, done); !ok {
+			return 0, false
+		}
+	}
+	return v, true
+}
+
+// postCharge inserts the tokens for an operation on n bytes which already
+// happened, along with the overhead of the rate, without blocking. Tokens
+// beyond the room left in the bucket are carried as debt, holding back later
+// operations until they are paid off.
+func (b *bucket) postCharge(n int) {
+	if n <= 0 {
+		return
+	}
+	b.l.RLock()
+	extra := b.opts.overhead(n)
+	b.l.RUnlock()
+	b.reserveOwn(n+extra, true)
+	for _, w := range b.windows {
+		w.postCharge(n)
+	}
+}
+
+// postCharged returns whether operations on the bucket are charged after
+// they happen.
+func (b *bucket) postCharged() bool {
+	b.l.RLock()
+	defer b.l.RUnlock()
+	return b.opts.PostCharge
+}
+
+// refund gives back n tokens which were inserted but not used, to the
+// bucket and its windows.
+func (b *bucket) refund(n int) {
+	b.giveBack(n)
+	for _, w := range b.windows {
+		w.giveBack(n)
+	}
+}
+
+// giveBack implements refund for this bucket alone, regardless of its
+// windows.
+func (b *bucket) giveBack(n int) {
+	b.l.Lock()
+	defer b.l.Unlock()
+
+	if b.opts.IsUnlimited() || n <= 0 {
+		return
+	}
+	if b.tokens -= int64(n); b.tokens < 0 {
+		b.tokens = 0
+	}
+	b.gen++
+}
+
+// drainLocked drains the bucket at now, given the time of the previous
+// drain. It returns the saturation callback to notify, if any, which must be
+// called after releasing the lock. Must be called with the lock held.
+func (b *bucket) drainLocked(last, now time.Time) (func(Stats), Stats) {
+	// Record the utilization of the interval(s) which just ended.
+	var notify func(Stats)
+	var stats Stats
+	if b.saturation != nil {
+		notify, stats = b.saturation.observe(b.opts, int(b.tokens), last, now)
+	}
+
+	// Bank the quota left unused since the previous drain.
+	b.bank(last, now)
+
+	// Drain the bucket, unless it is new and starts out full.
+	b.tokens = 0
+	if last.IsZero() && b.opts.StartFull {
+		b.tokens = int64(b.opts.capacity())
+	}
+
+	// Pay off any reserved debt, first with the intervals which passed
+	// since the previous drain, then with the quota of the new one.
+	if b.debt > 0 {
+		if b.opts.Interval > 0 && !last.IsZero() {
+			if idle := int64(now.Sub(last)/b.opts.Interval) - 1; idle > 0 {
+				if paid := idle * int64(b.opts.Size); paid < int64(b.debt) {
+					b.debt -= int(paid)
+				} else {
+					b.debt = 0
+				}
+			}
+		}
+		v := b.debt
+		if c := b.opts.capacity(); v > c {
+			v = c
+		}
+		b.tokens += int64(v)
+		b.debt -= v
+	}
+
+	// Update the drain timestamp. Later drains stay on the grid of whole
+	// intervals since the first, so that the time taken to get around to
+	// draining does not push back every interval which follows. The first
+	// drain may be delayed to keep buckets created together from draining
+	// in step.
+	b.drained = now
+	switch {
+	case last.IsZero():
+		b.drained = now.Add(b.opts.jitter())
+	case b.opts.Interval > 0:
+		if steps := now.Sub(last) / b.opts.Interval; steps > 0 {
+			b.drained = last.Add(steps * b.opts.Interval)
+		}
+	}
+
+	// Step the rate of any in-progress ramp.
+	b.advanceRamp(now)
+	b.gen++
+	return notify, stats
+}
+
+// bank adds the quota left unused between last and now to the banked
+// credit, up to the maximum of the rate. The first drain of a new bucket
+// banks nothing, but makes any burst of the rate available unless the
+// bucket starts full. Must be called with the lock held.
+func (b *bucket) bank(last, now time.Time) {
+	if last.IsZero() {
+		if b.opts.StartFull {
+			return
+		}
+		if burst := b.opts.burstCredit(); burst > b.credit {
+			b.credit = burst
+		}
+		return
+	}
+
+	max := b.opts.maxCredit()
+	if max <= 0 || b.opts.Interval <= 0 {
+		return
+	}
+
+	// The unused part of the interval which just ended, plus any whole
+	// intervals which passed without use.
+	unused := int64(b.opts.Size) - b.tokens
+	if unused < 0 {
+		unused = 0
+	}
+	if idle := int64(now.Sub(last)/b.opts.Interval) - 1; idle > 0 {
+		if idle > int64(max) {
+			idle = int64(max)
+		}
+		unused += idle * int64(b.opts.Size)
+	}
+
+	if credit := int64(b.credit) + unused; credit < int64(max) {
+		b.credit = int(credit)
+	} else {
+		b.credit = max
 	}
 }
 
-// setRate safely replaces the RateOpts on the bucket.
+// spendLocked takes up to n tokens from the banked credit, returning the
+// number taken. Credit is only spent once the bucket is full. Must be called
+// with the lock held.
+func (b *bucket) spendLocked(n int) int {
+	v := b.credit
+	if v > n {
+		v = n
+	}
+	if v > 0 {
+		b.credit -= v
+		b.gen++
+	}
+	return v
+}
+
+// setRate safely replaces the RateOpts on the bucket, canceling any
+// in-progress ramp.
 func (b *bucket) setRate(opts RateOpts) {
 	b.l.Lock()
 	b.opts = opts
+	b.ramp = nil
+	b.clampLocked()
+	if max := opts.maxCredit(); b.credit > max {
+		b.credit = max
+	}
+	b.gen++
+	b.notifyLocked()
+	b.l.Unlock()
+}
+
+// clampLocked limits the tokens in the bucket to its capacity, which may
+// have shrunk with a change of the rate. A bucket holding more than the new
+// capacity is simply full. Must be called with the lock held.
+func (b *bucket) clampLocked() {
+	if b.opts.IsUnlimited() {
+		return
+	}
+	if capacity := int64(b.opts.capacity()); b.tokens > capacity {
+		b.tokens = capacity
+	}
+}
+
+// available returns the number of tokens which can currently be inserted
+// without blocking, including banked credit. Nothing can be inserted while
+// others are waiting. It is the smallest of the bucket and its windows.
+func (b *bucket) available() int {
+	v := b.availableOwn()
+	for _, w := range b.windows {
+		if wv := w.available(); wv < v {
+			v = wv
+		}
+	}
+	return v
+}
+
+// availableOwn implements available for this bucket alone, regardless of
+// its windows.
+func (b *bucket) availableOwn() int {
+	b.drain(false)
+
+	b.l.RLock()
+	defer b.l.RUnlock()
+
+	if b.opts.IsUnlimited() {
+		return maxInt
+	}
+	if len(b.waiters) > 0 || atomic.LoadInt32(&b.pacing) > 0 {
+		return 0
+	}
+	v := b.opts.capacity() - int(atomic.LoadInt64(&b.tokens))
+	if v < 0 {
+		v = 0
+	}
+	if b.credit > maxInt-v {
+		return maxInt
+	}
+	return v + b.credit
+}
+
+// rate returns the RateOpts currently in effect on the bucket.
+func (b *bucket) rate() RateOpts {
+	b.l.Lock()
+	defer b.l.Unlock()
+	b.advanceRamp(b.clock.Now())
+	return b.opts
+}
+
+// reset clears the consumed tokens of the bucket, as if it was new, and
+// wakes any operations waiting on it.
+func (b *bucket) reset() {
+	for _, w := range b.windows {
+		w.reset()
+	}
+
+	b.l.Lock()
+	b.tokens = 0
+	b.debt = 0
+	b.drained = time.Time{}
+	b.gen++
+	b.notifyLocked()
+	b.l.Unlock()
+}
+
+// reserve returns the time to wait until n tokens could be inserted, given
+// the tokens and debt currently in the bucket. If commit is true, the tokens
+// are taken right away, and those beyond a full bucket and its credit are
+// carried as debt. Operations already waiting are not accounted for. The
+// boolean result is always true, as every rate eventually allows tokens.
+func (b *bucket) reserve(n int, commit bool) (time.Duration, bool) {
+	wait, _ := b.reserveOwn(n, commit)
+
+	// The wait is the longest of those of the windows.
+	for _, w := range b.windows {
+		if d, _ := w.reserve(n, commit); d > wait {
+			wait = d
+		}
+	}
+	return wait, true
+}
+
+// reserveOwn implements reserve for this bucket alone, regardless of its
+// windows.
+func (b *bucket) reserveOwn(n int, commit bool) (time.Duration, bool) {
+	b.drain(false)
+
+	b.l.Lock()
+	defer b.l.Unlock()
+
+	if b.opts.IsUnlimited() {
+		return 0, true
+	}
+
+	now := b.clock.Now()
+	capacity := b.opts.capacity()
+	wait := time.Duration(0)
+	if need := b.tokens + int64(b.debt) + int64(n) - int64(capacity) - int64(b.credit); need > 0 {
+		if b.opts.smooth() {
+			// Tokens leak continuously.
+			wait = b.drained.Add(time.Duration(float64(need) * float64(b.opts.Interval) / float64(b.opts.Size))).Sub(now)
+		} else {
+			// Every drain makes room for Size more tokens.
+			drains := (need + int64(b.opts.Size) - 1) / int64(b.opts.Size)
+			wait = b.drained.Add(time.Duration(drains) * b.opts.Interval).Sub(now)
+		}
+		if wait < 0 {
+			wait = 0
+		}
+	}
+
+	if commit && n > 0 {
+		if room := capacity - int(b.tokens); room > 0 {
+			if room > n {
+				room = n
+			}
+			b.tokens += int64(room)
+			n -= room
+		}
+		n -= b.spendLocked(n)
+		if n > 0 {
+			// Smooth buckets simply leak the excess over time.
+			if b.opts.smooth() {
+				b.tokens += int64(n)
+			} else {
+				b.debt += n
+			}
+		}
+		b.gen++
+	}
+	return wait, true
+}
+
+// snapshot returns a copy of the token state of the bucket.
+func (b *bucket) snapshot() Snapshot {
+	b.l.RLock()
+	defer b.l.RUnlock()
+	return Snapshot{Tokens: int(atomic.LoadInt64(&b.tokens)), Drained: b.drained}
+}
+
+// restore replaces the token state of the bucket.
+func (b *bucket) restore(s Snapshot) {
+	b.l.Lock()
+	b.tokens = int64(s.Tokens)
+	b.drained = s.Drained
+	b.gen++
 	b.l.Unlock()
 }
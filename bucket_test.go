@@ -1,18 +1,22 @@
 package iocap
 
 import (
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
 func TestBucketInsert(t *testing.T) {
 	// First create a bucket.
-	b := newBucket(RateOpts{Interval: 100 * time.Millisecond, Size: 256})
+	clock := newFakeClock()
+	b := newBucket(RateOpts{Interval: 100 * time.Millisecond, Size: 256, Coarse: true})
+	b.clock = clock
 
 	// Returns immediately if tokens are all inserted
-	start := time.Now()
+	start := clock.Now()
 	n := b.insert(256)
-	if time.Since(start) > 10*time.Millisecond {
+	if clock.Now() != start {
 		t.Fatal("should insert immediately")
 	}
 	if n != 256 {
@@ -21,8 +25,8 @@ func TestBucketInsert(t *testing.T) {
 
 	// Next token insert should block until the drain interval
 	n = b.insert(128)
-	if time.Since(start) < 100*time.Millisecond {
-		t.Fatal("should block")
+	if d := clock.Now().Sub(start); d != 100*time.Millisecond {
+		t.Fatalf("should block for 100ms, took %s", d)
 	}
 	if n != 128 {
 		t.Fatalf("expect 128, got: %d", n)
@@ -30,9 +34,9 @@ func TestBucketInsert(t *testing.T) {
 
 	// Inserting tokens to a non-empty bucket returns fast
 	// once we start to overflow.
-	start = time.Now()
+	start = clock.Now()
 	n = b.insert(256)
-	if time.Since(start) > 10*time.Millisecond {
+	if clock.Now() != start {
 		t.Fatal("should insert immediately")
 	}
 	if n != 128 {
@@ -40,8 +44,213 @@ func TestBucketInsert(t *testing.T) {
 	}
 }
 
-func TestBucketDrain(t *testing.T) {
+func TestBucketInsert_Huge(t *testing.T) {
+	b := newBucket(RateOpts{Interval: time.Second, Size: maxInt, Coarse: true})
+	b.clock = newFakeClock()
+
+	// Inserting beyond the room left must not wrap around.
+	if n := b.insert(maxInt - 10); n != maxInt-10 {
+		t.Fatalf("expect %d, got: %d", maxInt-10, n)
+	}
+	if n := b.insert(maxInt); n != 10 {
+		t.Fatalf("expect 10, got: %d", n)
+	}
+	if b.tokens != int64(maxInt) {
+		t.Fatalf("expect %d, got: %d", maxInt, b.tokens)
+	}
+}
+
+func TestBucketInsert_Empty(t *testing.T) {
+	clock := newFakeClock()
+	b := newBucket(RateOpts{Interval: time.Second, Size: 1})
+	b.clock = clock
+	b.insert(1)
+
+	// Empty inserts into the full bucket return right away.
+	for _, n := range []int{0, -1} {
+		if v := b.insert(n); v != 0 {
+			t.Fatalf("expect 0, got: %d", v)
+		}
+		if v, ok := b.pace(n, new(schedule), nil); v != 0 || !ok {
+			t.Fatalf("bad: %d, %v", v, ok)
+		}
+		if v := b.tryInsert(n); v != 0 {
+			t.Fatalf("expect 0, got: %d", v)
+		}
+	}
+	if clock.Now() != newFakeClock().Now() {
+		t.Fatal("should not wait")
+	}
+	if b.tokens != 1 {
+		t.Fatalf("expect 1, got: %d", b.tokens)
+	}
+}
+
+func TestBucketInsert_Fairness(t *testing.T) {
+	const workers, rounds = 50, 3
+	b := newBucket(RateOpts{Interval: 5 * time.Millisecond, Size: 100, Coarse: true})
+
+	// Every insert takes a whole interval of quota.
+	var l sync.Mutex
+	var maxWait time.Duration
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < rounds; j++ {
+				began := time.Now()
+				for n := 0; n < 100; {
+					n += b.insert(100 - n)
+				}
+				l.Lock()
+				if d := time.Since(began); d > maxWait {
+					maxWait = d
+				}
+				l.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Served in turn, no insert waits for more than the others ahead of it,
+	// plus some slack. The interval is measured to account for timer delays,
+	// which vary from one interval to the next on a busy machine.
+	interval := time.Since(start) / (workers * rounds)
+	if max := (workers + 5) * interval; maxWait > max {
+		t.Fatalf("expect waits up to %s, got: %s", max, maxWait)
+	}
+}
+
+func TestBucketInsert_Concurrent(t *testing.T) {
+	b := newBucket(RateOpts{Interval: time.Hour, Size: 100000, Coarse: true})
+	b.insert(1)
+
+	// Concurrent inserts fill the bucket exactly, without overshooting.
+	var total int64
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				v, ok := b.insertFast(7)
+				if !ok {
+					return
+				}
+				atomic.AddInt64(&total, int64(v))
+			}
+		}()
+	}
+	wg.Wait()
+
+	if total != 99999 {
+		t.Fatalf("expect 99999, got: %d", total)
+	}
+	if b.tokens != 100000 {
+		t.Fatalf("expect 100000 tokens, got: %d", b.tokens)
+	}
+}
+
+func TestBucketInsert_ConcurrentRate(t *testing.T) {
+	for _, coarse := range []bool{true, false} {
+		opts := RateOpts{Interval: 10 * time.Millisecond, Size: 1000, Coarse: coarse}
+		b := newBucket(opts)
+
+		// Hammer the bucket from several goroutines for a while.
+		var total int64
+		var wg sync.WaitGroup
+		start := time.Now()
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for time.Since(start) < 200*time.Millisecond {
+					atomic.AddInt64(&total, int64(b.insert(50+i*13)))
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		// No more than Size went through up front, plus Size for every
+		// interval passed since.
+		d := time.Since(start)
+		max := int64(opts.Size) + int64(float64(opts.Size)*float64(d)/float64(opts.Interval))
+		if total > max {
+			t.Fatalf("coarse %v: expect at most %d in %s, got: %d", coarse, max, d, total)
+		}
+	}
+}
+
+func TestBucketInsertFast_Smooth(t *testing.T) {
+	clock := newFakeClock()
+	b := newBucket(RateOpts{Interval: 100 * time.Millisecond, Size: 100})
+	b.clock = clock
+
+	// A new bucket has not leaked yet, so the first insert takes the slow
+	// path.
+	if _, ok := b.insertFast(50); ok {
+		t.Fatal("expect the slow path")
+	}
+	if n := b.insert(50); n != 50 {
+		t.Fatalf("expect 50, got: %d", n)
+	}
+
+	// While fewer tokens are due to leak than the bucket holds, inserts
+	// take the fast path, up to the room left at the last leak.
+	clock.Advance(10 * time.Millisecond)
+	if n, ok := b.insertFast(100); !ok || n != 50 {
+		t.Fatalf("expect 50, got: %d, %v", n, ok)
+	}
+
+	// A full bucket makes room a step at a time, which takes a leak.
+	if _, ok := b.insertFast(1); ok {
+		t.Fatal("expect the slow path")
+	}
+	b.drain(false)
+	if n, ok := b.insertFast(100); !ok || n != 10 {
+		t.Fatalf("expect 10, got: %d, %v", n, ok)
+	}
+
+	// Once the bucket could have leaked empty, the insert must leak first,
+	// rather than having the tokens it takes leak away with the others.
+	clock.Advance(200 * time.Millisecond)
+	if _, ok := b.insertFast(1); ok {
+		t.Fatal("expect the slow path")
+	}
+	if n := b.insert(1000); n != 100 {
+		t.Fatalf("expect 100, got: %d", n)
+	}
+}
+
+func TestBucketTryInsert(t *testing.T) {
+	clock := newFakeClock()
 	b := newBucket(RateOpts{Interval: 100 * time.Millisecond, Size: 256})
+	b.clock = clock
+
+	// Inserts as many tokens as fit.
+	if n := b.tryInsert(200); n != 200 {
+		t.Fatalf("expect 200, got: %d", n)
+	}
+	if n := b.tryInsert(200); n != 56 {
+		t.Fatalf("expect 56, got: %d", n)
+	}
+
+	// Returns immediately once the bucket is full.
+	start := clock.Now()
+	if n := b.tryInsert(1); n != 0 {
+		t.Fatalf("expect 0, got: %d", n)
+	}
+	if clock.Now() != start {
+		t.Fatal("should not block")
+	}
+}
+
+func TestBucketDrain(t *testing.T) {
+	clock := newFakeClock()
+	b := newBucket(RateOpts{Interval: 100 * time.Millisecond, Size: 256, Coarse: true})
+	b.clock = clock
 
 	// Place a token in the bucket for draining
 	b.insert(1)
@@ -53,10 +262,10 @@ func TestBucketDrain(t *testing.T) {
 	}
 
 	// Waits for the next interval and drains when wait is true
-	start := time.Now()
+	start := clock.Now()
 	b.drain(true)
-	if time.Since(start) < 100*time.Millisecond {
-		t.Fatal("should block")
+	if d := clock.Now().Sub(start); d != 100*time.Millisecond {
+		t.Fatalf("should block for 100ms, took %s", d)
 	}
 	if b.tokens != 0 {
 		t.Fatal("should drain tokens")
@@ -101,3 +310,108 @@ func TestBucketUnlimitedRate(t *testing.T) {
 		t.Fatalf("expect %d, got %d", expect, n)
 	}
 }
+
+func TestBucketSmooth(t *testing.T) {
+	clock := newFakeClock()
+	w := NewWriter(nil, RateOpts{Interval: time.Second, Size: 1000})
+	w.bucket.clock = clock
+	rec := &chunkRecorder{clock: clock}
+	w.dst = rec
+
+	start := clock.Now()
+	if _, err := w.Write(make([]byte, 2000)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The initial burst fills the bucket, after which 100 bytes leak out
+	// every 100ms rather than 1000 bytes every second.
+	if len(rec.sizes) != 11 || rec.sizes[0] != 1000 {
+		t.Fatalf("bad writes: %v", rec.sizes)
+	}
+	for i := 1; i < len(rec.sizes); i++ {
+		if rec.sizes[i] != 100 {
+			t.Fatalf("bad writes: %v", rec.sizes)
+		}
+		expect := time.Duration(i) * 100 * time.Millisecond
+		if d := rec.times[i].Sub(start); d != expect {
+			t.Fatalf("write %d: expect %s, got: %s", i, expect, d)
+		}
+	}
+}
+
+func TestBucketSmooth_Partial(t *testing.T) {
+	clock := newFakeClock()
+	b := newBucket(RateOpts{Interval: time.Second, Size: 1000})
+	b.clock = clock
+
+	if v := b.tryInsert(1000); v != 1000 {
+		t.Fatalf("expect 1000, got: %d", v)
+	}
+
+	// A quarter of the interval makes room for a quarter of the size.
+	clock.Sleep(250*time.Millisecond, nil)
+	if v := b.tryInsert(1000); v != 250 {
+		t.Fatalf("expect 250, got: %d", v)
+	}
+	if v := b.tryInsert(1000); v != 0 {
+		t.Fatalf("expect 0, got: %d", v)
+	}
+
+	// Less than a step of room is only handed out to inserts it fits.
+	clock.Sleep(50*time.Millisecond, nil)
+	if v := b.tryInsert(1000); v != 0 {
+		t.Fatalf("expect 0, got: %d", v)
+	}
+	if v := b.tryInsert(30); v != 30 {
+		t.Fatalf("expect 30, got: %d", v)
+	}
+}
+
+func TestBucketSmooth_Fast(t *testing.T) {
+	clock := newFakeClock()
+	b := newBucket(RateOpts{Interval: time.Millisecond, Size: 1 << 40})
+	b.clock = clock
+	b.tryInsert(1 << 40)
+
+	// At over a byte per nanosecond, leaking must still advance in time,
+	// rather than leaking again at the same instant.
+	clock.Sleep(time.Millisecond/3, nil)
+	b.tryInsert(1 << 40)
+	var n int
+	for i := 0; i < 100000; i++ {
+		n += b.tryInsert(1)
+	}
+	if n > 10000 {
+		t.Fatalf("expect the bucket to fill up, inserted: %d", n)
+	}
+}
+
+func TestBucketJitter(t *testing.T) {
+	clock := newFakeClock()
+	opts := RateOpts{Interval: time.Second, Size: 100, Jitter: 0.5}
+
+	// Buckets created together drain at different times.
+	b1, b2 := newBucket(opts), newBucket(opts)
+	b1.clock, b2.clock = clock, clock
+	b1.insert(1)
+	b2.insert(1)
+	if b1.drained.Equal(b2.drained) {
+		t.Fatalf("expect different drain times, got: %s", b1.drained)
+	}
+
+	// The first drain is only ever delayed, by up to half the interval.
+	for _, b := range []*bucket{b1, b2} {
+		if d := b.drained.Sub(clock.Now()); d < 0 || d > 500*time.Millisecond {
+			t.Fatalf("bad offset: %s", d)
+		}
+	}
+
+	// The rate is not exceeded.
+	start := clock.Now()
+	for n := 1; n < 300; {
+		n += b1.insert(300 - n)
+	}
+	if d := clock.Now().Sub(start); d < 2*time.Second || d > 2500*time.Millisecond {
+		t.Fatalf("expect 2s-2.5s, took %s", d)
+	}
+}
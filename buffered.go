@@ -0,0 +1,107 @@
+package iocap
+
+import (
+	"bufio"
+	"io"
+)
+
+// BufferedWriter is a rate limited writer which coalesces small writes
+// into batches, so that the rate is charged once per batch rather than
+// once per write. It suits streams of many tiny writes, such as those of
+// protocol encoders, whose cost would otherwise be dominated by the rate
+// limit itself.
+//
+// Bytes reach the underlying writer in the order they were written, once
+// the buffer fills up or on Flush. Writes larger than the buffer go
+// through in one piece if nothing is buffered. As with bufio.Writer, an
+// error from the underlying writer is returned by the Write or Flush which
+// hit it, and by every later one; bytes it did not take stay buffered.
+//
+// A BufferedWriter is not safe for concurrent use.
+type BufferedWriter struct {
+	buf *bufio.Writer
+	w   *Writer
+}
+
+// NewBufferedWriter wraps dst in a new rate limited writer, which buffers
+// up to size bytes at a time. If size is not positive, a default size of
+// 4KB is used.
+func NewBufferedWriter(dst io.Writer, opts RateOpts, size int) *BufferedWriter {
+	return newBufferedWriter(NewWriter(dst, opts), size)
+}
+
+// NewBufferedWriter creates and returns a new buffered writer in the group,
+// which charges each batch it writes to the group.
+func (g *Group) NewBufferedWriter(dst io.Writer, size int) *BufferedWriter {
+	return newBufferedWriter(g.NewWriter(dst), size)
+}
+
+// newBufferedWriter buffers the writes to w.
+func newBufferedWriter(w *Writer, size int) *BufferedWriter {
+	return &BufferedWriter{
+		buf: bufio.NewWriterSize(w, size),
+		w:   w,
+	}
+}
+
+// Write buffers p, writing out the buffer with rate limiting whenever it
+// fills up. It returns the number of bytes of p taken, which is less than
+// len(p) only along with an error.
+func (b *BufferedWriter) Write(p []byte) (int, error) {
+	return b.buf.Write(p)
+}
+
+// WriteString is like Write, but buffers the bytes of s.
+func (b *BufferedWriter) WriteString(s string) (int, error) {
+	return b.buf.WriteString(s)
+}
+
+// WriteByte buffers a single byte.
+func (b *BufferedWriter) WriteByte(c byte) error {
+	return b.buf.WriteByte(c)
+}
+
+// Flush writes out any buffered bytes, waiting on the rate limit as needed.
+func (b *BufferedWriter) Flush() error {
+	return b.buf.Flush()
+}
+
+// Buffered returns the number of bytes written but not yet flushed.
+func (b *BufferedWriter) Buffered() int {
+	return b.buf.Buffered()
+}
+
+// SetRate is used to dynamically set the rate options on the writer.
+func (b *BufferedWriter) SetRate(opts RateOpts) {
+	b.w.SetRate(opts)
+}
+
+// Rate returns the rate options currently in effect on the writer.
+func (b *BufferedWriter) Rate() RateOpts {
+	return b.w.Rate()
+}
+
+// Stats returns the traffic stats of the writer. Each batch written out
+// counts as one operation, and buffered bytes are not counted until they
+// are.
+func (b *BufferedWriter) Stats() TransferStats {
+	return b.w.Stats()
+}
+
+// Cancel aborts any flush blocked on the rate limit, as with
+// Writer.Cancel. Bytes which were not written out stay buffered.
+func (b *BufferedWriter) Cancel() {
+	b.w.Cancel()
+}
+
+// SetClock replaces the source of time of the writer. It must be called
+// before the writer is used.
+func (b *BufferedWriter) SetClock(c Clock) {
+	b.w.SetClock(c)
+}
+
+// Unwrap returns the underlying writer. Writing to it directly bypasses
+// both the buffer and the rate limit.
+func (b *BufferedWriter) Unwrap() io.Writer {
+	return b.w.Unwrap()
+}
@@ -0,0 +1,111 @@
+package iocap
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestBufferedWriter(t *testing.T) {
+	clock := newFakeClock()
+	buf := new(bytes.Buffer)
+	w := NewBufferedWriter(buf, RateOpts{Interval: 100 * time.Millisecond, Size: 1024, Coarse: true}, 512)
+	w.SetClock(clock)
+
+	// Write 4000 bytes in small writes of varying sizes.
+	var expect []byte
+	for i := 0; len(expect) < 4000; i++ {
+		p := bytes.Repeat([]byte{byte(i)}, 4+i%13)
+		if len(expect)+len(p) > 4000 {
+			p = p[:4000-len(expect)]
+		}
+		expect = append(expect, p...)
+		if n, err := w.Write(p); n != len(p) || err != nil {
+			t.Fatalf("bad: %d, %v", n, err)
+		}
+	}
+
+	// Only full batches are written until the flush.
+	if buf.Len() != 3584 || w.Buffered() != 416 {
+		t.Fatalf("expect 3584 written and 416 buffered, got: %d/%d", buf.Len(), w.Buffered())
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(buf.Bytes(), expect) {
+		t.Fatal("bytes written do not match")
+	}
+
+	// The rate is charged once per batch, and still applies in full.
+	if s := w.Stats(); s.Ops != 8 || s.BytesTransferred != 4000 {
+		t.Fatalf("expect 4000 bytes in 8 ops, got: %d in %d", s.BytesTransferred, s.Ops)
+	}
+	if d := clock.Now().Sub(newFakeClock().Now()); d != 300*time.Millisecond {
+		t.Fatalf("expect 300ms, took %s", d)
+	}
+}
+
+func TestBufferedWriter_Error(t *testing.T) {
+	w := NewBufferedWriter(failingWriter{}, RateOpts{Interval: time.Second, Size: 1024}, 16)
+
+	// Errors surface once the buffer is written out.
+	if n, err := w.Write(make([]byte, 10)); n != 10 || err != nil {
+		t.Fatalf("bad: %d, %v", n, err)
+	}
+	if n, err := w.Write(make([]byte, 10)); n != 6 || err != errFailed {
+		t.Fatalf("expect 6/%v, got: %d/%v", errFailed, n, err)
+	}
+
+	// Later writes and flushes fail the same way, and nothing is lost.
+	if err := w.WriteByte(0); err != errFailed {
+		t.Fatalf("expect %v, got: %v", errFailed, err)
+	}
+	if err := w.Flush(); err != errFailed {
+		t.Fatalf("expect %v, got: %v", errFailed, err)
+	}
+	if n := w.Buffered(); n != 16 {
+		t.Fatalf("expect 16 buffered, got: %d", n)
+	}
+}
+
+func TestGroupBufferedWriter(t *testing.T) {
+	clock := newFakeClock()
+	g := NewGroup(RateOpts{Interval: 100 * time.Millisecond, Size: 100})
+	g.SetClock(clock)
+	a := g.NewBufferedWriter(ioutil.Discard, 64)
+	b := g.NewBufferedWriter(ioutil.Discard, 64)
+
+	// Batches of both writers share the rate of the group.
+	for _, w := range []*BufferedWriter{a, b} {
+		w.WriteString("hello world")
+		if err := w.Flush(); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	if n := g.Snapshot().Tokens; n != 22 {
+		t.Fatalf("expect 22 tokens, got: %d", n)
+	}
+}
+
+func BenchmarkBufferedWriter(b *testing.B) {
+	// Small writes, such as those of protocol encoders, are charged once
+	// each by a Writer, and once per batch by a BufferedWriter.
+	p := make([]byte, 16)
+	rate := RateOpts{Interval: time.Millisecond, Size: 1 << 40}
+	b.Run("Writer", func(b *testing.B) {
+		w := NewWriter(ioutil.Discard, rate)
+		for i := 0; i < b.N; i++ {
+			w.Write(p)
+		}
+		b.ReportMetric(float64(w.Stats().Ops)/float64(b.N), "charges/op")
+	})
+	b.Run("BufferedWriter", func(b *testing.B) {
+		w := NewBufferedWriter(ioutil.Discard, rate, 4096)
+		for i := 0; i < b.N; i++ {
+			w.Write(p)
+		}
+		w.Flush()
+		b.ReportMetric(float64(w.Stats().Ops)/float64(b.N), "charges/op")
+	})
+}
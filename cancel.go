@@ -0,0 +1,253 @@
+package iocap
+
+import (
+	"context"
+	"os"
+	"sync"
+	"time"
+)
+
+// Cancel aborts any read blocked on the rate limit, which returns the
+// number of bytes already read along with ErrCanceled, and makes every
+// later read fail the same way right away. It is safe to call Cancel more
+// than once, and concurrently with Read.
+func (r *Reader) Cancel() {
+	r.intr.cancel()
+}
+
+// Cancel aborts any write blocked on the rate limit, which returns the
+// number of bytes already written along with ErrCanceled, and makes every
+// later write fail the same way right away. It is safe to call Cancel more
+// than once, and concurrently with Write.
+func (w *Writer) Cancel() {
+	w.intr.cancel()
+}
+
+// SetDeadline is the same as SetReadDeadline, so that readers can stand in
+// for connections.
+func (r *Reader) SetDeadline(t time.Time) {
+	r.intr.setDeadline(t)
+}
+
+// SetReadDeadline sets the time after which reads give up waiting on the
+// rate limit, like the read deadline of a net.Conn. It applies to reads
+// already blocked as well as later ones, which return the number of bytes
+// read so far along with os.ErrDeadlineExceeded, a net.Error whose Timeout
+// method returns true. A zero time clears the deadline. The deadline is in
+// real time, regardless of SetClock.
+func (r *Reader) SetReadDeadline(t time.Time) {
+	r.intr.setDeadline(t)
+}
+
+// SetDeadline is the same as SetWriteDeadline, so that writers can stand in
+// for connections.
+func (w *Writer) SetDeadline(t time.Time) {
+	w.intr.setDeadline(t)
+}
+
+// SetWriteDeadline sets the time after which writes give up waiting on the
+// rate limit, like the write deadline of a net.Conn. It applies to writes
+// already blocked as well as later ones, which return the number of bytes
+// written so far along with os.ErrDeadlineExceeded, a net.Error whose
+// Timeout method returns true. A zero time clears the deadline. The
+// deadline is in real time, regardless of SetClock.
+func (w *Writer) SetWriteDeadline(t time.Time) {
+	w.intr.setDeadline(t)
+}
+
+// interrupt stops the operations of a reader or writer when it is canceled
+// or its deadline passes. The zero value is ready to use.
+type interrupt struct {
+	l sync.Mutex
+
+	// ch is closed once operations should stop. It is replaced when the
+	// deadline is moved after passing.
+	ch chan struct{}
+
+	canceled bool
+	timer    *time.Timer
+}
+
+// done returns the channel closed once operations should stop, along with
+// the error of operations if they are already stopped.
+func (i *interrupt) done() (<-chan struct{}, error) {
+	i.l.Lock()
+	defer i.l.Unlock()
+	return i.chLocked(), i.errLocked()
+}
+
+// chLocked returns the current channel, creating it if needed. Must be
+// called with the lock held.
+func (i *interrupt) chLocked() chan struct{} {
+	if i.ch == nil {
+		i.ch = make(chan struct{})
+	}
+	return i.ch
+}
+
+// err returns the error of operations which were stopped, or nil if they
+// may go on.
+func (i *interrupt) err() error {
+	i.l.Lock()
+	defer i.l.Unlock()
+	return i.errLocked()
+}
+
+// errLocked implements err. Must be called with the lock held.
+func (i *interrupt) errLocked() error {
+	switch {
+	case i.canceled:
+		return ErrCanceled
+	case i.ch != nil && closed(i.ch):
+		return os.ErrDeadlineExceeded
+	}
+	return nil
+}
+
+// cancel stops operations for good.
+func (i *interrupt) cancel() {
+	i.l.Lock()
+	defer i.l.Unlock()
+	if i.canceled {
+		return
+	}
+	i.canceled = true
+	if i.timer != nil {
+		i.timer.Stop()
+	}
+	if ch := i.chLocked(); !closed(ch) {
+		close(ch)
+	}
+}
+
+// setDeadline stops operations at t, or never if t is zero.
+func (i *interrupt) setDeadline(t time.Time) {
+	i.l.Lock()
+	defer i.l.Unlock()
+	if i.canceled {
+		return
+	}
+	if i.timer != nil {
+		i.timer.Stop()
+		i.timer = nil
+	}
+
+	// Operations may go on again after a passed deadline is moved.
+	ch := i.chLocked()
+	if closed(ch) {
+		ch = make(chan struct{})
+		i.ch = ch
+	}
+	if t.IsZero() {
+		return
+	}
+
+	d := time.Until(t)
+	if d <= 0 {
+		close(ch)
+		return
+	}
+	i.timer = time.AfterFunc(d, func() {
+		i.l.Lock()
+		defer i.l.Unlock()
+		if i.ch == ch && !closed(ch) {
+			close(ch)
+		}
+	})
+}
+
+// reset clears any cancelation and deadline, so that operations may go on
+// again.
+func (i *interrupt) reset() {
+	i.l.Lock()
+	defer i.l.Unlock()
+	if i.timer != nil {
+		i.timer.Stop()
+		i.timer = nil
+	}
+	i.canceled = false
+	if i.ch != nil && closed(i.ch) {
+		i.ch = nil
+	}
+}
+
+// waitDone returns a channel which is closed once an operation waiting on
+// the rate limit should give up: when ctx is done, the timeout passes, or
+// stop is closed. Any of them may be unset. The returned function releases
+// the resources of the channel, and must be called once the operation is
+// over.
+func waitDone(ctx context.Context, timeout time.Duration, stop <-chan struct{}) (<-chan struct{}, func()) {
+	if ctx == nil && timeout <= 0 {
+		return stop, func() {}
+	}
+
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	if stop != nil {
+		go func() {
+			select {
+			case <-stop:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+	}
+	return ctx.Done(), cancel
+}
+
+// waitState holds the channel of waitDone for a single operation. The channel
+// is only made once the operation has to wait on the rate limit, so that
+// operations which never wait don't pay for a derived context and its
+// goroutine. The timeout is then counted from the first wait.
+type waitState struct {
+	ctx     context.Context
+	timeout time.Duration
+	stop    <-chan struct{}
+
+	ch      <-chan struct{}
+	release func()
+}
+
+// done returns the channel of waitDone, making it on first use.
+func (w *waitState) done() <-chan struct{} {
+	if w.release == nil {
+		w.ch, w.release = waitDone(w.ctx, w.timeout, w.stop)
+	}
+	return w.ch
+}
+
+// stopped returns whether the operation should give up, without making the
+// channel of done.
+func (w *waitState) stopped() bool {
+	if w.release != nil {
+		return closed(w.ch)
+	}
+	if w.ctx != nil && w.ctx.Err() != nil {
+		return true
+	}
+	return w.stop != nil && closed(w.stop)
+}
+
+// close releases the resources of the channel of done, if it was made.
+func (w *waitState) close() {
+	if w.release != nil {
+		w.release()
+	}
+}
+
+// closed returns whether ch is closed, without blocking.
+func closed(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,135 @@
+package iocap
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestWriterCancel(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := NewWriter(buf, RateOpts{Interval: time.Second, Size: 1})
+
+	// Cancel while the write is blocked on the rate limit.
+	var canceled time.Time
+	time.AfterFunc(50*time.Millisecond, func() {
+		canceled = time.Now()
+		w.Cancel()
+	})
+	n, err := w.Write(make([]byte, 10))
+	if d := time.Since(canceled); d > 20*time.Millisecond {
+		t.Fatalf("write should return promptly, took %s", d)
+	}
+	if n != 1 || buf.Len() != 1 || err != ErrCanceled {
+		t.Fatalf("expect 1/1/%v, got: %d/%d/%v", ErrCanceled, n, buf.Len(), err)
+	}
+
+	// Later writes fail right away, and canceling again is harmless.
+	w.Cancel()
+	if n, err := w.Write(make([]byte, 10)); n != 0 || err != ErrCanceled {
+		t.Fatalf("expect 0/%v, got: %d/%v", ErrCanceled, n, err)
+	}
+	if n, err := w.TryWrite(make([]byte, 10)); n != 0 || err != ErrCanceled {
+		t.Fatalf("expect 0/%v, got: %d/%v", ErrCanceled, n, err)
+	}
+}
+
+func TestReaderCancel(t *testing.T) {
+	r := NewReader(zeroReader{}, RateOpts{Interval: time.Second, Size: 1})
+
+	// Reads with a timeout or a context are canceled as well.
+	r.SetWaitTimeout(time.Hour)
+	r.ctx = context.Background()
+
+	var canceled time.Time
+	time.AfterFunc(50*time.Millisecond, func() {
+		canceled = time.Now()
+		r.Cancel()
+	})
+	n, err := r.Read(make([]byte, 10))
+	if d := time.Since(canceled); d > 20*time.Millisecond {
+		t.Fatalf("read should return promptly, took %s", d)
+	}
+	if n != 1 || err != ErrCanceled {
+		t.Fatalf("expect 1/%v, got: %d/%v", ErrCanceled, n, err)
+	}
+	if n, err := r.Read(make([]byte, 10)); n != 0 || err != ErrCanceled {
+		t.Fatalf("expect 0/%v, got: %d/%v", ErrCanceled, n, err)
+	}
+}
+
+func TestGroupCancel(t *testing.T) {
+	g := NewGroup(RateOpts{Interval: time.Second, Size: 1})
+	a, b := g.NewWriter(new(bytes.Buffer)), g.NewWriter(new(bytes.Buffer))
+
+	// Canceling a member leaves the others be.
+	a.Cancel()
+	if _, err := a.Write([]byte("x")); err != ErrCanceled {
+		t.Fatalf("expect %v, got: %v", ErrCanceled, err)
+	}
+	if n, err := b.Write([]byte("x")); n != 1 || err != nil {
+		t.Fatalf("expect 1/nil, got: %d/%v", n, err)
+	}
+}
+
+func TestWriterSetWriteDeadline(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := NewWriter(buf, RateOpts{Interval: time.Second, Size: 1})
+
+	// The write gives up once the deadline passes, well before the rate
+	// would let it finish.
+	deadline := time.Now().Add(50 * time.Millisecond)
+	w.SetWriteDeadline(deadline)
+	n, err := w.Write(make([]byte, 10))
+	if d := time.Since(deadline); d > 20*time.Millisecond {
+		t.Fatalf("write should return promptly, took %s past the deadline", d)
+	}
+	if n != 1 || buf.Len() != 1 {
+		t.Fatalf("expect 1 byte written, got: %d/%d", n, buf.Len())
+	}
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() || !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expect a timeout, got: %v", err)
+	}
+
+	// Later writes fail right away, until the deadline is cleared.
+	if _, err := w.Write(make([]byte, 10)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expect %v, got: %v", os.ErrDeadlineExceeded, err)
+	}
+	w.SetWriteDeadline(time.Time{})
+	w.SetRate(Unlimited)
+	if n, err := w.Write(make([]byte, 10)); n != 10 || err != nil {
+		t.Fatalf("expect 10/nil, got: %d/%v", n, err)
+	}
+}
+
+func TestReaderSetReadDeadline(t *testing.T) {
+	r := NewReader(zeroReader{}, RateOpts{Interval: time.Second, Size: 1})
+
+	// A deadline set while the read is blocked applies to it, and moving
+	// the deadline before it passes moves the timeout of the read.
+	var deadline time.Time
+	time.AfterFunc(20*time.Millisecond, func() {
+		r.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+		time.Sleep(10 * time.Millisecond)
+		deadline = time.Now().Add(50 * time.Millisecond)
+		r.SetDeadline(deadline)
+	})
+	n, err := r.Read(make([]byte, 10))
+	if d := time.Since(deadline); d < 0 || d > 20*time.Millisecond {
+		t.Fatalf("read should return at the deadline, returned %s after it", d)
+	}
+	if n != 1 || !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expect 1/%v, got: %d/%v", os.ErrDeadlineExceeded, n, err)
+	}
+
+	// A deadline in the past stops reads right away.
+	r = NewReader(zeroReader{}, Unlimited)
+	r.SetReadDeadline(time.Now().Add(-time.Second))
+	if n, err := r.Read(make([]byte, 10)); n != 0 || !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expect 0/%v, got: %d/%v", os.ErrDeadlineExceeded, n, err)
+	}
+}
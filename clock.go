@@ -0,0 +1,75 @@
+package iocap
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is the source of time used by rate limiters. The passing of time
+// can be simulated by replacing it, for example to make tests of rate
+// limited code deterministic and fast. See the SetClock methods.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+
+	// Sleep sleeps for d, or until done is closed, reporting whether the
+	// full duration passed. A nil done channel never closes.
+	Sleep(d time.Duration, done <-chan struct{}) bool
+}
+
+// realClock is a Clock backed by the time package.
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+// Sleep sleeps for d, using the shared pacer if it is enabled.
+func (realClock) Sleep(d time.Duration, done <-chan struct{}) bool {
+	if p := loadPacer(); p != nil {
+		return p.sleep(d, done)
+	}
+	return sleep(d, done)
+}
+
+// timers holds stopped timers for reuse by sleeps, so that waiting does not
+// allocate a new timer each time, and idle limiters hold none.
+var timers sync.Pool
+
+// sleep sleeps for d on a timer of its own, or until done is closed.
+func sleep(d time.Duration, done <-chan struct{}) bool {
+	return sleepEither(d, done, nil)
+}
+
+// sleepEither sleeps for d on a timer of its own, or until either a or b is
+// closed. Nil channels never close.
+func sleepEither(d time.Duration, a, b <-chan struct{}) bool {
+	if a == nil && b == nil {
+		time.Sleep(d)
+		return true
+	}
+
+	t, _ := timers.Get().(*time.Timer)
+	if t == nil {
+		t = time.NewTimer(d)
+	} else {
+		t.Reset(d)
+	}
+	defer func() {
+		if !t.Stop() {
+			// Empty the channel of a timer which fired unnoticed.
+			select {
+			case <-t.C:
+			default:
+			}
+		}
+		timers.Put(t)
+	}()
+
+	select {
+	case <-t.C:
+		return true
+	case <-a:
+		return false
+	case <-b:
+		return false
+	}
+}
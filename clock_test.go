@@ -0,0 +1,130 @@
+package iocap
+
+import (
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a virtual clock for tests. Sleeping advances the clock by
+// the requested duration immediately, so rate limited operations complete
+// without waiting on wall-clock time.
+type fakeClock struct {
+	now time.Time
+	l   sync.Mutex
+}
+
+// newFakeClock creates a new fake clock starting at an arbitrary time.
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2016, 8, 8, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.l.Lock()
+	defer c.l.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Sleep(d time.Duration, done <-chan struct{}) bool {
+	select {
+	case <-done:
+		return false
+	default:
+	}
+	c.Advance(d)
+	return true
+}
+
+// Advance moves the clock forward by d.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.l.Lock()
+	defer c.l.Unlock()
+	if d > 0 {
+		c.now = c.now.Add(d)
+	}
+}
+
+func TestSetClock(t *testing.T) {
+	clock := newFakeClock()
+	rate := RateOpts{Interval: time.Hour, Size: 1}
+
+	// A day's worth of hourly quota completes instantly on virtual time.
+	w := NewWriter(ioutil.Discard, rate)
+	w.SetClock(clock)
+	start := clock.Now()
+	if _, err := w.Write(make([]byte, 25)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d := clock.Now().Sub(start); d != 24*time.Hour {
+		t.Fatalf("expect 24h, got: %s", d)
+	}
+
+	// Members of a group share its clock.
+	g := NewGroup(rate)
+	g.SetClock(clock)
+	r := g.NewReader(zeroReader{})
+	start = clock.Now()
+	if _, err := r.Read(make([]byte, 3)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d := clock.Now().Sub(start); d != 2*time.Hour {
+		t.Fatalf("expect 2h, got: %s", d)
+	}
+}
+
+func TestSleepEither(t *testing.T) {
+	closed := make(chan struct{})
+	close(closed)
+
+	// Leave timers in the pool which fired, or may have, without anyone
+	// receiving from them.
+	for i := 0; i < 100; i++ {
+		sleepEither(0, closed, nil)
+		sleepEither(time.Hour, nil, closed)
+	}
+
+	// Reused timers sleep for the full duration.
+	for i := 0; i < 3; i++ {
+		start := time.Now()
+		if !sleepEither(20*time.Millisecond, make(chan struct{}), nil) {
+			t.Fatal("expect full sleep")
+		}
+		if d := time.Since(start); d < 20*time.Millisecond {
+			t.Fatalf("expect 20ms, took %s", d)
+		}
+	}
+}
+
+// benchmarkWaits runs intermittent traffic on 1k writers, each write waiting
+// once on the rate of its writer.
+func benchmarkWaits(b *testing.B, timeout time.Duration) {
+	writers := make([]*Writer, 1000)
+	for i := range writers {
+		writers[i] = NewWriter(ioutil.Discard, RateOpts{Interval: time.Millisecond, Size: 64})
+		writers[i].SetWaitTimeout(timeout)
+	}
+	data := make([]byte, 128)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var wg sync.WaitGroup
+		for _, w := range writers {
+			wg.Add(1)
+			go func(w *Writer) {
+				defer wg.Done()
+				w.Write(data)
+			}(w)
+		}
+		wg.Wait()
+	}
+}
+
+func BenchmarkWaits(b *testing.B) {
+	benchmarkWaits(b, 0)
+}
+
+func BenchmarkWaits_Timeout(b *testing.B) {
+	benchmarkWaits(b, time.Second)
+}
@@ -0,0 +1,154 @@
+package iocap
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+// ErrClosed is returned by reads and writes on a limiter returned by
+// NewReadCloser or NewWriteCloser once it has been closed.
+var ErrClosed = errors.New("iocap: read or write on closed limiter")
+
+// readCloser is a rate limited reader which closes its source on Close.
+type readCloser struct {
+	*Reader
+	src    io.Closer
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// NewReadCloser wraps src in a new rate limited reader, whose Close closes
+// src. Closing it also abandons any read blocked on the rate limit, and
+// reads after Close return ErrClosed. Like a Reader, it has an Unwrap method
+// returning src.
+func NewReadCloser(src io.ReadCloser, opts RateOpts) io.ReadCloser {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &readCloser{
+		Reader: NewReaderContext(ctx, src, opts),
+		src:    src,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// NewReadCloser creates and returns a new reader in the group, which closes
+// src as with NewReadCloser. Only the reads of the new reader are abandoned
+// on Close, not those of other members of the group.
+func (g *Group) NewReadCloser(src io.ReadCloser) io.ReadCloser {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &readCloser{
+		Reader: g.NewReaderContext(ctx, src),
+		src:    src,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// closedErr returns ErrClosed in place of the error of an operation
+// abandoned by Close, which cancels ctx.
+func closedErr(ctx context.Context, err error) error {
+	if err == context.Canceled && ctx.Err() != nil {
+		return ErrClosed
+	}
+	return err
+}
+
+// Read reads from the source with rate limiting, or returns ErrClosed once
+// the reader is closed.
+func (r *readCloser) Read(p []byte) (int, error) {
+	if r.ctx.Err() != nil {
+		return 0, ErrClosed
+	}
+	n, err := r.Reader.Read(p)
+	return n, closedErr(r.ctx, err)
+}
+
+// WriteTo is like the WriteTo of Reader, or returns ErrClosed once the
+// reader is closed.
+func (r *readCloser) WriteTo(w io.Writer) (int64, error) {
+	if r.ctx.Err() != nil {
+		return 0, ErrClosed
+	}
+	n, err := r.Reader.WriteTo(w)
+	return n, closedErr(r.ctx, err)
+}
+
+// Close abandons any read waiting on the rate limit and closes the source.
+func (r *readCloser) Close() error {
+	r.cancel()
+	return r.src.Close()
+}
+
+// writeCloser is a rate limited writer which closes its destination on
+// Close.
+type writeCloser struct {
+	*Writer
+	dst    io.Closer
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// NewWriteCloser wraps dst in a new rate limited writer, whose Close closes
+// dst. Closing it also abandons any write blocked on the rate limit, and
+// writes after Close return ErrClosed. Like a Writer, it has an Unwrap
+// method returning dst.
+func NewWriteCloser(dst io.WriteCloser, opts RateOpts) io.WriteCloser {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &writeCloser{
+		Writer: NewWriterContext(ctx, dst, opts),
+		dst:    dst,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// NewWriteCloser creates and returns a new writer in the group, which
+// closes dst as with NewWriteCloser. Only the writes of the new writer are
+// abandoned on Close, not those of other members of the group.
+func (g *Group) NewWriteCloser(dst io.WriteCloser) io.WriteCloser {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &writeCloser{
+		Writer: g.NewWriterContext(ctx, dst),
+		dst:    dst,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// Write writes to the destination with rate limiting, or returns ErrClosed
+// once the writer is closed.
+func (w *writeCloser) Write(p []byte) (int, error) {
+	if w.ctx.Err() != nil {
+		return 0, ErrClosed
+	}
+	n, err := w.Writer.Write(p)
+	return n, closedErr(w.ctx, err)
+}
+
+// WriteString is like the WriteString of Writer, or returns ErrClosed once
+// the writer is closed.
+func (w *writeCloser) WriteString(s string) (int, error) {
+	if w.ctx.Err() != nil {
+		return 0, ErrClosed
+	}
+	n, err := w.Writer.WriteString(s)
+	return n, closedErr(w.ctx, err)
+}
+
+// ReadFrom is like the ReadFrom of Writer, or returns ErrClosed once the
+// writer is closed.
+func (w *writeCloser) ReadFrom(src io.Reader) (int64, error) {
+	if w.ctx.Err() != nil {
+		return 0, ErrClosed
+	}
+	n, err := w.Writer.ReadFrom(src)
+	return n, closedErr(w.ctx, err)
+}
+
+// Close abandons any write waiting on the rate limit and closes the
+// destination.
+func (w *writeCloser) Close() error {
+	w.cancel()
+	return w.dst.Close()
+}
@@ -0,0 +1,148 @@
+package iocap
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+// closeCounter counts the calls to its Close method.
+type closeCounter struct {
+	closed int
+}
+
+func (c *closeCounter) Close() error {
+	c.closed++
+	return nil
+}
+
+func TestReadCloser(t *testing.T) {
+	c := new(closeCounter)
+	src := struct {
+		zeroReader
+		*closeCounter
+	}{zeroReader{}, c}
+	r := NewReadCloser(src, RateOpts{Interval: time.Second, Size: 1})
+
+	// Close while the read is throttled mid-stream.
+	type result struct {
+		n   int
+		err error
+	}
+	doneCh := make(chan result)
+	go func() {
+		n, err := r.Read(make([]byte, 10))
+		doneCh <- result{n, err}
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if err := r.Close(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var res result
+	select {
+	case res = <-doneCh:
+	case <-time.After(500 * time.Millisecond):
+		t.Fatalf("read should be abandoned promptly")
+	}
+	if n, err := res.n, res.err; n != 1 || err != ErrClosed {
+		t.Fatalf("expect 1/%v, got: %d/%v", ErrClosed, n, err)
+	}
+	if c.closed != 1 {
+		t.Fatalf("expect source closed once, got: %d", c.closed)
+	}
+
+	// Reads after Close fail without reading anything.
+	if n, err := r.Read(make([]byte, 10)); n != 0 || err != ErrClosed {
+		t.Fatalf("expect 0/%v, got: %d/%v", ErrClosed, n, err)
+	}
+}
+
+func TestWriteCloser(t *testing.T) {
+	c := new(closeCounter)
+	var written int
+	dst := struct {
+		writerFunc
+		*closeCounter
+	}{func(p []byte) (int, error) {
+		written += len(p)
+		return len(p), nil
+	}, c}
+	w := NewWriteCloser(dst, RateOpts{Interval: time.Second, Size: 1})
+
+	errCh := make(chan error)
+	var n int
+	go func() {
+		var err error
+		n, err = w.Write(make([]byte, 10))
+		errCh <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if err := w.Close(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	err := <-errCh
+	if n != 1 || written != 1 || err != ErrClosed {
+		t.Fatalf("expect 1/1/%v, got: %d/%d/%v", ErrClosed, n, written, err)
+	}
+	if c.closed != 1 {
+		t.Fatalf("expect destination closed once, got: %d", c.closed)
+	}
+	if n, err := w.Write(make([]byte, 10)); n != 0 || err != ErrClosed {
+		t.Fatalf("expect 0/%v, got: %d/%v", ErrClosed, n, err)
+	}
+}
+
+func TestCloser_Copy(t *testing.T) {
+	rate := RateOpts{Interval: time.Second, Size: 100}
+	r := NewReadCloser(struct {
+		zeroReader
+		*closeCounter
+	}{zeroReader{}, new(closeCounter)}, rate)
+	buf := new(bytes.Buffer)
+	w := NewWriteCloser(struct {
+		*bytes.Buffer
+		*closeCounter
+	}{buf, new(closeCounter)}, rate)
+	r.Close()
+	w.Close()
+
+	// Copies through the fast paths of WriteTo and ReadFrom are refused
+	// once closed, even with quota left.
+	if n, err := io.Copy(ioutil.Discard, r); n != 0 || err != ErrClosed {
+		t.Fatalf("expect 0/%v, got: %d/%v", ErrClosed, n, err)
+	}
+	src := struct{ io.Reader }{strings.NewReader("hello")}
+	if n, err := io.Copy(w, src); n != 0 || err != ErrClosed {
+		t.Fatalf("expect 0/%v, got: %d/%v", ErrClosed, n, err)
+	}
+	if n, err := io.WriteString(w, "hello"); n != 0 || err != ErrClosed {
+		t.Fatalf("expect 0/%v, got: %d/%v", ErrClosed, n, err)
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("expect nothing written, got: %q", buf.String())
+	}
+}
+
+func TestGroupWriteCloser(t *testing.T) {
+	g := NewGroup(RateOpts{Interval: time.Second, Size: 1})
+	c := new(closeCounter)
+	dst := struct {
+		writerFunc
+		*closeCounter
+	}{ioutil.Discard.Write, c}
+	w := g.NewWriteCloser(dst)
+	if err := w.Close(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := w.Write([]byte("x")); err != ErrClosed {
+		t.Fatalf("expect %v, got: %v", ErrClosed, err)
+	}
+
+	// Other members of the group are unaffected by the Close.
+	if n, err := g.NewWriter(ioutil.Discard).Write([]byte("x")); n != 1 || err != nil {
+		t.Fatalf("expect 1/nil, got: %d/%v", n, err)
+	}
+}
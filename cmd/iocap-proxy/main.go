@@ -0,0 +1,84 @@
+// Command iocap-proxy is a TCP proxy which limits the bandwidth of the
+// traffic passing through it, per client IP address and in total.
+//
+//	iocap-proxy -listen :9000 -upstream db:5432 -per-client 2MB/s -total 50MB/s
+//
+// Rates are in the format understood by iocap.ParseRate, such as "2MB/s",
+// "10Mbps" or "unlimited". Each limit applies to each direction separately.
+//
+// If -admin is given, an HTTP endpoint is served on that address. GET
+// returns the current rates and connected clients as JSON, and POST updates
+// the rates from the "per-client" and "total" form values.
+//
+// On SIGINT or SIGTERM, the proxy stops accepting connections and waits for
+// open connections to finish, for up to the -grace period.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/ryanuber/iocap"
+)
+
+func main() {
+	os.Exit(run(os.Args[1:]))
+}
+
+func run(args []string) int {
+	logger := log.New(os.Stderr, "", log.LstdFlags)
+
+	flags := flag.NewFlagSet("iocap-proxy", flag.ContinueOnError)
+	listen := flags.String("listen", "", "address to listen on")
+	upstream := flags.String("upstream", "", "upstream address to proxy to")
+	var perClient, total iocap.RateOpts
+	iocap.RateVar(flags, &perClient, "per-client", iocap.Unlimited, "rate per client IP address")
+	iocap.RateVar(flags, &total, "total", iocap.Unlimited, "rate of all clients combined")
+	admin := flags.String("admin", "", "address of the admin endpoint")
+	grace := flags.Duration("grace", 30*time.Second, "time to wait for connections on shutdown")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	if *listen == "" || *upstream == "" {
+		fmt.Fprintln(os.Stderr, "-listen and -upstream are required")
+		return 2
+	}
+
+	ln, err := net.Listen("tcp", *listen)
+	if err != nil {
+		logger.Printf("[ERR] %v", err)
+		return 1
+	}
+	p := newProxy(ln, *upstream, perClient, total, logger)
+
+	if *admin != "" {
+		go func() {
+			if err := http.ListenAndServe(*admin, p.admin()); err != nil {
+				logger.Printf("[ERR] admin: %v", err)
+			}
+		}()
+	}
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigCh
+		logger.Printf("[INFO] shutting down")
+		ln.Close()
+	}()
+
+	logger.Printf("[INFO] proxying %s to %s", ln.Addr(), *upstream)
+	p.serve()
+
+	// Wait for any open connections to drain.
+	p.shutdown(*grace)
+	return 0
+}
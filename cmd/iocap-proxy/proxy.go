@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ryanuber/iocap"
+	"github.com/ryanuber/iocap/netcap"
+)
+
+// proxy forwards connections accepted on a rate limited listener to a single
+// upstream address.
+type proxy struct {
+	ln       *netcap.Listener
+	upstream string
+	logger   *log.Logger
+
+	// conns tracks the open client connections, so that they can be closed
+	// if they do not finish in time during shutdown.
+	conns map[net.Conn]struct{}
+	wg    sync.WaitGroup
+	l     sync.Mutex
+}
+
+// newProxy creates a new proxy accepting connections on ln. Each client IP
+// address is limited to perClient, and all clients together to total.
+func newProxy(ln net.Listener, upstream string, perClient, total iocap.RateOpts, logger *log.Logger) *proxy {
+	l := netcap.NewIPListener(ln, perClient)
+	l.SetTotalRate(total)
+	return &proxy{
+		ln:       l,
+		upstream: upstream,
+		logger:   logger,
+		conns:    make(map[net.Conn]struct{}),
+	}
+}
+
+// serve accepts and proxies connections until the listener is closed.
+func (p *proxy) serve() error {
+	for {
+		c, err := p.ln.Accept()
+		if err != nil {
+			return err
+		}
+
+		p.l.Lock()
+		p.conns[c] = struct{}{}
+		p.wg.Add(1)
+		p.l.Unlock()
+
+		go p.handle(c)
+	}
+}
+
+// handle proxies a single client connection to the upstream.
+func (p *proxy) handle(c net.Conn) {
+	defer func() {
+		p.l.Lock()
+		delete(p.conns, c)
+		p.l.Unlock()
+		p.wg.Done()
+	}()
+
+	upstream, err := net.Dial("tcp", p.upstream)
+	if err != nil {
+		p.logger.Printf("[ERR] %s: %v", c.RemoteAddr(), err)
+		c.Close()
+		return
+	}
+
+	// The client connection is already rate limited by the listener.
+	up, down, err := netcap.Tunnel(c, nil, upstream, nil)
+	if err != nil {
+		p.logger.Printf("[ERR] %s: %v", c.RemoteAddr(), err)
+	}
+	p.logger.Printf("[INFO] %s: closed, %d bytes up, %d bytes down", c.RemoteAddr(), up, down)
+}
+
+// shutdown stops accepting connections and waits up to timeout for the open
+// connections to finish, closing any which remain after that.
+func (p *proxy) shutdown(timeout time.Duration) {
+	p.ln.Close()
+
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return
+	case <-time.After(timeout):
+	}
+
+	p.l.Lock()
+	for c := range p.conns {
+		c.Close()
+	}
+	p.l.Unlock()
+	<-done
+}
+
+// adminStatus is the response of the admin endpoint.
+type adminStatus struct {
+	PerClient iocap.RateOpts
+	Total     iocap.RateOpts
+	Clients   []netcap.IPStats
+}
+
+// admin returns an HTTP handler exposing the state of the proxy. GET
+// returns the current rates and clients. POST updates the rates from the
+// "per-client" and "total" form values, either of which may be omitted.
+func (p *proxy) admin() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+		case "POST":
+			if v := r.FormValue("per-client"); v != "" {
+				ro, err := iocap.ParseRate(v)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				p.ln.SetRate(ro)
+			}
+			if v := r.FormValue("total"); v != "" {
+				ro, err := iocap.ParseRate(v)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				p.ln.SetTotalRate(ro)
+			}
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var status adminStatus
+		status.PerClient, status.Total = p.ln.Rate()
+		status.Clients = p.ln.IPs()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+	})
+}
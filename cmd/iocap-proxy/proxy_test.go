@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/ryanuber/iocap"
+)
+
+// startUpstream starts a TCP server echoing everything it receives.
+func startUpstream(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return ln
+}
+
+// startProxy starts a proxy to upstream with the given rates.
+func startProxy(t *testing.T, upstream string, perClient, total iocap.RateOpts) *proxy {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	p := newProxy(ln, upstream, perClient, total, log.New(ioutil.Discard, "", 0))
+	go p.serve()
+	return p
+}
+
+// echo connects to the proxy from the local address ip, sends n bytes and
+// reads them back.
+func echo(p *proxy, ip string, n int) error {
+	d := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(ip)}}
+	conn, err := d.Dial("tcp", p.ln.Addr().String())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	go conn.Write(make([]byte, n))
+	_, err = io.ReadFull(conn, make([]byte, n))
+	return err
+}
+
+// timedEcho runs echo from each of ips concurrently, returning the time
+// taken for all of them to finish.
+func timedEcho(t *testing.T, p *proxy, n int, ips ...string) time.Duration {
+	start := time.Now()
+	errCh := make(chan error, len(ips))
+	for _, ip := range ips {
+		go func(ip string) {
+			errCh <- echo(p, ip, n)
+		}(ip)
+	}
+	for range ips {
+		if err := <-errCh; err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	return time.Since(start)
+}
+
+func TestProxy_PerClient(t *testing.T) {
+	upstream := startUpstream(t)
+	defer upstream.Close()
+
+	rate := iocap.RateOpts{Interval: 100 * time.Millisecond, Size: 256}
+	p := startProxy(t, upstream.Addr().String(), rate, iocap.Unlimited)
+	defer p.shutdown(time.Second)
+
+	// A single client is capped at its own rate.
+	if d := timedEcho(t, p, 1024, "127.0.0.1"); d < 300*time.Millisecond {
+		t.Fatalf("finished too quickly in %s", d)
+	}
+
+	// Different clients are capped separately.
+	if d := timedEcho(t, p, 256, "127.0.0.1", "127.0.0.2"); d > 150*time.Millisecond {
+		t.Fatalf("clients should not share a cap, took %s", d)
+	}
+}
+
+func TestProxy_Total(t *testing.T) {
+	upstream := startUpstream(t)
+	defer upstream.Close()
+
+	total := iocap.RateOpts{Interval: 100 * time.Millisecond, Size: 256}
+	p := startProxy(t, upstream.Addr().String(), iocap.Unlimited, total)
+	defer p.shutdown(time.Second)
+
+	// Clients from different addresses share the total, so 1024 bytes in
+	// each direction need at least three drains.
+	if d := timedEcho(t, p, 512, "127.0.0.1", "127.0.0.2"); d < 300*time.Millisecond {
+		t.Fatalf("finished too quickly in %s", d)
+	}
+}
+
+func TestProxy_Admin(t *testing.T) {
+	upstream := startUpstream(t)
+	defer upstream.Close()
+
+	p := startProxy(t, upstream.Addr().String(), iocap.Unlimited, iocap.Unlimited)
+	defer p.shutdown(time.Second)
+
+	ts := httptest.NewServer(p.admin())
+	defer ts.Close()
+
+	// Hold a connection open so that it shows up as a client.
+	conn, err := net.Dial("tcp", p.ln.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	time.Sleep(10 * time.Millisecond)
+
+	resp, err := http.PostForm(ts.URL, url.Values{"per-client": {"2MB/s"}, "total": {"10Mbps"}})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var status adminStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if expect := (iocap.RateOpts{Interval: time.Second, Size: 2 << 20}); status.PerClient != expect {
+		t.Fatalf("expect %v, got: %v", expect, status.PerClient)
+	}
+	if expect := iocap.Mbps(10); status.Total != expect {
+		t.Fatalf("expect %v, got: %v", expect, status.Total)
+	}
+	if len(status.Clients) != 1 || status.Clients[0].Conns != 1 {
+		t.Fatalf("bad clients: %v", status.Clients)
+	}
+
+	// Invalid rates are rejected.
+	resp, err = http.PostForm(ts.URL, url.Values{"total": {"fast"}})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expect 400, got: %d", resp.StatusCode)
+	}
+}
+
+func TestProxy_Shutdown(t *testing.T) {
+	upstream := startUpstream(t)
+	defer upstream.Close()
+
+	p := startProxy(t, upstream.Addr().String(), iocap.Unlimited, iocap.Unlimited)
+
+	conn, err := net.Dial("tcp", p.ln.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	time.Sleep(10 * time.Millisecond)
+
+	done := make(chan struct{})
+	go func() {
+		p.shutdown(time.Second)
+		close(done)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	// New connections are refused, while the open one keeps working.
+	if _, err := net.Dial("tcp", p.ln.Addr().String()); err == nil {
+		t.Fatal("expect new connections to be refused")
+	}
+	conn.Write([]byte("hello"))
+	if _, err := io.ReadFull(conn, make([]byte, 5)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	select {
+	case <-done:
+		t.Fatal("shutdown should wait for open connections")
+	default:
+	}
+
+	// Shutdown finishes once the connection closes.
+	conn.Close()
+	select {
+	case <-done:
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("shutdown did not finish")
+	}
+}
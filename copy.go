@@ -0,0 +1,236 @@
+package iocap
+
+import (
+	"io"
+	"time"
+)
+
+// maxCopyChunk is the largest chunk moved at once by copies, as with the
+// buffer of io.Copy.
+const maxCopyChunk = 32 << 10
+
+// copyChunk returns the size of the chunks to copy at the rate opts: as much
+// as the rate allows at once, up to maxCopyChunk.
+func copyChunk(opts RateOpts) int {
+	if c := opts.capacity(); !opts.IsUnlimited() && c < maxCopyChunk {
+		return c
+	}
+	return maxCopyChunk
+}
+
+// WriteTo implements io.WriterTo, so that io.Copy from the reader streams
+// from src to w without a buffer of its own. Each chunk is read with a
+// single read of src, no larger than the rate allows at once, and only the
+// bytes actually read are charged.
+func (r *Reader) WriteTo(w io.Writer) (n int64, err error) {
+	var buf []byte
+	for {
+		// Follow any change of the rate since the last chunk.
+		size := copyChunk(r.bucket.rate())
+		if size > cap(buf) {
+			buf = make([]byte, size)
+		}
+
+		v, rerr := r.read(buf[:size], true)
+		if v > 0 {
+			written, werr := w.Write(buf[:v])
+			n += int64(written)
+			if werr != nil {
+				return n, werr
+			}
+			if written < v {
+				return n, io.ErrShortWrite
+			}
+		}
+		if rerr == io.EOF {
+			return n, nil
+		}
+		if rerr != nil {
+			return n, rerr
+		}
+	}
+}
+
+// ReadFrom implements io.ReaderFrom, so that io.Copy to the writer reads
+// from src in chunks no larger than the rate allows at once, or the chunk
+// size of the writer. If the underlying writer is itself an io.ReaderFrom,
+// such as a file or a connection, chunks for which there is quota right
+// away are handed to its ReadFrom, so that any fast path of its own is
+// kept. Those are bounded by the quota available, which is only charged
+// once the bytes were moved, so that none is held while src blocks. Other
+// chunks are read with a single read of src and written with Write, so that
+// reaching the end of src never waits on the rate. Either way, only the
+// bytes actually moved are charged.
+func (w *Writer) ReadFrom(src io.Reader) (n int64, err error) {
+	var buf []byte
+	return w.readFrom(src, &buf)
+}
+
+// readFrom implements ReadFrom, reading through *buf, which is grown as
+// needed so that it can be reused across calls.
+func (w *Writer) readFrom(src io.Reader, buf *[]byte) (n int64, err error) {
+	rf, _ := w.dst.(io.ReaderFrom)
+	if w.source != nil {
+		rf = nil
+	}
+
+	for {
+		if err := w.intr.err(); err != nil {
+			return n, err
+		}
+		if w.ctx != nil && w.ctx.Err() != nil {
+			return n, w.ctx.Err()
+		}
+		size := w.copyChunk()
+		if rf != nil {
+			if want := w.bucket.available(); want > 0 {
+				if want > size {
+					want = size
+				}
+				v, err := w.readFromDst(rf, src, want)
+				n += v
+
+				// A chunk falling short without an error means src is
+				// at EOF.
+				if err != nil || v < int64(want) {
+					return n, err
+				}
+				continue
+			}
+		}
+
+		if size > cap(*buf) {
+			*buf = make([]byte, size)
+		}
+		v, rerr := src.Read((*buf)[:size])
+		if v > 0 {
+			written, werr := w.Write((*buf)[:v])
+			n += int64(written)
+			if werr != nil {
+				return n, werr
+			}
+		}
+		if rerr == io.EOF {
+			return n, nil
+		}
+		if rerr != nil {
+			return n, rerr
+		}
+	}
+}
+
+// readFromDst copies up to want bytes from src with the ReadFrom of the
+// underlying writer, then charges the bytes copied. Others may have taken
+// the quota in the meantime, in which case the charge is carried as debt.
+func (w *Writer) readFromDst(rf io.ReaderFrom, src io.Reader, want int) (int64, error) {
+	// The limited reader is recognized by the fast paths of files and
+	// connections.
+	v, err := rf.ReadFrom(&io.LimitedReader{R: src, N: int64(want)})
+	w.bucket.postCharge(int(v))
+	copied := int(v)
+	w.stats.count(&copied)
+	return v, err
+}
+
+// copyChunk returns the size of the chunks copied by ReadFrom.
+func (w *Writer) copyChunk() int {
+	size := copyChunk(w.bucket.rate())
+	if w.chunk > 0 && w.chunk < size {
+		size = w.chunk
+	}
+	return size
+}
+
+// copyPeriod is the time worth of the rate copied in each chunk by Copy.
+const copyPeriod = 10 * time.Millisecond
+
+// minCopyChunk is the smallest chunk copied by Copy, unless the rate allows
+// less at once.
+const minCopyChunk = 512
+
+// Copy copies from src to dst at the rate opts until EOF is reached on src
+// or an error occurs, like io.Copy. It returns the number of bytes copied,
+// and the first error encountered, if any. A successful Copy returns a nil
+// error rather than EOF.
+//
+// The data is copied in chunks of about 10ms worth of the rate, so that
+// slow copies are written out in small pieces rather than in bursts of a
+// whole interval, and fast copies go in large ones.
+func Copy(dst io.Writer, src io.Reader, opts RateOpts) (int64, error) {
+	w := NewWriter(dst, opts)
+	w.SetChunkSize(copySize(opts))
+	return w.ReadFrom(src)
+}
+
+// CopyGroup is like Copy, but copies at the rate of g, which is shared
+// with the other members of the group.
+func CopyGroup(dst io.Writer, src io.Reader, g *Group) (int64, error) {
+	w := g.NewWriter(dst)
+	w.SetChunkSize(copySize(g.Rate()))
+	return w.ReadFrom(src)
+}
+
+// copySize returns the size of the chunks copied by Copy at the rate opts.
+func copySize(opts RateOpts) int {
+	if opts.IsUnlimited() {
+		return maxCopyChunk
+	}
+	size := int(opts.BytesPerSecond() * copyPeriod.Seconds())
+	switch {
+	case size < minCopyChunk:
+		return minCopyChunk
+	case size > maxCopyChunk:
+		return maxCopyChunk
+	}
+	return size
+}
+
+// CopyN is like Copy, but copies at most n bytes, like io.CopyN. It returns
+// the number of bytes copied, and io.EOF if src ended before n bytes were
+// copied.
+//
+// If progress is not nil, it is called with the total number of bytes copied
+// so far after each chunk, so at most once per chunk as with Copy. It runs
+// synchronously on the copy, which it holds up while it runs, so it should
+// return quickly. It may report the progress elsewhere, but must not wait on
+// the copy itself.
+func CopyN(dst io.Writer, src io.Reader, n int64, opts RateOpts, progress func(copied int64)) (int64, error) {
+	return copyN(NewWriter(dst, opts), src, n, copySize(opts), progress)
+}
+
+// CopyNGroup is like CopyN, but copies at the rate of g, which is shared
+// with the other members of the group.
+func CopyNGroup(dst io.Writer, src io.Reader, n int64, g *Group, progress func(copied int64)) (int64, error) {
+	return copyN(g.NewWriter(dst), src, n, copySize(g.Rate()), progress)
+}
+
+// copyN implements CopyN, copying through w in chunks of the given size.
+func copyN(w *Writer, src io.Reader, n int64, size int, progress func(int64)) (written int64, err error) {
+	w.SetChunkSize(size)
+
+	// The buffer and limited reader are reused for every chunk.
+	var buf []byte
+	lr := &io.LimitedReader{R: src}
+	for written < n {
+		want := n - written
+		if c := int64(w.copyChunk()); want > c {
+			want = c
+		}
+
+		var v int64
+		lr.N = want
+		v, err = w.readFrom(lr, &buf)
+		written += v
+		if v > 0 && progress != nil {
+			progress(written)
+		}
+		if err != nil {
+			return
+		}
+		if v < want {
+			// The limit was not reached, so src is at EOF.
+			return written, io.EOF
+		}
+	}
+	return
+}
@@ -0,0 +1,390 @@
+package iocap
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+// copyTimed copies src to dst, and returns the bytes copied and the time
+// taken on clock.
+func copyTimed(t *testing.T, clock *fakeClock, dst io.Writer, src io.Reader) (int64, time.Duration) {
+	start := clock.Now()
+	n, err := io.Copy(dst, src)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return n, clock.Now().Sub(start)
+}
+
+func TestReaderWriteTo(t *testing.T) {
+	data := make([]byte, 1000)
+	rand.Read(data)
+	opts := RateOpts{Interval: 100 * time.Millisecond, Size: 100}
+
+	// Copy through WriteTo.
+	clock := newFakeClock()
+	r := NewReader(bytes.NewReader(data), opts)
+	r.SetClock(clock)
+	buf := new(bytes.Buffer)
+	n, d := copyTimed(t, clock, buf, r)
+	if n != 1000 || !bytes.Equal(buf.Bytes(), data) {
+		t.Fatalf("bad copy: %d bytes", n)
+	}
+
+	// A copy through a buffer of io.Copy moves the same bytes in the same
+	// time.
+	clock = newFakeClock()
+	r = NewReader(bytes.NewReader(data), opts)
+	r.SetClock(clock)
+	buf.Reset()
+	bn, bd := copyTimed(t, clock, buf, struct{ io.Reader }{r})
+	if bn != n || bd != d || !bytes.Equal(buf.Bytes(), data) {
+		t.Fatalf("expect %d bytes in %s, got %d in %s", n, d, bn, bd)
+	}
+
+	// Only the bytes actually read are charged, so a source returning a
+	// byte at a time is copied at the same rate.
+	clock = newFakeClock()
+	r = NewReader(byteReader{bytes.NewReader(data)}, opts)
+	r.SetClock(clock)
+	if sn, sd := copyTimed(t, clock, ioutil.Discard, r); sn != n || sd != d {
+		t.Fatalf("expect %d bytes in %s, got %d in %s", n, d, sn, sd)
+	}
+}
+
+func TestGroupReaderWriteTo(t *testing.T) {
+	clock := newFakeClock()
+	g := NewGroup(RateOpts{Interval: 100 * time.Millisecond, Size: 100})
+	g.SetClock(clock)
+
+	// Copies from members of the group share its rate.
+	start := clock.Now()
+	for i := 0; i < 2; i++ {
+		r := g.NewReader(bytes.NewReader(make([]byte, 500)))
+		if n, err := r.WriteTo(ioutil.Discard); n != 500 || err != nil {
+			t.Fatalf("expect 500/nil, got: %d/%v", n, err)
+		}
+	}
+	if d := clock.Now().Sub(start); d < 900*time.Millisecond {
+		t.Fatalf("expect at least 900ms, took %s", d)
+	}
+}
+
+func TestReaderWriteTo_Error(t *testing.T) {
+	r := NewReader(bytes.NewReader(make([]byte, 100)), Unlimited)
+	if n, err := r.WriteTo(failingWriter{}); n != 0 || err != errFailed {
+		t.Fatalf("expect 0/%v, got: %d/%v", errFailed, n, err)
+	}
+
+	// Errors of the source other than EOF are returned with the count.
+	r = NewReader(readerFunc(func(p []byte) (int, error) {
+		return 10, errFailed
+	}), Unlimited)
+	if n, err := r.WriteTo(ioutil.Discard); n != 10 || err != errFailed {
+		t.Fatalf("expect 10/%v, got: %d/%v", errFailed, n, err)
+	}
+}
+
+func TestWriterReadFrom(t *testing.T) {
+	data := make([]byte, 1000)
+	rand.Read(data)
+	opts := RateOpts{Interval: 100 * time.Millisecond, Size: 100}
+
+	// Copy through a buffer of io.Copy, hiding ReadFrom.
+	clock := newFakeClock()
+	w := NewWriter(new(bytes.Buffer), opts)
+	w.SetClock(clock)
+	n, d := copyTimed(t, clock, struct{ io.Writer }{w}, struct{ io.Reader }{bytes.NewReader(data)})
+
+	// ReadFrom moves the same bytes in the same time, whether or not the
+	// underlying writer is an io.ReaderFrom.
+	rf := new(readFromCounter)
+	for _, dst := range []io.Writer{rf, struct{ io.Writer }{new(bytes.Buffer)}} {
+		clock := newFakeClock()
+		w := NewWriter(dst, opts)
+		w.SetClock(clock)
+		start := clock.Now()
+		rn, err := w.ReadFrom(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if rd := clock.Now().Sub(start); rn != n || rd != d {
+			t.Fatalf("expect %d bytes in %s, got %d in %s", n, d, rn, rd)
+		}
+	}
+	if rf.calls == 0 || !bytes.Equal(rf.Bytes(), data) {
+		t.Fatalf("bad copy through ReadFrom: %d calls", rf.calls)
+	}
+}
+
+// readFromCounter is a buffer counting the calls to its ReadFrom.
+type readFromCounter struct {
+	bytes.Buffer
+	calls int
+}
+
+func (c *readFromCounter) ReadFrom(r io.Reader) (int64, error) {
+	c.calls++
+	return c.Buffer.ReadFrom(r)
+}
+
+func TestWriterReadFrom_Refund(t *testing.T) {
+	clock := newFakeClock()
+	w := NewWriter(new(bytes.Buffer), RateOpts{Interval: time.Second, Size: 100})
+	w.SetClock(clock)
+
+	// Only the bytes copied are charged.
+	if n, err := w.ReadFrom(bytes.NewReader(make([]byte, 30))); n != 30 || err != nil {
+		t.Fatalf("expect 30/nil, got: %d/%v", n, err)
+	}
+	if n := w.Available(); n != 70 {
+		t.Fatalf("expect 70 available, got: %d", n)
+	}
+}
+
+func TestWriterReadFrom_Blocked(t *testing.T) {
+	g := NewGroup(RateOpts{Interval: time.Hour, Size: 100})
+
+	// Start a copy to a writer with a ReadFrom of its own, from a source
+	// with nothing to read yet.
+	pr, pw := io.Pipe()
+	done := make(chan int64)
+	go func() {
+		n, _ := g.NewWriter(new(readFromCounter)).ReadFrom(pr)
+		done <- n
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	// The quota is not held while the copy waits on its source.
+	if n, err := g.NewWriter(ioutil.Discard).TryWrite(make([]byte, 100)); n != 100 || err != nil {
+		t.Fatalf("expect 100/nil, got: %d/%v", n, err)
+	}
+
+	// The bytes copied afterward are still charged.
+	pw.Write(make([]byte, 50))
+	pw.Close()
+	if n := <-done; n != 50 {
+		t.Fatalf("expect 50, got: %d", n)
+	}
+	if n := g.NewWriter(ioutil.Discard).Available(); n != 0 {
+		t.Fatalf("expect 0 available, got: %d", n)
+	}
+}
+
+func TestGroupWriterReadFrom(t *testing.T) {
+	clock := newFakeClock()
+	g := NewGroup(RateOpts{Interval: 100 * time.Millisecond, Size: 100})
+	g.SetClock(clock)
+
+	// Copies to members of the group share its rate.
+	start := clock.Now()
+	for i := 0; i < 2; i++ {
+		w := g.NewWriter(new(bytes.Buffer))
+		if n, err := w.ReadFrom(bytes.NewReader(make([]byte, 500))); n != 500 || err != nil {
+			t.Fatalf("expect 500/nil, got: %d/%v", n, err)
+		}
+	}
+	if d := clock.Now().Sub(start); d < 900*time.Millisecond {
+		t.Fatalf("expect at least 900ms, took %s", d)
+	}
+}
+
+func TestWriterReadFrom_Error(t *testing.T) {
+	// A failing writer returns the bytes written before it failed.
+	var written int
+	dst := writerFunc(func(p []byte) (int, error) {
+		if written+len(p) > 150 {
+			v := 150 - written
+			written = 150
+			return v, errFailed
+		}
+		written += len(p)
+		return len(p), nil
+	})
+	w := NewWriter(dst, RateOpts{Interval: time.Millisecond, Size: 100})
+	if n, err := w.ReadFrom(bytes.NewReader(make([]byte, 1000))); n != 150 || err != errFailed {
+		t.Fatalf("expect 150/%v, got: %d/%v", errFailed, n, err)
+	}
+
+	// Errors of the source are returned with the count, whether or not the
+	// underlying writer is an io.ReaderFrom.
+	src := readerFunc(func(p []byte) (int, error) {
+		return 10, errFailed
+	})
+	for _, dst := range []io.Writer{new(bytes.Buffer), struct{ io.Writer }{new(bytes.Buffer)}} {
+		w := NewWriter(dst, Unlimited)
+		if n, err := w.ReadFrom(src); n != 10 || err != errFailed {
+			t.Fatalf("expect 10/%v, got: %d/%v", errFailed, n, err)
+		}
+	}
+}
+
+func TestCopy(t *testing.T) {
+	data := make([]byte, 300)
+	rand.Read(data)
+	buf := new(bytes.Buffer)
+
+	// The first 100 bytes go right away, and the rest after two drains.
+	start := time.Now()
+	n, err := Copy(buf, bytes.NewReader(data), RateOpts{Interval: 50 * time.Millisecond, Size: 100})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if n != 300 || !bytes.Equal(buf.Bytes(), data) {
+		t.Fatalf("bad copy: %d bytes", n)
+	}
+	if d := time.Since(start); d < 90*time.Millisecond || d > 500*time.Millisecond {
+		t.Fatalf("expect about 100ms, took %s", d)
+	}
+
+	// Errors are returned with the bytes copied, but EOF is not.
+	if n, err := Copy(failingWriter{}, bytes.NewReader(data), Unlimited); n != 0 || err != errFailed {
+		t.Fatalf("expect 0/%v, got: %d/%v", errFailed, n, err)
+	}
+	if n, err := Copy(ioutil.Discard, new(bytes.Buffer), Unlimited); n != 0 || err != nil {
+		t.Fatalf("expect 0/nil, got: %d/%v", n, err)
+	}
+}
+
+func TestCopyGroup(t *testing.T) {
+	clock := newFakeClock()
+	g := NewGroup(KBps(10))
+	g.SetClock(clock)
+
+	// 30KB take two drains beyond the first 10KB.
+	start := clock.Now()
+	n, err := CopyGroup(ioutil.Discard, bytes.NewReader(make([]byte, 30*KB)), g)
+	if n != 30*KB || err != nil {
+		t.Fatalf("expect %d/nil, got: %d/%v", 30*KB, n, err)
+	}
+	if d := clock.Now().Sub(start); d != 2*time.Second {
+		t.Fatalf("expect 2s, took %s", d)
+	}
+}
+
+func TestCopyN(t *testing.T) {
+	data := make([]byte, 2000)
+	rand.Read(data)
+	buf := new(bytes.Buffer)
+
+	// Progress is reported in increasing steps, ending with the total.
+	var reports []int64
+	n, err := CopyN(buf, bytes.NewReader(data), 1500, RateOpts{Interval: time.Millisecond, Size: 200}, func(copied int64) {
+		reports = append(reports, copied)
+	})
+	if n != 1500 || err != nil {
+		t.Fatalf("expect 1500/nil, got: %d/%v", n, err)
+	}
+	if !bytes.Equal(buf.Bytes(), data[:1500]) {
+		t.Fatalf("bad copy")
+	}
+	if len(reports) < 2 || reports[len(reports)-1] != 1500 {
+		t.Fatalf("bad progress: %v", reports)
+	}
+	for i := 1; i < len(reports); i++ {
+		if reports[i] <= reports[i-1] {
+			t.Fatalf("progress should increase: %v", reports)
+		}
+	}
+
+	// A short source ends the copy with EOF.
+	n, err = CopyN(ioutil.Discard, bytes.NewReader(data), 3000, Unlimited, nil)
+	if n != 2000 || err != io.EOF {
+		t.Fatalf("expect 2000/EOF, got: %d/%v", n, err)
+	}
+}
+
+func TestCopyN_Allocs(t *testing.T) {
+	src := bytes.NewReader(make([]byte, 64*1024))
+	w := NewWriter(struct{ io.Writer }{ioutil.Discard}, Unlimited)
+
+	// The buffer is shared by all 64 chunks of the copy.
+	n := testing.AllocsPerRun(10, func() {
+		src.Seek(0, io.SeekStart)
+		copyN(w, src, 64*1024, 1024, nil)
+	})
+	if n > 4 {
+		t.Fatalf("expect a few allocs per copy, got: %v", n)
+	}
+}
+
+func TestCopyNGroup(t *testing.T) {
+	clock := newFakeClock()
+	g := NewGroup(KBps(10))
+	g.SetClock(clock)
+
+	// 25KB take 1.5s beyond the first 10KB, leaving the rest of the
+	// source.
+	var last int64
+	start := clock.Now()
+	n, err := CopyNGroup(ioutil.Discard, zeroReader{}, 25*KB, g, func(copied int64) {
+		last = copied
+	})
+	if n != 25*KB || err != nil {
+		t.Fatalf("expect %d/nil, got: %d/%v", 25*KB, n, err)
+	}
+	if last != n {
+		t.Fatalf("expect final progress %d, got: %d", n, last)
+	}
+	if d := clock.Now().Sub(start); d != 1500*time.Millisecond {
+		t.Fatalf("expect 1.5s, took %s", d)
+	}
+}
+
+func TestCopySize(t *testing.T) {
+	cases := []struct {
+		opts   RateOpts
+		expect int
+	}{
+		{Unlimited, maxCopyChunk},
+		{KBps(1), minCopyChunk},
+		{KBps(100), 1024},
+		{MBps(100), maxCopyChunk},
+	}
+	for _, tc := range cases {
+		if n := copySize(tc.opts); n != tc.expect {
+			t.Fatalf("%s: expect %d, got: %d", tc.opts, tc.expect, n)
+		}
+	}
+}
+
+func BenchmarkCopy(b *testing.B) {
+	// The source hides the WriteTo of bytes.Reader, as with a file or a
+	// connection.
+	data := make([]byte, 1<<20)
+	opts := RateOpts{Interval: time.Millisecond, Size: 1 << 40}
+	b.Run("Copy", func(b *testing.B) {
+		b.SetBytes(int64(len(data)))
+		for i := 0; i < b.N; i++ {
+			Copy(ioutil.Discard, struct{ io.Reader }{bytes.NewReader(data)}, opts)
+		}
+	})
+	b.Run("Writer", func(b *testing.B) {
+		b.SetBytes(int64(len(data)))
+		for i := 0; i < b.N; i++ {
+			io.Copy(NewWriter(ioutil.Discard, opts), struct{ io.Reader }{bytes.NewReader(data)})
+		}
+	})
+}
+
+func BenchmarkReaderWriteTo(b *testing.B) {
+	data := make([]byte, 1<<20)
+	opts := RateOpts{Interval: time.Millisecond, Size: 1 << 40}
+	b.Run("WriteTo", func(b *testing.B) {
+		b.SetBytes(int64(len(data)))
+		for i := 0; i < b.N; i++ {
+			io.Copy(ioutil.Discard, NewReader(bytes.NewReader(data), opts))
+		}
+	})
+	b.Run("Buffer", func(b *testing.B) {
+		b.SetBytes(int64(len(data)))
+		for i := 0; i < b.N; i++ {
+			r := NewReader(bytes.NewReader(data), opts)
+			io.Copy(ioutil.Discard, struct{ io.Reader }{r})
+		}
+	})
+}
@@ -2,11 +2,23 @@
 Package iocap provides rate limiting for data streams using the familiar
 io.Reader and io.Writer interfaces.
 
-Rates can be expressed in a few different units using helper functions:
+Rates can be expressed in a few different units using helper functions.
+Those ending in "bps" take bits per second, as usual for network links,
+and those ending in "Bps" take bytes per second:
 
 	rate := iocap.Kbps(512) // Kilobits/s
 	rate := iocap.Mbps(10)  // Megabits/s
 	rate := iocap.Gbps(1)   // Gigabits/s
+	rate := iocap.KBps(64)  // Kilobytes/s, the same as Kbps(512)
+	rate := iocap.MBps(5)   // Megabytes/s
+	rate := iocap.GBps(1)   // Gigabytes/s
+
+	rate := iocap.BitsPerSecond(9600) // Bits/s, for slow links
+
+Rates can be parsed from human-readable strings, such as those found in
+configuration files:
+
+	rate, err := iocap.ParseRate("10MB/s")
 
 Rates can also be described manually with any size or interval:
 
@@ -15,12 +27,35 @@ Rates can also be described manually with any size or interval:
 		Size:     5 * 1024 * 1024, // 5MB/s
 	}
 
+Profiles of typical network links provide rates for emulating slow clients
+in tests:
+
+	p, ok := iocap.ProfileByName("3g") // Or iocap.Profile3G
+	rate := p.Down
+
 Readers and Writers are created by passing in an existing io.Reader or
 io.Writer along with a rate.
 
 	r = iocap.NewReader(r, rate)
 	w = iocap.NewWriter(w, rate)
 
+Record writers limit the number of delimited records, such as log lines,
+written per interval rather than the number of bytes.
+
+	w = iocap.NewRecordWriter(w, '\n', iocap.RateOpts{
+		Interval: time.Second,
+		Size:     500, // 500 lines/s
+	})
+
+Limiters apply rates to operations which are not data streams, counting
+any unit of work in place of bytes.
+
+	l := iocap.NewLimiter(iocap.RateOpts{
+		Interval: time.Second,
+		Size:     100, // 100 jobs/s
+	})
+	n := l.Wait(len(jobs)) // Blocks until n jobs, at least one, may start
+
 Rate limits can be applied to multiple readers and/or writers by creating
 a rate limiting group for them.
 
@@ -31,5 +66,10 @@ a rate limiting group for them.
 	// applied and enforced across both.
 	r = g.NewReader(r)
 	w = g.NewWriter(w)
+
+Processes with many throttled streams can have all blocked operations woken
+by a single shared pacer rather than each sleeping on its own timer.
+
+	iocap.EnableSharedPacer(time.Millisecond)
 */
 package iocap
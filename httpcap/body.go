@@ -0,0 +1,101 @@
+package httpcap
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+
+	"github.com/ryanuber/iocap"
+)
+
+// ErrBodyTooLarge is returned when reading a request body beyond the limit
+// set by MaxUploadSize.
+var ErrBodyTooLarge = errors.New("httpcap: request body too large")
+
+// body wraps a request or response body, charging the bytes read from it
+// to one or more groups. Bodies are usually read with large buffers which
+// are only partially filled, so rather than reserving the full buffer up
+// front the bytes are charged after they have been read.
+type body struct {
+	rc      io.ReadCloser
+	charges []*iocap.Writer
+
+	// max is the maximum number of bytes which may be read, or zero for
+	// no limit. exceeded is called once when a read goes beyond it.
+	max      int64
+	read     int64
+	exceeded func()
+
+	// before is called once, before the first read.
+	before func()
+}
+
+// newBody creates a new body charging reads from rc to each of groups.
+// Reads waiting on the groups are abandoned once ctx is done.
+func newBody(ctx context.Context, rc io.ReadCloser, groups ...*iocap.Group) *body {
+	b := &body{rc: rc}
+	for _, g := range groups {
+		b.charges = append(b.charges, g.NewWriterContext(ctx, ioutil.Discard))
+	}
+	return b
+}
+
+// Read reads from the underlying body, blocking until the bytes read have
+// been charged to the groups.
+func (b *body) Read(p []byte) (int, error) {
+	if b.before != nil {
+		b.before()
+		b.before = nil
+	}
+
+	if b.max > 0 {
+		if b.read > b.max {
+			return 0, ErrBodyTooLarge
+		}
+
+		// Read at most one byte past the limit to detect going over it.
+		if remain := b.max - b.read + 1; int64(len(p)) > remain {
+			p = p[:remain]
+		}
+	}
+
+	n, err := b.rc.Read(p)
+
+	if b.max > 0 && b.read+int64(n) > b.max {
+		n = int(b.max - b.read)
+		b.read = b.max + 1
+		if cerr := b.charge(p[:n]); cerr != nil {
+			return n, cerr
+		}
+		if b.exceeded != nil {
+			b.exceeded()
+		}
+		return n, ErrBodyTooLarge
+	}
+
+	b.read += int64(n)
+	if cerr := b.charge(p[:n]); cerr != nil {
+		return n, cerr
+	}
+	return n, err
+}
+
+// charge charges p to each of the body's groups. It fails if the context
+// of the body is done while waiting.
+func (b *body) charge(p []byte) error {
+	if len(p) == 0 {
+		return nil
+	}
+	for _, charge := range b.charges {
+		if _, err := charge.Write(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes the underlying body.
+func (b *body) Close() error {
+	return b.rc.Close()
+}
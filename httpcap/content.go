@@ -0,0 +1,20 @@
+package httpcap
+
+import (
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/ryanuber/iocap"
+)
+
+// ServeContent is like http.ServeContent, but limits the response using the
+// group g. Range requests, HEAD requests and conditional requests behave
+// exactly as with http.ServeContent. Only the bytes sent to the client are
+// limited; seeking within content is not.
+func ServeContent(w http.ResponseWriter, r *http.Request, name string, modtime time.Time, content io.ReadSeeker, g *iocap.Group, opts ...Option) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, name, modtime, content)
+	})
+	GroupHandler(h, g, opts...).ServeHTTP(w, r)
+}
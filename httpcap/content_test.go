@@ -0,0 +1,99 @@
+package httpcap
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ryanuber/iocap"
+)
+
+func TestServeContent(t *testing.T) {
+	content := make([]byte, 4096)
+	for i := range content {
+		content[i] = byte(i)
+	}
+	modtime := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	rate := iocap.RateOpts{Interval: 100 * time.Millisecond, Size: 1024}
+
+	// Each request gets a group of its own, so timings are independent.
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ServeContent(w, r, "data.bin", modtime, bytes.NewReader(content), iocap.NewGroup(rate))
+	}))
+	defer ts.Close()
+
+	do := func(method string, header map[string]string) (*http.Response, []byte, time.Duration) {
+		req, err := http.NewRequest(method, ts.URL, nil)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+
+		start := time.Now()
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		return resp, body, time.Since(start)
+	}
+
+	// The full content is limited, needing at least 3 drains.
+	resp, body, d := do("GET", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expect 200, got: %d", resp.StatusCode)
+	}
+	if !bytes.Equal(body, content) {
+		t.Fatal("content mismatch")
+	}
+	if d < 300*time.Millisecond {
+		t.Fatalf("response returned too quickly in %s", d)
+	}
+
+	// A range at the end of the content only costs its own size.
+	resp, body, d = do("GET", map[string]string{"Range": "bytes=3072-3583"})
+	if resp.StatusCode != http.StatusPartialContent {
+		t.Fatalf("expect 206, got: %d", resp.StatusCode)
+	}
+	if v := resp.Header.Get("Content-Range"); v != "bytes 3072-3583/4096" {
+		t.Fatalf("bad content range: %q", v)
+	}
+	if !bytes.Equal(body, content[3072:3584]) {
+		t.Fatal("content mismatch")
+	}
+	if d > 80*time.Millisecond {
+		t.Fatalf("range took too long: %s", d)
+	}
+
+	// Ranges beyond the content are unsatisfiable.
+	resp, _, _ = do("GET", map[string]string{"Range": "bytes=5000-"})
+	if resp.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+		t.Fatalf("expect 416, got: %d", resp.StatusCode)
+	}
+
+	// HEAD sends the headers without a body.
+	resp, body, _ = do("HEAD", nil)
+	if resp.StatusCode != http.StatusOK || len(body) != 0 {
+		t.Fatalf("expect empty 200, got: %d with %d bytes", resp.StatusCode, len(body))
+	}
+	if resp.ContentLength != 4096 {
+		t.Fatalf("expect content length 4096, got: %d", resp.ContentLength)
+	}
+
+	// Unmodified content is not sent again.
+	resp, body, _ = do("GET", map[string]string{
+		"If-Modified-Since": modtime.Format(http.TimeFormat),
+	})
+	if resp.StatusCode != http.StatusNotModified || len(body) != 0 {
+		t.Fatalf("expect empty 304, got: %d with %d bytes", resp.StatusCode, len(body))
+	}
+}
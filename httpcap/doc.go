@@ -10,5 +10,11 @@ basis, or using a rate limiting group.
 	h = httpcap.GroupHandler(h, g)
 
 See the LimitByRequestIP method for a short-hand quick start.
+
+On the client side, an AdaptiveTransport limits request and response bodies
+using a group, and backs off whenever the server responds with 429 Too Many
+Requests.
+
+	client := &http.Client{Transport: httpcap.NewAdaptiveTransport(nil, g)}
 */
 package httpcap
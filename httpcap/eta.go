@@ -0,0 +1,72 @@
+package httpcap
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/ryanuber/iocap"
+)
+
+// defaultETAHeader is the header used by AdvertiseETA when none is given.
+const defaultETAHeader = "X-Throttle-ETA-Seconds"
+
+// estimator returns a function estimating how long a response of a given
+// size takes to send through the limiters of a request.
+func (h *handler) estimator(group, downloadGroup *iocap.Group, pace bool) func(size int64) time.Duration {
+	return func(size int64) time.Duration {
+		now := time.Now()
+
+		// A paced per-request group takes on the pace instead of its rate.
+		var groups []*iocap.Group
+		if !pace || h.group != nil {
+			groups = append(groups, group)
+		}
+		if downloadGroup != nil {
+			groups = append(groups, downloadGroup)
+		}
+
+		// The response is held back by the slowest of its limiters.
+		var eta time.Duration
+		for _, g := range groups {
+			if d := transferTime(size, g.Rate(), g.Snapshot(), now); d > eta {
+				eta = d
+			}
+		}
+		if pace {
+			ro := paceRate(size, h.paceOver, h.paceFloor)
+			if d := transferTime(size, ro, iocap.Snapshot{Drained: now}, now); d > eta {
+				eta = d
+			}
+		}
+		return eta
+	}
+}
+
+// transferTime estimates how long it takes to send size bytes at time now
+// through a limiter with the rate ro and the state s. Bytes fitting within
+// the current interval go out immediately, and the rest after as many
+// drains as it takes.
+func transferTime(size int64, ro iocap.RateOpts, s iocap.Snapshot, now time.Time) time.Duration {
+	if ro.IsUnlimited() {
+		return 0
+	}
+
+	avail := int64(ro.Size - s.Tokens)
+	next := s.Drained.Add(ro.Interval)
+	if !now.Before(next) {
+		// The interval is over, so the next insert drains the bucket.
+		avail = int64(ro.Size)
+		next = now.Add(ro.Interval)
+	}
+	if size <= avail {
+		return 0
+	}
+
+	drains := (size - avail + int64(ro.Size) - 1) / int64(ro.Size)
+	return next.Sub(now) + time.Duration(drains-1)*ro.Interval
+}
+
+// formatSeconds formats d as a number of seconds, to the millisecond.
+func formatSeconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', 3, 64)
+}
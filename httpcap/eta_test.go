@@ -0,0 +1,40 @@
+package httpcap
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ryanuber/iocap"
+)
+
+func TestTransferTime(t *testing.T) {
+	now := time.Now()
+	ro := iocap.RateOpts{Interval: 100 * time.Millisecond, Size: 100}
+
+	tcases := []struct {
+		size   int64
+		ro     iocap.RateOpts
+		snap   iocap.Snapshot
+		expect time.Duration
+	}{
+		// Unlimited transfers are immediate.
+		{1000, iocap.Unlimited, iocap.Snapshot{}, 0},
+
+		// Fits within the current interval.
+		{50, ro, iocap.Snapshot{Tokens: 50, Drained: now}, 0},
+
+		// Waits for the next drain, 40ms away.
+		{100, ro, iocap.Snapshot{Tokens: 50, Drained: now.Add(-60 * time.Millisecond)}, 40 * time.Millisecond},
+
+		// Waits for two more drains after that.
+		{300, ro, iocap.Snapshot{Tokens: 50, Drained: now.Add(-60 * time.Millisecond)}, 240 * time.Millisecond},
+
+		// A stale interval is drained on the next write.
+		{250, ro, iocap.Snapshot{Tokens: 100, Drained: now.Add(-time.Second)}, 200 * time.Millisecond},
+	}
+	for i, tc := range tcases {
+		if d := transferTime(tc.size, tc.ro, tc.snap, now); d != tc.expect {
+			t.Fatalf("%d: expect %s, got: %s", i, tc.expect, d)
+		}
+	}
+}
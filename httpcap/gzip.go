@@ -0,0 +1,129 @@
+package httpcap
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ryanuber/iocap"
+)
+
+// GzipThenLimit is like Handler, but gzip compresses responses for clients
+// accepting it before they are rate limited, so the rate applies to the
+// compressed bytes actually sent to the client. The response writer seen by
+// h implements http.Flusher, flushing both the compressor and the
+// connection.
+//
+// Compression happens inside the limit. Wrapping the result of Handler with
+// a separate gzip middleware instead would charge the limiter for the
+// uncompressed bytes.
+func GzipThenLimit(h http.Handler, ro iocap.RateOpts, opts ...Option) http.Handler {
+	return Handler(gzipHandler{h}, ro, opts...)
+}
+
+// gzipHandler compresses the responses of h for clients accepting gzip.
+type gzipHandler struct {
+	h http.Handler
+}
+
+func (g gzipHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !acceptsGzip(r) {
+		g.h.ServeHTTP(w, r)
+		return
+	}
+
+	gw := &gzipResponseWriter{ResponseWriter: w}
+	defer gw.close()
+	g.h.ServeHTTP(gw, r)
+}
+
+// acceptsGzip reports whether the Accept-Encoding header of r allows gzip.
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		parts := strings.Split(enc, ";")
+		if strings.TrimSpace(parts[0]) != "gzip" {
+			continue
+		}
+		for _, param := range parts[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, err := strconv.ParseFloat(param[2:], 64)
+				return err == nil && q > 0
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// gzipResponseWriter compresses the body of a response.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz *gzip.Writer
+
+	// started is set once the status code is known, and compress if the
+	// response may have a body to compress.
+	started  bool
+	compress bool
+}
+
+// WriteHeader implements part of the http.ResponseWriter interface, marking
+// responses with a body as compressed. Responses the handler already set a
+// Content-Encoding for are passed through as they are.
+func (w *gzipResponseWriter) WriteHeader(code int) {
+	if code >= 200 && !w.started {
+		w.started = true
+		if code != http.StatusNoContent && code != http.StatusNotModified &&
+			w.Header().Get("Content-Encoding") == "" {
+			w.compress = true
+			header := w.Header()
+			header.Del("Content-Length")
+			header.Set("Content-Encoding", "gzip")
+			header.Add("Vary", "Accept-Encoding")
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Write implements part of the http.ResponseWriter interface, compressing
+// the bytes written.
+func (w *gzipResponseWriter) Write(p []byte) (int, error) {
+	if !w.started {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.compress {
+		return w.ResponseWriter.Write(p)
+	}
+	if w.gz == nil {
+		w.gz = gzip.NewWriter(w.ResponseWriter)
+	}
+	return w.gz.Write(p)
+}
+
+// Flush implements the http.Flusher interface, flushing any compressed
+// data and then the underlying writer. Flushing before the first write
+// sends the headers with an implicit 200 status, as http.ResponseWriter
+// does.
+func (w *gzipResponseWriter) Flush() {
+	if !w.started {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.compress && w.gz == nil {
+		w.gz = gzip.NewWriter(w.ResponseWriter)
+	}
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// close finishes the compressed stream, if one was started.
+func (w *gzipResponseWriter) close() error {
+	if w.gz == nil {
+		return nil
+	}
+	return w.gz.Close()
+}
@@ -0,0 +1,158 @@
+package httpcap
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ryanuber/iocap"
+)
+
+// getGzip requests url accepting gzip, returning the compressed size and
+// decompressed body of the response along with the time taken.
+func getGzip(t *testing.T, url string) (int, []byte, time.Duration) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	start := time.Now()
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer resp.Body.Close()
+	raw, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	d := time.Since(start)
+
+	if v := resp.Header.Get("Content-Encoding"); v != "gzip" {
+		t.Fatalf("expect gzip, got: %q", v)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	body, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return len(raw), body, d
+}
+
+func TestGzipThenLimit(t *testing.T) {
+	random := make([]byte, 32*1024)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	zeros := make([]byte, 1024*1024)
+
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := w.(http.Flusher); !ok {
+			t.Errorf("expect writer to implement http.Flusher")
+		}
+		if r.URL.Path == "/random" {
+			w.Write(random)
+		} else {
+			w.Write(zeros)
+		}
+	})
+
+	rate := iocap.RateOpts{Interval: 100 * time.Millisecond, Size: 8 * 1024}
+	ts := httptest.NewServer(GzipThenLimit(h, rate))
+	defer ts.Close()
+
+	// A highly compressible megabyte is tiny on the wire, and goes through
+	// in a single interval, rather than the 12s it would take uncompressed.
+	n, body, d := getGzip(t, ts.URL+"/zeros")
+	if !bytes.Equal(body, zeros) {
+		t.Fatal("unexpected data")
+	}
+	if n >= rate.Size || d > time.Second {
+		t.Fatalf("compressed to %d bytes, took %s", n, d)
+	}
+
+	// Incompressible data doesn't shrink, so 32KB on the wire needs at
+	// least three drains.
+	n, body, d = getGzip(t, ts.URL+"/random")
+	if !bytes.Equal(body, random) {
+		t.Fatal("unexpected data")
+	}
+	if n < len(random) || d < 300*time.Millisecond {
+		t.Fatalf("compressed to %d bytes, took %s", n, d)
+	}
+}
+
+func TestGzipThenLimit_NotAccepted(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	})
+	ts := httptest.NewServer(GzipThenLimit(h, iocap.Unlimited))
+	defer ts.Close()
+
+	for _, enc := range []string{"", "identity", "gzip;q=0"} {
+		req, _ := http.NewRequest("GET", ts.URL, nil)
+		req.Header.Set("Accept-Encoding", enc)
+		client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.Header.Get("Content-Encoding") != "" || string(body) != "hello" {
+			t.Fatalf("%q: expect uncompressed response, got: %q", enc, body)
+		}
+	}
+}
+
+func TestGzipThenLimit_FlushFirst(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.(http.Flusher).Flush()
+		if r.URL.Path == "/hello" {
+			w.Write([]byte("hello"))
+		}
+	})
+	ts := httptest.NewServer(GzipThenLimit(h, iocap.Unlimited))
+	defer ts.Close()
+
+	// Flushing first still sends a compressed response, with or without a
+	// body written afterwards.
+	for path, expect := range map[string]string{"/hello": "hello", "/empty": ""} {
+		_, body, _ := getGzip(t, ts.URL+path)
+		if string(body) != expect {
+			t.Fatalf("%s: expect %q, got: %q", path, expect, body)
+		}
+	}
+}
+
+func TestGzipThenLimit_Encoded(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "br")
+		w.Write([]byte("brotli"))
+	})
+	ts := httptest.NewServer(GzipThenLimit(h, iocap.Unlimited))
+	defer ts.Close()
+
+	req, _ := http.NewRequest("GET", ts.URL, nil)
+	req.Header.Set("Accept-Encoding", "gzip, br")
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if v := resp.Header.Get("Content-Encoding"); v != "br" || string(body) != "brotli" {
+		t.Fatalf("expect untouched br response, got %q: %q", v, body)
+	}
+}
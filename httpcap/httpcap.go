@@ -1,76 +1,693 @@
 package httpcap
 
 import (
+	"context"
+	"errors"
+	"io"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/ryanuber/iocap"
 	"github.com/ryanuber/iocap/httpcap/mapper"
 )
 
+// ErrClientGone is returned by writes to a rate limited response once the
+// client has gone away, so that the handler can stop promptly.
+var ErrClientGone = errors.New("httpcap: client went away")
+
 // handler is a wrapper over a normal http.Handler, allowing the
 // rate to be controlled while sending data back to clients.
 type handler struct {
 	h     http.Handler
 	opts  iocap.RateOpts
 	group *iocap.Group
+
+	// limitStatus reports whether responses with the given status code
+	// are rate limited. A nil value limits all responses.
+	limitStatus func(code int) bool
+
+	// limitUploads enables limiting of request bodies, which share the
+	// quota of the response.
+	limitUploads bool
+
+	// Optional per-direction caps within the shared quota. For group
+	// handlers, the per-direction groups are shared by all requests.
+	uploadRate    iocap.RateOpts
+	downloadRate  iocap.RateOpts
+	uploadGroup   *iocap.Group
+	downloadGroup *iocap.Group
+
+	// maxUpload is the maximum request body size, and tooLarge the body of
+	// the 413 response sent when it is exceeded.
+	maxUpload int64
+	tooLarge  string
+
+	// Responses are paced to take roughly paceOver if set, no slower than
+	// paceFloor, buffering up to paceBuffer bytes to learn their size.
+	paceOver   time.Duration
+	paceFloor  iocap.RateOpts
+	paceBuffer int
+
+	// deferContinue holds off the 100 Continue response to requests
+	// expecting it until there is quota for the upload.
+	deferContinue bool
+
+	// headStart is the number of bytes at the start of each response which
+	// are sent without rate limiting.
+	headStart int
+
+	// chunkSize caps the size of each write of a limited response.
+	chunkSize int
+
+	// etaHeader is the response header advertising the expected duration
+	// of the transfer, if enabled.
+	etaHeader string
+
+	// overrideParam is the query parameter allowing the rate of a request
+	// to be overridden, for requests approved by overrideAllow.
+	overrideParam string
+	overrideAllow func(r *http.Request) bool
+
+	// meter gauges the traffic of the handler.
+	meter *meter
+
+	// stopper stops the limits of requests in flight on shutdown.
+	stopper stopper
 }
 
 // Handler creates a new rate limited HTTP handler wrapper. The rate described
 // by ro is used to rate limit each request independently.
-func Handler(h http.Handler, ro iocap.RateOpts) http.Handler {
-	return &handler{
-		h:    h,
-		opts: ro,
+func Handler(h http.Handler, ro iocap.RateOpts, opts ...Option) http.Handler {
+	hand := &handler{
+		h:     h,
+		opts:  ro,
+		meter: newMeter(),
 	}
+	for _, opt := range opts {
+		opt(hand)
+	}
+	return hand
 }
 
 // GroupHandler is like Handler, but wraps an http.Handler with group rate
 // limiting such that all requests share the same quota.
-func GroupHandler(h http.Handler, g *iocap.Group) http.Handler {
-	return &handler{
+func GroupHandler(h http.Handler, g *iocap.Group, opts ...Option) http.Handler {
+	hand := &handler{
 		h:     h,
 		group: g,
+		meter: newMeter(),
+	}
+	for _, opt := range opts {
+		opt(hand)
+	}
+	if !hand.uploadRate.IsUnlimited() {
+		hand.uploadGroup = iocap.NewGroup(hand.uploadRate)
 	}
+	if !hand.downloadRate.IsUnlimited() {
+		hand.downloadGroup = iocap.NewGroup(hand.downloadRate)
+	}
+	return hand
 }
 
 // LimitByRequestIP is a convenience wrapper to automatically limit inbound
 // requests by the given rate, per client IP address. Just give it any old
-// HTTP handler and a rate.
-func LimitByRequestIP(h http.Handler, opts iocap.RateOpts) http.Handler {
+// HTTP handler and a rate. Any options are applied to each group handler.
+func LimitByRequestIP(h http.Handler, ro iocap.RateOpts, opts ...Option) http.Handler {
 	return mapper.New(mapper.GroupByRequestIP, func(_ string) http.Handler {
-		return GroupHandler(h, iocap.NewGroup(opts))
+		return GroupHandler(h, iocap.NewGroup(ro), opts...)
 	}, time.Hour)
 }
 
+// LimitDuplexByRequestIP is like LimitByRequestIP, but the group of each
+// client IP address covers request bodies as well as responses, so that the
+// combined upload and download traffic of a client shares one quota. Use
+// the UploadRate and DownloadRate options to further cap either direction.
+func LimitDuplexByRequestIP(h http.Handler, ro iocap.RateOpts, opts ...Option) http.Handler {
+	return LimitByRequestIP(h, ro, append(opts, LimitUploads())...)
+}
+
+// LimitUploadByRequestIP is the mirror image of LimitByRequestIP, limiting
+// request bodies rather than responses. The uploads of each client IP
+// address share a group with the given rate, while responses are not
+// limited. Any options are applied to each group handler.
+func LimitUploadByRequestIP(h http.Handler, ro iocap.RateOpts, opts ...Option) http.Handler {
+	return mapper.New(mapper.GroupByRequestIP, func(_ string) http.Handler {
+		return GroupHandler(h, iocap.NewGroup(iocap.Unlimited), append(opts, UploadRate(ro))...)
+	}, time.Hour)
+}
+
+// LimitByContextValue is like LimitByRequestIP, but groups requests by the
+// string value stored under key in their context, such as a user ID set by
+// authentication middleware. Requests without the value are grouped by their
+// client IP address. The limiter must be installed inside the middleware
+// which sets the value, so that it runs after it:
+//
+//	h = auth(httpcap.LimitByContextValue(h, userKey, rate))
+func LimitByContextValue(h http.Handler, key interface{}, ro iocap.RateOpts, opts ...Option) http.Handler {
+	g := mapper.GroupByContextValue(key, mapper.GroupByRequestIP)
+	return mapper.New(g, func(_ string) http.Handler {
+		return GroupHandler(h, iocap.NewGroup(ro), opts...)
+	}, time.Hour)
+}
+
+// DynamicLimiter limits requests per group key, at a rate chosen for each key
+// by a user function. The embedded mapper handler allows groups to be
+// inspected and invalidated.
+type DynamicLimiter struct {
+	*mapper.Handler
+	rate func(key string) iocap.RateOpts
+}
+
+// LimitByRequestIPFunc is like LimitByRequestIP, but the rate of each client
+// IP address is chosen by calling rate with the address when its group is
+// created. Use Reevaluate to apply changes in the rates to existing groups.
+func LimitByRequestIPFunc(h http.Handler, rate func(key string) iocap.RateOpts, opts ...Option) *DynamicLimiter {
+	return newDynamicLimiter(h, mapper.GroupByRequestIP, rate, opts)
+}
+
+// LimitByRequestIPAndPath limits requests per combination of client IP
+// address and path class, so that the bulk downloads of a client don't
+// starve its interactive requests. Paths are classified by prefix as with
+// mapper.GroupByPathPrefix, and each class has its own rate in rates.
+// Classes missing from rates are unlimited.
+func LimitByRequestIPAndPath(h http.Handler, prefixes map[string]string, def string, rates map[string]iocap.RateOpts, opts ...Option) *DynamicLimiter {
+	g := mapper.GroupByAll(mapper.GroupByRequestIP, mapper.GroupByPathPrefix(prefixes, def))
+	return newDynamicLimiter(h, g, func(key string) iocap.RateOpts {
+		// The class comes last in the combined key.
+		return rates[key[strings.LastIndex(key, "|")+1:]]
+	}, opts)
+}
+
+// newDynamicLimiter creates a DynamicLimiter grouping requests with g.
+func newDynamicLimiter(h http.Handler, g mapper.RequestGrouper, rate func(key string) iocap.RateOpts, opts []Option) *DynamicLimiter {
+	return &DynamicLimiter{
+		Handler: mapper.New(g, func(key string) http.Handler {
+			return GroupHandler(h, iocap.NewGroup(rate(key)), opts...)
+		}, time.Hour),
+		rate: rate,
+	}
+}
+
+// Reevaluate calls the rate function again for the group with the given key,
+// if it exists, and applies the result to the group in place. Unlike
+// invalidating the group, the quota already consumed is kept.
+func (l *DynamicLimiter) Reevaluate(key string) {
+	if g, ok := GroupByKey(l, key); ok {
+		g.SetRate(l.rate(key))
+	}
+}
+
+// ReevaluateAll calls Reevaluate for every existing group.
+func (l *DynamicLimiter) ReevaluateAll() {
+	for _, key := range l.Keys() {
+		l.Reevaluate(key)
+	}
+}
+
+// GroupOf returns the group shared by the requests of a handler created by
+// GroupHandler. It returns false for any other handler.
+func GroupOf(h http.Handler) (*iocap.Group, bool) {
+	hand, ok := h.(*handler)
+	if !ok || hand.group == nil {
+		return nil, false
+	}
+	return hand.group, true
+}
+
+// GroupByKey returns the group with the given key in a handler created by
+// LimitByRequestIP or one of its variants, such as the client IP address of
+// its requests. It returns false if the group does not currently exist.
+func GroupByKey(h http.Handler, key string) (*iocap.Group, bool) {
+	m, ok := h.(interface {
+		Lookup(key string) (http.Handler, bool)
+	})
+	if !ok {
+		return nil, false
+	}
+	hand, ok := m.Lookup(key)
+	if !ok {
+		return nil, false
+	}
+	return GroupOf(hand)
+}
+
 // ServeHTTP implements the http.Handler interface, writing responses using
 // a rate limited response writer.
 func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if h.group != nil {
-		w = &responseWriter{
-			writer:         h.group.NewWriter(w),
-			ResponseWriter: w,
+	// Per-request handlers get a fresh group, shared only by the request
+	// and response of a single request.
+	group := h.group
+	uploadGroup, downloadGroup := h.uploadGroup, h.downloadGroup
+	if group == nil {
+		group = iocap.NewGroup(h.opts)
+		if !h.uploadRate.IsUnlimited() {
+			uploadGroup = iocap.NewGroup(h.uploadRate)
 		}
-	} else {
-		w = &responseWriter{
-			writer:         iocap.NewWriter(w, h.opts),
-			ResponseWriter: w,
+		if !h.downloadRate.IsUnlimited() {
+			downloadGroup = iocap.NewGroup(h.downloadRate)
+		}
+	}
+
+	// An override takes the place of the configured rate for this request
+	// alone, leaving any shared group untouched.
+	if ro, ok := h.override(w, r); ok {
+		group = iocap.NewGroup(ro)
+	}
+
+	h.meter.begin()
+	defer h.meter.end()
+
+	// Reject uploads declared to be too large up front.
+	if h.maxUpload > 0 && r.ContentLength > h.maxUpload {
+		h.rejectUpload(w)
+		return
+	}
+
+	// A per-direction cap is applied by chaining its writer underneath
+	// the shared one.
+	//
+	// Writes are abandoned once the client goes away, so that no more quota
+	// is charged for bytes nobody will receive, or when the handler is shut
+	// down with AbortWrites.
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	metered := &meteredWriter{w: w, meter: h.meter}
+	var dst io.Writer = metered
+	if downloadGroup != nil {
+		dst = downloadGroup.NewWriterContext(ctx, dst)
+	}
+
+	// Paced responses replace the rate of a per-request group, or are
+	// paced within the quota of a shared one.
+	var pace *pacing
+	if h.paceOver > 0 {
+		pace = &pacing{
+			over:  h.paceOver,
+			floor: h.paceFloor,
+			max:   h.paceBuffer,
+			apply: group.SetRate,
+		}
+		if h.group != nil {
+			pw := iocap.NewWriterContext(ctx, dst, iocap.Unlimited)
+			pace.apply = pw.SetRate
+			dst = pw
+		}
+	}
+
+	rw := &responseWriter{
+		writer:         group.NewWriterContext(ctx, dst),
+		ResponseWriter: w,
+		ctx:            ctx,
+		reqCtx:         r.Context(),
+		limitStatus:    h.limitStatus,
+		pace:           pace,
+		head:           h.headStart,
+		metered:        metered,
+	}
+	rw.writer.SetChunkSize(h.chunkSize)
+
+	// On shutdown, either lift the limits of the request or abort its
+	// writes.
+	untrack := h.stopper.track(func(policy ShutdownPolicy) {
+		if policy == AbortWrites {
+			cancel()
+			return
+		}
+		for _, g := range []*iocap.Group{group, uploadGroup, downloadGroup} {
+			if g != nil {
+				g.SetRate(iocap.Unlimited)
+			}
+		}
+	})
+	defer untrack()
+	if h.etaHeader != "" {
+		rw.etaHeader = h.etaHeader
+		rw.eta = h.estimator(group, downloadGroup, pace != nil)
+	}
+
+	var b *body
+	if h.limitUploads && r.Body != nil {
+		if uploadGroup != nil {
+			b = newBody(ctx, r.Body, group, uploadGroup)
+		} else {
+			b = newBody(ctx, r.Body, group)
+		}
+
+		// Respond 413 as soon as the limit is exceeded, if the handler
+		// has not started its own response yet.
+		b.max = h.maxUpload
+		b.exceeded = func() {
+			if !rw.decided {
+				h.rejectUpload(w)
+				rw.decided = true
+				rw.aborted = true
+				rw.status = http.StatusRequestEntityTooLarge
+			}
+		}
+
+		// The server sends 100 Continue when the body is first read, so
+		// waiting for quota beforehand keeps the client from sending a
+		// body which would only be throttled.
+		if h.deferContinue && strings.EqualFold(r.Header.Get("Expect"), "100-continue") {
+			b.before = func() {
+				group.Wait()
+				if uploadGroup != nil {
+					uploadGroup.Wait()
+				}
+			}
 		}
+
+		r2 := new(http.Request)
+		*r2 = *r
+		r2.Body = b
+		r = r2
+	}
+
+	h.h.ServeHTTP(rw, r)
+
+	if pace != nil && !rw.aborted {
+		pace.finish(rw.writer)
+	}
+
+	// If the upload went over the limit after the response had already
+	// started, there is no way to signal the error other than dropping
+	// the connection.
+	if b != nil && b.max > 0 && b.read > b.max && !rw.aborted {
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// override returns the rate requested in the override query parameter, if
+// overrides are enabled and allowed for r. Invalid values are reported in
+// a warning header and otherwise ignored.
+func (h *handler) override(w http.ResponseWriter, r *http.Request) (iocap.RateOpts, bool) {
+	if h.overrideParam == "" {
+		return iocap.RateOpts{}, false
+	}
+	v := r.URL.Query().Get(h.overrideParam)
+	if v == "" || h.overrideAllow == nil || !h.overrideAllow(r) {
+		return iocap.RateOpts{}, false
 	}
 
-	h.h.ServeHTTP(w, r)
+	ro, err := iocap.ParseRate(v)
+	if err != nil {
+		w.Header().Set(overrideWarningHeader, err.Error())
+		return iocap.RateOpts{}, false
+	}
+	return ro, true
+}
+
+// rejectUpload responds to a request whose body is too large.
+func (h *handler) rejectUpload(w http.ResponseWriter) {
+	w.Header().Set("Connection", "close")
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusRequestEntityTooLarge)
+	io.WriteString(w, h.tooLarge)
+}
+
+// Snapshot returns the limiter state of a group handler, allowing it to be
+// carried over by the mapper. Per-request handlers have no state to save.
+func (h *handler) Snapshot() (iocap.Snapshot, bool) {
+	if h.group == nil {
+		return iocap.Snapshot{}, false
+	}
+	return h.group.Snapshot(), true
+}
+
+// Restore restores the limiter state of a group handler.
+func (h *handler) Restore(s iocap.Snapshot) {
+	if h.group != nil {
+		h.group.Restore(s)
+	}
 }
 
 // responseWriter wraps an http.ResponseWriter in a rate limited
 // writer, effectively throttling throughput from the HTTP server to
 // all of its clients.
+//
+// The header map is that of the underlying writer, so trailers declared by
+// the handler, and their values set after the body is written, pass
+// through untouched. Any part of the body held back by the wrapper is
+// written out before ServeHTTP returns, ahead of the trailers.
 type responseWriter struct {
 	writer *iocap.Writer
 	http.ResponseWriter
+
+	// limitStatus decides whether the response is limited based on its
+	// status code, once it is known. bypass is set if it is not.
+	limitStatus func(code int) bool
+	decided     bool
+	bypass      bool
+
+	// aborted is set once the wrapper has responded on behalf of the
+	// handler, after which the handler's own response is discarded.
+	aborted bool
+
+	// pace spreads the response over a target duration, if enabled.
+	pace *pacing
+
+	// ctx is done once the client goes away, which is when reqCtx, the
+	// context of the request, is done, or when the handler is shut down.
+	ctx    context.Context
+	reqCtx context.Context
+
+	// head is the number of bytes left to send before limiting begins.
+	head int
+
+	// eta estimates the duration of a limited response of a given size,
+	// which is advertised in the etaHeader header.
+	eta       func(size int64) time.Duration
+	etaHeader string
+
+	// metered counts the bytes of the response sent with limiting, and
+	// bypassed those sent without.
+	metered  *meteredWriter
+	bypassed int64
+
+	// status is the status code sent, and err the first write error,
+	// after which all writes fail.
+	status int
+	err    error
+}
+
+// ResponseInfo is implemented by the response writers passed to the
+// handlers wrapped by this package. It allows handlers and their middleware
+// to learn the true outcome of a response.
+type ResponseInfo interface {
+	// Status returns the status code sent, or zero if none was sent yet.
+	Status() int
+
+	// BytesSent returns the number of body bytes written to the client.
+	BytesSent() int64
+
+	// Err returns the error which failed the response, if any. All writes
+	// fail with it once it is set.
+	Err() error
+}
+
+// Status implements ResponseInfo.
+func (w *responseWriter) Status() int {
+	return w.status
+}
+
+// BytesSent implements ResponseInfo.
+func (w *responseWriter) BytesSent() int64 {
+	return w.metered.n + w.bypassed
+}
+
+// Err implements ResponseInfo.
+func (w *responseWriter) Err() error {
+	return w.err
+}
+
+// WriteHeader implements part of the http.ResponseWriter interface. The
+// status code decides whether the rest of the response is rate limited.
+// Like with the standard library, it does nothing once the status has been
+// sent.
+func (w *responseWriter) WriteHeader(code int) {
+	if w.aborted || w.status != 0 {
+		return
+	}
+	if code >= 200 {
+		w.status = code
+	}
+	w.decide(code)
+	w.ResponseWriter.WriteHeader(code)
 }
 
 // Write implements part of the http.ResponseWriter interface, calling the
 // underlying rate limited writer instead of directly writing out bytes.
+// Once a write fails, all further writes fail fast with the same error,
+// without consuming any quota.
 func (w *responseWriter) Write(p []byte) (int, error) {
-	return w.writer.Write(p)
+	if err := w.begin(); err != nil {
+		return 0, err
+	}
+	n, err := w.write(p)
+	if err != nil {
+		w.err = err
+	}
+	return n, err
+}
+
+// WriteString implements io.StringWriter, writing s like Write. Strings
+// passed straight to the limiter are not converted to bytes first, unless
+// they are sent in part unlimited or paced.
+func (w *responseWriter) WriteString(s string) (int, error) {
+	if err := w.begin(); err != nil {
+		return 0, err
+	}
+	var n int
+	var err error
+	if w.bypass || (w.head == 0 && w.pace == nil) {
+		n, err = w.writeString(s)
+	} else {
+		n, err = w.write([]byte(s))
+	}
+	if err != nil {
+		w.err = err
+	}
+	return n, err
+}
+
+// begin prepares the response for a write, or returns the error failing
+// it.
+func (w *responseWriter) begin() error {
+	if w.aborted {
+		return ErrBodyTooLarge
+	}
+	if w.err != nil {
+		return w.err
+	}
+
+	// Writing without a prior WriteHeader implies a 200 status.
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.decide(http.StatusOK)
+	return nil
+}
+
+// write writes p, limited unless the response bypasses the limits.
+func (w *responseWriter) write(p []byte) (int, error) {
+	if w.bypass {
+		n, err := w.ResponseWriter.Write(p)
+		w.bypassed += int64(n)
+		return n, err
+	}
+
+	// Fail fast once the client is gone, rather than charging quota.
+	if w.ctx.Err() != nil {
+		return 0, w.gone()
+	}
+
+	// The head of the response goes out unlimited.
+	var n int
+	if w.head > 0 {
+		head := p
+		if len(head) > w.head {
+			head = head[:w.head]
+		}
+		v, err := w.metered.Write(head)
+		w.head -= v
+		n += v
+		if err != nil {
+			return n, err
+		}
+		p = p[v:]
+		if len(p) == 0 {
+			return n, nil
+		}
+
+		// Get the head to the client before waiting on the limiter.
+		if f, ok := w.ResponseWriter.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+
+	var v int
+	var err error
+	if w.pace != nil {
+		v, err = w.pace.write(w.writer, w.Header(), p)
+	} else {
+		v, err = w.writer.Write(p)
+	}
+	n += v
+	if err != nil && w.ctx.Err() != nil {
+		err = w.gone()
+	}
+	return n, err
+}
+
+// writeString is like write, for responses without an unlimited head or
+// pacing.
+func (w *responseWriter) writeString(s string) (int, error) {
+	if w.bypass {
+		n, err := io.WriteString(w.ResponseWriter, s)
+		w.bypassed += int64(n)
+		return n, err
+	}
+	if w.ctx.Err() != nil {
+		return 0, w.gone()
+	}
+	n, err := w.writer.WriteString(s)
+	if err != nil && w.ctx.Err() != nil {
+		err = w.gone()
+	}
+	return n, err
+}
+
+// gone returns the error for writes abandoned once ctx is done.
+func (w *responseWriter) gone() error {
+	if w.reqCtx.Err() == nil {
+		return ErrShutdown
+	}
+	return ErrClientGone
+}
+
+// Flush implements the http.Flusher interface, sending any buffered data to
+// the client. It does nothing if the underlying writer cannot flush.
+func (w *responseWriter) Flush() {
+	if w.aborted {
+		return
+	}
+
+	// Flushing commits the response, just like writing does.
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.decide(http.StatusOK)
+
+	// Give up on learning the size of a paced response.
+	if w.pace != nil && !w.pace.decided {
+		w.pace.decided = true
+		w.pace.flush(w.writer)
+	}
+
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// decide determines whether the response is rate limited based on its
+// status code. The decision is made once, on the first final status code.
+func (w *responseWriter) decide(code int) {
+	if w.decided || code < 200 {
+		return
+	}
+	w.decided = true
+	w.bypass = w.limitStatus != nil && !w.limitStatus(code)
+
+	// Advertise how long a limited response of known size will take.
+	if w.eta != nil && !w.bypass {
+		size, err := strconv.ParseInt(w.Header().Get("Content-Length"), 10, 64)
+		if err == nil {
+			if size -= int64(w.head); size < 0 {
+				size = 0
+			}
+			w.Header().Set(w.etaHeader, formatSeconds(w.eta(size)))
+		}
+	}
 }
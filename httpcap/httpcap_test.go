@@ -2,16 +2,21 @@ package httpcap
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/ryanuber/iocap"
+	"github.com/ryanuber/iocap/httpcap/mapper"
 )
 
 func TestHandler(t *testing.T) {
@@ -60,6 +65,43 @@ func TestHandler(t *testing.T) {
 	}
 }
 
+func TestHandler_WriteString(t *testing.T) {
+	data := strings.Repeat("x", 512)
+
+	// Write the body as a string, which the response writer takes without
+	// conversion.
+	h := http.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := w.(io.StringWriter); !ok {
+			t.Errorf("expect an io.StringWriter")
+		}
+		io.WriteString(w, data)
+		if n := w.(ResponseInfo).BytesSent(); n != int64(len(data)) {
+			t.Errorf("expect %d bytes sent, got: %d", len(data), n)
+		}
+	}))
+	h = Handler(h, iocap.RateOpts{Interval: 100 * time.Millisecond, Size: 128})
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	// The string is limited like any other body.
+	start := time.Now()
+	resp, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer resp.Body.Close()
+	out, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d := time.Since(start); d < 300*time.Millisecond {
+		t.Fatalf("response returned too quickly in %s", d)
+	}
+	if string(out) != data {
+		t.Fatal("unexpected data returned")
+	}
+}
+
 func TestGroupHandler(t *testing.T) {
 	// Create some random data for the response body.
 	data := make([]byte, 512)
@@ -96,18 +138,20 @@ func TestGroupHandler(t *testing.T) {
 
 			resp, err := http.Get(ts.URL)
 			if err != nil {
-				t.Fatalf("err: %v", err)
+				t.Errorf("err: %v", err)
+				return
 			}
 			defer resp.Body.Close()
 
 			// Check the response body.
 			out, err := ioutil.ReadAll(resp.Body)
 			if err != nil {
-				t.Fatalf("err: %v", err)
+				t.Errorf("err: %v", err)
+				return
 			}
 
 			if !bytes.Equal(out, data) {
-				t.Fatal("unexpected data returned")
+				t.Error("unexpected data returned")
 			}
 		}()
 	}
@@ -218,3 +262,691 @@ func ExampleLimitByRequestIP() {
 	fmt.Println(string(body))
 	// Output: hello world!
 }
+
+func TestGroupHandler_Snapshot(t *testing.T) {
+	// Create a per-path group mapper serving a small body.
+	rate := iocap.RateOpts{Interval: 200 * time.Millisecond, Size: 128}
+	newMapper := func() *mapper.Handler {
+		return mapper.New(func(r *http.Request) string {
+			return r.URL.Path
+		}, func(_ string) http.Handler {
+			h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write(make([]byte, 128))
+			})
+			return GroupHandler(h, iocap.NewGroup(rate))
+		}, time.Minute)
+	}
+
+	// Exhaust the budget of the group.
+	h := newMapper()
+	req, err := http.NewRequest("GET", "/foo", nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	// Simulate a restart, carrying over the snapshot.
+	h2 := newMapper()
+	h2.Import(h.Export())
+
+	// The old budget is still enforced, so the request has to wait for
+	// the next interval.
+	start := time.Now()
+	h2.ServeHTTP(httptest.NewRecorder(), req)
+	if d := time.Since(start); d < 100*time.Millisecond {
+		t.Fatalf("response returned too quickly in %s", d)
+	}
+}
+
+func TestLimitDuplexByRequestIP(t *testing.T) {
+	// Read the full request body, then respond with 512 bytes.
+	h := http.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		if r.Method == "GET" {
+			w.Write(make([]byte, 512))
+		}
+	}))
+
+	rate := iocap.RateOpts{Interval: 100 * time.Millisecond, Size: 128}
+	ts := httptest.NewServer(LimitDuplexByRequestIP(h, rate))
+	defer ts.Close()
+
+	// Upload and download 512 bytes each at the same time from the same
+	// client. Sharing one quota, the 1024 bytes need at least 7 drains.
+	start := time.Now()
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		resp, err := http.Post(ts.URL, "text/plain", bytes.NewReader(make([]byte, 512)))
+		if err != nil {
+			t.Errorf("err: %v", err)
+			return
+		}
+		resp.Body.Close()
+	}()
+	go func() {
+		defer wg.Done()
+		resp, err := http.Get(ts.URL)
+		if err != nil {
+			t.Errorf("err: %v", err)
+			return
+		}
+		defer resp.Body.Close()
+		if out, _ := ioutil.ReadAll(resp.Body); len(out) != 512 {
+			t.Errorf("expect 512, got: %d", len(out))
+		}
+	}()
+	wg.Wait()
+
+	if d := time.Since(start); d < 700*time.Millisecond {
+		t.Fatalf("requests returned too quickly in %s", d)
+	}
+}
+
+func TestLimitByRequestIPFunc(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 512))
+	})
+
+	// Give each client its own rate.
+	var l sync.Mutex
+	rates := map[string]iocap.RateOpts{
+		"10.0.0.1": {Interval: 100 * time.Millisecond, Size: 512},
+		"10.0.0.2": {Interval: 100 * time.Millisecond, Size: 128},
+	}
+	rate := func(key string) iocap.RateOpts {
+		l.Lock()
+		defer l.Unlock()
+		return rates[key]
+	}
+	dl := LimitByRequestIPFunc(h, rate)
+	ts := httptest.NewServer(dl)
+	defer ts.Close()
+
+	get := func(ip string) time.Duration {
+		req, err := http.NewRequest("GET", ts.URL, nil)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		req.Header.Set("X-Forwarded-For", ip)
+
+		start := time.Now()
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer resp.Body.Close()
+		if out, _ := ioutil.ReadAll(resp.Body); len(out) != 512 {
+			t.Fatalf("expect 512, got: %d", len(out))
+		}
+		return time.Since(start)
+	}
+
+	// The fast client fits in a single interval, while the slow one needs
+	// at least 3 drains.
+	if d := get("10.0.0.1"); d > 250*time.Millisecond {
+		t.Fatalf("fast client took too long: %s", d)
+	}
+	if d := get("10.0.0.2"); d < 300*time.Millisecond {
+		t.Fatalf("slow client returned too quickly in %s", d)
+	}
+
+	// Upgrading the slow client takes effect once reevaluated.
+	l.Lock()
+	rates["10.0.0.2"] = iocap.RateOpts{Interval: 100 * time.Millisecond, Size: 512}
+	l.Unlock()
+	dl.ReevaluateAll()
+
+	if ro := groupRate(t, dl, "10.0.0.2"); ro.Size != 512 {
+		t.Fatalf("expect rate to be reevaluated, got: %v", ro)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if d := get("10.0.0.2"); d > 250*time.Millisecond {
+		t.Fatalf("upgraded client took too long: %s", d)
+	}
+}
+
+// groupRate returns the rate of the group of a DynamicLimiter with the
+// given key.
+func groupRate(t *testing.T, dl *DynamicLimiter, key string) iocap.RateOpts {
+	g, ok := GroupByKey(dl, key)
+	if !ok {
+		t.Fatalf("missing group %q", key)
+	}
+	return g.Rate()
+}
+
+func TestLimitByRequestIPAndPath(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/files/big" {
+			w.Write(make([]byte, 4096))
+		} else {
+			w.Write(make([]byte, 256))
+		}
+	})
+
+	prefixes := map[string]string{"/api/": "api", "/files/": "bulk"}
+	rates := map[string]iocap.RateOpts{
+		"api":  {Interval: 100 * time.Millisecond, Size: 1024},
+		"bulk": {Interval: 100 * time.Millisecond, Size: 1024},
+	}
+	ts := httptest.NewServer(LimitByRequestIPAndPath(h, prefixes, "api", rates))
+	defer ts.Close()
+
+	// Start a bulk download, which needs at least 3 drains.
+	start := time.Now()
+	done := make(chan time.Duration)
+	go func() {
+		resp, err := http.Get(ts.URL + "/files/big")
+		if err != nil {
+			t.Errorf("err: %v", err)
+			done <- 0
+			return
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		done <- time.Since(start)
+	}()
+
+	// Meanwhile, API requests from the same client are not held up. Four
+	// of them fit within the API class's quota of a single interval.
+	time.Sleep(20 * time.Millisecond)
+	for i := 0; i < 4; i++ {
+		_, body, d := timedGet(t, ts.URL+"/api/users")
+		if len(body) != 256 {
+			t.Fatalf("expect 256, got: %d", len(body))
+		}
+		if d > 50*time.Millisecond {
+			t.Fatalf("api request took too long: %s", d)
+		}
+	}
+
+	// The bulk class's own cap still holds.
+	if d := <-done; d < 300*time.Millisecond {
+		t.Fatalf("bulk download returned too quickly in %s", d)
+	}
+}
+
+func TestLimitByContextValue(t *testing.T) {
+	type userKey struct{}
+
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 1024))
+	})
+	rate := iocap.RateOpts{Interval: 100 * time.Millisecond, Size: 1024}
+
+	// Mock auth middleware setting the user from a header.
+	auth := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if user := r.Header.Get("X-User"); user != "" {
+				r = r.WithContext(context.WithValue(r.Context(), userKey{}, user))
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+	lh := LimitByContextValue(h, userKey{}, rate)
+	ts := httptest.NewServer(auth(lh))
+	defer ts.Close()
+
+	get := func(user string) time.Duration {
+		req, err := http.NewRequest("GET", ts.URL, nil)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if user != "" {
+			req.Header.Set("X-User", user)
+		}
+
+		start := time.Now()
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer resp.Body.Close()
+		ioutil.ReadAll(resp.Body)
+		return time.Since(start)
+	}
+
+	// Each user and the anonymous client get a budget of their own, so the
+	// first request of each is immediate.
+	for _, user := range []string{"alice", "bob", ""} {
+		if d := get(user); d > 50*time.Millisecond {
+			t.Fatalf("%q: request took too long: %s", user, d)
+		}
+	}
+	for _, key := range []string{"alice", "bob", "127.0.0.1"} {
+		if _, ok := GroupByKey(lh, key); !ok {
+			t.Fatalf("missing group %q", key)
+		}
+	}
+
+	// A second request from the same user waits for its own budget.
+	if d := get("alice"); d < 50*time.Millisecond {
+		t.Fatalf("request returned too quickly in %s", d)
+	}
+}
+
+func TestGroupOf(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 512))
+	})
+	gh := GroupHandler(h, iocap.NewGroup(iocap.RateOpts{Interval: 100 * time.Millisecond, Size: 128}))
+	ts := httptest.NewServer(gh)
+	defer ts.Close()
+
+	// Per-request handlers have no group.
+	if _, ok := GroupOf(Handler(h, iocap.Unlimited)); ok {
+		t.Fatal("expect no group")
+	}
+
+	// Lifting the limit of the group speeds up the very next request.
+	g, ok := GroupOf(gh)
+	if !ok {
+		t.Fatal("expect group")
+	}
+	g.SetRate(iocap.RateOpts{Interval: 100 * time.Millisecond, Size: 512})
+
+	_, body, d := timedGet(t, ts.URL)
+	if len(body) != 512 {
+		t.Fatalf("expect 512, got: %d", len(body))
+	}
+	if d > 80*time.Millisecond {
+		t.Fatalf("request took too long: %s", d)
+	}
+}
+
+func TestGroupByKey(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 512))
+	})
+	lh := LimitByRequestIP(h, iocap.RateOpts{Interval: 100 * time.Millisecond, Size: 512})
+	ts := httptest.NewServer(lh)
+	defer ts.Close()
+
+	// Groups don't exist until the client makes a request.
+	if _, ok := GroupByKey(lh, "127.0.0.1"); ok {
+		t.Fatal("expect no group")
+	}
+	timedGet(t, ts.URL)
+
+	g, ok := GroupByKey(lh, "127.0.0.1")
+	if !ok {
+		t.Fatal("expect group")
+	}
+	g.SetRate(iocap.RateOpts{Interval: 100 * time.Millisecond, Size: 128})
+
+	// The next request needs at least 3 drains at the lowered rate.
+	time.Sleep(100 * time.Millisecond)
+	_, body, d := timedGet(t, ts.URL)
+	if len(body) != 512 {
+		t.Fatalf("expect 512, got: %d", len(body))
+	}
+	if d < 300*time.Millisecond {
+		t.Fatalf("request returned too quickly in %s", d)
+	}
+}
+
+func TestLimitUploadByRequestIP(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		w.Write(make([]byte, 4096))
+	})
+	rate := iocap.RateOpts{Interval: 100 * time.Millisecond, Size: 1024}
+	ts := httptest.NewServer(LimitUploadByRequestIP(h, rate))
+	defer ts.Close()
+
+	// upload posts 2048 bytes from ip, returning the elapsed time.
+	upload := func(ip string) time.Duration {
+		req, err := http.NewRequest("POST", ts.URL, bytes.NewReader(make([]byte, 2048)))
+		if err != nil {
+			t.Errorf("err: %v", err)
+			return 0
+		}
+		req.Header.Set("X-Forwarded-For", ip)
+
+		start := time.Now()
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Errorf("err: %v", err)
+			return 0
+		}
+		defer resp.Body.Close()
+		if out, _ := ioutil.ReadAll(resp.Body); len(out) != 4096 {
+			t.Errorf("expect 4096, got: %d", len(out))
+		}
+		return time.Since(start)
+	}
+
+	// parallel runs an upload from each of ips at once, returning the
+	// longest elapsed time.
+	parallel := func(ips ...string) time.Duration {
+		var l sync.Mutex
+		var max time.Duration
+		var wg sync.WaitGroup
+		for _, ip := range ips {
+			wg.Add(1)
+			go func(ip string) {
+				defer wg.Done()
+				d := upload(ip)
+				l.Lock()
+				if d > max {
+					max = d
+				}
+				l.Unlock()
+			}(ip)
+		}
+		wg.Wait()
+		return max
+	}
+
+	// Clients are paced independently, each needing a single drain. The
+	// responses are not limited.
+	if d := parallel("10.0.0.1", "10.0.0.2"); d < 100*time.Millisecond || d > 250*time.Millisecond {
+		t.Fatalf("expect independent uploads, took: %s", d)
+	}
+
+	// Parallel uploads of one client share its cap, needing 3 drains.
+	time.Sleep(100 * time.Millisecond)
+	if d := parallel("10.0.0.3", "10.0.0.3"); d < 300*time.Millisecond {
+		t.Fatalf("uploads returned too quickly in %s", d)
+	}
+}
+
+func TestLimitUploadByRequestIP_Abandoned(t *testing.T) {
+	done := make(chan error, 1)
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := ioutil.ReadAll(r.Body)
+		done <- err
+	})
+	rate := iocap.RateOpts{Interval: 100 * time.Millisecond, Size: 1024}
+	ts := httptest.NewServer(LimitUploadByRequestIP(h, rate))
+	defer ts.Close()
+
+	// Start a chunked upload, then abandon it. The body is left open, so
+	// that it can't be terminated before the connection is closed.
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequest("POST", ts.URL, pr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	go func() {
+		resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+		if err == nil {
+			resp.Body.Close()
+		}
+	}()
+	pw.Write(make([]byte, 4096))
+	cancel()
+
+	// The handler is released promptly.
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("expect error")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("handler was not released")
+	}
+}
+
+func TestNestedGroups(t *testing.T) {
+	// Respond with 256 bytes.
+	h := http.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 256))
+	}))
+
+	interval := 100 * time.Millisecond
+	tenantRate := iocap.RateOpts{Interval: interval, Size: 128}
+	userRate := iocap.RateOpts{Interval: interval, Size: 64}
+
+	// Tenants share a group; each user gets a sub-group of it.
+	nested := mapper.Nested(func(r *http.Request) string {
+		return r.Header.Get("X-Tenant")
+	}, func(string) mapper.HandlerFactory {
+		tenant := iocap.NewGroup(tenantRate)
+		return func(string) http.Handler {
+			return GroupHandler(h, tenant.NewSubGroup(userRate))
+		}
+	}, func(r *http.Request) string {
+		return r.Header.Get("X-User")
+	}, time.Minute)
+
+	ts := httptest.NewServer(nested)
+	defer ts.Close()
+
+	get := func(tenant, user string) time.Duration {
+		req, err := http.NewRequest("GET", ts.URL, nil)
+		if err != nil {
+			t.Errorf("err: %v", err)
+			return 0
+		}
+		req.Header.Set("X-Tenant", tenant)
+		req.Header.Set("X-User", user)
+
+		start := time.Now()
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Errorf("err: %v", err)
+			return 0
+		}
+		defer resp.Body.Close()
+		ioutil.ReadAll(resp.Body)
+		return time.Since(start)
+	}
+
+	// A single user is held to its own cap: 256 bytes at 64 per interval.
+	if d := get("a", "1"); d < 300*time.Millisecond {
+		t.Fatalf("response returned too quickly in %s", d)
+	}
+
+	// Four users of one tenant share the tenant cap: 1024 bytes at 128
+	// per interval, even though each user's cap alone would take ~300ms.
+	start := time.Now()
+	var wg sync.WaitGroup
+	for _, user := range []string{"2", "3", "4", "5"} {
+		wg.Add(1)
+		go func(user string) {
+			defer wg.Done()
+			get("b", user)
+		}(user)
+	}
+	wg.Wait()
+	if d := time.Since(start); d < 700*time.Millisecond {
+		t.Fatalf("responses returned too quickly in %s", d)
+	}
+}
+
+func TestHandler_Flush(t *testing.T) {
+	// Flush part of the response, then wait for the client to see it.
+	release := make(chan struct{})
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+		w.(http.Flusher).Flush()
+		<-release
+		w.Write([]byte(" world"))
+	})
+
+	// Buffering for pacing is cut short by the flush as well.
+	rate := iocap.RateOpts{Interval: 100 * time.Millisecond, Size: 1024}
+	ts := httptest.NewServer(Handler(h, rate,
+		PaceOver(time.Second, iocap.Unlimited), PaceBuffer(1024)))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer resp.Body.Close()
+
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(resp.Body, buf); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(buf) != "hello" {
+		t.Fatalf("bad data: %q", buf)
+	}
+	close(release)
+
+	rest, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(rest) != " world" {
+		t.Fatalf("bad data: %q", rest)
+	}
+}
+
+func TestHandler_Trailers(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Announced")
+		w.Write(make([]byte, 256))
+
+		// Set trailer values once the body is written.
+		w.Header().Set("X-Announced", "foo")
+		w.Header().Set(http.TrailerPrefix+"X-Unannounced", "bar")
+	})
+
+	rate := iocap.RateOpts{Interval: 50 * time.Millisecond, Size: 128}
+	handlers := map[string]http.Handler{
+		"handler": Handler(h, rate),
+		"paced":   Handler(h, rate, PaceOver(100*time.Millisecond, iocap.Unlimited), PaceBuffer(1024)),
+		"gzip":    GzipThenLimit(h, rate),
+	}
+	for name, handler := range handlers {
+		ts := httptest.NewServer(handler)
+		resp, err := http.Get(ts.URL)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		ts.Close()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+
+		if len(body) != 256 {
+			t.Fatalf("%s: expect 256 bytes, got: %d", name, len(body))
+		}
+		if v := resp.Trailer.Get("X-Announced"); v != "foo" {
+			t.Fatalf("%s: bad announced trailer: %q", name, v)
+		}
+		if v := resp.Trailer.Get("X-Unannounced"); v != "bar" {
+			t.Fatalf("%s: bad unannounced trailer: %q", name, v)
+		}
+	}
+}
+
+func TestHandler_ClientGone(t *testing.T) {
+	// Write until the client goes away, counting the bytes written.
+	var written int64
+	errCh := make(chan error, 1)
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf := make([]byte, 1024)
+		for {
+			n, err := w.Write(buf)
+			atomic.AddInt64(&written, int64(n))
+			if err != nil {
+				errCh <- err
+				return
+			}
+		}
+	})
+
+	g := iocap.NewGroup(iocap.RateOpts{Interval: 100 * time.Millisecond, Size: 1024})
+	trace := g.EnableTrace(1024)
+	ts := httptest.NewServer(GroupHandler(h, g))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := io.ReadFull(resp.Body, make([]byte, 2048)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp.Body.Close()
+
+	// The handler is told promptly, even though its write was blocked.
+	select {
+	case err := <-errCh:
+		if err != ErrClientGone {
+			t.Fatalf("expect ErrClientGone, got: %v", err)
+		}
+	case <-time.After(200 * time.Millisecond):
+		t.Fatal("handler was not stopped")
+	}
+
+	// The group is no longer charged for the response.
+	before, n := len(trace.Snapshot()), atomic.LoadInt64(&written)
+	time.Sleep(300 * time.Millisecond)
+	if after := len(trace.Snapshot()); after != before {
+		t.Fatalf("group charged after disconnect: %d events, then %d", before, after)
+	}
+	if v := atomic.LoadInt64(&written); v != n {
+		t.Fatalf("wrote %d bytes after disconnect", v-n)
+	}
+}
+
+// failingWriter is a response writer whose writes fail after n bytes.
+type failingWriter struct {
+	*httptest.ResponseRecorder
+	n int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > w.n {
+		p = p[:w.n]
+	}
+	n, _ := w.ResponseRecorder.Write(p)
+	w.n -= n
+	if w.n == 0 {
+		return n, io.ErrClosedPipe
+	}
+	return n, nil
+}
+
+func TestHandler_WriteError(t *testing.T) {
+	g := iocap.NewGroup(iocap.RateOpts{Interval: time.Hour, Size: 4096})
+
+	var errs []error
+	var info ResponseInfo
+	h := GroupHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		info = w.(ResponseInfo)
+		for i := 0; i < 3; i++ {
+			_, err := w.Write(make([]byte, 512))
+			errs = append(errs, err)
+		}
+
+		// The status can't change once the body started.
+		w.WriteHeader(http.StatusInternalServerError)
+	}), g)
+
+	req, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	h.ServeHTTP(&failingWriter{httptest.NewRecorder(), 700}, req)
+
+	// The first write succeeds, and the error of the second is latched.
+	if errs[0] != nil || errs[1] != io.ErrClosedPipe || errs[2] != io.ErrClosedPipe {
+		t.Fatalf("bad errors: %v", errs)
+	}
+	if err := info.Err(); err != io.ErrClosedPipe {
+		t.Fatalf("expect latched error, got: %v", err)
+	}
+	if n := info.BytesSent(); n != 700 {
+		t.Fatalf("expect 700 bytes sent, got: %d", n)
+	}
+	if code := info.Status(); code != http.StatusOK {
+		t.Fatalf("expect 200, got: %d", code)
+	}
+
+	// Only the bytes sent consumed quota.
+	if s := g.Snapshot(); s.Tokens != 700 {
+		t.Fatalf("expect 700 tokens, got: %d", s.Tokens)
+	}
+}
@@ -0,0 +1,184 @@
+// Package httpcaptest provides helpers for testing rate limited HTTP
+// handlers and clients, measuring transfers and asserting their rates.
+//
+// Assertions on wall-clock time are only as reliable as their margins. As a
+// rule of thumb, measure transfers spanning several intervals of the rate,
+// and allow for at least one interval of slack on the upper bound. Where the
+// limiters under test can be given a Clock, such as a group passed to
+// httpcap.GroupHandler, the methods of Clock measure on virtual time
+// instead, which is exact and doesn't wait.
+package httpcaptest
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ryanuber/iocap"
+)
+
+// Measurement describes a completed transfer.
+type Measurement struct {
+	// StatusCode and Header are those of the response.
+	StatusCode int
+	Header     http.Header
+
+	// Body is the response body, of which Bytes were received.
+	Body  []byte
+	Bytes int64
+
+	// Duration is the time from sending the request until the full body
+	// was received.
+	Duration time.Duration
+}
+
+// Rate returns the effective rate of the transfer, in bytes per second.
+func (m Measurement) Rate() float64 {
+	if m.Duration <= 0 {
+		return 0
+	}
+	return float64(m.Bytes) / m.Duration.Seconds()
+}
+
+// Clock is a virtual iocap.Clock. Sleeping advances it by the requested
+// duration immediately, so rate limited transfers on it complete without
+// waiting. Concurrent sleeps each advance it, so measurements on a Clock
+// are only exact for one transfer at a time.
+type Clock struct {
+	l   sync.Mutex
+	now time.Time
+}
+
+// NewClock returns a new virtual clock starting at an arbitrary time.
+func NewClock() *Clock {
+	return &Clock{now: time.Date(2016, 8, 8, 0, 0, 0, 0, time.UTC)}
+}
+
+// Now implements iocap.Clock.
+func (c *Clock) Now() time.Time {
+	c.l.Lock()
+	defer c.l.Unlock()
+	return c.now
+}
+
+// Sleep implements iocap.Clock, advancing the clock by d unless done is
+// already closed.
+func (c *Clock) Sleep(d time.Duration, done <-chan struct{}) bool {
+	select {
+	case <-done:
+		return false
+	default:
+	}
+	c.l.Lock()
+	defer c.l.Unlock()
+	if d > 0 {
+		c.now = c.now.Add(d)
+	}
+	return true
+}
+
+// MeasureGET is like the package function MeasureGET, but measures the
+// duration on the virtual clock.
+func (c *Clock) MeasureGET(t testing.TB, ts *httptest.Server, path string) Measurement {
+	t.Helper()
+	return measureGET(t, ts, path, c)
+}
+
+// DripHandler is like the package function DripHandler, but paces the
+// response on the virtual clock.
+func (c *Clock) DripHandler(size int, rate iocap.RateOpts) http.Handler {
+	return dripHandler(size, rate, c)
+}
+
+// MeasureGET performs a GET request for path against ts, reading the full
+// response body and measuring how long it took. Errors fail the test.
+func MeasureGET(t testing.TB, ts *httptest.Server, path string) Measurement {
+	t.Helper()
+	return measureGET(t, ts, path, nil)
+}
+
+// measureGET implements MeasureGET, measuring on c, or on wall-clock time
+// if c is nil.
+func measureGET(t testing.TB, ts *httptest.Server, path string, c iocap.Clock) Measurement {
+	t.Helper()
+
+	now := time.Now
+	if c != nil {
+		now = c.Now
+	}
+	start := now()
+	resp, err := ts.Client().Get(ts.URL + path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return Measurement{
+		StatusCode: resp.StatusCode,
+		Header:     resp.Header,
+		Body:       body,
+		Bytes:      int64(len(body)),
+		Duration:   now().Sub(start),
+	}
+}
+
+// AssertRateBetween fails the test unless the effective rate of m, in bytes
+// per second, is within min and max. A zero max means no upper bound.
+func AssertRateBetween(t testing.TB, m Measurement, min, max float64) {
+	t.Helper()
+	if r := m.Rate(); r < min || (max > 0 && r > max) {
+		t.Fatalf("expect rate between %.0f and %.0f B/s, got: %.0f B/s (%d bytes in %s)",
+			min, max, r, m.Bytes, m.Duration)
+	}
+}
+
+// AssertDurationBetween fails the test unless m took between min and max. A
+// zero max means no upper bound.
+func AssertDurationBetween(t testing.TB, m Measurement, min, max time.Duration) {
+	t.Helper()
+	if m.Duration < min || (max > 0 && m.Duration > max) {
+		t.Fatalf("expect duration between %s and %s, got: %s (%d bytes)",
+			min, max, m.Duration, m.Bytes)
+	}
+}
+
+// DripHandler returns a handler responding with size bytes, sent at the
+// given rate. It is useful for exercising rate limited clients against a
+// server of known speed. Each request gets the full size, at a rate of its
+// own.
+func DripHandler(size int, rate iocap.RateOpts) http.Handler {
+	return dripHandler(size, rate, nil)
+}
+
+// dripHandler implements DripHandler, pacing on c if not nil.
+func dripHandler(size int, rate iocap.RateOpts, c iocap.Clock) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(size))
+		f, _ := w.(http.Flusher)
+
+		lw := iocap.NewWriterContext(r.Context(), w, rate)
+		if c != nil {
+			lw.SetClock(c)
+		}
+		buf := make([]byte, 1024)
+		for remain := size; remain > 0; remain -= len(buf) {
+			if remain < len(buf) {
+				buf = buf[:remain]
+			}
+			if _, err := lw.Write(buf); err != nil {
+				return
+			}
+			if f != nil {
+				f.Flush()
+			}
+		}
+	})
+}
@@ -0,0 +1,67 @@
+package httpcaptest
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ryanuber/iocap"
+)
+
+func TestDripHandler(t *testing.T) {
+	rate := iocap.RateOpts{Interval: 100 * time.Millisecond, Size: 1024}
+	ts := httptest.NewServer(DripHandler(4096, rate))
+	defer ts.Close()
+
+	// 4096 bytes at 1024 per interval needs 3 drains.
+	m := MeasureGET(t, ts, "/")
+	if m.Bytes != 4096 || len(m.Body) != 4096 {
+		t.Fatalf("expect 4096, got: %d", m.Bytes)
+	}
+	if v := m.Header.Get("Content-Length"); v != "4096" {
+		t.Fatalf("bad content length: %q", v)
+	}
+	AssertDurationBetween(t, m, 300*time.Millisecond, 600*time.Millisecond)
+	AssertRateBetween(t, m, 4096/0.6, 4096/0.3)
+}
+
+func TestDripHandler_Repeat(t *testing.T) {
+	ts := httptest.NewServer(DripHandler(100, iocap.Unlimited))
+	defer ts.Close()
+
+	// Every request gets the full response.
+	for i := 0; i < 2; i++ {
+		m := MeasureGET(t, ts, "/")
+		if m.Bytes != 100 || m.Header.Get("Content-Length") != "100" {
+			t.Fatalf("request %d: expect 100, got: %d", i, m.Bytes)
+		}
+	}
+}
+
+func TestClock(t *testing.T) {
+	c := NewClock()
+	rate := iocap.RateOpts{Interval: time.Second, Size: 1024, Coarse: true}
+	ts := httptest.NewServer(c.DripHandler(4096, rate))
+	defer ts.Close()
+
+	// 4096 bytes at 1024 per second take exactly 3s of virtual time.
+	start := time.Now()
+	m := c.MeasureGET(t, ts, "/")
+	if m.Bytes != 4096 {
+		t.Fatalf("expect 4096, got: %d", m.Bytes)
+	}
+	AssertDurationBetween(t, m, 3*time.Second, 3*time.Second)
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("should not wait on wall-clock time, took %s", d)
+	}
+}
+
+func TestMeasurement_Rate(t *testing.T) {
+	m := Measurement{Bytes: 1000, Duration: 500 * time.Millisecond}
+	if r := m.Rate(); r != 2000 {
+		t.Fatalf("expect 2000, got: %f", r)
+	}
+	if r := (Measurement{Bytes: 1000}).Rate(); r != 0 {
+		t.Fatalf("expect 0, got: %f", r)
+	}
+}
@@ -1,6 +1,7 @@
 package mapper
 
 import (
+	"io"
 	"net"
 	"net/http"
 	"strings"
@@ -8,17 +9,21 @@ import (
 	"time"
 )
 
-// handler is a proxy http.Handler implementation, which allows splitting
+// Handler is a proxy http.Handler implementation, which allows splitting
 // incoming requests off to different handlers based on the parameters of
 // the request.
-type handler struct {
+type Handler struct {
 	grouper RequestGrouper
 	factory HandlerFactory
 
-	// Group handlers and associated reap timers.
-	groups    map[string]http.Handler
-	groupReap map[string]*time.Timer
-	reapDelay time.Duration
+	// Group handlers and associated reap timers and expiration times.
+	groups      map[string]http.Handler
+	groupReap   map[string]*time.Timer
+	groupExpire map[string]time.Time
+	reapDelay   time.Duration
+
+	// created are called with each new group handler.
+	created []func(key string, hand http.Handler)
 
 	l sync.Mutex
 }
@@ -31,19 +36,20 @@ type handler struct {
 // expiration, and is only recommended when grouping on commonly-seen request
 // parameter values (request path, headers, etc). A good rule of thumb is to
 // set the reap time to 2x the estimated max request duration.
-func New(g RequestGrouper, f HandlerFactory, r time.Duration) http.Handler {
-	return &handler{
-		grouper:   g,
-		factory:   f,
-		groups:    make(map[string]http.Handler),
-		groupReap: make(map[string]*time.Timer),
-		reapDelay: r,
+func New(g RequestGrouper, f HandlerFactory, r time.Duration) *Handler {
+	return &Handler{
+		grouper:     g,
+		factory:     f,
+		groups:      make(map[string]http.Handler),
+		groupReap:   make(map[string]*time.Timer),
+		groupExpire: make(map[string]time.Time),
+		reapDelay:   r,
 	}
 }
 
 // ServeHTTP implements the http.Handler interface using request's
 // matching grouped http.Handler.
-func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// First get the group key
 	group := h.grouper(r)
 
@@ -56,40 +62,122 @@ func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 // handler looks up or creates a new http.Handler for the given group. If
 // there is a reap timer configured, the timer is either started or reset.
-func (h *handler) handler(group string) http.Handler {
+func (h *Handler) handler(group string) http.Handler {
 	h.l.Lock()
 	defer h.l.Unlock()
 
 	hand, ok := h.groups[group]
 	if !ok {
 		// Create a new group and reap timer
-		hand = h.factory(group)
+		hand = h.create(group)
 		h.groups[group] = hand
 		if h.reapDelay != 0 {
-			t := time.AfterFunc(h.reapDelay, func() { h.reap(group) })
-			h.groupReap[group] = t
+			h.startReap(group, h.reapDelay)
 		}
 	} else {
 		// Reset the existing reap timer
 		if t, ok := h.groupReap[group]; ok {
 			t.Reset(h.reapDelay)
+			h.groupExpire[group] = time.Now().Add(h.reapDelay)
 		}
 	}
 
 	return hand
 }
 
-// reap is called after the reap delay to remove a group handler. Helps
-// avoid retaining a large pool of group handlers.
-func (h *handler) reap(group string) {
+// create creates the handler of a new group using the factory, passing it
+// to any OnCreate functions. Must be called with the lock held.
+func (h *Handler) create(group string) http.Handler {
+	hand := h.factory(group)
+	for _, fn := range h.created {
+		fn(group, hand)
+	}
+	return hand
+}
+
+// OnCreate registers fn to be called with the key and handler of each group
+// created from now on, before the group serves its first request. Groups
+// which already exist are not passed to fn; use Keys and Lookup for those.
+// fn is called with the handler locked, and must not call back into it.
+func (h *Handler) OnCreate(fn func(key string, hand http.Handler)) {
 	h.l.Lock()
 	defer h.l.Unlock()
+	h.created = append(h.created, fn)
+}
 
+// reap is called after the reap delay to remove a group handler. Helps
+// avoid retaining a large pool of group handlers.
+func (h *Handler) reap(group string) {
+	h.l.Lock()
+	hand := h.groups[group]
 	if t, ok := h.groupReap[group]; ok {
 		t.Stop()
 		delete(h.groupReap, group)
+		delete(h.groupExpire, group)
 	}
 	delete(h.groups, group)
+	h.l.Unlock()
+
+	// Tear down group handlers holding resources of their own, such as
+	// nested mappers.
+	if c, ok := hand.(io.Closer); ok {
+		c.Close()
+	}
+}
+
+// Close stops all reap timers and removes all groups, closing any group
+// handlers which implement io.Closer. The handler remains usable; later
+// requests create new groups as needed.
+func (h *Handler) Close() error {
+	h.l.Lock()
+	groups := h.groups
+	for _, t := range h.groupReap {
+		t.Stop()
+	}
+	h.groups = make(map[string]http.Handler)
+	h.groupReap = make(map[string]*time.Timer)
+	h.groupExpire = make(map[string]time.Time)
+	h.l.Unlock()
+
+	for _, hand := range groups {
+		if c, ok := hand.(io.Closer); ok {
+			c.Close()
+		}
+	}
+	return nil
+}
+
+// Lookup returns the handler of the group with the given key, if it exists.
+func (h *Handler) Lookup(key string) (http.Handler, bool) {
+	h.l.Lock()
+	defer h.l.Unlock()
+	hand, ok := h.groups[key]
+	return hand, ok
+}
+
+// Keys returns the keys of all current groups.
+func (h *Handler) Keys() []string {
+	h.l.Lock()
+	defer h.l.Unlock()
+	keys := make([]string, 0, len(h.groups))
+	for key := range h.groups {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// Invalidate removes the group with the given key immediately, as if it had
+// been reaped. The next request for the key creates a new group using the
+// factory.
+func (h *Handler) Invalidate(key string) {
+	h.reap(key)
+}
+
+// startReap starts the reap timer for a group, expiring it after d. Must be
+// called with the lock held.
+func (h *Handler) startReap(group string, d time.Duration) {
+	h.groupReap[group] = time.AfterFunc(d, func() { h.reap(group) })
+	h.groupExpire[group] = time.Now().Add(d)
 }
 
 // HandlerFactory is a function used to create a new http.Handler for the
@@ -124,3 +212,45 @@ func GroupByRequestIP(r *http.Request) string {
 	// server may have another format that we can't guess at.
 	return r.RemoteAddr
 }
+
+// GroupByAll returns a grouper combining the keys of all of the given
+// groupers, joined by "|", so that each distinct combination of keys forms
+// its own group.
+func GroupByAll(groupers ...RequestGrouper) RequestGrouper {
+	return func(r *http.Request) string {
+		keys := make([]string, len(groupers))
+		for i, g := range groupers {
+			keys[i] = g(r)
+		}
+		return strings.Join(keys, "|")
+	}
+}
+
+// GroupByPathPrefix returns a grouper classifying requests by the prefix of
+// their URL path. The prefixes map holds the class of each prefix, of which
+// the longest one matching the path applies. Requests matching no prefix
+// are put in the def class.
+func GroupByPathPrefix(prefixes map[string]string, def string) RequestGrouper {
+	return func(r *http.Request) string {
+		class, match := def, -1
+		for prefix, c := range prefixes {
+			if len(prefix) > match && strings.HasPrefix(r.URL.Path, prefix) {
+				class, match = c, len(prefix)
+			}
+		}
+		return class
+	}
+}
+
+// GroupByContextValue returns a grouper keying requests by the string value
+// stored under key in their context, such as a user ID set by authentication
+// middleware. Requests without a non-empty string value are grouped by
+// fallback instead.
+func GroupByContextValue(key interface{}, fallback RequestGrouper) RequestGrouper {
+	return func(r *http.Request) string {
+		if v, ok := r.Context().Value(key).(string); ok && v != "" {
+			return v
+		}
+		return fallback(r)
+	}
+}
@@ -1,6 +1,7 @@
 package mapper
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -73,6 +74,67 @@ func TestGroupByRequestIP(t *testing.T) {
 	}
 }
 
+func TestGroupByAll(t *testing.T) {
+	req, err := http.NewRequest("GET", "/api/users", nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	req.RemoteAddr = "1.2.3.4:1234"
+
+	byPath := func(r *http.Request) string {
+		return r.URL.Path
+	}
+	g := GroupByAll(GroupByRequestIP, byPath)
+	if v := g(req); v != "1.2.3.4|/api/users" {
+		t.Fatalf("expect %q, actual %q", "1.2.3.4|/api/users", v)
+	}
+}
+
+func TestGroupByPathPrefix(t *testing.T) {
+	g := GroupByPathPrefix(map[string]string{
+		"/api/":           "api",
+		"/api/downloads/": "bulk",
+		"/files/":         "bulk",
+	}, "other")
+
+	tcases := map[string]string{
+		"/api/users":         "api",
+		"/api/downloads/big": "bulk",
+		"/files/a.iso":       "bulk",
+		"/index.html":        "other",
+	}
+	for path, expect := range tcases {
+		req, err := http.NewRequest("GET", path, nil)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if v := g(req); v != expect {
+			t.Fatalf("%s: expect %q, actual %q", path, expect, v)
+		}
+	}
+}
+
+func TestGroupByContextValue(t *testing.T) {
+	type ctxKey struct{}
+
+	req, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	req.RemoteAddr = "1.2.3.4:1234"
+	g := GroupByContextValue(ctxKey{}, GroupByRequestIP)
+
+	// Requests without the value fall back.
+	if v := g(req); v != "1.2.3.4" {
+		t.Fatalf("expect %q, actual %q", "1.2.3.4", v)
+	}
+
+	req = req.WithContext(context.WithValue(req.Context(), ctxKey{}, "alice"))
+	if v := g(req); v != "alice" {
+		t.Fatalf("expect %q, actual %q", "alice", v)
+	}
+}
+
 func TestReap(t *testing.T) {
 	// Group requests by path
 	g := func(r *http.Request) string {
@@ -155,8 +217,92 @@ func TestReap(t *testing.T) {
 	}
 }
 
+func TestInvalidate(t *testing.T) {
+	g := func(r *http.Request) string {
+		return r.URL.Path
+	}
+
+	// Count the handlers created for each group.
+	created := make(map[string]int)
+	f := func(grp string) http.Handler {
+		created[grp]++
+		return stringHandler(grp)
+	}
+	h := New(g, f, time.Hour)
+
+	for _, path := range []string{"/foo", "/bar"} {
+		req, err := http.NewRequest("GET", path, nil)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	if keys := h.Keys(); len(keys) != 2 {
+		t.Fatalf("expect 2 keys, got: %v", keys)
+	}
+	if _, ok := h.Lookup("/foo"); !ok {
+		t.Fatal("expect /foo to exist")
+	}
+
+	// Invalidating removes only the given group.
+	h.Invalidate("/foo")
+	if _, ok := h.Lookup("/foo"); ok {
+		t.Fatal("expect /foo to be removed")
+	}
+	if _, ok := h.Lookup("/bar"); !ok {
+		t.Fatal("expect /bar to exist")
+	}
+
+	// The next request creates a new handler.
+	req, err := http.NewRequest("GET", "/foo", nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	if n := created["/foo"]; n != 2 {
+		t.Fatalf("expect 2 handlers created, got: %d", n)
+	}
+	if n := created["/bar"]; n != 1 {
+		t.Fatalf("expect 1 handler created, got: %d", n)
+	}
+}
+
 type stringHandler string
 
 func (h stringHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintln(w, string(h))
 }
+
+func TestOnCreate(t *testing.T) {
+	g := func(r *http.Request) string {
+		return r.URL.Path
+	}
+	h := New(g, func(grp string) http.Handler {
+		return stringHandler(grp)
+	}, time.Hour)
+
+	serve := func(path string) {
+		req, err := http.NewRequest("GET", path, nil)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	serve("/foo")
+
+	// Only groups created after registering are passed along, once each.
+	var created []string
+	h.OnCreate(func(key string, hand http.Handler) {
+		if hand != stringHandler(key) {
+			t.Errorf("unexpected handler for %q", key)
+		}
+		created = append(created, key)
+	})
+	serve("/foo")
+	serve("/bar")
+	serve("/bar")
+	h.Import(Snapshot{Groups: []GroupSnapshot{{Key: "/baz"}}})
+	if len(created) != 2 || created[0] != "/bar" || created[1] != "/baz" {
+		t.Fatalf("bad: %v", created)
+	}
+}
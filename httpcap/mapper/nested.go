@@ -0,0 +1,37 @@
+package mapper
+
+import (
+	"net/http"
+	"time"
+)
+
+// NestedFactory is a function used to set up a new outer group of a nested
+// mapper. It returns the HandlerFactory used to create the handlers of the
+// inner groups within it. State shared by all inner groups of the outer
+// group, such as an iocap.Group, is typically created here and captured by
+// the returned factory.
+type NestedFactory func(key string) HandlerFactory
+
+// Nested creates a two-level grouping HTTP handler. Requests are first
+// grouped by og, and each outer group is set up using of. Within an outer
+// group, requests are grouped again by ig, and each inner group's handler
+// is created by the factory returned for its outer group.
+//
+// Both levels expire after the reap duration r, as described in New. Inner
+// groups are kept as long as their outer group is, and reaping an outer
+// group tears down all of its inner groups along with it.
+//
+// A typical use is a tenant-wide rate limit with per-user limits inside of
+// it, using iocap sub-groups:
+//
+//	h = mapper.Nested(byTenant, func(string) mapper.HandlerFactory {
+//		tenant := iocap.NewGroup(tenantRate)
+//		return func(string) http.Handler {
+//			return httpcap.GroupHandler(h, tenant.NewSubGroup(userRate))
+//		}
+//	}, byUser, time.Hour)
+func Nested(og RequestGrouper, of NestedFactory, ig RequestGrouper, r time.Duration) *Handler {
+	return New(og, func(key string) http.Handler {
+		return New(ig, of(key), r)
+	}, r)
+}
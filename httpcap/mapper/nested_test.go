@@ -0,0 +1,135 @@
+package mapper
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// closeHandler is a handler recording whether it was closed.
+type closeHandler struct {
+	closed bool
+	l      sync.Mutex
+}
+
+func (h *closeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {}
+
+func (h *closeHandler) Close() error {
+	h.l.Lock()
+	defer h.l.Unlock()
+	h.closed = true
+	return nil
+}
+
+func TestNested(t *testing.T) {
+	byTenant := func(r *http.Request) string {
+		return r.Header.Get("X-Tenant")
+	}
+	byUser := func(r *http.Request) string {
+		return r.Header.Get("X-User")
+	}
+
+	// Count the outer groups set up, and track inner handlers.
+	var l sync.Mutex
+	tenants := make(map[string]int)
+	users := make(map[string]*closeHandler)
+	of := func(tenant string) HandlerFactory {
+		l.Lock()
+		tenants[tenant]++
+		l.Unlock()
+		return func(user string) http.Handler {
+			h := new(closeHandler)
+			l.Lock()
+			users[tenant+"/"+user] = h
+			l.Unlock()
+			return h
+		}
+	}
+
+	h := Nested(byTenant, of, byUser, 100*time.Millisecond)
+
+	serve := func(tenant, user string) {
+		req, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		req.Header.Set("X-Tenant", tenant)
+		req.Header.Set("X-User", user)
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	serve("a", "1")
+	serve("a", "2")
+	serve("b", "1")
+
+	// Users of a tenant share its outer group.
+	l.Lock()
+	if tenants["a"] != 1 || tenants["b"] != 1 {
+		t.Fatalf("bad: %v", tenants)
+	}
+	if len(users) != 3 {
+		t.Fatalf("bad: %v", users)
+	}
+	l.Unlock()
+
+	// Keep tenant b alive while tenant a expires.
+	time.Sleep(60 * time.Millisecond)
+	serve("b", "1")
+	time.Sleep(60 * time.Millisecond)
+
+	// Reaping tenant a tore down its users.
+	l.Lock()
+	for key, u := range users {
+		u.l.Lock()
+		closed := u.closed
+		u.l.Unlock()
+		if expect := key[0] == 'a'; closed != expect {
+			t.Fatalf("expect closed=%v for %s", expect, key)
+		}
+	}
+	l.Unlock()
+
+	// A new request for tenant a sets it up from scratch.
+	serve("a", "1")
+	l.Lock()
+	defer l.Unlock()
+	if tenants["a"] != 2 {
+		t.Fatalf("bad: %v", tenants)
+	}
+}
+
+func TestHandlerClose(t *testing.T) {
+	var handlers []*closeHandler
+	h := New(func(r *http.Request) string {
+		return r.URL.Path
+	}, func(_ string) http.Handler {
+		c := new(closeHandler)
+		handlers = append(handlers, c)
+		return c
+	}, time.Hour)
+
+	for i := 0; i < 3; i++ {
+		req, err := http.NewRequest("GET", fmt.Sprintf("/%d", i), nil)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	if err := h.Close(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// All groups are gone, and their handlers closed.
+	if len(h.groups) != 0 || len(h.groupReap) != 0 {
+		t.Fatalf("expect no groups, got: %d", len(h.groups))
+	}
+	for i, c := range handlers {
+		if !c.closed {
+			t.Fatalf("expect handler %d closed", i)
+		}
+	}
+}
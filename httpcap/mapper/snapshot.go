@@ -0,0 +1,92 @@
+package mapper
+
+import (
+	"time"
+
+	"github.com/ryanuber/iocap"
+)
+
+// Snapshotter is implemented by group handlers which are able to save and
+// restore the state of their rate limiter. The boolean return value of
+// Snapshot reports whether the handler has any state to save.
+type Snapshotter interface {
+	Snapshot() (iocap.Snapshot, bool)
+	Restore(iocap.Snapshot)
+}
+
+// Snapshot is a serializable copy of the set of active groups of a Handler.
+type Snapshot struct {
+	Groups []GroupSnapshot
+}
+
+// GroupSnapshot describes a single active group.
+type GroupSnapshot struct {
+	// Key is the group key returned by the RequestGrouper.
+	Key string
+
+	// TTL is the time remaining before the group is reaped. Zero means the
+	// group does not expire.
+	TTL time.Duration
+
+	// State is the limiter state of the group's handler, if the handler
+	// implements Snapshotter.
+	State *iocap.Snapshot `json:",omitempty"`
+}
+
+// Export returns a snapshot of the active groups, including their remaining
+// time-to-live and the limiter state of handlers implementing Snapshotter.
+func (h *Handler) Export() Snapshot {
+	h.l.Lock()
+	defer h.l.Unlock()
+
+	var snap Snapshot
+	for key, hand := range h.groups {
+		g := GroupSnapshot{Key: key}
+		if exp, ok := h.groupExpire[key]; ok {
+			g.TTL = exp.Sub(time.Now())
+			if g.TTL <= 0 {
+				// About to be reaped; don't carry it over.
+				continue
+			}
+		}
+		if s, ok := hand.(Snapshotter); ok {
+			if state, ok := s.Snapshot(); ok {
+				g.State = &state
+			}
+		}
+		snap.Groups = append(snap.Groups, g)
+	}
+	return snap
+}
+
+// Import pre-creates the groups in snap using the handler factory, restoring
+// their remaining time-to-live and, for handlers implementing Snapshotter,
+// their limiter state. It is intended to be called right after New, before
+// the handler starts serving requests. Groups which already exist are left
+// untouched.
+func (h *Handler) Import(snap Snapshot) {
+	h.l.Lock()
+	defer h.l.Unlock()
+
+	for _, g := range snap.Groups {
+		if _, ok := h.groups[g.Key]; ok {
+			continue
+		}
+
+		hand := h.create(g.Key)
+		if s, ok := hand.(Snapshotter); ok && g.State != nil {
+			s.Restore(*g.State)
+		}
+		h.groups[g.Key] = hand
+
+		// Restore the remaining time-to-live. Groups which did not expire
+		// before get the configured reap delay.
+		ttl := g.TTL
+		if ttl <= 0 || ttl > h.reapDelay {
+			ttl = h.reapDelay
+		}
+		if ttl != 0 {
+			h.startReap(g.Key, ttl)
+		}
+	}
+}
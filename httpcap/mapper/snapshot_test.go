@@ -0,0 +1,115 @@
+package mapper
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ryanuber/iocap"
+)
+
+// stateHandler is a handler implementing Snapshotter.
+type stateHandler struct {
+	state iocap.Snapshot
+}
+
+func (h *stateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.state.Tokens++
+}
+
+func (h *stateHandler) Snapshot() (iocap.Snapshot, bool) {
+	return h.state, true
+}
+
+func (h *stateHandler) Restore(s iocap.Snapshot) {
+	h.state = s
+}
+
+func TestExportImport(t *testing.T) {
+	g := func(r *http.Request) string {
+		return r.URL.Path
+	}
+
+	// Track the handlers created by the factory.
+	handlers := make(map[string]*stateHandler)
+	f := func(key string) http.Handler {
+		h := new(stateHandler)
+		handlers[key] = h
+		return h
+	}
+
+	h := New(g, f, time.Minute)
+
+	// Serve a few requests so the groups accumulate state.
+	for _, path := range []string{"/foo", "/foo", "/bar"} {
+		req, err := http.NewRequest("GET", path, nil)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	// Round-trip the snapshot through JSON to simulate a restart.
+	raw, err := json.Marshal(h.Export())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var snap Snapshot
+	if err := json.Unmarshal(raw, &snap); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if n := len(snap.Groups); n != 2 {
+		t.Fatalf("expect 2 groups, got: %d", n)
+	}
+	for _, g := range snap.Groups {
+		if g.TTL <= 0 || g.TTL > time.Minute {
+			t.Fatalf("bad TTL for %q: %s", g.Key, g.TTL)
+		}
+	}
+
+	// Import into a fresh handler. Groups are re-created by the factory
+	// with their state restored.
+	handlers = make(map[string]*stateHandler)
+	h2 := New(g, f, time.Minute)
+	h2.Import(snap)
+
+	if v := handlers["/foo"].state.Tokens; v != 2 {
+		t.Fatalf("expect 2, got: %d", v)
+	}
+	if v := handlers["/bar"].state.Tokens; v != 1 {
+		t.Fatalf("expect 1, got: %d", v)
+	}
+	if _, ok := h2.groupReap["/foo"]; !ok {
+		t.Fatal("expect reap timer to be restored")
+	}
+}
+
+func TestImport_TTL(t *testing.T) {
+	g := func(r *http.Request) string {
+		return r.URL.Path
+	}
+	f := func(_ string) http.Handler {
+		return stringHandler(time.Now().String())
+	}
+
+	h := New(g, f, time.Minute)
+	h.Import(Snapshot{Groups: []GroupSnapshot{{Key: "/foo", TTL: 50 * time.Millisecond}}})
+
+	h.l.Lock()
+	_, ok := h.groups["/foo"]
+	h.l.Unlock()
+	if !ok {
+		t.Fatal("expect group to be created")
+	}
+
+	// The group is reaped after its remaining TTL rather than the full
+	// reap delay.
+	time.Sleep(100 * time.Millisecond)
+	h.l.Lock()
+	defer h.l.Unlock()
+	if _, ok := h.groups["/foo"]; ok {
+		t.Fatal("expect group to be reaped")
+	}
+}
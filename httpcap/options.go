@@ -0,0 +1,178 @@
+package httpcap
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/ryanuber/iocap"
+)
+
+// Option configures optional behavior of the rate limited handlers created
+// by Handler, GroupHandler and the convenience wrappers built on them.
+type Option func(*handler)
+
+// LimitStatusClasses restricts rate limiting to responses whose status code
+// falls into one of the given classes, expressed as the leading digit (2 for
+// 2xx, 3 for 3xx, and so on). Other responses, such as error pages, are
+// written straight through without consuming any quota. With no classes
+// given, only 2xx and 3xx responses are limited.
+func LimitStatusClasses(classes ...int) Option {
+	if len(classes) == 0 {
+		classes = []int{2, 3}
+	}
+	return func(h *handler) {
+		h.limitStatus = func(code int) bool {
+			for _, class := range classes {
+				if code/100 == class {
+					return true
+				}
+			}
+			return false
+		}
+	}
+}
+
+// LimitUploads enables rate limiting of request bodies. Uploads share the
+// quota of the handler with the response, so the combined traffic of a
+// request in both directions is limited to a single rate.
+func LimitUploads() Option {
+	return func(h *handler) {
+		h.limitUploads = true
+	}
+}
+
+// UploadRate caps request bodies at ro, in addition to the shared quota of
+// the handler. Group handlers share the cap across all of their requests.
+// Implies LimitUploads.
+func UploadRate(ro iocap.RateOpts) Option {
+	return func(h *handler) {
+		h.limitUploads = true
+		h.uploadRate = ro
+	}
+}
+
+// DownloadRate caps responses at ro, in addition to the shared quota of the
+// handler. Group handlers share the cap across all of their requests.
+func DownloadRate(ro iocap.RateOpts) Option {
+	return func(h *handler) {
+		h.downloadRate = ro
+	}
+}
+
+// DeferContinue holds off the 100 Continue response to requests sent with
+// "Expect: 100-continue" until the group has quota available for the
+// upload, so that clients don't start sending a body which would only be
+// throttled. Without it, the response is sent as soon as the handler starts
+// reading the body, as usual. Implies LimitUploads.
+func DeferContinue() Option {
+	return func(h *handler) {
+		h.limitUploads = true
+		h.deferContinue = true
+	}
+}
+
+// MaxUploadSize limits request bodies to n bytes, in addition to limiting
+// their rate. Implies LimitUploads. Requests declaring a larger
+// Content-Length are rejected with 413 Request Entity Too Large and msg as
+// the response body, without calling the handler. Otherwise, reads going
+// beyond the limit return ErrBodyTooLarge; if the handler has not started
+// its response at that point, the 413 response is sent on its behalf and
+// anything the handler writes afterward is discarded. If the response had
+// already started, the connection is dropped once the handler returns.
+func MaxUploadSize(n int64, msg string) Option {
+	return func(h *handler) {
+		h.limitUploads = true
+		h.maxUpload = n
+		h.tooLarge = msg
+	}
+}
+
+// PaceOver spreads each response evenly over roughly the duration d,
+// whatever its size, based on its Content-Length header. Responses of
+// unknown size are sent at the configured rate of the handler, unless
+// PaceBuffer allows them to be buffered to learn their size. The pace of
+// small responses is kept from dropping below floor; Unlimited means no
+// floor. With a group handler, the pace applies within the group's quota.
+func PaceOver(d time.Duration, floor iocap.RateOpts) Option {
+	return func(h *handler) {
+		h.paceOver = d
+		h.paceFloor = floor
+	}
+}
+
+// PaceBuffer buffers up to n bytes of each response of unknown size for
+// PaceOver. Responses which fit within the buffer are paced by their size,
+// while larger ones are sent at the configured rate of the handler.
+func PaceBuffer(n int) Option {
+	return func(h *handler) {
+		h.paceBuffer = n
+	}
+}
+
+// HeadStart sends the first n bytes of each response without rate limiting,
+// so that clients can start rendering a page promptly even under aggressive
+// limits. The rest of the response is limited as usual. The allowance
+// applies to each response separately and is not charged to the quota.
+func HeadStart(n int) Option {
+	return func(h *handler) {
+		h.headStart = n
+	}
+}
+
+// ChunkSize caps each write of a limited response to the client at n bytes,
+// without changing the rate. Large buckets then go out as a steady series of
+// smaller writes, rather than one large burst per interval, which plays
+// better with HTTP/2 flow control and progress reporting in browsers.
+func ChunkSize(n int) Option {
+	return func(h *handler) {
+		h.chunkSize = n
+	}
+}
+
+// AdvertiseETA sets the given response header, X-Throttle-ETA-Seconds if
+// empty, to an estimate of the number of seconds a limited response will take
+// to send. The estimate is based on the Content-Length of the response when
+// its header is written, the rates in effect and the quota already used, so
+// it is only given for responses of known size. Computing it does not hold
+// up the response.
+func AdvertiseETA(header string) Option {
+	if header == "" {
+		header = defaultETAHeader
+	}
+	return func(h *handler) {
+		h.etaHeader = header
+	}
+}
+
+// StatsSink passes the traffic of the handler, as returned by StatsOf, to
+// fn as each request begins and ends, such as to export it as metrics. For
+// handlers created by LimitByRequestIP or its variants, fn is given the
+// traffic of the group of the request. It is called synchronously on the
+// request, so it should return quickly.
+func StatsSink(fn func(HandlerStats)) Option {
+	return func(h *handler) {
+		h.meter.sink = fn
+	}
+}
+
+// overrideWarningHeader reports invalid rates given to RateOverride.
+const overrideWarningHeader = "X-Throttle-Warning"
+
+// RateOverride lets requests pick their own rate with the query parameter
+// param, in the format understood by iocap.ParseRate. For example, with a
+// param of "x-throttle", GET /video.mp4?x-throttle=256KB/s is served at
+// 256KB/s. This is meant for simulating slow clients in test environments.
+// The override replaces the configured rate for that request only; a group
+// handler serves it outside the group's quota.
+//
+// The parameter is controlled by the client, so any request allowed to use
+// it can lift its own limit. Only requests for which allow returns true may
+// override their rate, such as those from internal addresses or with signed
+// URLs; a nil allow denies all requests. Invalid values are ignored, and
+// reported in the X-Throttle-Warning response header.
+func RateOverride(param string, allow func(r *http.Request) bool) Option {
+	return func(h *handler) {
+		h.overrideParam = param
+		h.overrideAllow = allow
+	}
+}
@@ -0,0 +1,544 @@
+package httpcap
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ryanuber/iocap"
+)
+
+// timedGet performs a GET request against url, reading the full body, and
+// returns the response along with the elapsed time.
+func timedGet(t *testing.T, url string) (*http.Response, []byte, time.Duration) {
+	start := time.Now()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return resp, body, time.Since(start)
+}
+
+func TestLimitStatusClasses(t *testing.T) {
+	// Respond with 512 bytes and the status given in the query, if any.
+	h := http.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if v := r.URL.Query().Get("status"); v != "" {
+			code, _ := strconv.Atoi(v)
+			w.WriteHeader(code)
+		}
+		w.Write(make([]byte, 512))
+	}))
+
+	rate := iocap.RateOpts{Interval: 100 * time.Millisecond, Size: 128}
+	ts := httptest.NewServer(Handler(h, rate, LimitStatusClasses()))
+	defer ts.Close()
+
+	// Successful responses are limited, whether the status is explicit
+	// or implied by the first write.
+	for _, path := range []string{"/?status=200", "/"} {
+		resp, body, d := timedGet(t, ts.URL+path)
+		if resp.StatusCode != 200 || len(body) != 512 {
+			t.Fatalf("bad: %d %d", resp.StatusCode, len(body))
+		}
+		if d < 300*time.Millisecond {
+			t.Fatalf("response to %s returned too quickly in %s", path, d)
+		}
+	}
+
+	// Error responses of the same size are not.
+	resp, body, d := timedGet(t, ts.URL+"/?status=500")
+	if resp.StatusCode != 500 || len(body) != 512 {
+		t.Fatalf("bad: %d %d", resp.StatusCode, len(body))
+	}
+	if d > 100*time.Millisecond {
+		t.Fatalf("error response should not be limited, took %s", d)
+	}
+}
+
+func TestLimitStatusClasses_Custom(t *testing.T) {
+	h := http.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write(make([]byte, 512))
+	}))
+
+	// Explicitly limiting 4xx responses applies the rate to them.
+	rate := iocap.RateOpts{Interval: 100 * time.Millisecond, Size: 128}
+	ts := httptest.NewServer(Handler(h, rate, LimitStatusClasses(4)))
+	defer ts.Close()
+
+	if _, _, d := timedGet(t, ts.URL); d < 300*time.Millisecond {
+		t.Fatalf("response returned too quickly in %s", d)
+	}
+}
+
+func TestUploadRate(t *testing.T) {
+	// Read the full request body, then respond with 256 bytes.
+	var l sync.Mutex
+	var uploaded time.Duration
+	h := http.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ioutil.ReadAll(r.Body)
+		l.Lock()
+		uploaded = time.Since(start)
+		l.Unlock()
+		w.Write(make([]byte, 256))
+	}))
+
+	// A generous shared quota, with uploads capped much lower.
+	rate := iocap.RateOpts{Interval: 100 * time.Millisecond, Size: 4096}
+	upload := iocap.RateOpts{Interval: 100 * time.Millisecond, Size: 64}
+	ts := httptest.NewServer(GroupHandler(h, iocap.NewGroup(rate), UploadRate(upload)))
+	defer ts.Close()
+
+	start := time.Now()
+	resp, err := http.Post(ts.URL, "text/plain", bytes.NewReader(make([]byte, 256)))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	out, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	total := time.Since(start)
+
+	// The upload is paced by its cap, while the download is not.
+	l.Lock()
+	defer l.Unlock()
+	if uploaded < 300*time.Millisecond {
+		t.Fatalf("upload returned too quickly in %s", uploaded)
+	}
+	if len(out) != 256 {
+		t.Fatalf("expect 256, got: %d", len(out))
+	}
+	if d := total - uploaded; d > 100*time.Millisecond {
+		t.Fatalf("download should not be capped, took %s", d)
+	}
+}
+
+func TestMaxUploadSize(t *testing.T) {
+	var l sync.Mutex
+	var called bool
+	var readErr error
+	h := http.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l.Lock()
+		called = true
+		_, readErr = ioutil.ReadAll(r.Body)
+		l.Unlock()
+
+		// Anything the handler responds with after the limit is discarded.
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok"))
+	}))
+
+	rate := iocap.RateOpts{Interval: 100 * time.Millisecond, Size: 4096}
+	ts := httptest.NewServer(Handler(h, rate, MaxUploadSize(128, "too big")))
+	defer ts.Close()
+
+	post := func(body io.Reader) (*http.Response, string) {
+		resp, err := http.Post(ts.URL, "text/plain", body)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer resp.Body.Close()
+		out, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		return resp, string(out)
+	}
+
+	// Within the limit passes through.
+	resp, out := post(bytes.NewReader(make([]byte, 128)))
+	if resp.StatusCode != http.StatusOK || out != "ok" {
+		t.Fatalf("bad response: %d %q", resp.StatusCode, out)
+	}
+
+	// A declared Content-Length over the limit is rejected without calling
+	// the handler.
+	l.Lock()
+	called = false
+	l.Unlock()
+	resp, out = post(bytes.NewReader(make([]byte, 256)))
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expect 413, got: %d", resp.StatusCode)
+	}
+	if out != "too big" {
+		t.Fatalf("bad body: %q", out)
+	}
+	l.Lock()
+	if called {
+		t.Fatal("handler should not be called")
+	}
+	l.Unlock()
+
+	// A chunked body of unknown length is cut off once it goes over.
+	resp, out = post(io.MultiReader(bytes.NewReader(make([]byte, 256))))
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expect 413, got: %d", resp.StatusCode)
+	}
+	if out != "too big" {
+		t.Fatalf("bad body: %q", out)
+	}
+	l.Lock()
+	defer l.Unlock()
+	if readErr != ErrBodyTooLarge {
+		t.Fatalf("expect ErrBodyTooLarge, got: %v", readErr)
+	}
+}
+
+func TestMaxUploadSize_Started(t *testing.T) {
+	// Start the response before reading the body.
+	h := http.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("started"))
+		ioutil.ReadAll(r.Body)
+	}))
+
+	rate := iocap.RateOpts{Interval: 100 * time.Millisecond, Size: 4096}
+	ts := httptest.NewServer(Handler(h, rate, MaxUploadSize(128, "too big")))
+	defer ts.Close()
+
+	// The connection is dropped rather than finishing the response, which
+	// may or may not have made it to the client in part.
+	resp, err := http.Post(ts.URL, "text/plain", io.MultiReader(bytes.NewReader(make([]byte, 256))))
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if _, err := ioutil.ReadAll(resp.Body); err == nil {
+		t.Fatal("expect error reading truncated response")
+	}
+}
+
+// timeContinue sends a request expecting 100 Continue to addr, returning
+// the time taken for the interim response to arrive. The body is only sent
+// after that, as a real client would.
+func timeContinue(t *testing.T, addr string) time.Duration {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+
+	start := time.Now()
+	fmt.Fprintf(conn, "POST / HTTP/1.1\r\nHost: %s\r\nContent-Length: 5\r\nExpect: 100-continue\r\n\r\n", addr)
+
+	br := bufio.NewReader(conn)
+	line, err := br.ReadString('\n')
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !strings.HasPrefix(line, "HTTP/1.1 100") {
+		t.Fatalf("expect 100 Continue, got: %q", line)
+	}
+	d := time.Since(start)
+
+	// Skip the rest of the interim response, then send the body.
+	if _, err := br.ReadString('\n'); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	conn.Write([]byte("hello"))
+
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if string(body) != "hello" {
+		t.Fatalf("bad body: %q", body)
+	}
+	return d
+}
+
+func TestDeferContinue(t *testing.T) {
+	// Echo the request body.
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(body)
+	})
+
+	rate := iocap.RateOpts{Interval: 200 * time.Millisecond, Size: 64, Coarse: true}
+	for _, deferred := range []bool{false, true} {
+		g := iocap.NewGroup(rate)
+		var opts []Option
+		if deferred {
+			opts = append(opts, DeferContinue())
+		} else {
+			opts = append(opts, LimitUploads())
+		}
+		ts := httptest.NewServer(GroupHandler(h, g, opts...))
+
+		// With an idle group, the handshake goes through right away.
+		if d := timeContinue(t, ts.Listener.Addr().String()); d > 50*time.Millisecond {
+			t.Fatalf("deferred=%v: idle group took %s", deferred, d)
+		}
+
+		// Saturate the group. The interim response is only held off when
+		// deferring is enabled.
+		time.Sleep(200 * time.Millisecond)
+		g.NewWriter(ioutil.Discard).Write(make([]byte, 64))
+		d := timeContinue(t, ts.Listener.Addr().String())
+		if deferred && d < 150*time.Millisecond {
+			t.Fatalf("saturated group should defer, took %s", d)
+		}
+		if !deferred && d > 50*time.Millisecond {
+			t.Fatalf("should not defer when disabled, took %s", d)
+		}
+		ts.Close()
+	}
+}
+
+func TestHeadStart(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 2048))
+	})
+	g := iocap.NewGroup(iocap.RateOpts{Interval: 100 * time.Millisecond, Size: 256})
+	ts := httptest.NewServer(GroupHandler(h, g, HeadStart(1024)))
+	defer ts.Close()
+
+	// Each response gets its own head start, even on a reused connection.
+	for i := 0; i < 2; i++ {
+		start := time.Now()
+		resp, err := http.Get(ts.URL)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+
+		// The head arrives without waiting on the limiter.
+		if _, err := io.ReadFull(resp.Body, make([]byte, 1024)); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if d := time.Since(start); d > 80*time.Millisecond {
+			t.Fatalf("head took too long: %s", d)
+		}
+
+		// The remaining 1024 bytes need at least 3 drains.
+		rest, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if len(rest) != 1024 {
+			t.Fatalf("expect 1024, got: %d", len(rest))
+		}
+		if d := time.Since(start); d < 300*time.Millisecond {
+			t.Fatalf("tail returned too quickly in %s", d)
+		}
+	}
+}
+
+// writeRecorder is a handler wrapper recording the size of each write made
+// to the response by the wrapped handler.
+type writeRecorder struct {
+	h     http.Handler
+	l     sync.Mutex
+	sizes []int
+}
+
+func (rec *writeRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rec.h.ServeHTTP(&recordingWriter{w, rec}, r)
+}
+
+type recordingWriter struct {
+	http.ResponseWriter
+	rec *writeRecorder
+}
+
+func (w *recordingWriter) Write(p []byte) (int, error) {
+	w.rec.l.Lock()
+	w.rec.sizes = append(w.rec.sizes, len(p))
+	w.rec.l.Unlock()
+	return w.ResponseWriter.Write(p)
+}
+
+func TestChunkSize(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 64*1024))
+	})
+	rate := iocap.RateOpts{Interval: 100 * time.Millisecond, Size: 32 * 1024, Coarse: true}
+	rec := &writeRecorder{h: Handler(h, rate, ChunkSize(4096))}
+
+	ts := httptest.NewUnstartedServer(rec)
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
+
+	start := time.Now()
+	resp, err := ts.Client().Get(ts.URL)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Fatalf("expect HTTP/2, got: %s", resp.Proto)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(body) != 64*1024 {
+		t.Fatalf("expect %d, got: %d", 64*1024, len(body))
+	}
+
+	// The rate is unchanged, so the second half waits for a drain.
+	if d := time.Since(start); d < 100*time.Millisecond {
+		t.Fatalf("response returned too quickly in %s", d)
+	}
+
+	rec.l.Lock()
+	defer rec.l.Unlock()
+	if len(rec.sizes) != 16 {
+		t.Fatalf("expect 16 writes, got: %v", rec.sizes)
+	}
+	for _, size := range rec.sizes {
+		if size != 4096 {
+			t.Fatalf("expect 4096, got: %v", rec.sizes)
+		}
+	}
+}
+
+func TestAdvertiseETA(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "4096")
+		w.Write(make([]byte, 4096))
+	})
+	rate := iocap.RateOpts{Interval: 100 * time.Millisecond, Size: 1024}
+	ts := httptest.NewServer(Handler(h, rate, AdvertiseETA("")))
+	defer ts.Close()
+
+	resp, body, d := timedGet(t, ts.URL)
+	if len(body) != 4096 {
+		t.Fatalf("expect 4096, got: %d", len(body))
+	}
+
+	// The estimate is within tolerance of the measured transfer time.
+	secs, err := strconv.ParseFloat(resp.Header.Get("X-Throttle-ETA-Seconds"), 64)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	eta := time.Duration(secs * float64(time.Second))
+	if eta < 250*time.Millisecond || eta > 300*time.Millisecond {
+		t.Fatalf("expect eta of about 300ms, got: %s", eta)
+	}
+	if diff := d - eta; diff < -50*time.Millisecond || diff > 100*time.Millisecond {
+		t.Fatalf("expect eta %s to match transfer time %s", eta, d)
+	}
+}
+
+func TestAdvertiseETA_Unknown(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 128))
+	})
+	ts := httptest.NewServer(Handler(h, iocap.Unlimited, AdvertiseETA("X-ETA")))
+	defer ts.Close()
+
+	// Responses of unknown size get no estimate.
+	resp, _, _ := timedGet(t, ts.URL)
+	if v := resp.Header.Get("X-ETA"); v != "" {
+		t.Fatalf("expect no eta, got: %q", v)
+	}
+}
+
+func TestRateOverride(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 4096))
+	})
+
+	// Overrides are only allowed with the secret token.
+	allow := func(r *http.Request) bool {
+		return r.Header.Get("X-Token") == "secret"
+	}
+	rate := iocap.RateOpts{Interval: 100 * time.Millisecond, Size: 1024}
+	ts := httptest.NewServer(Handler(h, rate, RateOverride("x-throttle", allow)))
+	defer ts.Close()
+
+	get := func(query, token string) (*http.Response, time.Duration) {
+		req, err := http.NewRequest("GET", ts.URL+"/?"+query, nil)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		req.Header.Set("X-Token", token)
+
+		start := time.Now()
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer resp.Body.Close()
+		if out, _ := ioutil.ReadAll(resp.Body); len(out) != 4096 {
+			t.Fatalf("expect 4096, got: %d", len(out))
+		}
+		return resp, time.Since(start)
+	}
+
+	// The configured rate needs at least 3 drains.
+	if _, d := get("", "secret"); d < 300*time.Millisecond {
+		t.Fatalf("request returned too quickly in %s", d)
+	}
+
+	// An allowed override takes effect.
+	if _, d := get("x-throttle=1MB/s", "secret"); d > 80*time.Millisecond {
+		t.Fatalf("override took too long: %s", d)
+	}
+
+	// Disallowed requests keep the configured rate.
+	if _, d := get("x-throttle=1MB/s", "wrong"); d < 300*time.Millisecond {
+		t.Fatalf("request returned too quickly in %s", d)
+	}
+
+	// Invalid values fall back to the configured rate, with a warning.
+	resp, d := get("x-throttle=fast", "secret")
+	if d < 300*time.Millisecond {
+		t.Fatalf("request returned too quickly in %s", d)
+	}
+	if v := resp.Header.Get("X-Throttle-Warning"); v == "" {
+		t.Fatal("expect warning header")
+	}
+}
+
+func TestRateOverride_Disabled(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 4096))
+	})
+	rate := iocap.RateOpts{Interval: 100 * time.Millisecond, Size: 1024}
+	ts := httptest.NewServer(Handler(h, rate))
+	defer ts.Close()
+
+	// Without the option, the query parameter means nothing.
+	resp, _, d := timedGet(t, ts.URL+"/?x-throttle=1MB/s")
+	if d < 300*time.Millisecond {
+		t.Fatalf("request returned too quickly in %s", d)
+	}
+	if v := resp.Header.Get("X-Throttle-Warning"); v != "" {
+		t.Fatalf("expect no warning, got: %q", v)
+	}
+}
+
+func TestRateOverride_NilAllow(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 4096))
+	})
+	rate := iocap.RateOpts{Interval: 100 * time.Millisecond, Size: 1024}
+	ts := httptest.NewServer(Handler(h, rate, RateOverride("x-throttle", nil)))
+	defer ts.Close()
+
+	// Without an allow function, no request may lift its limit.
+	_, _, d := timedGet(t, ts.URL+"/?x-throttle=unlimited")
+	if d < 300*time.Millisecond {
+		t.Fatalf("request returned too quickly in %s", d)
+	}
+}
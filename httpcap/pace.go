@@ -0,0 +1,90 @@
+package httpcap
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ryanuber/iocap"
+)
+
+// paceSteps is the number of intervals a paced response is spread over.
+const paceSteps = 10
+
+// pacing spreads a response over a target duration, regardless of its size.
+type pacing struct {
+	over  time.Duration
+	floor iocap.RateOpts
+
+	// apply sets the rate of the response once its size is known.
+	apply func(iocap.RateOpts)
+
+	// buf holds the start of a response of unknown size, up to max bytes,
+	// in the hope that the whole response fits and its size can be
+	// learned.
+	max     int
+	buf     []byte
+	decided bool
+}
+
+// write writes p to dst, pacing the response based on its Content-Length
+// header or its buffered size.
+func (p *pacing) write(dst io.Writer, header http.Header, b []byte) (int, error) {
+	if !p.decided {
+		if size, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64); err == nil {
+			p.decide(size)
+		} else if len(p.buf)+len(b) <= p.max {
+			p.buf = append(p.buf, b...)
+			return len(b), nil
+		} else {
+			// Too large to learn the size, so the configured rate applies.
+			p.decided = true
+			if err := p.flush(dst); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return dst.Write(b)
+}
+
+// finish writes out any buffered response once the handler is done, paced
+// using the size of the buffer.
+func (p *pacing) finish(dst io.Writer) error {
+	if !p.decided {
+		p.decide(int64(len(p.buf)))
+	}
+	return p.flush(dst)
+}
+
+// decide applies the pace for a response of the given size.
+func (p *pacing) decide(size int64) {
+	p.decided = true
+	if size > 0 {
+		p.apply(paceRate(size, p.over, p.floor))
+	}
+}
+
+// flush writes out the buffered part of the response.
+func (p *pacing) flush(dst io.Writer) error {
+	if len(p.buf) == 0 {
+		return nil
+	}
+	_, err := dst.Write(p.buf)
+	p.buf = nil
+	return err
+}
+
+// paceRate returns the rate at which size bytes take roughly the duration
+// over, but no slower than floor. The first chunk goes out immediately, so
+// the response is split into one more chunk than the number of intervals.
+func paceRate(size int64, over time.Duration, floor iocap.RateOpts) iocap.RateOpts {
+	ro := iocap.RateOpts{
+		Interval: over / paceSteps,
+		Size:     int((size + paceSteps) / (paceSteps + 1)),
+	}
+	if !floor.IsUnlimited() && ro.BytesPerSecond() < floor.BytesPerSecond() {
+		return floor
+	}
+	return ro
+}
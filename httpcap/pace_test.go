@@ -0,0 +1,98 @@
+package httpcap
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/ryanuber/iocap"
+	"github.com/ryanuber/iocap/httpcap/httpcaptest"
+)
+
+// sizeHandler responds with the number of bytes given by the "size" query
+// parameter, setting Content-Length unless "chunked" is given.
+func sizeHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		size, _ := strconv.Atoi(r.URL.Query().Get("size"))
+		if r.URL.Query().Get("chunked") == "" {
+			w.Header().Set("Content-Length", strconv.Itoa(size))
+		}
+		buf := make([]byte, 1024)
+		for size > 0 {
+			if size < len(buf) {
+				buf = buf[:size]
+			}
+			w.Write(buf)
+			size -= len(buf)
+		}
+	})
+}
+
+func TestPaceOver(t *testing.T) {
+	// The configured rate is very slow, but paced responses replace it.
+	rate := iocap.RateOpts{Interval: time.Second, Size: 1}
+	ts := httptest.NewServer(Handler(sizeHandler(), rate,
+		PaceOver(500*time.Millisecond, iocap.Unlimited)))
+	defer ts.Close()
+
+	// Very different sizes take about the same time.
+	for _, size := range []int{10 * 1024, 1024 * 1024} {
+		m := httpcaptest.MeasureGET(t, ts, "?size="+strconv.Itoa(size))
+		if m.Bytes != int64(size) {
+			t.Fatalf("expect %d, got: %d", size, m.Bytes)
+		}
+		httpcaptest.AssertDurationBetween(t, m, 450*time.Millisecond, 750*time.Millisecond)
+	}
+}
+
+func TestPaceOver_Buffer(t *testing.T) {
+	rate := iocap.RateOpts{Interval: 100 * time.Millisecond, Size: 1024}
+	ts := httptest.NewServer(Handler(sizeHandler(), rate,
+		PaceOver(500*time.Millisecond, iocap.Unlimited), PaceBuffer(8192)))
+	defer ts.Close()
+
+	// A response of unknown size fitting in the buffer is paced.
+	m := httpcaptest.MeasureGET(t, ts, "?chunked=1&size=8192")
+	if m.Bytes != 8192 {
+		t.Fatalf("expect 8192, got: %d", m.Bytes)
+	}
+	httpcaptest.AssertDurationBetween(t, m, 450*time.Millisecond, 750*time.Millisecond)
+
+	// A larger one falls back to the configured rate.
+	m = httpcaptest.MeasureGET(t, ts, "?chunked=1&size=16384")
+	if m.Bytes != 16384 {
+		t.Fatalf("expect 16384, got: %d", m.Bytes)
+	}
+	httpcaptest.AssertDurationBetween(t, m, 1500*time.Millisecond, 0)
+}
+
+func TestPaceOver_Floor(t *testing.T) {
+	rate := iocap.RateOpts{Interval: time.Second, Size: 1}
+	floor := iocap.RateOpts{Interval: 100 * time.Millisecond, Size: 1024}
+	ts := httptest.NewServer(Handler(sizeHandler(), rate,
+		PaceOver(time.Second, floor)))
+	defer ts.Close()
+
+	// A tiny response is not stretched below the floor.
+	m := httpcaptest.MeasureGET(t, ts, "?size=100")
+	if m.Bytes != 100 {
+		t.Fatalf("expect 100, got: %d", m.Bytes)
+	}
+	httpcaptest.AssertDurationBetween(t, m, 0, 100*time.Millisecond)
+}
+
+func TestPaceOver_Group(t *testing.T) {
+	g := iocap.NewGroup(iocap.RateOpts{Interval: 100 * time.Millisecond, Size: 1 << 20})
+	ts := httptest.NewServer(GroupHandler(sizeHandler(), g,
+		PaceOver(500*time.Millisecond, iocap.Unlimited)))
+	defer ts.Close()
+
+	// The group's rate is left alone, while the response is paced.
+	m := httpcaptest.MeasureGET(t, ts, "?size=10240")
+	httpcaptest.AssertDurationBetween(t, m, 450*time.Millisecond, 750*time.Millisecond)
+	if r := g.Rate(); r.Size != 1<<20 {
+		t.Fatalf("group rate changed: %v", r)
+	}
+}
@@ -0,0 +1,167 @@
+package httpcap
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ryanuber/iocap"
+)
+
+// ErrShutdown is returned by writes to a rate limited response which were
+// abandoned by Shutdown.
+var ErrShutdown = errors.New("httpcap: handler shut down")
+
+// ShutdownPolicy decides what happens to the responses in flight in a rate
+// limited handler when it is shut down.
+type ShutdownPolicy int
+
+const (
+	// LiftLimits removes the rate limits of the handler, so that responses
+	// in flight finish as quickly as possible.
+	LiftLimits ShutdownPolicy = iota
+
+	// AbortWrites fails all limited writes with ErrShutdown, so that
+	// responses in flight end right away, incomplete.
+	AbortWrites
+)
+
+// Shutdown applies policy to the handler h, created by Handler, GroupHandler
+// or one of the per-IP helpers, once the grace period has passed. Responses
+// in flight keep their rate until then, and the policy also applies to any
+// requests which start afterward, including those of groups a mapper creates
+// after the shutdown. Shutdown returns immediately, reporting whether h is a
+// rate limited handler.
+//
+// Requests sleeping in the limiter can otherwise hold up a graceful server
+// shutdown for as long as their remaining bytes take to send; see
+// RegisterShutdown.
+func Shutdown(h http.Handler, policy ShutdownPolicy, grace time.Duration) bool {
+	if _, ok := handlers(h); !ok {
+		return false
+	}
+
+	stop := func() {
+		// Groups a mapper creates from now on start out shut down. Those
+		// created before the hook is in place are in the mapper already.
+		if m, ok := h.(interface {
+			OnCreate(fn func(key string, hand http.Handler))
+		}); ok {
+			m.OnCreate(func(_ string, hand http.Handler) {
+				if hand, ok := hand.(*handler); ok {
+					hand.shutdown(policy)
+				}
+			})
+		}
+		hands, _ := handlers(h)
+		for _, hand := range hands {
+			hand.shutdown(policy)
+		}
+	}
+	if grace > 0 {
+		time.AfterFunc(grace, stop)
+	} else {
+		stop()
+	}
+	return true
+}
+
+// RegisterShutdown arranges for Shutdown to be applied to h when srv is
+// shut down.
+func RegisterShutdown(srv *http.Server, h http.Handler, policy ShutdownPolicy, grace time.Duration) {
+	srv.RegisterOnShutdown(func() {
+		Shutdown(h, policy, grace)
+	})
+}
+
+// handlers returns the rate limited handlers behind h, which may be a
+// single handler or a mapper of them.
+func handlers(h http.Handler) ([]*handler, bool) {
+	if hand, ok := h.(*handler); ok {
+		return []*handler{hand}, true
+	}
+
+	m, ok := h.(interface {
+		Keys() []string
+		Lookup(key string) (http.Handler, bool)
+	})
+	if !ok {
+		return nil, false
+	}
+	var hands []*handler
+	for _, key := range m.Keys() {
+		if hand, ok := m.Lookup(key); ok {
+			if hand, ok := hand.(*handler); ok {
+				hands = append(hands, hand)
+			}
+		}
+	}
+	return hands, true
+}
+
+// shutdown applies policy to the handler and its requests in flight.
+func (h *handler) shutdown(policy ShutdownPolicy) {
+	if policy == LiftLimits && h.group != nil {
+		for _, g := range []*iocap.Group{h.group, h.uploadGroup, h.downloadGroup} {
+			if g != nil {
+				g.SetRate(iocap.Unlimited)
+			}
+		}
+	}
+	h.stopper.stop(policy)
+}
+
+// stopper tracks the requests in flight in a handler, so that their limits
+// can be stopped on shutdown.
+type stopper struct {
+	l        sync.Mutex
+	stopped  bool
+	policy   ShutdownPolicy
+	next     uint64
+	inflight map[uint64]func(ShutdownPolicy)
+}
+
+// track registers a request, whose limits are stopped by calling fn with
+// the shutdown policy. If the handler is already shut down, fn is called
+// right away. The returned function must be called once the request is
+// done.
+func (s *stopper) track(fn func(ShutdownPolicy)) func() {
+	s.l.Lock()
+	if s.stopped {
+		policy := s.policy
+		s.l.Unlock()
+		fn(policy)
+		return func() {}
+	}
+
+	if s.inflight == nil {
+		s.inflight = make(map[uint64]func(ShutdownPolicy))
+	}
+	id := s.next
+	s.next++
+	s.inflight[id] = fn
+	s.l.Unlock()
+
+	return func() {
+		s.l.Lock()
+		delete(s.inflight, id)
+		s.l.Unlock()
+	}
+}
+
+// stop stops the limits of all requests in flight and any to come.
+func (s *stopper) stop(policy ShutdownPolicy) {
+	s.l.Lock()
+	s.stopped = true
+	s.policy = policy
+	fns := make([]func(ShutdownPolicy), 0, len(s.inflight))
+	for _, fn := range s.inflight {
+		fns = append(fns, fn)
+	}
+	s.l.Unlock()
+
+	for _, fn := range fns {
+		fn(policy)
+	}
+}
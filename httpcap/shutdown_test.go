@@ -0,0 +1,127 @@
+package httpcap
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ryanuber/iocap"
+)
+
+// shutdownServer starts a server with a slow limited download, along with
+// a request for it which has started receiving the response. The error of
+// the handler's write is sent on errCh.
+func shutdownServer(t *testing.T, policy ShutdownPolicy, grace time.Duration) (*httptest.Server, *http.Response, chan error) {
+	errCh := make(chan error, 1)
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "102400")
+		_, err := w.Write(make([]byte, 100*1024))
+		errCh <- err
+	})
+
+	// 100KB at 1KB per 100ms takes 10s.
+	lh := Handler(h, iocap.RateOpts{Interval: 100 * time.Millisecond, Size: 1024})
+	ts := httptest.NewServer(lh)
+	RegisterShutdown(ts.Config, lh, policy, grace)
+
+	resp, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return ts, resp, errCh
+}
+
+func TestShutdown_LiftLimits(t *testing.T) {
+	ts, resp, errCh := shutdownServer(t, LiftLimits, 0)
+	defer ts.Close()
+	defer resp.Body.Close()
+
+	start := time.Now()
+	done := make(chan []byte)
+	go func() {
+		body, _ := ioutil.ReadAll(resp.Body)
+		done <- body
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	if err := ts.Config.Shutdown(context.Background()); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("shutdown took too long: %s", d)
+	}
+
+	// The response completes.
+	if err := <-errCh; err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if body := <-done; len(body) != 100*1024 {
+		t.Fatalf("expect %d, got: %d", 100*1024, len(body))
+	}
+}
+
+func TestShutdown_AbortWrites(t *testing.T) {
+	ts, resp, errCh := shutdownServer(t, AbortWrites, 200*time.Millisecond)
+	defer ts.Close()
+	defer resp.Body.Close()
+
+	start := time.Now()
+	done := make(chan []byte)
+	go func() {
+		body, _ := ioutil.ReadAll(resp.Body)
+		done <- body
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	if err := ts.Config.Shutdown(context.Background()); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The response keeps going for the grace period, then is cut short.
+	if d := time.Since(start); d < 200*time.Millisecond || d > time.Second {
+		t.Fatalf("expect shutdown after the grace period, took: %s", d)
+	}
+	if err := <-errCh; err != ErrShutdown {
+		t.Fatalf("expect ErrShutdown, got: %v", err)
+	}
+	if body := <-done; len(body) == 0 || len(body) >= 100*1024 {
+		t.Fatalf("expect partial body, got: %d", len(body))
+	}
+}
+
+func TestShutdown_NewGroup(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 10*1024))
+	})
+
+	// 10KB at 1KB per 100ms takes a second for each client.
+	lh := LimitByRequestIP(h, iocap.RateOpts{Interval: 100 * time.Millisecond, Size: 1024})
+	if !Shutdown(lh, LiftLimits, 0) {
+		t.Fatal("expect true")
+	}
+
+	// A client showing up after the shutdown gets a group without limits.
+	req, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	req.RemoteAddr = "10.0.0.1:1234"
+	rec := httptest.NewRecorder()
+	start := time.Now()
+	lh.ServeHTTP(rec, req)
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Fatalf("expect limits lifted, took: %s", d)
+	}
+	if rec.Body.Len() != 10*1024 {
+		t.Fatalf("expect %d, got: %d", 10*1024, rec.Body.Len())
+	}
+}
+
+func TestShutdown_Unknown(t *testing.T) {
+	if Shutdown(http.NotFoundHandler(), LiftLimits, 0) {
+		t.Fatal("expect false")
+	}
+}
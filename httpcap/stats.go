@@ -0,0 +1,183 @@
+package httpcap
+
+import (
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// HandlerStats is a live view of the traffic of a rate limited handler.
+type HandlerStats struct {
+	// Active is the number of requests currently being served.
+	Active int64
+
+	// Recent is the number of response bytes sent during the last complete
+	// second.
+	Recent int64
+
+	// Total is the number of response bytes sent since the handler was
+	// created.
+	Total int64
+}
+
+// StatsOf returns the current traffic of a handler created by Handler or
+// GroupHandler. For handlers created by LimitByRequestIP or its variants,
+// the traffic of all of the current groups is added up; traffic of groups
+// which have since been reaped is not included. It returns false for any
+// other handler.
+func StatsOf(h http.Handler) (HandlerStats, bool) {
+	if hand, ok := h.(*handler); ok {
+		return hand.meter.stats(), true
+	}
+
+	m, ok := h.(interface {
+		Keys() []string
+		Lookup(key string) (http.Handler, bool)
+	})
+	if !ok {
+		return HandlerStats{}, false
+	}
+	var total HandlerStats
+	for _, key := range m.Keys() {
+		if s, ok := StatsByKey(h, key); ok {
+			total.Active += s.Active
+			total.Recent += s.Recent
+			total.Total += s.Total
+		}
+	}
+	return total, true
+}
+
+// StatsByKey returns the current traffic of the group with the given key in
+// a handler created by LimitByRequestIP or one of its variants. It returns
+// false if the group does not currently exist.
+func StatsByKey(h http.Handler, key string) (HandlerStats, bool) {
+	m, ok := h.(interface {
+		Lookup(key string) (http.Handler, bool)
+	})
+	if !ok {
+		return HandlerStats{}, false
+	}
+	hand, ok := m.Lookup(key)
+	if !ok {
+		return HandlerStats{}, false
+	}
+	if hand, ok := hand.(*handler); ok {
+		return hand.meter.stats(), true
+	}
+	return HandlerStats{}, false
+}
+
+// meteredWriter counts the bytes written through it with a meter, and in
+// total in n.
+type meteredWriter struct {
+	w     io.Writer
+	meter *meter
+	n     int64
+}
+
+func (w *meteredWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.meter.add(n)
+	w.n += int64(n)
+	return n, err
+}
+
+func (w *meteredWriter) WriteString(s string) (int, error) {
+	n, err := io.WriteString(w.w, s)
+	w.meter.add(n)
+	w.n += int64(n)
+	return n, err
+}
+
+// meter gauges the traffic of a handler. Bytes are accumulated over a
+// window of one period, and the count of the last complete window is kept
+// once it is over. All of it is updated with atomics, so that writes of
+// responses never contend on a lock. The window is rolled over with a
+// compare-and-swap of its start, and bytes sent while it rolls over may be
+// counted in either window.
+type meter struct {
+	active int64
+	total  int64
+
+	// start is the start of the current window, in Unix nanoseconds, and
+	// cur and last the bytes sent in the current and last complete windows.
+	start int64
+	cur   int64
+	last  int64
+
+	period time.Duration
+
+	// sink, if set, is called with the stats as each request begins and
+	// ends.
+	sink func(HandlerStats)
+}
+
+// newMeter returns a meter with a period of one second.
+func newMeter() *meter {
+	return &meter{period: time.Second, start: time.Now().UnixNano()}
+}
+
+// begin and end mark the start and end of a request.
+func (m *meter) begin() {
+	atomic.AddInt64(&m.active, 1)
+	m.report()
+}
+
+func (m *meter) end() {
+	atomic.AddInt64(&m.active, -1)
+	m.report()
+}
+
+// report passes the current traffic to the sink, if any.
+func (m *meter) report() {
+	if m.sink != nil {
+		m.sink(m.stats())
+	}
+}
+
+// add counts n bytes sent.
+func (m *meter) add(n int) {
+	if n == 0 {
+		return
+	}
+	atomic.AddInt64(&m.total, int64(n))
+	m.roll(time.Now().UnixNano())
+	atomic.AddInt64(&m.cur, int64(n))
+}
+
+// roll moves on to the window containing now, in Unix nanoseconds. Only the
+// caller which swaps the start of the window moves the bytes of the current
+// window over to the last one.
+func (m *meter) roll(now int64) {
+	period := int64(m.period)
+	for {
+		start := atomic.LoadInt64(&m.start)
+		elapsed := now - start
+		if elapsed < period {
+			return
+		}
+		if !atomic.CompareAndSwapInt64(&m.start, start, now-elapsed%period) {
+			continue
+		}
+
+		// If a whole window went by since, nothing was sent in the last one.
+		cur := atomic.SwapInt64(&m.cur, 0)
+		if elapsed >= 2*period {
+			cur = 0
+		}
+		atomic.StoreInt64(&m.last, cur)
+		return
+	}
+}
+
+// stats returns the current traffic.
+func (m *meter) stats() HandlerStats {
+	m.roll(time.Now().UnixNano())
+	return HandlerStats{
+		Active: atomic.LoadInt64(&m.active),
+		Recent: atomic.LoadInt64(&m.last),
+		Total:  atomic.LoadInt64(&m.total),
+	}
+}
@@ -0,0 +1,184 @@
+package httpcap
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ryanuber/iocap"
+)
+
+func TestStatsOf(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 4096))
+	})
+	rate := iocap.RateOpts{Interval: 100 * time.Millisecond, Size: 1024}
+	hand := Handler(h, rate)
+	hand.(*handler).meter.period = 100 * time.Millisecond
+	ts := httptest.NewServer(hand)
+	defer ts.Close()
+
+	// Run several slow downloads at once, each taking at least 3 drains.
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := http.Get(ts.URL)
+			if err != nil {
+				t.Errorf("err: %v", err)
+				return
+			}
+			ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+		}()
+	}
+
+	// Sample the gauges mid-flight.
+	time.Sleep(150 * time.Millisecond)
+	s, ok := StatsOf(hand)
+	if !ok {
+		t.Fatal("expect stats")
+	}
+	if s.Active != 3 {
+		t.Fatalf("expect 3 active, got: %d", s.Active)
+	}
+	if s.Total < 3*1024 || s.Total >= 3*4096 {
+		t.Fatalf("expect partial total, got: %d", s.Total)
+	}
+	if s.Recent < 1024 || s.Recent > 3*2*1024 {
+		t.Fatalf("expect recent traffic, got: %d", s.Recent)
+	}
+
+	// Everything is accounted for once done, and nothing is active.
+	wg.Wait()
+	time.Sleep(250 * time.Millisecond)
+	s, _ = StatsOf(hand)
+	if s.Active != 0 {
+		t.Fatalf("expect 0 active, got: %d", s.Active)
+	}
+	if s.Total != 3*4096 {
+		t.Fatalf("expect %d, got: %d", 3*4096, s.Total)
+	}
+	if s.Recent != 0 {
+		t.Fatalf("expect no recent traffic, got: %d", s.Recent)
+	}
+}
+
+func TestStatsByKey(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 512))
+	})
+	lh := LimitByRequestIP(h, iocap.Unlimited)
+	ts := httptest.NewServer(lh)
+	defer ts.Close()
+
+	if _, ok := StatsOf(http.NotFoundHandler()); ok {
+		t.Fatal("expect no stats")
+	}
+
+	timedGet(t, ts.URL)
+	timedGet(t, ts.URL)
+
+	s, ok := StatsByKey(lh, "127.0.0.1")
+	if !ok {
+		t.Fatal("expect stats")
+	}
+	if s.Total != 1024 {
+		t.Fatalf("expect 1024, got: %d", s.Total)
+	}
+	if s, _ := StatsOf(lh); s.Total != 1024 {
+		t.Fatalf("expect 1024, got: %d", s.Total)
+	}
+}
+
+func TestMeter_Roll(t *testing.T) {
+	m := newMeter()
+	start := m.start
+	m.cur = 100
+
+	// Within the window, nothing moves.
+	m.roll(start + int64(500*time.Millisecond))
+	if m.cur != 100 || m.last != 0 {
+		t.Fatalf("bad: %d/%d", m.cur, m.last)
+	}
+
+	// The next window keeps the count of the last one, aligned to the
+	// period.
+	m.roll(start + int64(1500*time.Millisecond))
+	if m.cur != 0 || m.last != 100 {
+		t.Fatalf("bad: %d/%d", m.cur, m.last)
+	}
+	if m.start != start+int64(time.Second) {
+		t.Fatalf("expect window at 1s, got: %s", time.Duration(m.start-start))
+	}
+
+	// After a whole idle window, nothing was sent in the last one.
+	m.cur = 50
+	m.roll(start + int64(3500*time.Millisecond))
+	if m.cur != 0 || m.last != 0 {
+		t.Fatalf("bad: %d/%d", m.cur, m.last)
+	}
+}
+
+func TestMeter_Concurrent(t *testing.T) {
+	m := newMeter()
+	m.period = time.Millisecond
+
+	// Writers and readers of the stats race without losing bytes.
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10000; j++ {
+				m.add(10)
+				if j%100 == 0 {
+					m.stats()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if s := m.stats(); s.Total != 8*10000*10 || s.Recent > s.Total {
+		t.Fatalf("bad stats: %+v", s)
+	}
+}
+
+func TestStatsSink(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 512))
+	})
+	var l sync.Mutex
+	var got []HandlerStats
+	sink := StatsSink(func(s HandlerStats) {
+		l.Lock()
+		got = append(got, s)
+		l.Unlock()
+	})
+	ts := httptest.NewServer(Handler(h, iocap.Unlimited, sink))
+	defer ts.Close()
+	timedGet(t, ts.URL)
+
+	// The stats are reported as the request begins and ends. The handler
+	// may still be returning once the response is read.
+	l.Lock()
+	defer l.Unlock()
+	for i := 0; i < 100 && len(got) < 2; i++ {
+		l.Unlock()
+		time.Sleep(time.Millisecond)
+		l.Lock()
+	}
+	if len(got) != 2 {
+		t.Fatalf("expect 2 reports, got: %+v", got)
+	}
+	if got[0].Active != 1 || got[0].Total != 0 {
+		t.Fatalf("bad stats at start: %+v", got[0])
+	}
+	if got[1].Active != 0 || got[1].Total != 512 {
+		t.Fatalf("bad stats at end: %+v", got[1])
+	}
+}
@@ -0,0 +1,223 @@
+package httpcap
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ryanuber/iocap"
+)
+
+// DefaultAdaptPolicy is the AdaptPolicy used by an AdaptiveTransport when
+// none is configured. It halves the rate on each throttling response and
+// restores it in steps of a tenth of the maximum rate.
+var DefaultAdaptPolicy AdaptPolicy = &AIMD{Factor: 0.5}
+
+// AdaptPolicy decides how an AdaptiveTransport adjusts its rate in response
+// to feedback from the server.
+type AdaptPolicy interface {
+	// Decrease returns the rate to apply after the server signaled that the
+	// client is sending too much. max is the rate the transport started at.
+	Decrease(cur, max iocap.RateOpts) iocap.RateOpts
+
+	// Increase returns the rate to apply after a period of successful
+	// responses. The result should never exceed max.
+	Increase(cur, max iocap.RateOpts) iocap.RateOpts
+}
+
+// AIMD is an additive-increase, multiplicative-decrease AdaptPolicy.
+type AIMD struct {
+	// Factor is multiplied with the current size on each decrease. A zero
+	// value means 0.5.
+	Factor float64
+
+	// Step is the number of bytes per interval added back on each increase.
+	// A zero value means a tenth of the maximum size.
+	Step int
+
+	// Min is the smallest size the rate will be decreased to. Values less
+	// than one are treated as one byte per interval.
+	Min int
+}
+
+// Decrease implements AdaptPolicy.
+func (a *AIMD) Decrease(cur, max iocap.RateOpts) iocap.RateOpts {
+	factor := a.Factor
+	if factor <= 0 || factor >= 1 {
+		factor = 0.5
+	}
+	min := a.Min
+	if min < 1 {
+		min = 1
+	}
+
+	cur.Size = int(float64(cur.Size) * factor)
+	if cur.Size < min {
+		cur.Size = min
+	}
+	return cur
+}
+
+// Increase implements AdaptPolicy.
+func (a *AIMD) Increase(cur, max iocap.RateOpts) iocap.RateOpts {
+	step := a.Step
+	if step <= 0 {
+		step = max.Size / 10
+	}
+	if step < 1 {
+		step = 1
+	}
+
+	cur.Size += step
+	if cur.Size > max.Size {
+		cur.Size = max.Size
+	}
+	return cur
+}
+
+// AdaptiveTransport is an http.RoundTripper which rate limits request and
+// response bodies using a shared group. The rate of the group is reduced
+// whenever the server responds with 429 Too Many Requests (or 503 Service
+// Unavailable with a Retry-After header), and gradually restored after a
+// period of successful responses. A Retry-After value also holds back any
+// further requests until it has passed.
+type AdaptiveTransport struct {
+	// Transport is the underlying round tripper used to perform requests.
+	// If nil, http.DefaultTransport is used.
+	Transport http.RoundTripper
+
+	// Policy decides how the rate changes. If nil, DefaultAdaptPolicy is
+	// used.
+	Policy AdaptPolicy
+
+	// RecoverAfter is how long the server must go without throttling the
+	// client before the rate is increased by one step. A zero value means
+	// one second.
+	RecoverAfter time.Duration
+
+	// MaxPause is the longest pause honored from a Retry-After value, so
+	// that a server cannot hold back the client indefinitely. A zero value
+	// means one minute.
+	MaxPause time.Duration
+
+	group *iocap.Group
+	max   iocap.RateOpts
+
+	changed time.Time
+	pause   time.Time
+	l       sync.Mutex
+}
+
+// NewAdaptiveTransport creates a new adaptive transport on top of rt. The
+// transport rate limits requests using g, and the rate currently set on g
+// is used as the ceiling which the rate is restored to. Adaptation has no
+// effect if the group is unlimited.
+func NewAdaptiveTransport(rt http.RoundTripper, g *iocap.Group) *AdaptiveTransport {
+	return &AdaptiveTransport{
+		Transport: rt,
+		group:     g,
+		max:       g.Rate(),
+		changed:   time.Now(),
+	}
+}
+
+// RoundTrip implements the http.RoundTripper interface. A request waiting
+// out a pause requested by the server returns the error of its context
+// once it is done.
+func (t *AdaptiveTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// Honor any pause requested by the server.
+	t.l.Lock()
+	pause := t.pause
+	t.l.Unlock()
+	if d := pause.Sub(time.Now()); d > 0 {
+		timer := time.NewTimer(d)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+	}
+
+	// The request must not be modified, so limit the body of a copy.
+	if req.Body != nil {
+		r2 := new(http.Request)
+		*r2 = *req
+		r2.Body = newBody(req.Context(), req.Body, t.group)
+		req = r2
+	}
+
+	rt := t.Transport
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	t.feedback(resp)
+
+	resp.Body = newBody(req.Context(), resp.Body, t.group)
+	return resp, nil
+}
+
+// feedback adjusts the rate of the transport based on the response.
+func (t *AdaptiveTransport) feedback(resp *http.Response) {
+	if t.max.IsUnlimited() {
+		return
+	}
+
+	policy := t.Policy
+	if policy == nil {
+		policy = DefaultAdaptPolicy
+	}
+	recoverAfter := t.RecoverAfter
+	if recoverAfter == 0 {
+		recoverAfter = time.Second
+	}
+	maxPause := t.MaxPause
+	if maxPause == 0 {
+		maxPause = time.Minute
+	}
+
+	retryAfter := resp.Header.Get("Retry-After")
+
+	t.l.Lock()
+	defer t.l.Unlock()
+
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests,
+		resp.StatusCode == http.StatusServiceUnavailable && retryAfter != "":
+		t.group.SetRate(policy.Decrease(t.group.Rate(), t.max))
+		t.changed = time.Now()
+		if d, ok := parseRetryAfter(retryAfter); ok {
+			if d > maxPause {
+				d = maxPause
+			}
+			t.pause = time.Now().Add(d)
+		}
+
+	case resp.StatusCode < 400 && time.Since(t.changed) >= recoverAfter:
+		if cur := t.group.Rate(); cur != t.max {
+			t.group.SetRate(policy.Increase(cur, t.max))
+		}
+		t.changed = time.Now()
+	}
+}
+
+// parseRetryAfter parses the value of a Retry-After header, which is either
+// a number of seconds or an HTTP date.
+func parseRetryAfter(v string) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return t.Sub(time.Now()), true
+	}
+	return 0, false
+}
@@ -0,0 +1,238 @@
+package httpcap
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ryanuber/iocap"
+	"github.com/ryanuber/iocap/httpcap/httpcaptest"
+)
+
+func TestAIMD(t *testing.T) {
+	max := iocap.RateOpts{Interval: time.Second, Size: 1000}
+	a := &AIMD{Factor: 0.5, Step: 100, Min: 200}
+
+	// Decreases multiplicatively.
+	cur := a.Decrease(max, max)
+	if cur.Size != 500 {
+		t.Fatalf("expect 500, got: %d", cur.Size)
+	}
+
+	// Never drops below the minimum.
+	cur = a.Decrease(a.Decrease(cur, max), max)
+	if cur.Size != 200 {
+		t.Fatalf("expect 200, got: %d", cur.Size)
+	}
+
+	// Increases additively.
+	cur = a.Increase(cur, max)
+	if cur.Size != 300 {
+		t.Fatalf("expect 300, got: %d", cur.Size)
+	}
+
+	// Never exceeds the maximum.
+	cur = a.Increase(iocap.RateOpts{Interval: time.Second, Size: 950}, max)
+	if cur != max {
+		t.Fatalf("expect %v, got: %v", max, cur)
+	}
+}
+
+func TestAdaptiveTransport_Backoff(t *testing.T) {
+	// Throttle every other request.
+	var l sync.Mutex
+	var count int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l.Lock()
+		count++
+		n := count
+		l.Unlock()
+
+		if n == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte("hello world!"))
+	}))
+	defer ts.Close()
+
+	max := iocap.RateOpts{Interval: 100 * time.Millisecond, Size: 1024}
+	g := iocap.NewGroup(max)
+	tr := NewAdaptiveTransport(nil, g)
+	tr.RecoverAfter = 100 * time.Millisecond
+	client := &http.Client{Transport: tr}
+
+	// The first request is throttled and reduces the rate.
+	resp, err := client.Get(ts.URL)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("expect 429, got: %d", resp.StatusCode)
+	}
+	if v := g.Rate().Size; v != 512 {
+		t.Fatalf("expect 512, got: %d", v)
+	}
+
+	// The next request waits out the Retry-After, then succeeds. The rate
+	// is stepped back up since the recovery period has passed.
+	start := time.Now()
+	resp, err = client.Get(ts.URL)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d := time.Since(start); d < 900*time.Millisecond {
+		t.Fatalf("should pause for Retry-After, took %s", d)
+	}
+	if string(body) != "hello world!" {
+		t.Fatalf("bad: %q", body)
+	}
+	if v := g.Rate().Size; v != 614 {
+		t.Fatalf("expect 614, got: %d", v)
+	}
+}
+
+func TestAdaptiveTransport_Pause(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("throttle") != "" {
+			w.Header().Set("Retry-After", "3600")
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+	}))
+	defer ts.Close()
+
+	g := iocap.NewGroup(iocap.RateOpts{Interval: 100 * time.Millisecond, Size: 1024})
+	tr := NewAdaptiveTransport(nil, g)
+	client := &http.Client{Transport: tr}
+	resp, err := client.Get(ts.URL + "/?throttle=1")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp.Body.Close()
+
+	// A request waiting out the pause is canceled with its context.
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequest("GET", ts.URL, nil)
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	if _, err := client.Do(req.WithContext(ctx)); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expect %v, got: %v", context.Canceled, err)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Fatalf("should return once canceled, took %s", d)
+	}
+
+	// Long pauses are capped at MaxPause.
+	tr = NewAdaptiveTransport(nil, g)
+	tr.MaxPause = 200 * time.Millisecond
+	client = &http.Client{Transport: tr}
+	resp, err = client.Get(ts.URL + "/?throttle=1")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp.Body.Close()
+	start = time.Now()
+	if resp, err = client.Get(ts.URL); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp.Body.Close()
+	if d := time.Since(start); d < 150*time.Millisecond || d > time.Second {
+		t.Fatalf("expect a pause of about 200ms, took %s", d)
+	}
+}
+
+func TestAdaptiveTransport_Converge(t *testing.T) {
+	// The server rejects requests once more than threshold bytes were
+	// received within the current 100ms window.
+	const threshold = 1000
+	var l sync.Mutex
+	var window time.Time
+	var received, total int
+	start := time.Now()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+
+		l.Lock()
+		defer l.Unlock()
+		if now := time.Now(); now.Sub(window) >= 100*time.Millisecond {
+			window = now
+			received = 0
+		}
+		received += len(body)
+		if time.Since(start) > time.Second {
+			total += len(body)
+		}
+		if received > threshold {
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+	}))
+	defer ts.Close()
+
+	// Start out at four times the rate the server tolerates.
+	g := iocap.NewGroup(iocap.RateOpts{Interval: 100 * time.Millisecond, Size: 4 * threshold})
+	tr := NewAdaptiveTransport(nil, g)
+	tr.Policy = &AIMD{Factor: 0.5, Step: 50}
+	tr.RecoverAfter = 200 * time.Millisecond
+	client := &http.Client{Transport: tr}
+
+	payload := make([]byte, 100)
+	for time.Since(start) < 2*time.Second {
+		resp, err := client.Post(ts.URL, "text/plain", bytes.NewReader(payload))
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		resp.Body.Close()
+	}
+
+	// The rate should have come down below the 4x starting point, and the
+	// traffic in the second half should be near the threshold.
+	if v := g.Rate().Size; v >= 4*threshold {
+		t.Fatalf("rate was not reduced: %d", v)
+	}
+	l.Lock()
+	defer l.Unlock()
+	if max := 15 * threshold; total > max {
+		t.Fatalf("expect at most %d bytes in the last second, got: %d", max, total)
+	}
+}
+
+func TestAdaptiveTransport_Download(t *testing.T) {
+	// The server sends much faster than the client allows.
+	fast := iocap.RateOpts{Interval: 100 * time.Millisecond, Size: 64 * 1024}
+	ts := httptest.NewServer(httpcaptest.DripHandler(4096, fast))
+	defer ts.Close()
+
+	g := iocap.NewGroup(iocap.RateOpts{Interval: 100 * time.Millisecond, Size: 1024})
+	client := &http.Client{Transport: NewAdaptiveTransport(nil, g)}
+
+	start := time.Now()
+	resp, err := client.Get(ts.URL)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The download is held to the client's rate of 10KB/s.
+	m := httpcaptest.Measurement{Bytes: int64(len(body)), Duration: time.Since(start)}
+	if m.Bytes != 4096 {
+		t.Fatalf("expect 4096, got: %d", m.Bytes)
+	}
+	httpcaptest.AssertRateBetween(t, m, 4096/0.6, 4096/0.3)
+}
@@ -0,0 +1,20 @@
+package iocap
+
+import (
+	"go/build"
+	"testing"
+)
+
+func TestNoHTTPImport(t *testing.T) {
+	// HTTP integration lives in httpcap. The core package must stay free of
+	// net/http so that plain Reader and Writer users don't pull it in.
+	pkg, err := build.ImportDir(".", 0)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for _, imp := range pkg.Imports {
+		if imp == "net/http" {
+			t.Fatal("core package must not import net/http")
+		}
+	}
+}
@@ -1,10 +1,17 @@
 package iocap
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"io"
+	"math"
+	"math/rand"
 	"time"
 )
 
+// Sizes of bit units in bytes, for use with rates. A kilobit is 1024 bits,
+// or 128 bytes.
 const (
 	_  = (1 << (10 * iota)) / 8
 	Kb // Kilobit
@@ -12,78 +19,523 @@ const (
 	Gb // Gigabit
 )
 
+// Sizes of byte units in bytes, for use with rates. A kilobyte is 1024
+// bytes, eight times a kilobit.
+const (
+	_  = 1 << (10 * iota)
+	KB // Kilobyte
+	MB // Megabyte
+	GB // Gigabyte
+)
+
 var (
 	// The zero-value of RateOpts is used to indicate that no rate limit
-	// should be applied to read/write operations.
-	Unlimited = RateOpts{0, 0}
+	// should be applied to read/write operations. Other rates may also
+	// be unlimited; use RateOpts.IsUnlimited rather than comparing with
+	// Unlimited.
+	Unlimited = RateOpts{}
+
+	// ErrWouldBlock is returned by TryRead and TryWrite when the rate
+	// limit leaves no quota for the operation right now.
+	ErrWouldBlock = errors.New("iocap: operation would block")
+
+	// ErrRateTimeout is returned by reads and writes which waited on the
+	// rate limit for longer than their wait timeout.
+	ErrRateTimeout = errors.New("iocap: timed out waiting on rate limit")
+
+	// ErrCanceled is returned by reads and writes of a reader or writer
+	// whose Cancel method was called.
+	ErrCanceled = errors.New("iocap: operation canceled")
+
+	// ErrNotSupported is returned by TryRead and TryWrite of readers and
+	// writers backed by a TokenSource which cannot be waited on without
+	// blocking.
+	ErrNotSupported = errors.New("iocap: not supported by the token source")
 )
 
 // Reader implements the io.Reader interface and limits the rate at which
 // bytes come off of the underlying source reader.
 type Reader struct {
+	// stats is first, so that its atomic fields are 64-bit aligned.
+	stats transferStats
+
 	src    io.Reader
 	bucket *bucket
+
+	// ctx, if set, cancels reads blocked on the rate limit.
+	ctx context.Context
+
+	// chunk caps the size of each read from src, if non-zero.
+	chunk int
+
+	// timeout bounds the time a read waits on the rate limit, if non-zero.
+	timeout time.Duration
+
+	// intr stops operations on Cancel or once the deadline passes.
+	intr interrupt
+
+	// short makes each read call src at most once, rather than filling p.
+	short bool
+
+	// source, if set, provides the quota in place of the bucket.
+	source TokenSource
+
+	// parent, if set, is the reader of the parent group which src is, for
+	// readers of sub-groups.
+	parent *Reader
 }
 
 // NewReader wraps src in a new rate limited reader.
 func NewReader(src io.Reader, opts RateOpts) *Reader {
+	b := newBucket(opts)
 	return &Reader{
+		stats:  newTransferStats(b.clock.Now()),
 		src:    src,
-		bucket: newBucket(opts),
+		bucket: b,
+	}
+}
+
+// NewReaderMulti wraps src in a new reader limited by every one of the given
+// rates at once, such as a per-second rate along with a coarser per-minute
+// quota. Each read takes its quota from all of the rates. While any of them
+// has no quota left, the read waits for it without holding the quota of the
+// others. Refunds, overhead, Available, Reserve and Reset apply to all of
+// the rates, while SetRate, RampTo and Rate apply to the first one only,
+// leaving the others as they were given. Without any rates, the reader is
+// unlimited.
+func NewReaderMulti(src io.Reader, opts ...RateOpts) *Reader {
+	b := newMultiBucket(opts)
+	return &Reader{
+		stats:  newTransferStats(b.clock.Now()),
+		src:    src,
+		bucket: b,
 	}
 }
 
+// NewReaderContext is like NewReader, but reads are abandoned once ctx is
+// done, including while blocked on the rate limit. The read then returns
+// the number of bytes already read along with ctx.Err().
+func NewReaderContext(ctx context.Context, src io.Reader, opts RateOpts) *Reader {
+	r := NewReader(src, opts)
+	r.ctx = ctx
+	return r
+}
+
 // Read reads bytes off of the underlying source reader onto p with rate
-// limiting. Reads until EOF or until p is filled.
+// limiting. Reads until EOF or until p is filled, unless short reads are
+// enabled with SetShortReads. Reads of an empty p return right away, without
+// reading from src or waiting on the rate.
 func (r *Reader) Read(p []byte) (n int, err error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	return r.read(p, r.short)
+}
+
+// read implements Read. If short is set, src is read at most once.
+func (r *Reader) read(p []byte, short bool) (n int, err error) {
+	defer r.stats.count(&n)
+	stopped, err := r.intr.done()
+	if err != nil {
+		return 0, err
+	}
+
+	wt := waitState{ctx: r.ctx, timeout: r.timeout, stop: stopped}
+	defer wt.close()
+
+	if r.source != nil {
+		return r.readSource(&wt, p, short)
+	}
+
+	if r.bucket.postCharged() {
+		return r.readPost(&wt, p, short)
+	}
+
+	var s schedule
 	for n < len(p) {
-		// Ask for enough space to fit all remaining bytes
-		v := r.bucket.insert(len(p) - n)
+		// Ask for enough space to fit all remaining bytes, or the next
+		// chunk.
+		want := len(p) - n
+		if r.chunk > 0 && want > r.chunk {
+			want = r.chunk
+		}
+		want, ok := r.stats.pace(r.bucket, want, &s, &wt)
+		if !ok {
+			return n, r.waitErr()
+		}
+
+		// Give back the tokens if canceled while acquiring them.
+		if wt.stopped() {
+			r.bucket.refund(want)
+			return n, r.waitErr()
+		}
 
 		// Read from src into the byte range in p
-		v, err = r.src.Read(p[n : n+v])
+		var v int
+		v, err = r.src.Read(p[n : n+want])
+
+		// Give back the tokens of a short read, so that the rate reflects
+		// the bytes actually read. The bucket is no longer full, so any
+		// pacing schedule is dropped.
+		if v < want {
+			r.bucket.refund(want - v)
+			s.valid = false
+		}
+
+		// Charge the overhead of the rate for the bytes read.
+		if !r.stats.chargeOverhead(r.bucket, v, &s, &wt) && err == nil {
+			err = r.waitErr()
+		}
 
 		// Count the actual number of bytes read.
 		n += v
 
 		// Return any errors from the underlying reader. Preserves the
 		// underlying implementation's functionality.
-		if err != nil {
+		if err != nil || short {
 			return
 		}
 	}
 	return
 }
 
+// readPost implements Read for rates with PostCharge set. Each read from
+// src is limited to the quota available when it starts, and charged once
+// the number of bytes read is known.
+func (r *Reader) readPost(wt *waitState, p []byte, short bool) (n int, err error) {
+	for n < len(p) {
+		want := len(p) - n
+		if r.chunk > 0 && want > r.chunk {
+			want = r.chunk
+		}
+		start := r.bucket.clock.Now()
+		want, ok := r.bucket.allowance(want, wt.done())
+		r.stats.wait(r.bucket.clock, start)
+		if !ok {
+			return n, r.waitErr()
+		}
+
+		var v int
+		v, err = r.src.Read(p[n : n+want])
+		r.bucket.postCharge(v)
+		n += v
+		if err != nil || short {
+			return
+		}
+	}
+	return
+}
+
+// waitErr returns the error of a read which gave up waiting on the rate
+// limit: ErrCanceled if the reader was canceled, os.ErrDeadlineExceeded
+// if its deadline passed, that of its context if it is done, or else the
+// timeout.
+func (r *Reader) waitErr() error {
+	if err := r.intr.err(); err != nil {
+		return err
+	}
+	if r.ctx != nil && r.ctx.Err() != nil {
+		return r.ctx.Err()
+	}
+	return ErrRateTimeout
+}
+
+// SetWaitTimeout bounds the total time a single Read may wait on the rate
+// limit to d. A Read waiting for longer returns the number of bytes read so
+// far, along with ErrRateTimeout. Zero, the default, waits as long as needed.
+// The timeout is measured in real time, regardless of SetClock. It must not
+// be called concurrently with Read.
+func (r *Reader) SetWaitTimeout(d time.Duration) {
+	r.timeout = d
+}
+
+// SetShortReads makes each Read call the underlying reader at most once,
+// returning whatever it got, as much of p as the rate allows, in the way of
+// most readers. By default, Read calls the underlying reader until p is
+// filled, which can block on a connection long after a complete message has
+// arrived. It must not be called concurrently with Read.
+func (r *Reader) SetShortReads(on bool) {
+	r.short = on
+}
+
+// SetChunkSize caps the size of each read made from the underlying reader at
+// n bytes, regardless of the rate, as with Writer.SetChunkSize. Quota is
+// acquired one chunk at a time, so large reads see cancelation, deadlines
+// and rate changes between chunks. Zero, the default, reads as much as the
+// rate allows at once. It must not be called concurrently with Read.
+func (r *Reader) SetChunkSize(n int) {
+	r.chunk = n
+}
+
+// TryRead is like Read, but never blocks on the rate limit. It reads at
+// most once from the underlying reader, as much of p as the quota allows,
+// and returns ErrWouldBlock without reading if there is no quota left. Like
+// Read, it returns right away for an empty p. See TokenSource for readers
+// backed by one.
+func (r *Reader) TryRead(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if err := r.intr.err(); err != nil {
+		return 0, err
+	}
+
+	want := len(p)
+	if r.chunk > 0 && want > r.chunk {
+		want = r.chunk
+	}
+	want, err := tryAcquire(r.bucket, r.source, want)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := r.src.Read(p[:want])
+	if n < want {
+		r.bucket.refund(want - n)
+	}
+	r.bucket.chargeOverheadNow(n)
+	r.stats.count(&n)
+	return n, err
+}
+
 // SetRate is used to dynamically set the rate options on the reader.
 func (r *Reader) SetRate(opts RateOpts) {
+	if r.source != nil {
+		r.source.SetRate(opts)
+		return
+	}
 	r.bucket.setRate(opts)
 }
 
+// RampTo gradually changes the rate of the reader to opts over the given
+// duration, stepping the rate once per interval. A subsequent SetRate or
+// RampTo cancels the ramp.
+func (r *Reader) RampTo(opts RateOpts, over time.Duration) {
+	r.bucket.rampTo(opts, over)
+}
+
+// Rate returns the rate options currently in effect on the reader.
+func (r *Reader) Rate() RateOpts {
+	return r.bucket.rate()
+}
+
+// Available returns the number of bytes the reader can currently transfer
+// without blocking, as far as its own rate (shared by any other members of
+// its group) allows. It is the largest int if the rate is unlimited.
+func (r *Reader) Available() int {
+	if r.source != nil {
+		return availableSource(r.source)
+	}
+	return r.bucket.available()
+}
+
+// Reserve returns how long transferring n bytes would have to wait on the
+// reader's rate right now, without consuming any quota. Transfers larger than
+// the rate's Size are estimated over as many intervals as needed. Other
+// operations already waiting are not accounted for. It returns zero if the
+// rate is unlimited. The boolean result is always true, as rates which would
+// never allow any bytes are unlimited instead; see RateOpts.IsUnlimited. It
+// is false only for readers backed by a TokenSource, whose wait is unknown.
+func (r *Reader) Reserve(n int) (time.Duration, bool) {
+	if r.source != nil {
+		return 0, false
+	}
+	return r.bucket.reserve(n, false)
+}
+
+// ReserveAndCommit is like Reserve, but also consumes the quota for n bytes
+// right away, for a transfer made outside of the reader once the returned
+// duration has passed. Quota reserved beyond what is available now holds
+// back later operations until it is paid off.
+func (r *Reader) ReserveAndCommit(n int) (time.Duration, bool) {
+	if r.source != nil {
+		return 0, false
+	}
+	return r.bucket.reserve(n, true)
+}
+
+// Reset clears the quota consumed by the reader, so that it can transfer
+// its full capacity right away. Blocked operations, including those of any
+// other members of its group, are woken to take the new quota.
+func (r *Reader) Reset() {
+	r.bucket.reset()
+}
+
+// Reuse makes the reader read from src instead, like the Reset method of
+// bufio.Reader, so that readers can be kept in a sync.Pool rather than
+// allocated for each stream. The rate and its quota are kept, so that
+// bytes read from the previous source are still charged; call Reset as
+// well to start with the full capacity. The stats, cancelation and
+// deadline of the reader are cleared, while its other settings, such as
+// its context and chunk size, are kept. It must not be called
+// concurrently with Read.
+func (r *Reader) Reuse(src io.Reader) {
+	if r.parent != nil {
+		r.parent.Reuse(src)
+	} else {
+		r.src = src
+	}
+	r.intr.reset()
+	r.stats.reset(r.bucket.clock.Now())
+}
+
+// Capacity returns the number of bytes the reader may transfer at once,
+// which is the Size of its rate, or the Burst of a smooth rate.
+func (r *Reader) Capacity() int {
+	return r.bucket.rate().capacity()
+}
+
+// SetClock replaces the source of time of the reader, which is shared by
+// any other members of its group. It must be called before the reader is
+// used.
+func (r *Reader) SetClock(c Clock) {
+	r.bucket.setClock(c)
+}
+
+// Unwrap returns the underlying reader, following the naming of
+// errors.Unwrap so that chains of wrappers can be walked. The reader of a
+// sub-group unwraps to that of its parent group. Reading from the returned
+// reader directly bypasses the rate limit.
+func (r *Reader) Unwrap() io.Reader {
+	return r.src
+}
+
 // Writer implements the io.Writer interface and limits the rate at which
 // bytes are written to the underlying writer.
 type Writer struct {
+	// stats is first, so that its atomic fields are 64-bit aligned.
+	stats transferStats
+
 	dst    io.Writer
 	bucket *bucket
+
+	// ctx, if set, cancels writes blocked on the rate limit.
+	ctx context.Context
+
+	// chunk caps the size of each write to dst, if non-zero.
+	chunk int
+
+	// timeout bounds the time a write waits on the rate limit, if non-zero.
+	timeout time.Duration
+
+	// intr stops operations on Cancel or once the deadline passes.
+	intr interrupt
+
+	// source, if set, provides the quota in place of the bucket.
+	source TokenSource
+
+	// parent, if set, is the writer of the parent group which dst is, for
+	// writers of sub-groups.
+	parent *Writer
 }
 
 // NewWriter wraps dst in a new rate limited writer.
 func NewWriter(dst io.Writer, opts RateOpts) *Writer {
+	b := newBucket(opts)
 	return &Writer{
+		stats:  newTransferStats(b.clock.Now()),
 		dst:    dst,
-		bucket: newBucket(opts),
+		bucket: b,
 	}
 }
 
+// NewWriterMulti wraps dst in a new writer limited by every one of the given
+// rates at once, as with NewReaderMulti. SetRate, RampTo and Rate apply to
+// the first rate only. Without any rates, the writer is unlimited.
+func NewWriterMulti(dst io.Writer, opts ...RateOpts) *Writer {
+	b := newMultiBucket(opts)
+	return &Writer{
+		stats:  newTransferStats(b.clock.Now()),
+		dst:    dst,
+		bucket: b,
+	}
+}
+
+// NewWriterContext is like NewWriter, but writes are abandoned once ctx is
+// done, including while blocked on the rate limit. The write then returns
+// the number of bytes already written along with ctx.Err().
+func NewWriterContext(ctx context.Context, dst io.Writer, opts RateOpts) *Writer {
+	w := NewWriter(dst, opts)
+	w.ctx = ctx
+	return w
+}
+
 // Write writes len(p) bytes onto the underlying io.Writer, respecting the
-// configured rate limit options.
-func (w *Writer) Write(p []byte) (n int, err error) {
-	for n < len(p) {
-		// Ask for enough space to write p completely.
-		v := w.bucket.insert(len(p) - n)
+// configured rate limit options. Empty writes return right away, without
+// writing to dst or waiting on the rate.
+func (w *Writer) Write(p []byte) (int, error) {
+	return w.write(len(p), func(off, n int) (int, error) {
+		return w.dst.Write(p[off : off+n])
+	})
+}
+
+// WriteString implements io.StringWriter, writing s like Write. If the
+// underlying writer is an io.StringWriter, the string is passed on to it
+// without conversion. Otherwise, each chunk allowed by the rate is
+// converted to bytes on its own.
+func (w *Writer) WriteString(s string) (int, error) {
+	if sw, ok := w.dst.(io.StringWriter); ok {
+		return w.write(len(s), func(off, n int) (int, error) {
+			return sw.WriteString(s[off : off+n])
+		})
+	}
+	return w.write(len(s), func(off, n int) (int, error) {
+		return w.dst.Write([]byte(s[off : off+n]))
+	})
+}
 
-		// Write from the byte offset on p into the writer.
-		v, err = w.dst.Write(p[n : n+v])
+// write implements Write and WriteString for size bytes, writing out the
+// n bytes at offset off of each chunk with put.
+func (w *Writer) write(size int, put func(off, n int) (int, error)) (n int, err error) {
+	if size == 0 {
+		return 0, nil
+	}
+	defer w.stats.count(&n)
+	stopped, err := w.intr.done()
+	if err != nil {
+		return 0, err
+	}
+
+	wt := waitState{ctx: w.ctx, timeout: w.timeout, stop: stopped}
+	defer wt.close()
+
+	if w.source != nil {
+		return w.writeSource(&wt, size, put)
+	}
+
+	var s schedule
+	for n < size {
+		// Ask for enough space to write completely, or the next chunk.
+		want := size - n
+		if w.chunk > 0 && want > w.chunk {
+			want = w.chunk
+		}
+		want, ok := w.stats.pace(w.bucket, want, &s, &wt)
+		if !ok {
+			return n, w.waitErr()
+		}
+
+		// Give back the tokens if canceled while acquiring them.
+		if wt.stopped() {
+			w.bucket.refund(want)
+			return n, w.waitErr()
+		}
+
+		// Write from the byte offset into the writer.
+		var v int
+		v, err = put(n, want)
+
+		// Give back the tokens of bytes which were not written, so that
+		// other members of a group are not held back by them.
+		if v < want {
+			w.bucket.refund(want - v)
+			s.valid = false
+		}
+
+		// Charge the overhead of the rate for the bytes written.
+		if !w.stats.chargeOverhead(w.bucket, v, &s, &wt) && err == nil {
+			err = w.waitErr()
+		}
 
 		// Count the actual bytes written.
 		n += v
@@ -97,26 +549,363 @@ func (w *Writer) Write(p []byte) (n int, err error) {
 	return
 }
 
+// waitErr returns the error of a write which gave up waiting on the rate
+// limit: ErrCanceled if the writer was canceled, os.ErrDeadlineExceeded
+// if its deadline passed, that of its context if it is done, or else the
+// timeout.
+func (w *Writer) waitErr() error {
+	if err := w.intr.err(); err != nil {
+		return err
+	}
+	if w.ctx != nil && w.ctx.Err() != nil {
+		return w.ctx.Err()
+	}
+	return ErrRateTimeout
+}
+
+// TryWrite is like Write, but never blocks on the rate limit. It writes as
+// much of p as the quota allows, and returns ErrWouldBlock along with the
+// number of bytes written if that is not all of p. Writes are never
+// canceled by the context of the writer, as they don't wait. Like Write, it
+// returns right away for an empty p. See TokenSource for writers backed by
+// one.
+func (w *Writer) TryWrite(p []byte) (n int, err error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	defer w.stats.count(&n)
+	if err := w.intr.err(); err != nil {
+		return 0, err
+	}
+	for n < len(p) {
+		want := len(p) - n
+		if w.chunk > 0 && want > w.chunk {
+			want = w.chunk
+		}
+		if want, err = tryAcquire(w.bucket, w.source, want); err != nil {
+			return n, err
+		}
+
+		var v int
+		v, err = w.dst.Write(p[n : n+want])
+		if v < want {
+			w.bucket.refund(want - v)
+		}
+		w.bucket.chargeOverheadNow(v)
+
+		n += v
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
 // SetRate is used to dynamically set the rate options on the writer.
 func (w *Writer) SetRate(opts RateOpts) {
+	if w.source != nil {
+		w.source.SetRate(opts)
+		return
+	}
 	w.bucket.setRate(opts)
 }
 
-// RateOpts is used to encapsulate rate limiting options.
+// RampTo gradually changes the rate of the writer to opts over the given
+// duration, stepping the rate once per interval. A subsequent SetRate or
+// RampTo cancels the ramp.
+func (w *Writer) RampTo(opts RateOpts, over time.Duration) {
+	w.bucket.rampTo(opts, over)
+}
+
+// Rate returns the rate options currently in effect on the writer.
+func (w *Writer) Rate() RateOpts {
+	return w.bucket.rate()
+}
+
+// Available returns the number of bytes the writer can currently transfer
+// without blocking, as far as its own rate (shared by any other members of
+// its group) allows. It is the largest int if the rate is unlimited.
+func (w *Writer) Available() int {
+	if w.source != nil {
+		return availableSource(w.source)
+	}
+	return w.bucket.available()
+}
+
+// Reserve returns how long transferring n bytes would have to wait on the
+// writer's rate right now, without consuming any quota. Transfers larger than
+// the rate's Size are estimated over as many intervals as needed. Other
+// operations already waiting are not accounted for. It returns zero if the
+// rate is unlimited. The boolean result is always true, as rates which would
+// never allow any bytes are unlimited instead; see RateOpts.IsUnlimited. It
+// is false only for writers backed by a TokenSource, whose wait is unknown.
+func (w *Writer) Reserve(n int) (time.Duration, bool) {
+	if w.source != nil {
+		return 0, false
+	}
+	return w.bucket.reserve(n, false)
+}
+
+// ReserveAndCommit is like Reserve, but also consumes the quota for n bytes
+// right away, for a transfer made outside of the writer once the returned
+// duration has passed. Quota reserved beyond what is available now holds
+// back later operations until it is paid off.
+func (w *Writer) ReserveAndCommit(n int) (time.Duration, bool) {
+	if w.source != nil {
+		return 0, false
+	}
+	return w.bucket.reserve(n, true)
+}
+
+// Reset clears the quota consumed by the writer, so that it can transfer
+// its full capacity right away. Blocked operations, including those of any
+// other members of its group, are woken to take the new quota.
+func (w *Writer) Reset() {
+	w.bucket.reset()
+}
+
+// Reuse makes the writer write to dst instead, like the Reset method of
+// bufio.Writer, as with Reader.Reuse. The rate and its quota are kept, and
+// the stats, cancelation and deadline of the writer are cleared. It must
+// not be called concurrently with Write.
+func (w *Writer) Reuse(dst io.Writer) {
+	if w.parent != nil {
+		w.parent.Reuse(dst)
+	} else {
+		w.dst = dst
+	}
+	w.intr.reset()
+	w.stats.reset(w.bucket.clock.Now())
+}
+
+// Capacity returns the number of bytes the writer may transfer at once,
+// which is the Size of its rate, or the Burst of a smooth rate.
+func (w *Writer) Capacity() int {
+	return w.bucket.rate().capacity()
+}
+
+// SetClock replaces the source of time of the writer, which is shared by
+// any other members of its group. It must be called before the writer is
+// used.
+func (w *Writer) SetClock(c Clock) {
+	w.bucket.setClock(c)
+}
+
+// Unwrap returns the underlying writer, following the naming of
+// errors.Unwrap so that chains of wrappers can be walked. The writer of a
+// sub-group unwraps to that of its parent group. Writing to the returned
+// writer directly bypasses the rate limit.
+func (w *Writer) Unwrap() io.Writer {
+	return w.dst
+}
+
+// SetWaitTimeout bounds the total time a single Write may wait on the rate
+// limit to d. A Write waiting for longer returns the number of bytes written
+// so far, along with ErrRateTimeout. Zero, the default, waits as long as
+// needed. The timeout is measured in real time, regardless of SetClock. It
+// must not be called concurrently with Write.
+func (w *Writer) SetWaitTimeout(d time.Duration) {
+	w.timeout = d
+}
+
+// SetChunkSize caps the size of each write made to the underlying writer at
+// n bytes, regardless of the rate. Data admitted by a large bucket is then
+// written out in a series of smaller pieces. Zero, the default, writes as
+// much as the rate allows at once. Quota is acquired one chunk at a time, so
+// large writes see cancelation, deadlines and rate changes between chunks.
+// It must not be called concurrently with Write.
+func (w *Writer) SetChunkSize(n int) {
+	w.chunk = n
+}
+
+// RateOpts is used to encapsulate rate limiting options. A rate limits
+// anything only if both its Interval and Size are positive. Otherwise, such
+// as with a Size of zero and a non-zero Interval, it is unlimited like the
+// zero value, Unlimited, rather than allowing nothing.
 type RateOpts struct {
 	// Interval is the time period of the rate
 	Interval time.Duration
 
 	// Size is the number of bytes per interval
 	Size int
+
+	// MaxBank enables idle credit banking when non-zero. Quota left unused
+	// at the end of an interval, including whole intervals spent idle, is
+	// banked as credit up to MaxBank bytes. Once the quota of an interval
+	// is used up, banked credit is spent immediately rather than waiting
+	// for the next interval. Credit only accrues through idleness, so
+	// sustained traffic still converges to the base rate. Setting MaxBank
+	// makes the rate coarse.
+	MaxBank int
+
+	// Coarse makes the limiter release quota all at once at the end of
+	// each interval, rather than leaking it continuously in proportion to
+	// the time passed. By default, once the initial burst of Size is used
+	// up, traffic flows in steps of about a tenth of Size. Coarse limiters
+	// let it out in bursts of Size once per interval instead, and take less
+	// locking per operation. Rates with MaxBank or Jitter set are always
+	// coarse, as both are defined in terms of interval drains.
+	Coarse bool
+
+	// Burst, if larger than Size, is the number of bytes which may be
+	// consumed at once by an idle limiter, while Interval and Size keep
+	// defining the sustained rate. Smooth limiters simply hold up to Burst
+	// bytes instead of Size. For coarse ones, the part of the burst beyond
+	// Size is kept as credit, which is available right away to a new
+	// limiter and replenished by unused quota like MaxBank. Zero means a
+	// burst of Size.
+	Burst int
+
+	// Jitter, between 0 and 1, delays the first drain of a limiter by a
+	// random fraction of Interval up to Jitter. Limiters created at the same
+	// time then drain at different times, rather than all releasing their
+	// quota at once. As drains are only ever delayed, the rate is not
+	// exceeded. Setting Jitter makes the rate coarse.
+	Jitter float64
+
+	// StartFull makes a new limiter start out as if its quota was just used
+	// up, rather than allowing Size (or Burst) bytes right away, so that
+	// even the first bytes are paced. It also applies after Reset.
+	StartFull bool
+
+	// Overhead is a number of extra bytes charged for each read or write
+	// on the underlying reader or writer, and Weight is the number of bytes
+	// charged per byte read or written, if above 1. Together they account
+	// for framing added on the wire, such as by TLS, so that the rate
+	// applies to the bytes actually sent. The counts returned by reads and
+	// writes are not affected.
+	Overhead int
+	Weight   float64
+
+	// PostCharge makes readers charge the bytes they read once the read
+	// returns, rather than taking quota for the whole buffer up-front. A
+	// read then waits only until some quota is available, reads up to that
+	// much, and charges what was actually read, so that sources trickling
+	// in small reads do not hold quota they do not use. Reads which overlap
+	// may together exceed the quota of an interval, which is made up for by
+	// holding back later reads. Writers know their byte counts up-front,
+	// and ignore PostCharge.
+	PostCharge bool
+}
+
+// IsUnlimited returns whether the rate places no limit, which is the case
+// unless both its Interval and Size are positive.
+func (o RateOpts) IsUnlimited() bool {
+	return o.Interval <= 0 || o.Size <= 0
+}
+
+// IsZero returns whether the rate is the zero value, Unlimited, with no
+// options set at all.
+func (o RateOpts) IsZero() bool {
+	return o == RateOpts{}
+}
+
+// overhead returns the number of extra bytes charged by the rate for an
+// operation on n bytes.
+func (o RateOpts) overhead(n int) int {
+	if n <= 0 {
+		return 0
+	}
+	extra := o.Overhead
+	if o.Weight > 1 {
+		extra += int(float64(n)*(o.Weight-1) + 0.5)
+	}
+	if extra < 0 {
+		return 0
+	}
+	return extra
+}
+
+// jitter returns a random delay for the first drain of a bucket with the
+// rate.
+func (o RateOpts) jitter() time.Duration {
+	j := o.Jitter
+	switch {
+	case j <= 0 || o.Interval <= 0:
+		return 0
+	case j > 1:
+		j = 1
+	}
+	return time.Duration(rand.Int63n(int64(float64(o.Interval)*j) + 1))
+}
+
+// smooth returns whether a bucket with the rate leaks tokens continuously,
+// rather than draining them once per interval.
+func (o RateOpts) smooth() bool {
+	return !o.Coarse && o.MaxBank <= 0 && o.Jitter <= 0
+}
+
+// capacity returns the number of tokens a bucket with the rate holds.
+func (o RateOpts) capacity() int {
+	if o.smooth() && o.Burst > o.Size {
+		return o.Burst
+	}
+	return o.Size
 }
 
-// perSecond is an internal helper to calculate rates.
+// burstCredit returns the credit available to a new bucket with the rate.
+func (o RateOpts) burstCredit() int {
+	if o.smooth() || o.Burst <= o.Size {
+		return 0
+	}
+	return o.Burst - o.Size
+}
+
+// maxCredit returns the maximum banked credit of a bucket with the rate.
+func (o RateOpts) maxCredit() int {
+	if burst := o.burstCredit(); burst > o.MaxBank {
+		return burst
+	}
+	return o.MaxBank
+}
+
+// Snapshot is a point-in-time copy of the state of a limiter. It can be used
+// to carry consumed quota over to a new limiter, for example across a
+// process restart.
+type Snapshot struct {
+	// Tokens is the number of bytes consumed in the current interval.
+	Tokens int
+
+	// Drained is the time at which the current interval started.
+	Drained time.Time
+}
+
+// maxInt is the largest value of an int on the platform.
+const maxInt = int(^uint(0) >> 1)
+
+// PerDuration returns a RateOpts configured for n bytes per d, such as 10MB
+// per 250ms for fine-grained pacing or 1GB per 6h for a coarse quota. Both n
+// and d must be positive, as the rate would not limit anything otherwise.
+func PerDuration(n int, d time.Duration) (RateOpts, error) {
+	if n <= 0 || d <= 0 {
+		return Unlimited, fmt.Errorf("iocap: invalid rate of %d bytes per %s", n, d)
+	}
+	return RateOpts{Interval: d, Size: n}, nil
+}
+
+// perSecond is an internal helper to calculate rates. Rates of no bytes are
+// unlimited, while rates of less than a byte per second allow one byte over
+// a proportionally longer interval, as with Scale, rather than rounding down
+// to no limit at all.
 func perSecond(n, base float64) RateOpts {
-	return RateOpts{
-		Interval: time.Second,
-		Size:     int(n * base),
+	if size := n * base; size > 0 && size < 1 {
+		return RateOpts{Interval: clampDuration(float64(time.Second) / size), Size: 1}
+	}
+	ro, err := PerDuration(clampSize(n*base), time.Second)
+	if err != nil {
+		return Unlimited
 	}
+	return ro
+}
+
+// clampSize converts a number of bytes to a rate size, clamping it to the
+// largest int rather than letting very high rates wrap around on platforms
+// with 32-bit ints.
+func clampSize(n float64) int {
+	if n >= float64(maxInt) {
+		return maxInt
+	}
+	return int(n)
 }
 
 // Kbps returns a RateOpts configured for n kilobits per second.
@@ -134,34 +923,289 @@ func Gbps(n float64) RateOpts {
 	return perSecond(n, Gb)
 }
 
+// BitsPerSecond returns a RateOpts configured for n bits per second, for
+// slow links such as 9600 or 300 bits per second. Whole numbers of bits are
+// represented exactly, over the shortest interval of up to 8 seconds which
+// holds a whole number of bytes: 300 bits per second is 75 bytes every 2
+// seconds. Fractional numbers of bits are rounded to the nearest byte per
+// second, or to one byte over a longer interval for rates below a byte per
+// second.
+func BitsPerSecond(n float64) RateOpts {
+	if n <= 0 {
+		return perSecond(n, 1)
+	}
+	if n == math.Trunc(n) && n < float64(maxInt)/8 {
+		k := 8
+		for k > 1 && (int(n)*(k/2))%8 == 0 {
+			k /= 2
+		}
+		return RateOpts{Interval: time.Duration(k) * time.Second, Size: int(n) * k / 8}
+	}
+	return RateOpts{Interval: time.Second, Size: 1}.Scale(n / 8)
+}
+
+// KBps returns a RateOpts configured for n kilobytes per second. Note the
+// capital B: a rate of KBps(1) is eight times that of Kbps(1).
+func KBps(n float64) RateOpts {
+	return perSecond(n, KB)
+}
+
+// MBps returns a RateOpts configured for n megabytes per second.
+func MBps(n float64) RateOpts {
+	return perSecond(n, MB)
+}
+
+// GBps returns a RateOpts configured for n gigabytes per second.
+func GBps(n float64) RateOpts {
+	return perSecond(n, GB)
+}
+
 // Group is used to group multiple readers and/or writers onto the same bucket,
 // thus enforcing the rate limit across multiple independent processes.
+// Members blocked on the rate are served in the order they started waiting,
+// so that concurrent operations share the rate in turns rather than one of
+// them taking it all.
 type Group struct {
 	bucket *bucket
+
+	// parent is the group enclosing a sub-group, if any.
+	parent *Group
+
+	// source, if set, provides the quota of readers and writers in place
+	// of the bucket.
+	source TokenSource
 }
 
 // NewGroup creates a new rate limiting group with the specific rate.
 func NewGroup(opts RateOpts) *Group {
-	return &Group{newBucket(opts)}
+	return &Group{bucket: newBucket(opts)}
+}
+
+// NewGroupMulti creates a new rate limiting group whose members are limited
+// by every one of the given rates at once, as with NewReaderMulti. SetRate,
+// RampTo, Rate, Snapshot and Restore apply to the first rate only. Without
+// any rates, the group is unlimited.
+func NewGroupMulti(opts ...RateOpts) *Group {
+	return &Group{bucket: newMultiBucket(opts)}
+}
+
+// NewSubGroup creates a new group nested within g. Readers and writers of
+// the sub-group are limited by the sub-group's own rate, and also share the
+// quota of g (and any of its parents) with all other members of g.
+func (g *Group) NewSubGroup(opts RateOpts) *Group {
+	return &Group{
+		bucket: newBucket(opts),
+		parent: g,
+	}
 }
 
 // SetRate is used to dynamically update the rate options of the group.
 func (g *Group) SetRate(opts RateOpts) {
+	if g.source != nil {
+		g.source.SetRate(opts)
+		return
+	}
 	g.bucket.setRate(opts)
 }
 
+// RampTo gradually changes the rate of the group to opts over the given
+// duration, stepping the rate once per interval. A subsequent SetRate or
+// RampTo cancels the ramp.
+func (g *Group) RampTo(opts RateOpts, over time.Duration) {
+	g.bucket.rampTo(opts, over)
+}
+
+// Rate returns the rate options currently applied to the group, including
+// the current step of any in-progress ramp.
+func (g *Group) Rate() RateOpts {
+	return g.bucket.rate()
+}
+
+// Available returns the number of bytes members of the group can currently
+// transfer without blocking, also considering any parent groups. It is the
+// largest int if the rates are unlimited.
+func (g *Group) Available() int {
+	v := g.bucket.available()
+	if g.source != nil {
+		v = availableSource(g.source)
+	}
+	if g.parent != nil {
+		if pv := g.parent.Available(); pv < v {
+			v = pv
+		}
+	}
+	return v
+}
+
+// Reserve returns how long members of the group would have to wait to
+// transfer n bytes right now, also considering any parent groups, as with
+// Reader.Reserve.
+func (g *Group) Reserve(n int) (time.Duration, bool) {
+	return g.reserve(n, false)
+}
+
+// ReserveAndCommit is like Reserve, but also consumes the quota for n bytes
+// of the group and its parents right away, as with
+// Reader.ReserveAndCommit.
+func (g *Group) ReserveAndCommit(n int) (time.Duration, bool) {
+	return g.reserve(n, true)
+}
+
+// reserve implements Reserve and ReserveAndCommit. Nothing is committed
+// unless all of the groups allow it.
+func (g *Group) reserve(n int, commit bool) (time.Duration, bool) {
+	var wait time.Duration
+	for p := g; p != nil; p = p.parent {
+		if p.source != nil {
+			return 0, false
+		}
+		d, ok := p.bucket.reserve(n, false)
+		if !ok {
+			return 0, false
+		}
+		if d > wait {
+			wait = d
+		}
+	}
+	if commit {
+		for p := g; p != nil; p = p.parent {
+			p.bucket.reserve(n, true)
+		}
+	}
+	return wait, true
+}
+
+// Reset clears the quota consumed by the group, so that its members can
+// transfer its full capacity right away. Blocked members are woken to take
+// the new quota. Parent groups are not reset.
+func (g *Group) Reset() {
+	g.bucket.reset()
+}
+
+// Capacity returns the number of bytes members of the group may transfer
+// at once, which is the Size of its rate, or the Burst of a smooth rate.
+func (g *Group) Capacity() int {
+	return g.bucket.rate().capacity()
+}
+
+// SetClock replaces the source of time of the group. Parent groups keep
+// their own clocks. It must be called before the group is used.
+func (g *Group) SetClock(c Clock) {
+	g.bucket.setClock(c)
+}
+
+// Wait blocks until the group has quota available, without consuming any.
+// It is useful to hold off starting a transfer, such as an upload the client
+// is waiting for permission to send, while the group is saturated. There is
+// no guarantee the quota is still available by the time it is used.
+func (g *Group) Wait() {
+	if g.parent != nil {
+		g.parent.Wait()
+	}
+	g.bucket.wait()
+}
+
+// OnSaturation registers fn to be called when the fraction of each
+// interval's quota consumed by the group stays at or above threshold for
+// at least the sustain duration. fn is called again, with Saturated set to
+// false, once an interval completes below the threshold. Utilization is
+// evaluated as the group's quota is replenished, so recovery of a group
+// which goes completely idle is reported on its next use. Groups with
+// smooth rates are evaluated over intervals of their own, starting with
+// their first use after the call. Calling OnSaturation replaces any
+// previously registered callback; a nil fn removes it.
+func (g *Group) OnSaturation(threshold float64, sustain time.Duration, fn func(Stats)) {
+	g.bucket.l.Lock()
+	defer g.bucket.l.Unlock()
+
+	if fn == nil {
+		g.bucket.saturation = nil
+		return
+	}
+	g.bucket.saturation = &saturation{
+		threshold: threshold,
+		sustain:   sustain,
+		fn:        fn,
+	}
+}
+
+// Snapshot returns a copy of the group's current limiter state.
+func (g *Group) Snapshot() Snapshot {
+	return g.bucket.snapshot()
+}
+
+// Restore replaces the group's limiter state with s. The rate of the group
+// is not changed.
+func (g *Group) Restore(s Snapshot) {
+	g.bucket.restore(s)
+}
+
 // NewWriter creates and returns a new writer in the group.
 func (g *Group) NewWriter(dst io.Writer) *Writer {
+	var parent *Writer
+	if g.parent != nil {
+		// Writes pass through the parent's writer on the way out.
+		parent = g.parent.NewWriter(dst)
+		dst = parent
+	}
+	return &Writer{
+		stats:  newTransferStats(g.bucket.clock.Now()),
+		dst:    dst,
+		bucket: g.bucket,
+		source: g.source,
+		parent: parent,
+	}
+}
+
+// NewWriterContext creates and returns a new writer in the group, whose
+// writes are abandoned once ctx is done, as with NewWriterContext.
+func (g *Group) NewWriterContext(ctx context.Context, dst io.Writer) *Writer {
+	var parent *Writer
+	if g.parent != nil {
+		parent = g.parent.NewWriterContext(ctx, dst)
+		dst = parent
+	}
 	return &Writer{
+		stats:  newTransferStats(g.bucket.clock.Now()),
 		dst:    dst,
 		bucket: g.bucket,
+		ctx:    ctx,
+		source: g.source,
+		parent: parent,
 	}
 }
 
 // NewReader creates and returns a new reader in the group.
 func (g *Group) NewReader(src io.Reader) *Reader {
+	var parent *Reader
+	if g.parent != nil {
+		// Reads are pulled through the parent's reader.
+		parent = g.parent.NewReader(src)
+		src = parent
+	}
+	return &Reader{
+		stats:  newTransferStats(g.bucket.clock.Now()),
+		src:    src,
+		bucket: g.bucket,
+		source: g.source,
+		parent: parent,
+	}
+}
+
+// NewReaderContext creates and returns a new reader in the group, whose
+// reads are abandoned once ctx is done, as with NewReaderContext.
+func (g *Group) NewReaderContext(ctx context.Context, src io.Reader) *Reader {
+	var parent *Reader
+	if g.parent != nil {
+		parent = g.parent.NewReaderContext(ctx, src)
+		src = parent
+	}
 	return &Reader{
+		stats:  newTransferStats(g.bucket.clock.Now()),
 		src:    src,
 		bucket: g.bucket,
+		ctx:    ctx,
+		source: g.source,
+		parent: parent,
 	}
 }
@@ -2,10 +2,19 @@ package iocap
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"reflect"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"testing/iotest"
 	"time"
 )
 
@@ -17,19 +26,21 @@ func TestReader(t *testing.T) {
 	}
 	buf := bytes.NewBuffer(data)
 
-	// Create the Reader with a rate limit applied.
+	// Create the Reader with a rate limit applied, on virtual time.
+	clock := newFakeClock()
 	r := NewReader(buf, RateOpts{Interval: 100 * time.Millisecond, Size: 128})
+	r.SetClock(clock)
 	out := make([]byte, 512)
 
 	// Record the start time and execute the read.
-	start := time.Now()
+	start := clock.Now()
 	n, err := r.Read(out)
 
 	// Check that we actually rate limited the read. 300ms because
 	// initially we can read 128 bytes, then 3 bucket drains block
 	// at 100ms a pop.
-	if d := time.Since(start); d < 300*time.Millisecond {
-		t.Fatalf("read returned to quickly in %s", d)
+	if d := clock.Now().Sub(start); d != 300*time.Millisecond {
+		t.Fatalf("expect 300ms, took %s", d)
 	}
 
 	// Check the return values and data.
@@ -44,18 +55,190 @@ func TestReader(t *testing.T) {
 	}
 }
 
+func TestReader_ShortReads(t *testing.T) {
+	clock := newFakeClock()
+	r := NewReader(byteReader{zeroReader{}}, RateOpts{Interval: 100 * time.Millisecond, Size: 128})
+	r.SetClock(clock)
+
+	// Reading a byte at a time still achieves the full rate, as the
+	// tokens reserved beyond each byte are given back.
+	start := clock.Now()
+	n, err := r.Read(make([]byte, 512))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if n != 512 {
+		t.Fatalf("expect 512, got: %d", n)
+	}
+	if d := clock.Now().Sub(start); d != 300*time.Millisecond {
+		t.Fatalf("expect 300ms, took %s", d)
+	}
+}
+
+// byteReader reads at most one byte per call from r.
+type byteReader struct {
+	r io.Reader
+}
+
+func (b byteReader) Read(p []byte) (int, error) {
+	if len(p) > 1 {
+		p = p[:1]
+	}
+	return b.r.Read(p)
+}
+
+// readerFunc adapts a function to an io.Reader.
+type readerFunc func(p []byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) {
+	return f(p)
+}
+
+func TestReader_PostCharge(t *testing.T) {
+	totals := make(map[bool]int)
+	for _, post := range []bool{false, true} {
+		clock := newFakeClock()
+		opts := RateOpts{Interval: 100 * time.Millisecond, Size: 100, PostCharge: post, Coarse: true}
+		g := NewGroup(opts)
+		g.SetClock(clock)
+
+		// A trickling source takes 10ms to deliver each byte. Meanwhile,
+		// another reader of the group reads what it can.
+		fast := g.NewReader(zeroReader{})
+		slow := g.NewReader(readerFunc(func(p []byte) (int, error) {
+			clock.Advance(10 * time.Millisecond)
+			n, _ := fast.TryRead(make([]byte, 10))
+			totals[post] += n + 1
+			return 1, nil
+		}))
+
+		// Read with a large buffer for ten intervals.
+		start := clock.Now()
+		for clock.Now().Sub(start) < 10*opts.Interval {
+			if _, err := slow.Read(make([]byte, 100)); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+		}
+
+		// The rate is never exceeded.
+		intervals := int(clock.Now().Sub(start)/opts.Interval) + 1
+		if max := intervals * opts.Size; totals[post] > max {
+			t.Fatalf("expect at most %d, got: %d", max, totals[post])
+		}
+	}
+
+	// Charging up-front holds quota the trickling source does not use,
+	// while charging after the read leaves it to the other reader.
+	if totals[false] >= 1000 {
+		t.Fatalf("expect under 1000 up-front, got: %d", totals[false])
+	}
+	if totals[true] < 1000 {
+		t.Fatalf("expect at least 1000 after, got: %d", totals[true])
+	}
+}
+
 func TestReaderSetRate(t *testing.T) {
 	// Create a new reader with unlimited rate.
 	r := NewReader(new(bytes.Buffer), Unlimited)
 
 	// Set the rate to something and check it.
-	expect := RateOpts{time.Second, 1}
+	expect := RateOpts{Interval: time.Second, Size: 1}
 	r.SetRate(expect)
 	if v := r.bucket.opts; v != expect {
 		t.Fatalf("expect %v\nactual: %v", expect, v)
 	}
 }
 
+func TestReaderSetShortReads(t *testing.T) {
+	// A message smaller than the buffer is returned as soon as it has
+	// arrived, without waiting for more.
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	go pw.Write(make([]byte, 200))
+
+	r := NewReader(pr, RateOpts{Interval: time.Second, Size: 1 << 20})
+	r.SetShortReads(true)
+	done := make(chan int)
+	go func() {
+		n, _ := r.Read(make([]byte, 32<<10))
+		done <- n
+	}()
+	select {
+	case n := <-done:
+		if n != 200 {
+			t.Fatalf("expect 200, got: %d", n)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("read should return the bytes available")
+	}
+
+	// Reads are still bounded by the rate.
+	r = NewReader(zeroReader{}, RateOpts{Interval: time.Second, Size: 10})
+	r.SetShortReads(true)
+	if n, err := r.Read(make([]byte, 100)); n != 10 || err != nil {
+		t.Fatalf("expect 10/nil, got: %d/%v", n, err)
+	}
+
+	// Short reads behave like any other reader.
+	data := make([]byte, 1000)
+	rand.Read(data)
+	r = NewReader(bytes.NewReader(data), RateOpts{Interval: time.Millisecond, Size: 256})
+	r.SetShortReads(true)
+	if err := iotest.TestReader(r, data); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestReaderSetChunkSize(t *testing.T) {
+	clock := newFakeClock()
+	var sizes []int
+	src := readerFunc(func(p []byte) (int, error) {
+		sizes = append(sizes, len(p))
+		return len(p), nil
+	})
+	r := NewReader(src, RateOpts{Interval: 100 * time.Millisecond, Size: 1000})
+	r.SetClock(clock)
+	r.SetChunkSize(300)
+
+	// The quota of the bucket is read in chunks, without waiting.
+	if n, err := r.Read(make([]byte, 1000)); n != 1000 || err != nil {
+		t.Fatalf("bad: %d, %v", n, err)
+	}
+	if !reflect.DeepEqual(sizes, []int{300, 300, 300, 100}) {
+		t.Fatalf("bad read sizes: %v", sizes)
+	}
+	if clock.Now() != newFakeClock().Now() {
+		t.Fatal("should not wait")
+	}
+	r.Reset()
+	if n, err := r.TryRead(make([]byte, 1000)); n != 300 || err != nil {
+		t.Fatalf("bad: %d, %v", n, err)
+	}
+}
+
+func TestReaderSetChunkSize_SetRate(t *testing.T) {
+	// A huge read would take 10s at the rate.
+	r := NewReader(zeroReader{}, RateOpts{Interval: 50 * time.Millisecond, Size: 1000})
+	r.SetChunkSize(100)
+	doneCh := make(chan error, 1)
+	go func() {
+		_, err := r.Read(make([]byte, 200000))
+		doneCh <- err
+	}()
+	time.Sleep(75 * time.Millisecond)
+
+	// Lifting the rate mid-read applies to the rest of it.
+	r.SetRate(Unlimited)
+	select {
+	case err := <-doneCh:
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("read still blocked")
+	}
+}
+
 func TestWriter(t *testing.T) {
 	// Create some random data to write.
 	data := make([]byte, 512)
@@ -63,17 +246,19 @@ func TestWriter(t *testing.T) {
 		t.Fatalf("err: %v", err)
 	}
 
-	// Create the writer with an applied rate limit.
+	// Create the writer with an applied rate limit, on virtual time.
+	clock := newFakeClock()
 	buf := new(bytes.Buffer)
 	w := NewWriter(buf, RateOpts{Interval: 100 * time.Millisecond, Size: 128})
+	w.SetClock(clock)
 
 	// Record the start time and perform the write.
-	start := time.Now()
+	start := clock.Now()
 	n, err := w.Write(data)
 
 	// Check that we rate limited the write.
-	if d := time.Since(start); d < 300*time.Millisecond {
-		t.Fatalf("write returned too quickly in %s", d)
+	if d := clock.Now().Sub(start); d != 300*time.Millisecond {
+		t.Fatalf("expect 300ms, took %s", d)
 	}
 
 	// Check errors and data values.
@@ -88,18 +273,139 @@ func TestWriter(t *testing.T) {
 	}
 }
 
+func TestWriterWriteString(t *testing.T) {
+	data := strings.Repeat("x", 384)
+	opts := RateOpts{Interval: 100 * time.Millisecond, Size: 128, Coarse: true}
+
+	// Strings are written to a string writer directly, and converted for
+	// any other writer, paced the same either way.
+	var sb strings.Builder
+	buf := new(bytes.Buffer)
+	for _, dst := range []io.Writer{&sb, struct{ io.Writer }{buf}} {
+		clock := newFakeClock()
+		w := NewWriter(dst, opts)
+		w.SetClock(clock)
+		start := clock.Now()
+		if n, err := w.WriteString(data); n != len(data) || err != nil {
+			t.Fatalf("expect %d/nil, got: %d/%v", len(data), n, err)
+		}
+		if d := clock.Now().Sub(start); d != 200*time.Millisecond {
+			t.Fatalf("expect 200ms, took %s", d)
+		}
+	}
+	if sb.String() != data || buf.String() != data {
+		t.Fatalf("unexpected data written")
+	}
+}
+
+func TestUnwrap(t *testing.T) {
+	// Walking the writers of nested groups leads back to the original
+	// destination.
+	buf := new(bytes.Buffer)
+	parent := NewGroup(Unlimited)
+	sub := parent.NewSubGroup(Unlimited)
+	var w io.Writer = sub.NewWriter(buf)
+	for {
+		u, ok := w.(interface{ Unwrap() io.Writer })
+		if !ok {
+			break
+		}
+		w = u.Unwrap()
+	}
+	if w != buf {
+		t.Fatalf("expect the original writer, got: %#v", w)
+	}
+
+	// The closer and seeker variants unwrap as well.
+	src := bytes.NewReader(nil)
+	if r := NewReader(src, Unlimited).Unwrap(); r != src {
+		t.Fatalf("expect the original reader, got: %#v", r)
+	}
+	rs := NewReadSeeker(src, Unlimited).(interface{ Unwrap() io.Reader })
+	if r := rs.Unwrap(); r != src {
+		t.Fatalf("expect the original reader, got: %#v", r)
+	}
+	rc := ioutil.NopCloser(src)
+	if r := NewReadCloser(rc, Unlimited).(interface{ Unwrap() io.Reader }).Unwrap(); r != rc {
+		t.Fatalf("expect the original reader, got: %#v", r)
+	}
+}
+
 func TestWriterSetRate(t *testing.T) {
 	// Create a new writer with unlimited rate.
 	w := NewWriter(new(bytes.Buffer), Unlimited)
 
 	// Set the rate to something and check it.
-	expect := RateOpts{time.Second, 1}
+	expect := RateOpts{Interval: time.Second, Size: 1}
 	w.SetRate(expect)
 	if v := w.bucket.opts; v != expect {
 		t.Fatalf("expect %v\nactual: %v", expect, v)
 	}
 }
 
+func TestWriterSetRate_Shrink(t *testing.T) {
+	clock := newFakeClock()
+	buf := new(bytes.Buffer)
+	w := NewWriter(buf, RateOpts{Interval: 100 * time.Millisecond, Size: 1000, Coarse: true})
+	w.SetClock(clock)
+
+	// Fill the bucket, then shrink it.
+	if _, err := w.Write(make([]byte, 1000)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	w.SetRate(RateOpts{Interval: 100 * time.Millisecond, Size: 100, Coarse: true})
+	if n := w.bucket.tokens; n != 100 {
+		t.Fatalf("expect 100 tokens, got: %d", n)
+	}
+
+	// Writes continue at the new rate.
+	start := clock.Now()
+	n, err := w.Write(make([]byte, 250))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if n != 250 || buf.Len() != 1250 {
+		t.Fatalf("expect 250 of 1250, got: %d of %d", n, buf.Len())
+	}
+	if d := clock.Now().Sub(start); d != 300*time.Millisecond {
+		t.Fatalf("expect 300ms, took %s", d)
+	}
+}
+
+func TestWriterSetRate_Wakeup(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	writers := map[string]*Writer{
+		"plain":   NewWriter(new(bytes.Buffer), RateOpts{Interval: time.Second, Size: 1}),
+		"context": NewWriterContext(ctx, new(bytes.Buffer), RateOpts{Interval: time.Second, Size: 1}),
+	}
+	for name, w := range writers {
+		// Block a write on a rate of 1B/s.
+		doneCh := make(chan error, 1)
+		go func() {
+			_, err := w.Write(make([]byte, 10))
+			doneCh <- err
+		}()
+		time.Sleep(50 * time.Millisecond)
+
+		// Lifting the rate completes the write right away.
+		start := time.Now()
+		w.SetRate(Unlimited)
+		select {
+		case err := <-doneCh:
+			if err != nil {
+				t.Fatalf("%s: err: %v", name, err)
+			}
+		case <-time.After(500 * time.Millisecond):
+			t.Fatalf("%s: write still blocked", name)
+		}
+		if d := time.Since(start); d > 20*time.Millisecond {
+			t.Fatalf("%s: write took %s to complete", name, d)
+		}
+	}
+}
+
 func TestGroup(t *testing.T) {
 	// Create the rate limiting group.
 	g := NewGroup(RateOpts{Interval: 100 * time.Millisecond, Size: 8})
@@ -131,7 +437,7 @@ func TestGroup(t *testing.T) {
 		defer wg.Done()
 
 		if _, err := w.Write(in); err != nil {
-			t.Fatalf("err: %v", err)
+			t.Errorf("err: %v", err)
 		}
 	}()
 
@@ -139,7 +445,7 @@ func TestGroup(t *testing.T) {
 		defer wg.Done()
 
 		if _, err := r.Read(out); err != nil {
-			t.Fatalf("err: %v", err)
+			t.Errorf("err: %v", err)
 		}
 	}()
 
@@ -155,18 +461,475 @@ func TestGroup(t *testing.T) {
 	}
 }
 
+func TestGroup_Interleave(t *testing.T) {
+	g := NewGroup(RateOpts{Interval: 100 * time.Millisecond, Size: 8, Coarse: true})
+
+	// Record which writer each chunk written came from.
+	var l sync.Mutex
+	var order []string
+	record := func(name string) io.Writer {
+		return writerFunc(func(p []byte) (int, error) {
+			l.Lock()
+			order = append(order, name)
+			l.Unlock()
+			return len(p), nil
+		})
+	}
+
+	var wg sync.WaitGroup
+	for _, name := range []string{"a", "b"} {
+		w := g.NewWriter(record(name))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := w.Write(make([]byte, 24)); err != nil {
+				t.Errorf("err: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// The writers take turns, rather than one finishing before the
+	// other makes progress.
+	run := 1
+	for i := 1; i < len(order); i++ {
+		if order[i] != order[i-1] {
+			run = 1
+		} else if run++; run > 2 {
+			t.Fatalf("writers did not interleave: %v", order)
+		}
+	}
+}
+
+func TestGroup_ConcurrentRate(t *testing.T) {
+	clock := newFakeClock()
+	opts := RateOpts{Interval: 100 * time.Millisecond, Size: 100, Coarse: true}
+	g := NewGroup(opts)
+	g.SetClock(clock)
+
+	// Count the bytes written within the first ten intervals.
+	start := clock.Now()
+	end := start.Add(10 * opts.Interval)
+	var total int64
+	dst := writerFunc(func(p []byte) (int, error) {
+		if clock.Now().Before(end) {
+			atomic.AddInt64(&total, int64(len(p)))
+		}
+		return len(p), nil
+	})
+
+	// Two writers race on the group until the intervals are over.
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := g.NewWriter(dst)
+			for clock.Now().Before(end) {
+				if _, err := w.Write(make([]byte, 7)); err != nil {
+					t.Errorf("err: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// No interval is spent twice. The initial burst and nine drains allow
+	// ten intervals' worth, within the 10xSize plus burst upper bound.
+	if max := int64(10 * opts.Size); total > max {
+		t.Fatalf("expect at most %d, got: %d", max, total)
+	}
+}
+
+// writerFunc adapts a function to an io.Writer.
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
+
+func TestMulti(t *testing.T) {
+	// 10B per 10ms, but at most 50B per 200ms.
+	opts := []RateOpts{
+		{Interval: 10 * time.Millisecond, Size: 10},
+		{Interval: 200 * time.Millisecond, Size: 50},
+	}
+
+	// The first rate alone would let 100B through in about 90ms, but the
+	// second holds the rest back until its interval is over.
+	check := func(name string, fn func() (int, error)) {
+		start := time.Now()
+		n, err := fn()
+		if err != nil {
+			t.Fatalf("%s: err: %v", name, err)
+		}
+		if n != 100 {
+			t.Fatalf("%s: expect 100, got: %d", name, n)
+		}
+		if d := time.Since(start); d < 200*time.Millisecond || d > time.Second {
+			t.Fatalf("%s: expect 200ms-1s, took %s", name, d)
+		}
+	}
+	check("reader", func() (int, error) {
+		return io.ReadFull(NewReaderMulti(zeroReader{}, opts...), make([]byte, 100))
+	})
+	check("writer", func() (int, error) {
+		return NewWriterMulti(ioutil.Discard, opts...).Write(make([]byte, 100))
+	})
+	check("group", func() (int, error) {
+		return NewGroupMulti(opts...).NewWriter(ioutil.Discard).Write(make([]byte, 100))
+	})
+
+	// Without rates, there is no limit.
+	if r := NewReaderMulti(zeroReader{}).Rate(); r != Unlimited {
+		t.Fatalf("expect unlimited, got: %v", r)
+	}
+}
+
+func TestMulti_Window(t *testing.T) {
+	clock := newFakeClock()
+	perSecond := RateOpts{Interval: time.Second, Size: 100, Coarse: true}
+	perMinute := RateOpts{Interval: time.Minute, Size: 1000, Coarse: true}
+	w := NewWriterMulti(ioutil.Discard, perSecond, perMinute)
+	w.SetClock(clock)
+
+	// Writes within the per-second rate go through at that rate until the
+	// per-minute quota is used up.
+	start := clock.Now()
+	for i := 0; i < 10; i++ {
+		if _, err := w.Write(make([]byte, 100)); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	if d := clock.Now().Sub(start); d != 9*time.Second {
+		t.Fatalf("expect 9s, took %s", d)
+	}
+
+	// Then the per-minute cap kicks in.
+	if _, err := w.Write(make([]byte, 100)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d := clock.Now().Sub(start); d != time.Minute {
+		t.Fatalf("expect 1m, took %s", d)
+	}
+
+	// SetRate and Rate only concern the first rate, so lifting it leaves
+	// the per-minute cap in place.
+	w.SetRate(Unlimited)
+	if r := w.Rate(); r != Unlimited {
+		t.Fatalf("expect unlimited, got: %v", r)
+	}
+	start = clock.Now()
+	if _, err := w.Write(make([]byte, 1000)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d := clock.Now().Sub(start); d != time.Minute {
+		t.Fatalf("expect 1m, took %s", d)
+	}
+}
+
+func TestMulti_NoHold(t *testing.T) {
+	g := NewGroupMulti(
+		RateOpts{Interval: 20 * time.Millisecond, Size: 100},
+		RateOpts{Interval: time.Hour, Size: 100})
+	w := g.NewWriter(ioutil.Discard)
+	w.Write(make([]byte, 100))
+
+	// Block a write on the second rate.
+	go w.Write(make([]byte, 100))
+	time.Sleep(100 * time.Millisecond)
+
+	// The blocked write holds none of the quota of the first rate.
+	if n := g.bucket.availableOwn(); n != 100 {
+		t.Fatalf("expect 100 available, got: %d", n)
+	}
+	if n := g.Available(); n != 0 {
+		t.Fatalf("expect 0 available, got: %d", n)
+	}
+	w.Cancel()
+}
+
 func TestGroupSetRate(t *testing.T) {
 	// Create a new group with unlimited rate.
 	g := NewGroup(Unlimited)
 
 	// Set the rate to something and check it.
-	expect := RateOpts{1, 1}
+	expect := RateOpts{Interval: 1, Size: 1}
 	g.SetRate(expect)
 	if v := g.bucket.opts; v != expect {
 		t.Fatalf("expect: %v\nactual: %v", expect, v)
 	}
 }
 
+func TestGroupRate(t *testing.T) {
+	expect := RateOpts{Interval: time.Second, Size: 128}
+	g := NewGroup(expect)
+	if v := g.Rate(); v != expect {
+		t.Fatalf("expect: %v\nactual: %v", expect, v)
+	}
+
+	// Reflects changes made by SetRate.
+	expect = RateOpts{Interval: time.Second, Size: 256}
+	g.SetRate(expect)
+	if v := g.Rate(); v != expect {
+		t.Fatalf("expect: %v\nactual: %v", expect, v)
+	}
+}
+
+func TestGroupAvailable(t *testing.T) {
+	clock := newFakeClock()
+	parent := NewGroup(RateOpts{Interval: time.Second, Size: 100})
+	parent.SetClock(clock)
+	g := parent.NewSubGroup(RateOpts{Interval: time.Second, Size: 60})
+	g.SetClock(clock)
+
+	if n := g.Capacity(); n != 60 {
+		t.Fatalf("expect 60, got: %d", n)
+	}
+	if n := g.Available(); n != 60 {
+		t.Fatalf("expect 60, got: %d", n)
+	}
+
+	// Use by other members of the parent limits the sub-group.
+	parent.NewWriter(ioutil.Discard).Write(make([]byte, 70))
+	if n := g.Available(); n != 30 {
+		t.Fatalf("expect 30, got: %d", n)
+	}
+	w := g.NewWriter(ioutil.Discard)
+	w.Write(make([]byte, 20))
+	if n := g.Available(); n != 10 {
+		t.Fatalf("expect 10, got: %d", n)
+	}
+	if n := w.Available(); n != 40 {
+		t.Fatalf("expect 40, got: %d", n)
+	}
+
+	// The quota is available again once drained.
+	clock.Advance(time.Second)
+	if n := g.Available(); n != 60 {
+		t.Fatalf("expect 60, got: %d", n)
+	}
+
+	// Unlimited groups always have room.
+	if n := NewGroup(Unlimited).Available(); n != maxInt {
+		t.Fatalf("expect %d, got: %d", maxInt, n)
+	}
+}
+
+func TestGroupReset(t *testing.T) {
+	clock := newFakeClock()
+	g := NewGroup(RateOpts{Interval: time.Second, Size: 100})
+	g.SetClock(clock)
+	w := g.NewWriter(ioutil.Discard)
+
+	// A full group allows a full insert right after a reset.
+	w.Write(make([]byte, 100))
+	g.Reset()
+	start := clock.Now()
+	if _, err := w.Write(make([]byte, 100)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d := clock.Now().Sub(start); d != 0 {
+		t.Fatalf("expect no wait, took %s", d)
+	}
+}
+
+func TestWriterReset_Wakeup(t *testing.T) {
+	w := NewWriter(ioutil.Discard, RateOpts{Interval: time.Hour, Size: 100})
+	w.Write(make([]byte, 100))
+
+	// A write blocked on the full bucket completes once it is reset.
+	doneCh := make(chan error, 1)
+	go func() {
+		_, err := w.Write(make([]byte, 100))
+		doneCh <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	w.Reset()
+
+	select {
+	case err := <-doneCh:
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("write still blocked")
+	}
+}
+
+func TestGroupSnapshot(t *testing.T) {
+	clock := newFakeClock()
+	rate := RateOpts{Interval: 100 * time.Millisecond, Size: 8}
+	g := NewGroup(rate)
+	g.SetClock(clock)
+
+	// Exhaust the group's quota and take a snapshot.
+	g.NewWriter(new(bytes.Buffer)).Write(make([]byte, 8))
+	snap := g.Snapshot()
+	if snap.Tokens != 8 {
+		t.Fatalf("expect 8, got: %d", snap.Tokens)
+	}
+
+	// A new group restored from the snapshot inherits the consumed quota,
+	// so the next write must wait for the interval to pass.
+	g2 := NewGroup(rate)
+	g2.SetClock(clock)
+	g2.Restore(snap)
+
+	start := clock.Now()
+	g2.NewWriter(new(bytes.Buffer)).Write(make([]byte, 8))
+	if d := clock.Now().Sub(start); d != 100*time.Millisecond {
+		t.Fatalf("expect 100ms, took %s", d)
+	}
+}
+
+func TestGroupSubGroup(t *testing.T) {
+	parent := NewGroup(RateOpts{Interval: 100 * time.Millisecond, Size: 8, Coarse: true})
+
+	// Two sub-groups with generous rates of their own are still bound by
+	// the quota of the parent.
+	sub1 := parent.NewSubGroup(RateOpts{Interval: 100 * time.Millisecond, Size: 1024, Coarse: true})
+	sub2 := parent.NewSubGroup(RateOpts{Interval: 100 * time.Millisecond, Size: 1024, Coarse: true})
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	wg.Add(2)
+	for _, g := range []*Group{sub1, sub2} {
+		go func(g *Group) {
+			defer wg.Done()
+			g.NewWriter(new(bytes.Buffer)).Write(make([]byte, 12))
+		}(g)
+	}
+	wg.Wait()
+	if d := time.Since(start); d < 200*time.Millisecond {
+		t.Fatalf("finished too quickly in %s", d)
+	}
+
+	// A sub-group's own rate applies even when the parent has quota left.
+	parent.SetRate(Unlimited)
+	sub := parent.NewSubGroup(RateOpts{Interval: 100 * time.Millisecond, Size: 8, Coarse: true})
+	buf := new(bytes.Buffer)
+	r := sub.NewReader(bytes.NewBufferString("hello world!"))
+	start = time.Now()
+	out := make([]byte, 12)
+	if _, err := r.Read(out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d := time.Since(start); d < 100*time.Millisecond {
+		t.Fatalf("read returned too quickly in %s", d)
+	}
+	buf.Write(out)
+	if v := buf.String(); v != "hello world!" {
+		t.Fatalf("bad: %q", v)
+	}
+}
+
+func TestRateOptsIsUnlimited(t *testing.T) {
+	cases := []struct {
+		ro        RateOpts
+		unlimited bool
+		zero      bool
+	}{
+		{Unlimited, true, true},
+		{RateOpts{Interval: time.Second}, true, false},
+		{RateOpts{Size: 100}, true, false},
+		{RateOpts{Interval: -time.Second, Size: 100}, true, false},
+		{RateOpts{Interval: time.Second, Size: -1}, true, false},
+		{RateOpts{Coarse: true, Burst: 10}, true, false},
+		{RateOpts{Interval: time.Second, Size: 1}, false, false},
+		{Kbps(1), false, false},
+	}
+	for _, c := range cases {
+		if v := c.ro.IsUnlimited(); v != c.unlimited {
+			t.Fatalf("%#v: expect unlimited %v, got: %v", c.ro, c.unlimited, v)
+		}
+		if v := c.ro.IsZero(); v != c.zero {
+			t.Fatalf("%#v: expect zero %v, got: %v", c.ro, c.zero, v)
+		}
+	}
+
+	// Rates equivalent to Unlimited do not hold back transfers.
+	clock := newFakeClock()
+	for _, ro := range []RateOpts{
+		{Interval: time.Second},
+		{Size: 10},
+		{Interval: time.Second, Size: -1, Coarse: true},
+	} {
+		w := NewWriter(ioutil.Discard, ro)
+		w.SetClock(clock)
+		start := clock.Now()
+		if _, err := w.Write(make([]byte, 1<<20)); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if d := clock.Now().Sub(start); d != 0 {
+			t.Fatalf("%#v: expect no wait, took %s", ro, d)
+		}
+		if n := w.Available(); n != maxInt {
+			t.Fatalf("%#v: expect %d, got: %d", ro, maxInt, n)
+		}
+	}
+}
+
+func TestPerDuration(t *testing.T) {
+	cases := []struct {
+		n      int
+		d      time.Duration
+		expect RateOpts
+	}{
+		{10 * MB, 250 * time.Millisecond, RateOpts{Interval: 250 * time.Millisecond, Size: 10 << 20}},
+		{GB, 6 * time.Hour, RateOpts{Interval: 6 * time.Hour, Size: 1 << 30}},
+		{128 * Kb, time.Second, Kbps(128)},
+		{5 * MB, time.Second, MBps(5)},
+		{1200, time.Second, BitsPerSecond(9600)},
+	}
+	for _, c := range cases {
+		ro, err := PerDuration(c.n, c.d)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if ro != c.expect {
+			t.Fatalf("expect %#v, got: %#v", c.expect, ro)
+		}
+	}
+
+	// Rates which would not limit anything are rejected.
+	for _, c := range []struct {
+		n int
+		d time.Duration
+	}{{0, time.Second}, {-1, time.Second}, {1, 0}, {1, -time.Second}} {
+		ro, err := PerDuration(c.n, c.d)
+		if err == nil {
+			t.Fatalf("%d per %s: expect error", c.n, c.d)
+		}
+		if ro != Unlimited {
+			t.Fatalf("%d per %s: expect unlimited, got: %#v", c.n, c.d, ro)
+		}
+	}
+
+	// So are helpers for rates of no bytes.
+	for _, ro := range []RateOpts{Kbps(0), MBps(0), GBps(-1)} {
+		if ro != Unlimited {
+			t.Fatalf("expect unlimited, got: %#v", ro)
+		}
+	}
+
+	// Rates of less than a byte per second are not rounded down to no
+	// limit, but allow a byte over a longer interval.
+	for _, c := range []struct {
+		ro     RateOpts
+		expect time.Duration
+	}{
+		{Kbps(0.001), 7812500 * time.Microsecond},
+		{KBps(0.0001), 9765625 * time.Microsecond},
+		{Gbps(0.0001 / Gb), 10000 * time.Second},
+	} {
+		if c.ro.Size != 1 || c.ro.Interval < c.expect*99/100 || c.ro.Interval > c.expect*101/100 {
+			t.Fatalf("expect 1 byte per %s, got: %#v", c.expect, c.ro)
+		}
+	}
+}
+
 func TestKbps(t *testing.T) {
 	ro := Kbps(128)
 	if ro.Interval != time.Second {
@@ -197,6 +960,180 @@ func TestGbps(t *testing.T) {
 	}
 }
 
+func TestKBps(t *testing.T) {
+	ro := KBps(128)
+	if ro.Interval != time.Second {
+		t.Fatalf("expect 1s, got: %s", ro.Interval)
+	}
+	if expect := 128 * 1024; expect != ro.Size {
+		t.Fatalf("expect %d, got: %d", expect, ro.Size)
+	}
+
+	// Bytes are eight times as large as bits.
+	if v := Kbps(1024); v != KBps(128) {
+		t.Fatalf("expect %v, got: %v", KBps(128), v)
+	}
+}
+
+func TestBitsPerSecond(t *testing.T) {
+	cases := map[float64]RateOpts{
+		9600:  {Interval: time.Second, Size: 1200},
+		56000: {Interval: time.Second, Size: 7000},
+		300:   {Interval: 2 * time.Second, Size: 75},
+		110:   {Interval: 4 * time.Second, Size: 55},
+		1:     {Interval: 8 * time.Second, Size: 1},
+		1024:  Kbps(1),
+		12.5:  {Interval: time.Second, Size: 2},
+		2.5:   {Interval: 3200 * time.Millisecond, Size: 1},
+	}
+	for n, expect := range cases {
+		if ro := BitsPerSecond(n); ro != expect {
+			t.Fatalf("%v: expect %#v, got: %#v", n, expect, ro)
+		}
+	}
+
+	// No bits means no limit, as with the other helpers.
+	if ro := BitsPerSecond(0); ro != Unlimited {
+		t.Fatalf("expect unlimited, got: %#v", ro)
+	}
+}
+
+func TestMBps(t *testing.T) {
+	ro := MBps(5)
+	if ro.Interval != time.Second {
+		t.Fatalf("expect 1s, got: %s", ro.Interval)
+	}
+	if expect := 5 * 1024 * 1024; expect != ro.Size {
+		t.Fatalf("expect %d, got: %d", expect, ro.Size)
+	}
+}
+
+func TestGBps(t *testing.T) {
+	ro := GBps(1.5)
+	if ro.Interval != time.Second {
+		t.Fatalf("expect 1s, got: %s", ro.Interval)
+	}
+	if expect := 3 << 29; expect != ro.Size {
+		t.Fatalf("expect %d, got: %d", expect, ro.Size)
+	}
+}
+
+func TestGbps_Clamp(t *testing.T) {
+	if ro := Gbps(1e12); ro.Size != maxInt {
+		t.Fatalf("expect %d, got: %d", maxInt, ro.Size)
+	}
+}
+
+func TestHighRate(t *testing.T) {
+	// 10Gbps, drained every 100ms.
+	rate := Gbps(10)
+	rate.Interval /= 10
+	rate.Size /= 10
+	rate.Coarse = true
+
+	// 3GiB take 23 drains of 128MiB beyond the initial bucket.
+	const size = 3 << 30
+	expect := 2300 * time.Millisecond
+
+	clock := newFakeClock()
+	w := NewWriter(ioutil.Discard, rate)
+	w.SetClock(clock)
+	start := clock.Now()
+	buf := make([]byte, 1<<20)
+	n, err := io.CopyBuffer(w, io.LimitReader(nopReader{}, size), buf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if n != size {
+		t.Fatalf("expect %d, got: %d", int64(size), n)
+	}
+	if d := clock.Now().Sub(start); d != expect {
+		t.Fatalf("expect %s, took %s", expect, d)
+	}
+
+	r := NewReader(nopReader{}, rate)
+	r.SetClock(clock)
+	start = clock.Now()
+	dst := struct{ io.Writer }{ioutil.Discard}
+	if n, err = io.CopyBuffer(dst, io.LimitReader(r, size), buf); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if n != size {
+		t.Fatalf("expect %d, got: %d", int64(size), n)
+	}
+	if d := clock.Now().Sub(start); d != expect {
+		t.Fatalf("expect %s, took %s", expect, d)
+	}
+}
+
+// lateClock is a fake clock which oversleeps by a fixed delay, like a busy
+// machine getting around to waking up late.
+type lateClock struct {
+	*fakeClock
+	late time.Duration
+}
+
+func (c lateClock) Sleep(d time.Duration, done <-chan struct{}) bool {
+	return c.fakeClock.Sleep(d+c.late, done)
+}
+
+func TestWriter_Drift(t *testing.T) {
+	clock := lateClock{newFakeClock(), 5 * time.Millisecond}
+	opts := RateOpts{Interval: 100 * time.Millisecond, Size: 1000}
+	w := NewWriter(ioutil.Discard, opts)
+	w.SetClock(clock)
+
+	// Use up the initial burst, then copy for 50 intervals.
+	if _, err := w.Write(make([]byte, opts.Size)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	start := clock.Now()
+	total := 0
+	for clock.Now().Sub(start) < 50*opts.Interval {
+		n, err := w.Write(make([]byte, opts.Size))
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		total += n
+	}
+
+	// Waking up late does not slow down the rate.
+	elapsed := clock.Now().Sub(start)
+	expect := float64(opts.Size) * float64(elapsed) / float64(opts.Interval)
+	if d := math.Abs(float64(total)-expect) / expect; d > 0.01 {
+		t.Fatalf("expect %.0f bytes in %s, got: %d", expect, elapsed, total)
+	}
+}
+
+func TestWriter_DriftLarge(t *testing.T) {
+	for _, coarse := range []bool{true, false} {
+		clock := lateClock{newFakeClock(), 5 * time.Millisecond}
+		opts := RateOpts{Interval: 100 * time.Millisecond, Size: 1000, Coarse: coarse}
+		w := NewWriter(ioutil.Discard, opts)
+		w.SetClock(clock)
+
+		// A single write of 50 intervals follows a schedule. The first
+		// interval goes out right away, and waking up late for each of the
+		// others must not push back the ones after it.
+		start := clock.Now()
+		if _, err := w.Write(make([]byte, 50*opts.Size)); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		expect := 49 * opts.Interval
+		if d := clock.Now().Sub(start); d < expect || d > expect+clock.late {
+			t.Fatalf("coarse %v: expect %s, took %s", coarse, expect, d)
+		}
+	}
+}
+
+// nopReader is an endless source of bytes which leaves the buffer as is,
+// avoiding the cost of filling it in throughput tests.
+type nopReader struct{}
+
+func (nopReader) Read(p []byte) (int, error) {
+	return len(p), nil
+}
+
 func ExampleReader() {
 	// Create a buffer to read from.
 	buf := bytes.NewBufferString("hello world!")
@@ -262,3 +1199,359 @@ func ExampleGroup() {
 	fmt.Println(string(out))
 	// Output: hello world!
 }
+
+func TestGroupWait(t *testing.T) {
+	clock := newFakeClock()
+	g := NewGroup(RateOpts{Interval: 100 * time.Millisecond, Size: 100, Coarse: true})
+	g.bucket.clock = clock
+
+	// Returns immediately while there is quota left.
+	start := clock.Now()
+	g.Wait()
+	g.NewWriter(new(bytes.Buffer)).Write(make([]byte, 100))
+	if d := clock.Now().Sub(start); d != 0 {
+		t.Fatalf("should not wait, took %s", d)
+	}
+
+	// Blocks until the next interval once the quota is used up, without
+	// consuming any of it.
+	g.Wait()
+	if d := clock.Now().Sub(start); d != 100*time.Millisecond {
+		t.Fatalf("expect 100ms, took %s", d)
+	}
+	if s := g.Snapshot(); s.Tokens != 0 {
+		t.Fatalf("expect no tokens consumed, got: %d", s.Tokens)
+	}
+}
+
+func TestGroup_FailedWrite(t *testing.T) {
+	clock := newFakeClock()
+	g := NewGroup(RateOpts{Interval: 100 * time.Millisecond, Size: 100})
+	g.SetClock(clock)
+
+	// A writer failing to write anything takes no quota from the group.
+	failed := g.NewWriter(failingWriter{})
+	if _, err := failed.Write(make([]byte, 100)); err != errFailed {
+		t.Fatalf("expect %v, got: %v", errFailed, err)
+	}
+
+	// The full quota remains for a sibling.
+	start := clock.Now()
+	if _, err := g.NewWriter(new(bytes.Buffer)).Write(make([]byte, 100)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d := clock.Now().Sub(start); d != 0 {
+		t.Fatalf("expect no wait, took %s", d)
+	}
+}
+
+var errFailed = errors.New("failed")
+
+// failingWriter fails every write.
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errFailed
+}
+
+func TestTryWrite(t *testing.T) {
+	clock := newFakeClock()
+	buf := new(bytes.Buffer)
+	w := NewWriter(buf, RateOpts{Interval: 100 * time.Millisecond, Size: 128})
+	w.SetClock(clock)
+
+	// Writes as much as fits, then fails right away.
+	start := clock.Now()
+	n, err := w.TryWrite(make([]byte, 200))
+	if !errors.Is(err, ErrWouldBlock) {
+		t.Fatalf("expect %v, got: %v", ErrWouldBlock, err)
+	}
+	if n != 128 || buf.Len() != 128 {
+		t.Fatalf("expect 128, got: %d (%d written)", n, buf.Len())
+	}
+	if _, err := w.TryWrite([]byte{0}); err != ErrWouldBlock {
+		t.Fatalf("expect %v, got: %v", ErrWouldBlock, err)
+	}
+	if d := clock.Now().Sub(start); d != 0 {
+		t.Fatalf("expect no wait, took %s", d)
+	}
+
+	// Succeeds again once the bucket drains.
+	clock.Advance(100 * time.Millisecond)
+	if n, err := w.TryWrite(make([]byte, 72)); err != nil || n != 72 {
+		t.Fatalf("bad: %d, %v", n, err)
+	}
+}
+
+func TestTryWrite_Queued(t *testing.T) {
+	w := NewWriter(ioutil.Discard, RateOpts{Interval: 100 * time.Millisecond, Size: 100})
+	w.Write(make([]byte, 100))
+
+	// Block a write on the full bucket.
+	start := time.Now()
+	doneCh := make(chan time.Duration, 1)
+	go func() {
+		w.Write(make([]byte, 100))
+		doneCh <- time.Since(start)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	// Polling with TryWrite must not take the next interval ahead of it.
+	var polled int
+	for {
+		select {
+		case d := <-doneCh:
+			if polled != 0 {
+				t.Fatalf("expect nothing written by TryWrite, got: %d", polled)
+			}
+			if d > 170*time.Millisecond {
+				t.Fatalf("expect about 100ms, took %s", d)
+			}
+			return
+		default:
+		}
+		n, _ := w.TryWrite(make([]byte, 100))
+		polled += n
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestTryRead(t *testing.T) {
+	clock := newFakeClock()
+	r := NewReader(zeroReader{}, RateOpts{Interval: 100 * time.Millisecond, Size: 128})
+	r.SetClock(clock)
+
+	// Reads as much as the quota allows.
+	n, err := r.TryRead(make([]byte, 200))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if n != 128 {
+		t.Fatalf("expect 128, got: %d", n)
+	}
+
+	// Fails right away while the bucket is full.
+	if n, err = r.TryRead(make([]byte, 200)); err != ErrWouldBlock || n != 0 {
+		t.Fatalf("bad: %d, %v", n, err)
+	}
+	if clock.Now() != newFakeClock().Now() {
+		t.Fatal("should not wait")
+	}
+}
+
+func TestEmptyReadWrite(t *testing.T) {
+	clock := newFakeClock()
+	rate := RateOpts{Interval: time.Hour, Size: 1}
+	r := NewReader(readerFunc(func(p []byte) (int, error) {
+		if len(p) == 0 {
+			t.Fatal("empty read should not reach the source")
+		}
+		return len(p), nil
+	}), rate)
+	r.SetClock(clock)
+	w := NewWriter(writerFunc(func(p []byte) (int, error) {
+		if len(p) == 0 {
+			t.Fatal("empty write should not reach the destination")
+		}
+		return len(p), nil
+	}), rate)
+	w.SetClock(clock)
+
+	// Exhaust the quota of both.
+	if _, err := r.Read(make([]byte, 1)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := w.Write([]byte{0}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Empty reads and writes return right away, and are not counted.
+	start := clock.Now()
+	if n, err := r.Read(nil); n != 0 || err != nil {
+		t.Fatalf("bad: %d, %v", n, err)
+	}
+	if n, err := w.Write(nil); n != 0 || err != nil {
+		t.Fatalf("bad: %d, %v", n, err)
+	}
+	if n, err := w.WriteString(""); n != 0 || err != nil {
+		t.Fatalf("bad: %d, %v", n, err)
+	}
+	if n, err := r.TryRead(nil); n != 0 || err != nil {
+		t.Fatalf("bad: %d, %v", n, err)
+	}
+	if n, err := w.TryWrite(nil); n != 0 || err != nil {
+		t.Fatalf("bad: %d, %v", n, err)
+	}
+	if d := clock.Now().Sub(start); d != 0 {
+		t.Fatalf("expect no wait, took %s", d)
+	}
+	if ops := r.Stats().Ops; ops != 1 {
+		t.Fatalf("expect 1 read, got: %d", ops)
+	}
+	if ops := w.Stats().Ops; ops != 1 {
+		t.Fatalf("expect 1 write, got: %d", ops)
+	}
+}
+
+func TestWaitTimeout(t *testing.T) {
+	rate := RateOpts{Interval: time.Second, Size: 1}
+
+	// A write at 1B/s gives up after the timeout, with the byte written.
+	buf := new(bytes.Buffer)
+	w := NewWriter(buf, rate)
+	w.SetWaitTimeout(10 * time.Millisecond)
+	start := time.Now()
+	n, err := w.Write(make([]byte, 10))
+	if err != ErrRateTimeout {
+		t.Fatalf("expect %v, got: %v", ErrRateTimeout, err)
+	}
+	if n != 1 || buf.Len() != 1 {
+		t.Fatalf("expect 1, got: %d (%d written)", n, buf.Len())
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Fatalf("took too long: %s", d)
+	}
+
+	// The same applies to reads.
+	r := NewReader(zeroReader{}, rate)
+	r.SetWaitTimeout(10 * time.Millisecond)
+	start = time.Now()
+	if n, err = r.Read(make([]byte, 10)); err != ErrRateTimeout {
+		t.Fatalf("expect %v, got: %v", ErrRateTimeout, err)
+	}
+	if n != 1 {
+		t.Fatalf("expect 1, got: %d", n)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Fatalf("took too long: %s", d)
+	}
+
+	// The error of a canceled context takes precedence.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	w = NewWriterContext(ctx, new(bytes.Buffer), rate)
+	w.SetWaitTimeout(time.Hour)
+	if _, err := w.Write(make([]byte, 10)); err != context.Canceled {
+		t.Fatalf("expect %v, got: %v", context.Canceled, err)
+	}
+}
+
+func TestWriterContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	buf := new(bytes.Buffer)
+	w := NewWriterContext(ctx, buf, RateOpts{Interval: time.Second, Size: 10})
+
+	// Cancel while the write is blocked on the rate limit.
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	n, err := w.Write(make([]byte, 100))
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Fatalf("write should be abandoned promptly, took %s", d)
+	}
+	if err != context.Canceled {
+		t.Fatalf("expect context.Canceled, got: %v", err)
+	}
+	if n != 10 || buf.Len() != 10 {
+		t.Fatalf("expect 10 bytes written, got: %d/%d", n, buf.Len())
+	}
+
+	// Later writes fail without writing anything.
+	if n, err := w.Write(make([]byte, 10)); n != 0 || err != context.Canceled {
+		t.Fatalf("expect 0/context.Canceled, got: %d/%v", n, err)
+	}
+}
+
+func TestWriterContext_NoWait(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w := NewWriterContext(ctx, ioutil.Discard, RateOpts{Interval: time.Millisecond, Size: 1 << 40})
+	w.SetWaitTimeout(time.Hour)
+	r := NewReaderContext(ctx, zeroReader{}, RateOpts{Interval: time.Millisecond, Size: 1 << 40})
+	r.SetWaitTimeout(time.Hour)
+	p := make([]byte, 64)
+
+	// Operations which never wait on the rate don't derive a context.
+	if n := testing.AllocsPerRun(100, func() { w.Write(p) }); n != 0 {
+		t.Fatalf("expect no allocs per write, got: %v", n)
+	}
+	if n := testing.AllocsPerRun(100, func() { r.Read(p) }); n != 0 {
+		t.Fatalf("expect no allocs per read, got: %v", n)
+	}
+}
+
+func TestReaderContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := NewReaderContext(ctx, zeroReader{}, RateOpts{Interval: time.Second, Size: 1})
+
+	// Cancel while the read is blocked on the rate limit.
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	n, err := r.Read(make([]byte, 10))
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Fatalf("read should be abandoned promptly, took %s", d)
+	}
+	if err != context.Canceled {
+		t.Fatalf("expect context.Canceled, got: %v", err)
+	}
+	if n != 1 {
+		t.Fatalf("expect 1 byte read, got: %d", n)
+	}
+
+	// Later reads fail without reading anything.
+	if n, err := r.Read(make([]byte, 10)); n != 0 || err != context.Canceled {
+		t.Fatalf("expect 0/context.Canceled, got: %d/%v", n, err)
+	}
+}
+
+func TestGroupReaderContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	g := NewGroup(RateOpts{Interval: time.Second, Size: 1})
+	r := g.NewReaderContext(ctx, zeroReader{})
+
+	// A reader in the group without the context is unaffected.
+	if n, err := g.NewReader(zeroReader{}).Read(make([]byte, 1)); n != 1 || err != nil {
+		t.Fatalf("expect 1/nil, got: %d/%v", n, err)
+	}
+
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	n, err := r.Read(make([]byte, 10))
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Fatalf("read should be abandoned promptly, took %s", d)
+	}
+	if n != 0 || err != context.Canceled {
+		t.Fatalf("expect 0/context.Canceled, got: %d/%v", n, err)
+	}
+}
+
+func BenchmarkWriterWriteString(b *testing.B) {
+	// Discard is an io.StringWriter, like many buffers and log sinks.
+	s := strings.Repeat("x", 1024)
+	w := NewWriter(ioutil.Discard, RateOpts{Interval: time.Millisecond, Size: 1 << 40})
+	b.Run("WriteString", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			w.WriteString(s)
+		}
+	})
+	b.Run("Write", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			w.Write([]byte(s))
+		}
+	})
+}
+
+func BenchmarkGroupParallelWrite(b *testing.B) {
+	// The rate is high enough that writes rarely wait, so that only the
+	// accounting is measured.
+	g := NewGroup(RateOpts{Interval: time.Millisecond, Size: 1 << 40})
+	p := make([]byte, 32<<10)
+	b.SetBytes(int64(len(p)))
+	b.RunParallel(func(pb *testing.PB) {
+		w := g.NewWriter(ioutil.Discard)
+		for pb.Next() {
+			w.Write(p)
+		}
+	})
+}
@@ -0,0 +1,140 @@
+package iocap
+
+import (
+	"context"
+	"time"
+)
+
+// Limiter limits the rate of arbitrary operations, counted in units such as
+// records processed, for uses which don't go through readers and writers.
+// It applies rates exactly like readers and writers do, with one unit in
+// place of each byte.
+type Limiter struct {
+	bucket *bucket
+
+	// parent is the limiter of the parent group, for limiters in a
+	// sub-group.
+	parent *Limiter
+}
+
+// NewLimiter creates a new limiter with the given rate.
+func NewLimiter(opts RateOpts) *Limiter {
+	return &Limiter{bucket: newBucket(opts)}
+}
+
+// NewLimiter creates and returns a new limiter in the group, sharing its
+// quota with all other members.
+func (g *Group) NewLimiter() *Limiter {
+	l := &Limiter{bucket: g.bucket}
+	if g.parent != nil {
+		l.parent = g.parent.NewLimiter()
+	}
+	return l
+}
+
+// Wait blocks until at least one of n units is allowed by the rate, and
+// returns the number allowed, which may be less than n. Callers wanting all
+// n units call Wait again for the rest. Wait returns zero if n is not
+// positive.
+func (l *Limiter) Wait(n int) int {
+	if n <= 0 {
+		return 0
+	}
+	v := l.bucket.insert(n)
+	if l.parent != nil {
+		// Give back what the parent doesn't allow.
+		if pv := l.parent.Wait(v); pv < v {
+			l.bucket.refund(v - pv)
+			v = pv
+		}
+	}
+	return v
+}
+
+// WaitContext is like Wait, but gives up once ctx is done, returning zero
+// along with the error of ctx.
+func (l *Limiter) WaitContext(ctx context.Context, n int) (int, error) {
+	if n <= 0 {
+		return 0, nil
+	}
+	v, ok := l.bucket.acquire(n, new(schedule), ctx.Done())
+	if !ok {
+		return 0, ctx.Err()
+	}
+	if l.parent != nil {
+		pv, err := l.parent.WaitContext(ctx, v)
+		if pv < v {
+			l.bucket.refund(v - pv)
+			v = pv
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	return v, nil
+}
+
+// TryWait is like Wait, but never blocks. It returns zero if no units are
+// allowed right now.
+func (l *Limiter) TryWait(n int) int {
+	if n <= 0 {
+		return 0
+	}
+	v := l.bucket.tryInsert(n)
+	if l.parent != nil && v > 0 {
+		if pv := l.parent.TryWait(v); pv < v {
+			l.bucket.refund(v - pv)
+			v = pv
+		}
+	}
+	return v
+}
+
+// SetRate is used to dynamically set the rate options on the limiter.
+func (l *Limiter) SetRate(opts RateOpts) {
+	l.bucket.setRate(opts)
+}
+
+// RampTo gradually changes the rate of the limiter to opts over the given
+// duration, stepping the rate once per interval. A subsequent SetRate or
+// RampTo cancels the ramp.
+func (l *Limiter) RampTo(opts RateOpts, over time.Duration) {
+	l.bucket.rampTo(opts, over)
+}
+
+// Rate returns the rate options currently in effect on the limiter.
+func (l *Limiter) Rate() RateOpts {
+	return l.bucket.rate()
+}
+
+// Available returns the number of units the limiter currently allows
+// without blocking, also considering any parent groups. It is the largest
+// int if the rates are unlimited.
+func (l *Limiter) Available() int {
+	v := l.bucket.available()
+	if l.parent != nil {
+		if pv := l.parent.Available(); pv < v {
+			v = pv
+		}
+	}
+	return v
+}
+
+// Capacity returns the number of units the limiter allows at once, which is
+// the Size of its rate, or the Burst of a smooth rate.
+func (l *Limiter) Capacity() int {
+	return l.bucket.rate().capacity()
+}
+
+// Reset clears the quota consumed by the limiter, and wakes any blocked
+// callers to take the new quota. Parent groups are not reset.
+func (l *Limiter) Reset() {
+	l.bucket.reset()
+}
+
+// SetClock replaces the source of time of the limiter, which is shared by
+// any other members of its group. It must be called before the limiter is
+// used.
+func (l *Limiter) SetClock(c Clock) {
+	l.bucket.setClock(c)
+}
@@ -0,0 +1,91 @@
+package iocap
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	clock := newFakeClock()
+	l := NewLimiter(RateOpts{Interval: time.Second, Size: 10, Coarse: true})
+	l.SetClock(clock)
+
+	// Allows up to the capacity at once.
+	if n := l.Wait(25); n != 10 {
+		t.Fatalf("expect 10, got: %d", n)
+	}
+	if n := l.TryWait(1); n != 0 {
+		t.Fatalf("expect 0, got: %d", n)
+	}
+
+	// Then blocks for the next interval.
+	start := clock.Now()
+	if n := l.Wait(15); n != 10 {
+		t.Fatalf("expect 10, got: %d", n)
+	}
+	if d := clock.Now().Sub(start); d != time.Second {
+		t.Fatalf("expect 1s, took %s", d)
+	}
+
+	// Nothing is waited for without units.
+	if n := l.Wait(0); n != 0 {
+		t.Fatalf("expect 0, got: %d", n)
+	}
+}
+
+func TestLimiter_Unlimited(t *testing.T) {
+	l := NewLimiter(Unlimited)
+	for i := 0; i < 3; i++ {
+		if n := l.Wait(1 << 30); n != 1<<30 {
+			t.Fatalf("expect %d, got: %d", 1<<30, n)
+		}
+	}
+}
+
+func TestLimiter_Concurrent(t *testing.T) {
+	l := NewLimiter(RateOpts{Interval: 10 * time.Millisecond, Size: 10})
+
+	// Concurrent callers share the rate.
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < 20; {
+				n += l.Wait(20 - n)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// 100 units take 9 intervals beyond the first.
+	if d := time.Since(start); d < 90*time.Millisecond {
+		t.Fatalf("finished too quickly in %s", d)
+	}
+}
+
+func TestGroupNewLimiter(t *testing.T) {
+	clock := newFakeClock()
+	parent := NewGroup(RateOpts{Interval: time.Second, Size: 10})
+	parent.SetClock(clock)
+	g := parent.NewSubGroup(RateOpts{Interval: time.Second, Size: 100})
+	g.SetClock(clock)
+
+	// Limiters share the quota of the group and its parents with readers
+	// and writers.
+	parent.NewLimiter().Wait(4)
+	l := g.NewLimiter()
+	if n := l.Wait(100); n != 6 {
+		t.Fatalf("expect 6, got: %d", n)
+	}
+	if n := l.Available(); n != 0 {
+		t.Fatalf("expect 0, got: %d", n)
+	}
+
+	// The sub-group is only charged for what the parent allowed.
+	if s := g.Snapshot(); s.Tokens != 6 {
+		t.Fatalf("expect 6 tokens, got: %d", s.Tokens)
+	}
+}
@@ -0,0 +1,30 @@
+/*
+Package netcap provides rate limiting helpers for raw network connections.
+
+A Listener wraps a net.Listener so that every accepted connection is rate
+limited, optionally reporting per-connection traffic once it closes.
+
+	l := netcap.NewListener(ln, rate)
+	l.OnClose(func(s netcap.ConnStats) {
+		log.Printf("%s: %d in, %d out", s.RemoteAddr, s.BytesIn, s.BytesOut)
+	})
+
+NewIPListener instead shares the rate among all connections from the same
+remote IP address, and can cap the number of concurrent connections per
+address.
+
+	l := netcap.NewIPListener(ln, rate)
+	l.MaxConnsPerIP(8)
+
+Either kind of listener may additionally cap the combined traffic of all of
+its connections with SetTotalRate.
+
+Tunneled traffic, such as an HTTP CONNECT tunnel established by a forward
+proxy, bypasses the response writer machinery of httpcap once the tunnel is
+up. Tunnel copies such traffic in both directions while charging it to a
+rate limiting group.
+
+	conn, buf, _ := w.(http.Hijacker).Hijack()
+	up, down, err := netcap.Tunnel(conn, buf, upstream, g)
+*/
+package netcap
@@ -0,0 +1,365 @@
+package netcap
+
+import (
+	"io/ioutil"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ryanuber/iocap"
+)
+
+// Listener is a net.Listener which rate limits the connections it accepts.
+// The rate is applied to each direction separately.
+type Listener struct {
+	net.Listener
+	rate    iocap.RateOpts
+	onClose func(ConnStats)
+
+	// totalIn and totalOut cap the combined traffic of all connections, if
+	// set by SetTotalRate.
+	totalIn  *iocap.Group
+	totalOut *iocap.Group
+
+	// perIP groups connections by remote IP address, sharing the rate
+	// among all connections from the same address.
+	perIP    bool
+	maxPerIP int
+	reject   func(net.Conn)
+	ips      map[string]*ipState
+	l        sync.Mutex
+}
+
+// ipState tracks the connections from a single remote IP address.
+type ipState struct {
+	conns   int
+	in, out *iocap.Group
+}
+
+// NewListener wraps ln in a new rate limited listener. Each connection
+// accepted from it is limited to ro in each direction independently.
+func NewListener(ln net.Listener, ro iocap.RateOpts) *Listener {
+	return &Listener{
+		Listener: ln,
+		rate:     ro,
+	}
+}
+
+// NewIPListener is like NewListener, but all connections from the same
+// remote IP address share the rate ro in each direction. The state of an
+// address is released once its last connection closes.
+func NewIPListener(ln net.Listener, ro iocap.RateOpts) *Listener {
+	return &Listener{
+		Listener: ln,
+		rate:     ro,
+		perIP:    true,
+		ips:      make(map[string]*ipState),
+	}
+}
+
+// MaxConnsPerIP limits the number of concurrent connections from a single
+// remote IP address on a listener created by NewIPListener. Connections
+// over the limit are handed to the reject function, which defaults to
+// closing them immediately, and Accept moves on to the next connection. A
+// zero value means no limit. It must be called before the listener starts
+// accepting connections.
+func (l *Listener) MaxConnsPerIP(n int) {
+	l.maxPerIP = n
+}
+
+// OnReject sets the policy applied to connections rejected by the
+// MaxConnsPerIP limit. fn is responsible for closing the connection, and
+// may respond to the client first. It is called from Accept, so it should
+// not block for long. It must be called before the listener starts
+// accepting connections.
+func (l *Listener) OnReject(fn func(net.Conn)) {
+	l.reject = fn
+}
+
+// OnClose registers fn to be called exactly once for each accepted
+// connection when it is closed, receiving the connection's final stats. It
+// must be called before the listener starts accepting connections. fn is
+// called from the goroutine closing the connection, so it does not block
+// Accept, but a slow fn does delay that Close call.
+func (l *Listener) OnClose(fn func(ConnStats)) {
+	l.onClose = fn
+}
+
+// SetRate changes the rate of the listener. Connections accepted afterward
+// use the new rate. On a listener created by NewIPListener, the rate of the
+// addresses with open connections is updated as well.
+func (l *Listener) SetRate(ro iocap.RateOpts) {
+	l.l.Lock()
+	defer l.l.Unlock()
+
+	l.rate = ro
+	for _, state := range l.ips {
+		state.in.SetRate(ro)
+		state.out.SetRate(ro)
+	}
+}
+
+// SetTotalRate caps the combined traffic of all connections accepted by the
+// listener to ro in each direction, in addition to the rate of each
+// connection or address. Calling it again changes the cap, including for
+// connections which are already open. Connections accepted before the first
+// call are not covered by the cap.
+func (l *Listener) SetTotalRate(ro iocap.RateOpts) {
+	l.l.Lock()
+	defer l.l.Unlock()
+
+	if l.totalIn == nil {
+		l.totalIn = iocap.NewGroup(ro)
+		l.totalOut = iocap.NewGroup(ro)
+		return
+	}
+	l.totalIn.SetRate(ro)
+	l.totalOut.SetRate(ro)
+}
+
+// Rate returns the rate of the listener, along with the total rate set by
+// SetTotalRate, or Unlimited if there is none.
+func (l *Listener) Rate() (rate, total iocap.RateOpts) {
+	l.l.Lock()
+	defer l.l.Unlock()
+
+	rate = l.rate
+	if l.totalIn != nil {
+		total = l.totalIn.Rate()
+	}
+	return
+}
+
+// IPStats describes the state of a single remote IP address.
+type IPStats struct {
+	// IP is the remote address.
+	IP string
+
+	// Conns is the number of open connections from the address.
+	Conns int
+}
+
+// IPs returns the state of each remote IP address with open connections on
+// a listener created by NewIPListener.
+func (l *Listener) IPs() []IPStats {
+	l.l.Lock()
+	defer l.l.Unlock()
+
+	stats := make([]IPStats, 0, len(l.ips))
+	for ip, state := range l.ips {
+		stats = append(stats, IPStats{IP: ip, Conns: state.conns})
+	}
+	return stats
+}
+
+// newGroups creates the inbound and outbound groups for a connection or an
+// address. Must be called with the lock held.
+func (l *Listener) newGroups() (in, out *iocap.Group) {
+	if l.totalIn != nil {
+		return l.totalIn.NewSubGroup(l.rate), l.totalOut.NewSubGroup(l.rate)
+	}
+	return iocap.NewGroup(l.rate), iocap.NewGroup(l.rate)
+}
+
+// Accept waits for and returns the next connection, wrapped with the rate
+// limit of the listener.
+func (l *Listener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		if !l.perIP {
+			l.l.Lock()
+			in, out := l.newGroups()
+			l.l.Unlock()
+			return newConn(c, in, out, l.closed(nil)), nil
+		}
+
+		ip := remoteIP(c)
+		l.l.Lock()
+		state, ok := l.ips[ip]
+		if !ok {
+			state = new(ipState)
+			state.in, state.out = l.newGroups()
+			l.ips[ip] = state
+		}
+		if l.maxPerIP > 0 && state.conns >= l.maxPerIP {
+			l.l.Unlock()
+			l.rejectConn(c)
+			continue
+		}
+		state.conns++
+		l.l.Unlock()
+
+		release := func() {
+			l.l.Lock()
+			defer l.l.Unlock()
+			if state.conns--; state.conns == 0 {
+				delete(l.ips, ip)
+			}
+		}
+		return newConn(c, state.in, state.out, l.closed(release)), nil
+	}
+}
+
+// closed returns the function called when an accepted connection closes,
+// running release (if any) before the close callback.
+func (l *Listener) closed(release func()) func(ConnStats) {
+	onClose := l.onClose
+	return func(s ConnStats) {
+		if release != nil {
+			release()
+		}
+		if onClose != nil {
+			onClose(s)
+		}
+	}
+}
+
+// rejectConn applies the reject policy to a connection over the limit.
+func (l *Listener) rejectConn(c net.Conn) {
+	if l.reject != nil {
+		l.reject(c)
+		return
+	}
+	c.Close()
+}
+
+// remoteIP returns the IP address of the remote end of c, falling back to
+// the full address if it is not in host:port form.
+func remoteIP(c net.Conn) string {
+	addr := c.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// ConnStats is a record of the traffic over a single connection.
+type ConnStats struct {
+	// RemoteAddr is the address of the peer.
+	RemoteAddr net.Addr
+
+	// BytesIn and BytesOut are the number of bytes read from and written
+	// to the connection.
+	BytesIn  int64
+	BytesOut int64
+
+	// Duration is the time the connection was open.
+	Duration time.Duration
+
+	// Throttled is the total time reads and writes spent waiting on the
+	// rate limit, excluding time spent in the network itself.
+	Throttled time.Duration
+}
+
+// Conn is a rate limited net.Conn. Reads and writes are charged to separate
+// groups, which may be shared with other connections.
+type Conn struct {
+	// Counters are accessed atomically and kept first for alignment.
+	bytesIn   int64
+	bytesOut  int64
+	throttled int64
+	writing   int64
+
+	net.Conn
+
+	// in charges bytes after they are read; reading first avoids blocking
+	// on a full buffer the peer never intends to fill.
+	in  *iocap.Writer
+	out *iocap.Writer
+
+	opened time.Time
+
+	onClose   func(ConnStats)
+	closeOnce sync.Once
+}
+
+// newConn wraps c, charging reads to in and writes to out. onClose, if not
+// nil, is called once the connection is closed.
+func newConn(c net.Conn, in, out *iocap.Group, onClose func(ConnStats)) *Conn {
+	conn := &Conn{
+		Conn:    c,
+		in:      in.NewWriter(ioutil.Discard),
+		opened:  time.Now(),
+		onClose: onClose,
+	}
+	conn.out = out.NewWriter(connWriter{conn})
+	return conn
+}
+
+// Read reads from the connection, blocking until the bytes read have been
+// charged to the inbound rate limit.
+func (c *Conn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		start := time.Now()
+		c.in.Write(p[:n])
+		atomic.AddInt64(&c.throttled, int64(time.Since(start)))
+		atomic.AddInt64(&c.bytesIn, int64(n))
+	}
+	return n, err
+}
+
+// Write writes p to the connection, respecting the outbound rate limit.
+func (c *Conn) Write(p []byte) (int, error) {
+	start := time.Now()
+	writing := atomic.LoadInt64(&c.writing)
+
+	n, err := c.out.Write(p)
+
+	// Time not spent in the network was spent waiting on the limiter.
+	writing = atomic.LoadInt64(&c.writing) - writing
+	atomic.AddInt64(&c.throttled, int64(time.Since(start))-writing)
+	atomic.AddInt64(&c.bytesOut, int64(n))
+	return n, err
+}
+
+// Close closes the connection. The close callback of the listener is called
+// on the first Close, which also releases the connection's slot in any
+// per-IP connection limit.
+func (c *Conn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(func() {
+		if c.onClose != nil {
+			c.onClose(c.Stats())
+		}
+	})
+	return err
+}
+
+// CloseWrite shuts down the writing side of the connection, if supported by
+// the underlying connection. Otherwise, the connection is closed entirely.
+func (c *Conn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return c.Close()
+}
+
+// Stats returns the current traffic stats of the connection.
+func (c *Conn) Stats() ConnStats {
+	return ConnStats{
+		RemoteAddr: c.RemoteAddr(),
+		BytesIn:    atomic.LoadInt64(&c.bytesIn),
+		BytesOut:   atomic.LoadInt64(&c.bytesOut),
+		Duration:   time.Since(c.opened),
+		Throttled:  time.Duration(atomic.LoadInt64(&c.throttled)),
+	}
+}
+
+// connWriter writes to the underlying connection of a Conn, tracking the
+// time spent doing so.
+type connWriter struct {
+	c *Conn
+}
+
+func (w connWriter) Write(p []byte) (int, error) {
+	start := time.Now()
+	n, err := w.c.Conn.Write(p)
+	atomic.AddInt64(&w.c.writing, int64(time.Since(start)))
+	return n, err
+}
@@ -0,0 +1,368 @@
+package netcap
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ryanuber/iocap"
+)
+
+// startEchoListener serves an echo protocol on a new rate limited listener,
+// returning the listener, a channel of accepted server-side connections and
+// a channel of close records.
+func startEchoListener(t *testing.T, ro iocap.RateOpts) (*Listener, <-chan net.Conn, <-chan ConnStats) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	l := NewListener(ln, ro)
+	records := make(chan ConnStats, 16)
+	l.OnClose(func(s ConnStats) {
+		records <- s
+	})
+
+	accepted := make(chan net.Conn, 16)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return l, accepted, records
+}
+
+func TestListener_OnClose(t *testing.T) {
+	rate := iocap.RateOpts{Interval: 100 * time.Millisecond, Size: 64}
+	l, accepted, records := startEchoListener(t, rate)
+	defer l.Close()
+
+	dial := func() *net.TCPConn {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		return conn.(*net.TCPConn)
+	}
+
+	// Graceful close: send 100 bytes, half-close and read the echo.
+	graceful := dial()
+	graceful.Write(make([]byte, 100))
+	graceful.CloseWrite()
+	out, err := ioutil.ReadAll(graceful)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out) != 100 {
+		t.Fatalf("expect 100, got: %d", len(out))
+	}
+	graceful.Close()
+	<-accepted
+
+	// Abrupt reset: wait for the echo so the server saw the data, then
+	// close with a zero linger time to send a RST.
+	reset := dial()
+	reset.Write(make([]byte, 50))
+	if _, err := io.ReadFull(reset, make([]byte, 50)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	reset.SetLinger(0)
+	reset.Close()
+	<-accepted
+
+	// Server-side close while the client is still connected.
+	server := dial()
+	server.Write(make([]byte, 10))
+	if _, err := io.ReadFull(server, make([]byte, 10)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	serverConn := <-accepted
+	serverConn.Close()
+	defer server.Close()
+
+	// Collect exactly one record per connection.
+	expect := map[string]int64{
+		graceful.LocalAddr().String(): 100,
+		reset.LocalAddr().String():    50,
+		server.LocalAddr().String():   10,
+	}
+	seen := make(map[string]ConnStats)
+	for len(seen) < len(expect) {
+		select {
+		case s := <-records:
+			addr := s.RemoteAddr.String()
+			if _, ok := seen[addr]; ok {
+				t.Fatalf("duplicate record for %s", addr)
+			}
+			seen[addr] = s
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for records, got: %v", seen)
+		}
+	}
+
+	for addr, n := range expect {
+		s, ok := seen[addr]
+		if !ok {
+			t.Fatalf("missing record for %s", addr)
+		}
+		if s.BytesIn != n || s.BytesOut != n {
+			t.Fatalf("expect %d/%d for %s, got: %d/%d", n, n, addr, s.BytesIn, s.BytesOut)
+		}
+		if s.Duration <= 0 {
+			t.Fatalf("bad duration: %s", s.Duration)
+		}
+	}
+
+	// 100 bytes each way at 64 bytes per interval had to wait.
+	if v := seen[graceful.LocalAddr().String()].Throttled; v < 50*time.Millisecond {
+		t.Fatalf("expect throttled time, got: %s", v)
+	}
+
+	// No further records arrive once the echo goroutines close their
+	// connections a second time.
+	select {
+	case s := <-records:
+		t.Fatalf("unexpected record: %v", s)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestListener_Rate(t *testing.T) {
+	rate := iocap.RateOpts{Interval: 100 * time.Millisecond, Size: 128}
+	l, _, _ := startEchoListener(t, rate)
+	defer l.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+
+	// Echo 512 bytes through the limited connection.
+	data := bytes.Repeat([]byte("a"), 512)
+	start := time.Now()
+	conn.Write(data)
+	out := make([]byte, len(data))
+	if _, err := io.ReadFull(conn, out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d := time.Since(start); d < 300*time.Millisecond {
+		t.Fatalf("echo returned too quickly in %s", d)
+	}
+	if !bytes.Equal(out, data) {
+		t.Fatal("unexpected data returned")
+	}
+}
+
+func TestIPListener_MaxConnsPerIP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	l := NewIPListener(ln, iocap.Unlimited)
+	l.MaxConnsPerIP(2)
+	l.OnReject(func(c net.Conn) {
+		c.Write([]byte("busy"))
+		c.Close()
+	})
+	defer l.Close()
+
+	// Serve an echo protocol.
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	// ping dials the listener and checks whether the connection is
+	// admitted, returning it if so.
+	ping := func() (net.Conn, bool) {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		conn.Write([]byte("ping"))
+		out := make([]byte, 4)
+		if _, err := io.ReadFull(conn, out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		switch string(out) {
+		case "ping":
+			return conn, true
+		case "busy":
+			conn.Close()
+			return nil, false
+		default:
+			t.Fatalf("bad: %q", out)
+			return nil, false
+		}
+	}
+
+	// Two connections are admitted, further ones are rejected.
+	c1, ok := ping()
+	if !ok {
+		t.Fatal("expect first conn to be admitted")
+	}
+	c2, ok := ping()
+	if !ok {
+		t.Fatal("expect second conn to be admitted")
+	}
+	defer c2.Close()
+	for i := 0; i < 3; i++ {
+		if _, ok := ping(); ok {
+			t.Fatal("expect conn to be rejected")
+		}
+	}
+
+	// Closing a connection frees up a slot once the server side closes.
+	c1.Close()
+	deadline := time.Now().Add(time.Second)
+	for {
+		l.l.Lock()
+		n := l.ips["127.0.0.1"].conns
+		l.l.Unlock()
+		if n == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expect 1 conn, got: %d", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	c3, ok := ping()
+	if !ok {
+		t.Fatal("expect conn to be admitted again")
+	}
+	c3.Close()
+}
+
+func TestIPListener_SharedRate(t *testing.T) {
+	rate := iocap.RateOpts{Interval: 100 * time.Millisecond, Size: 128}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	l := NewIPListener(ln, rate)
+	defer l.Close()
+
+	// Send 256 bytes to each client as soon as it connects.
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn.Write(make([]byte, 256))
+				conn.Close()
+			}()
+		}
+	}()
+
+	// Two connections from the same address share the rate, so the 512
+	// bytes in total need at least three drains.
+	start := time.Now()
+	done := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			conn, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				done <- err
+				return
+			}
+			defer conn.Close()
+			_, err = ioutil.ReadAll(conn)
+			done <- err
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	if d := time.Since(start); d < 300*time.Millisecond {
+		t.Fatalf("finished too quickly in %s", d)
+	}
+
+	// The address is forgotten once all of its connections are closed.
+	time.Sleep(10 * time.Millisecond)
+	l.l.Lock()
+	defer l.l.Unlock()
+	if n := len(l.ips); n != 0 {
+		t.Fatalf("expect no tracked addresses, got: %d", n)
+	}
+}
+
+func TestListener_TotalRate(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	l := NewListener(ln, iocap.Unlimited)
+	l.SetTotalRate(iocap.RateOpts{Interval: 100 * time.Millisecond, Size: 128})
+	defer l.Close()
+
+	// Send 256 bytes to each client as soon as it connects.
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn.Write(make([]byte, 256))
+				conn.Close()
+			}()
+		}
+	}()
+
+	// Each connection is unlimited on its own, but together they share
+	// the total rate, so the 512 bytes need at least three drains.
+	start := time.Now()
+	done := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			conn, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				done <- err
+				return
+			}
+			defer conn.Close()
+			_, err = ioutil.ReadAll(conn)
+			done <- err
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	if d := time.Since(start); d < 300*time.Millisecond {
+		t.Fatalf("finished too quickly in %s", d)
+	}
+
+	// Raising the total rate applies to the same groups.
+	l.SetTotalRate(iocap.Unlimited)
+	if _, total := l.Rate(); total != iocap.Unlimited {
+		t.Fatalf("expect unlimited, got: %v", total)
+	}
+}
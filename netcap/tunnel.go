@@ -0,0 +1,85 @@
+package netcap
+
+import (
+	"bufio"
+	"io"
+	"net"
+
+	"github.com/ryanuber/iocap"
+)
+
+// closeWriter is implemented by connections supporting half-close, such as
+// *net.TCPConn and *net.UnixConn.
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// Tunnel copies data in both directions between a client connection and an
+// upstream connection until both directions are finished, rate limiting all
+// traffic with g, if not nil. Returns the number of bytes sent upstream and
+// down to the client, along with the first error encountered.
+//
+// buf holds any buffered reads and writes of the client connection, as
+// returned by http.Hijacker. Pending writes are flushed and buffered reads
+// are forwarded upstream before anything else. buf may be nil.
+//
+// When one side finishes sending, the write side of the other connection is
+// closed so the end of stream propagates through the tunnel. Connections
+// which do not support half-close are closed entirely. Both connections are
+// closed when Tunnel returns.
+func Tunnel(client net.Conn, buf *bufio.ReadWriter, upstream net.Conn, g *iocap.Group) (up, down int64, err error) {
+	defer client.Close()
+	defer upstream.Close()
+
+	// Reads from the client go through the buffered reader so that any
+	// bytes the HTTP server already consumed are not lost.
+	var src io.Reader = client
+	if buf != nil {
+		if err := buf.Flush(); err != nil {
+			return 0, 0, err
+		}
+		src = buf.Reader
+	}
+
+	type result struct {
+		up  bool
+		n   int64
+		err error
+	}
+	ch := make(chan result, 2)
+
+	pipe := func(dst net.Conn, src io.Reader, isUp bool) {
+		var w io.Writer = dst
+		if g != nil {
+			w = g.NewWriter(dst)
+		}
+		n, err := io.Copy(w, src)
+		if err != nil {
+			// Abort the tunnel; closing both ends unblocks the other
+			// direction.
+			client.Close()
+			upstream.Close()
+		} else if cw, ok := dst.(closeWriter); ok {
+			cw.CloseWrite()
+		} else {
+			dst.Close()
+		}
+		ch <- result{isUp, n, err}
+	}
+
+	go pipe(upstream, src, true)
+	go pipe(client, upstream, false)
+
+	for i := 0; i < 2; i++ {
+		res := <-ch
+		if res.up {
+			up = res.n
+		} else {
+			down = res.n
+		}
+		if err == nil {
+			err = res.err
+		}
+	}
+	return
+}
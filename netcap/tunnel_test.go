@@ -0,0 +1,139 @@
+package netcap
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ryanuber/iocap"
+)
+
+// tunnelResult is the outcome of a Tunnel call made by the test proxy.
+type tunnelResult struct {
+	up, down int64
+	err      error
+}
+
+// startProxy starts a forward proxy which tunnels CONNECT requests through
+// g, reporting the result of each tunnel on the returned channel.
+func startProxy(t *testing.T, g *iocap.Group) (*httptest.Server, <-chan tunnelResult) {
+	results := make(chan tunnelResult, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "CONNECT" {
+			http.Error(w, "bad method", http.StatusMethodNotAllowed)
+			return
+		}
+
+		upstream, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Errorf("err: %v", err)
+			return
+		}
+
+		// Write the response through the buffer; Tunnel flushes it.
+		buf.WriteString("HTTP/1.1 200 Connection established\r\n\r\n")
+
+		up, down, err := Tunnel(conn, buf, upstream, g)
+		results <- tunnelResult{up, down, err}
+	}))
+	return ts, results
+}
+
+// startEcho starts a TCP server which reads until EOF, then echoes the data
+// back and closes the connection.
+func startEcho(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				data, _ := ioutil.ReadAll(conn)
+				conn.Write(data)
+			}()
+		}
+	}()
+	return ln
+}
+
+func TestTunnel(t *testing.T) {
+	echo := startEcho(t)
+	defer echo.Close()
+
+	g := iocap.NewGroup(iocap.RateOpts{Interval: 100 * time.Millisecond, Size: 256})
+	proxy, results := startProxy(t, g)
+	defer proxy.Close()
+
+	// Create some random data to send through the tunnel.
+	data := make([]byte, 512)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+
+	// Send the start of the payload along with the CONNECT request so that
+	// it ends up in the proxy's buffered reader.
+	start := time.Now()
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", echo.Addr(), echo.Addr())
+	conn.Write(data[:16])
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expect 200, got: %d", resp.StatusCode)
+	}
+
+	// Send the rest and half-close our side; the echo server only responds
+	// once it sees the end of stream propagated through the tunnel.
+	conn.Write(data[16:])
+	conn.(*net.TCPConn).CloseWrite()
+
+	out, err := ioutil.ReadAll(br)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(out, data) {
+		t.Fatal("unexpected data returned")
+	}
+
+	// 1024 bytes cross the tunnel at 256 bytes per interval, requiring
+	// three drains.
+	if d := time.Since(start); d < 300*time.Millisecond {
+		t.Fatalf("tunnel finished too quickly in %s", d)
+	}
+
+	res := <-results
+	if res.err != nil {
+		t.Fatalf("err: %v", res.err)
+	}
+	if res.up != 512 || res.down != 512 {
+		t.Fatalf("expect 512/512, got: %d/%d", res.up, res.down)
+	}
+}
@@ -0,0 +1,170 @@
+package iocap
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// schedule is a pacing plan for a single large read or write. Once the
+// operation has filled the bucket, the time of each following drain, or
+// for smooth rates the time the next step has leaked, is known in advance.
+// So rather than going through the full insert and drain cycle every time,
+// the operation sleeps until the next wakeup and claims the quota made
+// available with a single lock.
+//
+// The schedule is only valid as long as the operation is the sole user of
+// the bucket. Any other change to the bucket, such as an insert by another
+// member of a group or a rate change, invalidates it, as does another
+// insert waiting on the bucket. The operation then falls back to a regular
+// insert, so that other members of a group interleave as usual.
+type schedule struct {
+	valid bool
+	gen   uint64
+	wake  time.Time
+}
+
+// pace is like insertUntil, but follows and maintains the schedule s across
+// the calls of a single operation. Calls are recorded if tracing is enabled.
+func (b *bucket) pace(n int, s *schedule, done <-chan struct{}) (int, bool) {
+	t, _ := b.trace.Load().(*Trace)
+	if t == nil {
+		return b.acquire(n, s, done)
+	}
+
+	start := b.clock.Now()
+	v, ok := b.acquire(n, s, done)
+	t.record(TraceEvent{
+		Time:      start,
+		Requested: n,
+		Granted:   v,
+		Waited:    b.clock.Now().Sub(start),
+	})
+	return v, ok
+}
+
+// acquire implements pace. Tokens are taken from the windows of the bucket
+// after the bucket itself. If a window is full, all tokens taken so far are
+// given back while waiting for room in it, so that no window holds quota
+// while another one blocks, and the operation starts over.
+func (b *bucket) acquire(n int, s *schedule, done <-chan struct{}) (int, bool) {
+	if n <= 0 {
+		return 0, true
+	}
+	for {
+		v, ok := b.acquireOwn(n, s, done)
+		if !ok || len(b.windows) == 0 {
+			return v, ok
+		}
+		v, full := b.takeWindows(v)
+		if full == nil {
+			return v, true
+		}
+		s.valid = false
+		if _, ok := full.allowance(n, done); !ok {
+			return 0, false
+		}
+	}
+}
+
+// acquireOwn implements acquire for this bucket alone, regardless of its
+// windows.
+func (b *bucket) acquireOwn(n int, s *schedule, done <-chan struct{}) (int, bool) {
+	if s.valid {
+		if v, ok := b.wake(n, s, done); ok {
+			return v, true
+		}
+	}
+
+	v, ok := b.insertUntil(n, done)
+	if ok && v < n {
+		// The bucket is full, so the rest of the operation waits for the
+		// next drain.
+		b.plan(s)
+	}
+	return v, ok
+}
+
+// plan establishes a schedule from the current state of the bucket, if it
+// is full.
+func (b *bucket) plan(s *schedule) {
+	b.l.RLock()
+	defer b.l.RUnlock()
+
+	full := b.opts.Size
+	if b.opts.smooth() {
+		full = b.opts.capacity()
+	}
+	s.valid = !b.opts.IsUnlimited() &&
+		int(atomic.LoadInt64(&b.tokens)) >= full && b.credit == 0 &&
+		b.debt == 0 && atomic.LoadInt32(&b.waiting) == 0
+	s.gen = atomic.LoadUint64(&b.gen)
+	s.wake = b.due()
+}
+
+// wake sleeps until the next scheduled drain or leak, then drains or leaks
+// the bucket and inserts up to n tokens. If the schedule was invalidated in
+// the meantime, or done was closed, nothing is inserted and false is
+// returned.
+func (b *bucket) wake(n int, s *schedule, done <-chan struct{}) (v int, ok bool) {
+	s.valid = false
+	b.l.RLock()
+	changed := b.changed
+	b.l.RUnlock()
+
+	atomic.AddInt32(&b.pacing, 1)
+	defer atomic.AddInt32(&b.pacing, -1)
+	if !b.sleep(s.wake.Sub(b.clock.Now()), changed, done) {
+		return 0, false
+	}
+
+	b.l.Lock()
+	if b.gen != s.gen || atomic.LoadInt32(&b.waiting) != 0 {
+		b.l.Unlock()
+		return 0, false
+	}
+
+	now := b.clock.Now()
+	if b.opts.smooth() {
+		notify, stats := b.leakLocked(now)
+		if v = b.takeLocked(n); v < n {
+			s.valid = true
+			s.gen = b.gen
+			s.wake = b.due()
+		}
+		b.l.Unlock()
+
+		if notify != nil {
+			notify(stats)
+		}
+		return v, true
+	}
+	notify, stats := b.drainLocked(b.drained, now)
+
+	v = n
+	if !b.opts.IsUnlimited() {
+		if v > b.opts.Size {
+			v = b.opts.Size
+		}
+		b.tokens = int64(v)
+		b.gen++
+
+		// A late wakeup may have banked some credit.
+		if v < n {
+			v += b.spendLocked(n - v)
+		}
+	}
+
+	if v < n && b.credit == 0 {
+		s.valid = true
+		s.gen = b.gen
+		// Stay on the grid of drains, so that waking up late does not
+		// push back the next wakeup.
+		s.wake = b.drained.Add(b.opts.Interval)
+	}
+	b.l.Unlock()
+
+	if notify != nil {
+		notify(stats)
+	}
+	return v, true
+}
@@ -0,0 +1,200 @@
+package iocap
+
+import (
+	"io/ioutil"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// chunkRecorder records the size and time of each write made to it.
+type chunkRecorder struct {
+	clock  Clock
+	sizes  []int
+	times  []time.Time
+	before func()
+}
+
+func (r *chunkRecorder) Write(p []byte) (int, error) {
+	if r.before != nil {
+		r.before()
+	}
+	r.sizes = append(r.sizes, len(p))
+	r.times = append(r.times, r.clock.Now())
+	return len(p), nil
+}
+
+func TestPace_Schedule(t *testing.T) {
+	clock := newFakeClock()
+	w := NewWriter(nil, RateOpts{Interval: 100 * time.Millisecond, Size: 100, Coarse: true})
+	w.bucket.clock = clock
+	rec := &chunkRecorder{clock: clock}
+	w.dst = rec
+
+	start := clock.Now()
+	n, err := w.Write(make([]byte, 1000))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if n != 1000 {
+		t.Fatalf("expect 1000, got: %d", n)
+	}
+
+	// One full interval per chunk, starting immediately.
+	if len(rec.sizes) != 10 {
+		t.Fatalf("expect 10 chunks, got: %v", rec.sizes)
+	}
+	for i, size := range rec.sizes {
+		if size != 100 {
+			t.Fatalf("expect 100, got: %d", size)
+		}
+		if d := rec.times[i].Sub(start); d != time.Duration(i)*100*time.Millisecond {
+			t.Fatalf("chunk %d written at %s", i, d)
+		}
+	}
+}
+
+func TestPace_ScheduleSmooth(t *testing.T) {
+	clock := newFakeClock()
+	b := newBucket(RateOpts{Interval: 100 * time.Millisecond, Size: 100})
+	b.clock = clock
+	start := clock.Now()
+
+	// Filling the bucket establishes a schedule, waking once a step of a
+	// tenth of the size has leaked.
+	var s schedule
+	if v, _ := b.pace(1000, &s, nil); v != 100 {
+		t.Fatalf("expect 100, got: %d", v)
+	}
+	if !s.valid || s.wake.Sub(start) != 10*time.Millisecond {
+		t.Fatalf("bad schedule: %#v", s)
+	}
+
+	// Each wakeup claims the next step and schedules the one after.
+	for i := 1; i <= 5; i++ {
+		v, ok := b.wake(1000, &s, nil)
+		if !ok || v != 10 {
+			t.Fatalf("expect 10, got: %d, %v", v, ok)
+		}
+		if d := clock.Now().Sub(start); d != time.Duration(i)*10*time.Millisecond {
+			t.Fatalf("woke up at %s", d)
+		}
+		if !s.valid {
+			t.Fatal("expect a valid schedule")
+		}
+	}
+}
+
+func TestPace_ChunkSize(t *testing.T) {
+	clock := newFakeClock()
+	w := NewWriter(nil, RateOpts{Interval: 100 * time.Millisecond, Size: 400, Coarse: true})
+	w.bucket.clock = clock
+	w.SetChunkSize(100)
+	rec := &chunkRecorder{clock: clock}
+	w.dst = rec
+
+	start := clock.Now()
+	n, err := w.Write(make([]byte, 1000))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if n != 1000 {
+		t.Fatalf("expect 1000, got: %d", n)
+	}
+
+	// Every write is capped at the chunk size, while the rate is unchanged.
+	if len(rec.sizes) != 10 {
+		t.Fatalf("expect 10 writes, got: %v", rec.sizes)
+	}
+	for i, size := range rec.sizes {
+		if size != 100 {
+			t.Fatalf("expect 100, got: %v", rec.sizes)
+		}
+		expect := time.Duration(i/4) * 100 * time.Millisecond
+		if d := rec.times[i].Sub(start); d != expect {
+			t.Fatalf("write %d: expect %s, got: %s", i, expect, d)
+		}
+	}
+}
+
+func TestPace_SetRate(t *testing.T) {
+	clock := newFakeClock()
+	w := NewWriter(nil, RateOpts{Interval: 100 * time.Millisecond, Size: 100, Coarse: true})
+	w.bucket.clock = clock
+	rec := &chunkRecorder{clock: clock}
+	w.dst = rec
+
+	// Lower the rate in the middle of the write, after the third chunk was
+	// admitted. The rest of the write proceeds at the new rate.
+	rec.before = func() {
+		if len(rec.sizes) == 2 {
+			w.SetRate(RateOpts{Interval: 100 * time.Millisecond, Size: 50, Coarse: true})
+		}
+	}
+
+	if _, err := w.Write(make([]byte, 400)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expect := []int{100, 100, 100, 50, 50}
+	if len(rec.sizes) != len(expect) {
+		t.Fatalf("expect %v, got: %v", expect, rec.sizes)
+	}
+	for i := range expect {
+		if rec.sizes[i] != expect[i] {
+			t.Fatalf("expect %v, got: %v", expect, rec.sizes)
+		}
+	}
+}
+
+func TestPace_Waiting(t *testing.T) {
+	b := newBucket(RateOpts{Interval: 100 * time.Millisecond, Size: 100, Coarse: true})
+	b.clock = newFakeClock()
+
+	// Filling the bucket establishes a schedule.
+	var s schedule
+	if v, _ := b.pace(200, &s, nil); v != 100 {
+		t.Fatalf("expect 100, got: %d", v)
+	}
+	if !s.valid {
+		t.Fatal("expect a valid schedule")
+	}
+
+	// Another member of the group starts waiting on the bucket. The
+	// schedule is abandoned so the waiter gets a fair chance at the quota.
+	atomic.AddInt32(&b.waiting, 1)
+	if _, ok := b.wake(100, &s, nil); ok {
+		t.Fatal("expect schedule to be abandoned")
+	}
+	b.plan(&s)
+	if s.valid {
+		t.Fatal("expect no schedule while others are waiting")
+	}
+}
+
+// benchmarkLarge measures the overhead of a large paced write, using a
+// virtual clock so that only the limiter itself is measured.
+func benchmarkLarge(b *testing.B, write func(w *Writer, p []byte)) {
+	p := make([]byte, 1<<20)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		w := NewWriter(ioutil.Discard, RateOpts{Interval: time.Millisecond, Size: 1024})
+		w.bucket.clock = newFakeClock()
+		write(w, p)
+	}
+}
+
+func BenchmarkWriter_Large(b *testing.B) {
+	benchmarkLarge(b, func(w *Writer, p []byte) {
+		w.Write(p)
+	})
+}
+
+func BenchmarkWriter_LargeUnscheduled(b *testing.B) {
+	benchmarkLarge(b, func(w *Writer, p []byte) {
+		for n := 0; n < len(p); {
+			v := w.bucket.insert(len(p) - n)
+			w.dst.Write(p[n : n+v])
+			n += v
+		}
+	})
+}
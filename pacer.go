@@ -0,0 +1,199 @@
+package iocap
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+var (
+	// shared is the process-wide pacer, if enabled.
+	shared  *pacer
+	sharedL sync.RWMutex
+)
+
+// minPacerResolution is the resolution used in place of one which is zero
+// or negative.
+const minPacerResolution = time.Millisecond
+
+// EnableSharedPacer switches blocked reads and writes over to a single
+// process-wide pacer. Instead of each waiting operation sleeping on its own
+// timer, the pacer ticks once per resolution and wakes all operations which
+// are due. With many throttled streams, this replaces thousands of timer
+// wakeups per interval with one, at the cost of operations resuming up to
+// resolution late. Calling it again changes the resolution. A resolution of
+// zero or less is raised to a millisecond.
+func EnableSharedPacer(resolution time.Duration) {
+	if resolution <= 0 {
+		resolution = minPacerResolution
+	}
+
+	sharedL.Lock()
+	defer sharedL.Unlock()
+
+	if shared != nil {
+		shared.close()
+	}
+	shared = newPacer(resolution)
+}
+
+// DisableSharedPacer stops the shared pacer. Operations waiting on it are
+// woken, and return to using their own timers.
+func DisableSharedPacer() {
+	sharedL.Lock()
+	defer sharedL.Unlock()
+
+	if shared != nil {
+		shared.close()
+		shared = nil
+	}
+}
+
+// loadPacer returns the shared pacer, or nil if it is not enabled.
+func loadPacer() *pacer {
+	sharedL.RLock()
+	defer sharedL.RUnlock()
+	return shared
+}
+
+// pacer wakes sleeping operations from a single ticker.
+type pacer struct {
+	resolution time.Duration
+
+	waiters waiters
+	closed  bool
+	kick    chan struct{}
+	stop    chan struct{}
+
+	// ticks is the number of times the pacer has woken up.
+	ticks uint64
+
+	l sync.Mutex
+}
+
+// newPacer creates a new pacer and starts its goroutine.
+func newPacer(resolution time.Duration) *pacer {
+	p := &pacer{
+		resolution: resolution,
+		kick:       make(chan struct{}, 1),
+		stop:       make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+// sleep blocks until at least d has passed, as of the pacer's next tick, or
+// until done is closed.
+func (p *pacer) sleep(d time.Duration, done <-chan struct{}) bool {
+	if d <= 0 {
+		return true
+	}
+
+	w := &waiter{
+		deadline: time.Now().Add(d),
+		ch:       make(chan struct{}),
+	}
+
+	p.l.Lock()
+	if p.closed {
+		// Raced with the pacer being disabled.
+		p.l.Unlock()
+		return sleep(d, done)
+	}
+	heap.Push(&p.waiters, w)
+	p.l.Unlock()
+
+	// Wake up the pacer if it is idle.
+	select {
+	case p.kick <- struct{}{}:
+	default:
+	}
+
+	// A canceled waiter is left in the heap, and woken by a later tick.
+	select {
+	case <-w.ch:
+		return true
+	case <-done:
+		return false
+	}
+}
+
+// run ticks while there are operations waiting, waking those which are due.
+func (p *pacer) run() {
+	var ticker *time.Ticker
+	for {
+		p.l.Lock()
+		idle := len(p.waiters) == 0
+		p.l.Unlock()
+
+		if idle {
+			if ticker != nil {
+				ticker.Stop()
+				ticker = nil
+			}
+			select {
+			case <-p.kick:
+			case <-p.stop:
+				return
+			}
+			continue
+		}
+
+		if ticker == nil {
+			ticker = time.NewTicker(p.resolution)
+		}
+		select {
+		case now := <-ticker.C:
+			p.wake(now)
+		case <-p.stop:
+			ticker.Stop()
+			return
+		}
+	}
+}
+
+// wake wakes all operations due at now.
+func (p *pacer) wake(now time.Time) {
+	p.l.Lock()
+	defer p.l.Unlock()
+
+	p.ticks++
+	for len(p.waiters) > 0 && !p.waiters[0].deadline.After(now) {
+		close(heap.Pop(&p.waiters).(*waiter).ch)
+	}
+}
+
+// close stops the pacer, waking all waiting operations early. Sleeping
+// operations re-check the bucket when woken, so waking early is harmless.
+func (p *pacer) close() {
+	p.l.Lock()
+	defer p.l.Unlock()
+
+	p.closed = true
+	close(p.stop)
+	for _, w := range p.waiters {
+		close(w.ch)
+	}
+	p.waiters = nil
+}
+
+// waiter is an operation sleeping on the pacer.
+type waiter struct {
+	deadline time.Time
+	ch       chan struct{}
+}
+
+// waiters is a heap of waiters ordered by deadline.
+type waiters []*waiter
+
+func (h waiters) Len() int            { return len(h) }
+func (h waiters) Less(i, j int) bool  { return h[i].deadline.Before(h[j].deadline) }
+func (h waiters) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *waiters) Push(x interface{}) { *h = append(*h, x.(*waiter)) }
+
+func (h *waiters) Pop() interface{} {
+	old := *h
+	w := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return w
+}
@@ -0,0 +1,131 @@
+package iocap
+
+import (
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSharedPacer(t *testing.T) {
+	EnableSharedPacer(5 * time.Millisecond)
+	defer DisableSharedPacer()
+
+	w := NewWriter(ioutil.Discard, RateOpts{Interval: 50 * time.Millisecond, Size: 128})
+
+	// Writing 512 bytes needs three drains, now paced by the shared pacer.
+	start := time.Now()
+	if _, err := w.Write(make([]byte, 512)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	d := time.Since(start)
+	if d < 150*time.Millisecond {
+		t.Fatalf("write returned too quickly in %s", d)
+	}
+	if d > 250*time.Millisecond {
+		t.Fatalf("write took too long: %s", d)
+	}
+
+	p := loadPacer()
+	p.l.Lock()
+	defer p.l.Unlock()
+	if p.ticks == 0 {
+		t.Fatal("expect the pacer to tick")
+	}
+}
+
+func TestSharedPacer_Resolution(t *testing.T) {
+	for _, res := range []time.Duration{0, -time.Second} {
+		EnableSharedPacer(res)
+		if p := loadPacer(); p.resolution != minPacerResolution {
+			t.Fatalf("expect %s, got: %s", minPacerResolution, p.resolution)
+		}
+
+		// The ticker only starts once an operation waits on the pacer.
+		w := NewWriter(ioutil.Discard, RateOpts{Interval: 10 * time.Millisecond, Size: 128})
+		if _, err := w.Write(make([]byte, 256)); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		DisableSharedPacer()
+	}
+}
+
+func TestSharedPacer_Disable(t *testing.T) {
+	EnableSharedPacer(5 * time.Millisecond)
+
+	w := NewWriter(ioutil.Discard, RateOpts{Interval: 50 * time.Millisecond, Size: 128})
+	done := make(chan struct{})
+	go func() {
+		w.Write(make([]byte, 512))
+		close(done)
+	}()
+
+	// Disabling the pacer in the middle of the write falls back to timers
+	// without losing track of the waiting operation.
+	time.Sleep(75 * time.Millisecond)
+	DisableSharedPacer()
+	if loadPacer() != nil {
+		t.Fatal("expect pacer to be disabled")
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("write did not finish")
+	}
+}
+
+// countingClock is a real clock counting the sleeps made through it.
+type countingClock struct {
+	realClock
+	sleeps *int64
+}
+
+func (c countingClock) Sleep(d time.Duration, done <-chan struct{}) bool {
+	atomic.AddInt64(c.sleeps, 1)
+	return c.realClock.Sleep(d, done)
+}
+
+// benchmarkWriters runs 10k concurrent throttled writers, reporting the
+// number of timer wakeups per run.
+func benchmarkWriters(b *testing.B, pacer bool) {
+	if pacer {
+		EnableSharedPacer(time.Millisecond)
+		defer DisableSharedPacer()
+	}
+
+	var sleeps int64
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var wg sync.WaitGroup
+		for j := 0; j < 10000; j++ {
+			w := NewWriter(ioutil.Discard, RateOpts{Interval: 10 * time.Millisecond, Size: 64})
+			w.bucket.clock = countingClock{sleeps: &sleeps}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				w.Write(make([]byte, 256))
+			}()
+		}
+		wg.Wait()
+	}
+	b.StopTimer()
+
+	wakeups := float64(atomic.LoadInt64(&sleeps))
+	if p := loadPacer(); p != nil {
+		p.l.Lock()
+		wakeups = float64(p.ticks)
+		p.l.Unlock()
+	}
+	b.ReportMetric(wakeups/float64(b.N), "wakeups/op")
+}
+
+func BenchmarkWriters_Timers(b *testing.B) {
+	benchmarkWriters(b, false)
+}
+
+func BenchmarkWriters_SharedPacer(b *testing.B) {
+	benchmarkWriters(b, true)
+}
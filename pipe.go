@@ -0,0 +1,129 @@
+package iocap
+
+import (
+	"io"
+	"sync"
+)
+
+// pipe is the state shared by the two ends of a rate limited pipe.
+type pipe struct {
+	r *io.PipeReader
+	w *io.PipeWriter
+
+	// limit paces the writes to w, which wl keeps whole as with io.Pipe,
+	// rather than interleaving their chunks.
+	limit *Writer
+	wl    sync.Mutex
+
+	// err is the error of writes once either end is closed.
+	l   sync.Mutex
+	err error
+}
+
+// PipeReader is the read half of a pipe created with Pipe.
+type PipeReader struct {
+	p *pipe
+}
+
+// PipeWriter is the write half of a pipe created with Pipe.
+type PipeWriter struct {
+	p *pipe
+}
+
+// Pipe creates a synchronous in-memory pipe like io.Pipe, whose throughput
+// is limited to the rate opts. Writes block both until readers have
+// consumed the data, as with io.Pipe, and on the rate limit. Closing either
+// end unblocks writes waiting on the rate limit as well as those waiting on
+// readers, which return the same errors as with io.Pipe.
+//
+// It is safe to call Read and Write in parallel with each other or with
+// Close. Parallel calls to Write are gated sequentially, and share the rate.
+func Pipe(opts RateOpts) (*PipeReader, *PipeWriter) {
+	r, w := io.Pipe()
+	p := &pipe{
+		r:     r,
+		w:     w,
+		limit: NewWriter(w, opts),
+	}
+	return &PipeReader{p}, &PipeWriter{p}
+}
+
+// close records err as the error of later writes, unless an end of the
+// pipe was already closed, and abandons writes waiting on the rate limit.
+func (p *pipe) close(err error) {
+	p.l.Lock()
+	if p.err == nil {
+		p.err = err
+	}
+	p.l.Unlock()
+	p.limit.Cancel()
+}
+
+// closeErr returns the error of writes on the closed pipe.
+func (p *pipe) closeErr() error {
+	p.l.Lock()
+	defer p.l.Unlock()
+	return p.err
+}
+
+// Read implements io.Reader, reading data written to the other end of the
+// pipe, as with io.PipeReader. Reads are not rate limited themselves, but
+// only see data as fast as the writes are allowed.
+func (r *PipeReader) Read(data []byte) (int, error) {
+	return r.p.r.Read(data)
+}
+
+// Close closes the reader. Subsequent writes to the write half of the pipe
+// return io.ErrClosedPipe.
+func (r *PipeReader) Close() error {
+	return r.CloseWithError(nil)
+}
+
+// CloseWithError closes the reader. Subsequent writes to the write half of
+// the pipe return err, or io.ErrClosedPipe if err is nil.
+func (r *PipeReader) CloseWithError(err error) error {
+	r.p.r.CloseWithError(err)
+	if err == nil {
+		err = io.ErrClosedPipe
+	}
+	r.p.close(err)
+	return nil
+}
+
+// SetRate is used to dynamically set the rate options of the pipe.
+func (r *PipeReader) SetRate(opts RateOpts) {
+	r.p.limit.SetRate(opts)
+}
+
+// Write implements io.Writer, writing data to the pipe with rate limiting.
+// It blocks until the data is allowed by the rate and has been consumed by
+// readers, or either end of the pipe is closed.
+func (w *PipeWriter) Write(data []byte) (int, error) {
+	w.p.wl.Lock()
+	defer w.p.wl.Unlock()
+
+	n, err := w.p.limit.Write(data)
+	if err == ErrCanceled {
+		err = w.p.closeErr()
+	}
+	return n, err
+}
+
+// Close closes the writer. Subsequent reads from the read half of the pipe
+// return no bytes and io.EOF.
+func (w *PipeWriter) Close() error {
+	return w.CloseWithError(nil)
+}
+
+// CloseWithError closes the writer. Subsequent reads from the read half of
+// the pipe return no bytes and err, or io.EOF if err is nil.
+func (w *PipeWriter) CloseWithError(err error) error {
+	w.p.w.CloseWithError(err)
+	w.p.close(io.ErrClosedPipe)
+	return nil
+}
+
+// SetRate is used to dynamically set the rate options of the pipe.
+func (w *PipeWriter) SetRate(opts RateOpts) {
+	w.p.limit.SetRate(opts)
+}
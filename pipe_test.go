@@ -0,0 +1,125 @@
+package iocap
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestPipe(t *testing.T) {
+	clock := newFakeClock()
+	r, w := Pipe(RateOpts{Interval: 100 * time.Millisecond, Size: 100})
+	w.p.limit.SetClock(clock)
+
+	data := make([]byte, 1000)
+	rand.Read(data)
+	go func() {
+		w.Write(data[:400])
+		w.Write(data[400:])
+		w.Close()
+	}()
+	out, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(out, data) {
+		t.Fatal("bytes read do not match")
+	}
+
+	// 1000 bytes at 100 bytes per 100ms.
+	if d := clock.Now().Sub(newFakeClock().Now()); d != 900*time.Millisecond {
+		t.Fatalf("expect 900ms, took %s", d)
+	}
+}
+
+func TestPipe_Throughput(t *testing.T) {
+	r, w := Pipe(RateOpts{Interval: 50 * time.Millisecond, Size: 1000})
+	go func() {
+		w.Write(make([]byte, 5000))
+		w.Close()
+	}()
+	start := time.Now()
+	n, err := io.Copy(ioutil.Discard, r)
+	if err != nil || n != 5000 {
+		t.Fatalf("bad: %d, %v", n, err)
+	}
+	if d := time.Since(start); d < 180*time.Millisecond || d > time.Second {
+		t.Fatalf("expect about 200ms, took %s", d)
+	}
+}
+
+func TestPipe_CloseThrottled(t *testing.T) {
+	rate := RateOpts{Interval: time.Second, Size: 1}
+	for _, tc := range []struct {
+		name   string
+		close  func(*PipeReader, *PipeWriter)
+		expect error
+	}{
+		{"reader", func(r *PipeReader, w *PipeWriter) { r.Close() }, io.ErrClosedPipe},
+		{"reader error", func(r *PipeReader, w *PipeWriter) { r.CloseWithError(errFailed) }, errFailed},
+		{"writer", func(r *PipeReader, w *PipeWriter) { w.Close() }, io.ErrClosedPipe},
+	} {
+		r, w := Pipe(rate)
+		go io.Copy(ioutil.Discard, r)
+
+		// Close while the write is throttled mid-stream.
+		type result struct {
+			n   int
+			err error
+		}
+		doneCh := make(chan result, 1)
+		go func() {
+			n, err := w.Write(make([]byte, 10))
+			doneCh <- result{n, err}
+		}()
+		time.Sleep(50 * time.Millisecond)
+		tc.close(r, w)
+
+		select {
+		case res := <-doneCh:
+			if res.n != 1 || res.err != tc.expect {
+				t.Fatalf("%s: expect 1/%v, got: %d/%v", tc.name, tc.expect, res.n, res.err)
+			}
+		case <-time.After(500 * time.Millisecond):
+			t.Fatalf("%s: write still blocked", tc.name)
+		}
+
+		// Later writes fail right away.
+		if n, err := w.Write([]byte("x")); n != 0 || err != tc.expect {
+			t.Fatalf("%s: expect 0/%v, got: %d/%v", tc.name, tc.expect, n, err)
+		}
+	}
+}
+
+func TestPipe_CloseWriter(t *testing.T) {
+	r, w := Pipe(RateOpts{Interval: time.Second, Size: 100})
+	w.CloseWithError(errFailed)
+	if n, err := r.Read(make([]byte, 10)); n != 0 || err != errFailed {
+		t.Fatalf("expect 0/%v, got: %d/%v", errFailed, n, err)
+	}
+}
+
+func TestPipe_SetRate(t *testing.T) {
+	r, w := Pipe(RateOpts{Interval: time.Second, Size: 1})
+	go io.Copy(ioutil.Discard, r)
+	doneCh := make(chan error, 1)
+	go func() {
+		_, err := w.Write(make([]byte, 10))
+		doneCh <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// Lifting the rate completes the write right away.
+	r.SetRate(Unlimited)
+	select {
+	case err := <-doneCh:
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("write still blocked")
+	}
+}
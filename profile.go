@@ -0,0 +1,60 @@
+package iocap
+
+import (
+	"strings"
+	"time"
+)
+
+// Profile describes a typical network link, such as for emulating slow
+// clients in tests. The figures of the built-in profiles are rough, commonly
+// cited values rather than measurements.
+type Profile struct {
+	// Name identifies the profile for ProfileByName.
+	Name string
+
+	// Down is the rate from the network to the client, and Up the rate
+	// from the client to the network.
+	Down RateOpts
+	Up   RateOpts
+
+	// Latency is the suggested round-trip time of the link. Rate limiters
+	// do not add latency by themselves.
+	Latency time.Duration
+}
+
+var (
+	// ProfileGPRS is a 2G mobile data link.
+	ProfileGPRS = Profile{Name: "gprs", Down: Kbps(50), Up: Kbps(20), Latency: 500 * time.Millisecond}
+
+	// Profile3G is a 3G mobile data link.
+	Profile3G = Profile{Name: "3g", Down: Kbps(1600), Up: Kbps(768), Latency: 150 * time.Millisecond}
+
+	// ProfileLTE is a 4G mobile data link.
+	ProfileLTE = Profile{Name: "lte", Down: Mbps(20), Up: Mbps(5), Latency: 50 * time.Millisecond}
+
+	// ProfileDSL is a basic DSL line.
+	ProfileDSL = Profile{Name: "dsl", Down: Mbps(2), Up: Kbps(256), Latency: 25 * time.Millisecond}
+
+	// ProfileSatellite is a link over a geostationary satellite.
+	ProfileSatellite = Profile{Name: "satellite", Down: Mbps(15), Up: Mbps(3), Latency: 600 * time.Millisecond}
+)
+
+// profiles holds the built-in profiles, for ProfileByName.
+var profiles = []*Profile{
+	&ProfileGPRS,
+	&Profile3G,
+	&ProfileLTE,
+	&ProfileDSL,
+	&ProfileSatellite,
+}
+
+// ProfileByName returns the built-in profile with the given name, such as
+// "3g" or "satellite", ignoring case. It returns false if there is none.
+func ProfileByName(name string) (Profile, bool) {
+	for _, p := range profiles {
+		if strings.EqualFold(p.Name, name) {
+			return *p, true
+		}
+	}
+	return Profile{}, false
+}
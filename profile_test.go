@@ -0,0 +1,39 @@
+package iocap
+
+import (
+	"testing"
+)
+
+func TestProfiles(t *testing.T) {
+	for _, p := range profiles {
+		// Profiles limit both directions, downloads at least as fast.
+		if p.Down.IsUnlimited() || p.Up.IsUnlimited() {
+			t.Fatalf("%s: expect limits, got: %v, %v", p.Name, p.Down, p.Up)
+		}
+		if p.Down.BytesPerSecond() < p.Up.BytesPerSecond() {
+			t.Fatalf("%s: expect down %v >= up %v", p.Name, p.Down, p.Up)
+		}
+		if p.Latency <= 0 {
+			t.Fatalf("%s: bad latency: %s", p.Name, p.Latency)
+		}
+	}
+}
+
+func TestProfileByName(t *testing.T) {
+	for _, name := range []string{"gprs", "3G", "LTE", "dsl", "Satellite"} {
+		p, ok := ProfileByName(name)
+		if !ok {
+			t.Fatalf("%s: expect profile", name)
+		}
+		if v, _ := ProfileByName(p.Name); v != p {
+			t.Fatalf("%s: expect %v, got: %v", name, p, v)
+		}
+	}
+	if p, ok := ProfileByName("3g"); !ok || p != Profile3G {
+		t.Fatalf("expect %v, got: %v", Profile3G, p)
+	}
+
+	if _, ok := ProfileByName("carrier pigeon"); ok {
+		t.Fatal("expect no profile")
+	}
+}
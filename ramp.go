@@ -0,0 +1,82 @@
+package iocap
+
+import (
+	"time"
+)
+
+// ramp describes a gradual transition of a bucket's rate.
+type ramp struct {
+	from, to RateOpts
+	start    time.Time
+	over     time.Duration
+}
+
+// at returns the effective rate of the ramp at the given time, and whether
+// the ramp has completed. The rate is interpolated linearly in bytes per
+// second, in steps of the target interval, and expressed using the interval
+// of the target rate.
+func (r *ramp) at(now time.Time) (RateOpts, bool) {
+	elapsed := now.Sub(r.start)
+	if elapsed >= r.over {
+		return r.to, true
+	}
+	elapsed -= elapsed % r.to.Interval
+
+	frac := float64(elapsed) / float64(r.over)
+	from := float64(r.from.Size) / r.from.Interval.Seconds()
+	to := float64(r.to.Size) / r.to.Interval.Seconds()
+	bps := from + (to-from)*frac
+
+	size := int(bps*r.to.Interval.Seconds() + 0.5)
+	if size < 1 {
+		size = 1
+	}
+	// Only the size is stepped; the other options of the target, such as
+	// its overhead, apply throughout the ramp.
+	opts := r.to
+	opts.Size = size
+	return opts, false
+}
+
+// rampTo starts a gradual transition from the current rate of the bucket
+// to opts, taking the given duration. Ramps from or to Unlimited, and ramps
+// with no duration, take effect immediately.
+func (b *bucket) rampTo(opts RateOpts, over time.Duration) {
+	b.l.Lock()
+	defer b.l.Unlock()
+
+	now := b.clock.Now()
+	b.advanceRamp(now)
+	b.gen++
+
+	if over <= 0 || opts.IsUnlimited() || b.opts.IsUnlimited() {
+		b.opts = opts
+		b.ramp = nil
+		b.clampLocked()
+		b.notifyLocked()
+		return
+	}
+
+	b.ramp = &ramp{
+		from:  b.opts,
+		to:    opts,
+		start: now,
+		over:  over,
+	}
+}
+
+// advanceRamp applies the current step of an in-progress ramp to the
+// bucket. Must be called with the lock held.
+func (b *bucket) advanceRamp(now time.Time) {
+	if b.ramp == nil {
+		return
+	}
+	opts, done := b.ramp.at(now)
+	if opts != b.opts {
+		b.opts = opts
+		b.gen++
+	}
+	if done {
+		b.ramp = nil
+	}
+}
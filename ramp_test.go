@@ -0,0 +1,166 @@
+package iocap
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestGroupRampTo(t *testing.T) {
+	clock := newFakeClock()
+	g := NewGroup(RateOpts{Interval: 100 * time.Millisecond, Size: 100})
+	g.bucket.clock = clock
+
+	target := RateOpts{Interval: 100 * time.Millisecond, Size: 1100}
+	g.RampTo(target, time.Second)
+
+	// Keep traffic flowing while sampling the effective rate once per
+	// interval. It must rise monotonically to the target.
+	w := g.NewWriter(ioutil.Discard)
+	last := 0
+	for i := 0; i < 10; i++ {
+		w.Write(make([]byte, 50))
+		size := g.Rate().Size
+		if size < last {
+			t.Fatalf("rate decreased from %d to %d", last, size)
+		}
+		if size > target.Size {
+			t.Fatalf("rate %d overshot target", size)
+		}
+		last = size
+		clock.Advance(100 * time.Millisecond)
+	}
+
+	// Halfway through, the rate is halfway between.
+	if last == 100 || last == target.Size {
+		t.Fatalf("expect intermediate rate, got: %d", last)
+	}
+
+	// Settles on the target once the ramp has passed.
+	clock.Advance(100 * time.Millisecond)
+	if v := g.Rate(); v != target {
+		t.Fatalf("expect %v, got: %v", target, v)
+	}
+	clock.Advance(time.Second)
+	if v := g.Rate(); v != target {
+		t.Fatalf("expect %v, got: %v", target, v)
+	}
+}
+
+func TestGroupRampTo_Steps(t *testing.T) {
+	clock := newFakeClock()
+	g := NewGroup(RateOpts{Interval: time.Second, Size: 1000})
+	g.bucket.clock = clock
+
+	// Ramp down, and express the result in the new interval.
+	g.RampTo(RateOpts{Interval: 100 * time.Millisecond, Size: 10}, time.Second)
+
+	expect := []int{100, 91, 82, 73, 64, 55, 46, 37, 28, 19}
+	for _, size := range expect {
+		if v := g.Rate().Size; v != size {
+			t.Fatalf("expect %d, got: %d", size, v)
+		}
+
+		// Steps only happen on interval boundaries.
+		clock.Advance(50 * time.Millisecond)
+		if v := g.Rate().Size; v != size {
+			t.Fatalf("expect %d, got: %d", size, v)
+		}
+		clock.Advance(50 * time.Millisecond)
+	}
+}
+
+func TestGroupRampTo_Cancel(t *testing.T) {
+	clock := newFakeClock()
+	g := NewGroup(RateOpts{Interval: 100 * time.Millisecond, Size: 100})
+	g.bucket.clock = clock
+
+	g.RampTo(RateOpts{Interval: 100 * time.Millisecond, Size: 1100}, time.Second)
+	clock.Advance(500 * time.Millisecond)
+
+	// SetRate cancels the ramp.
+	expect := RateOpts{Interval: 100 * time.Millisecond, Size: 10}
+	g.SetRate(expect)
+	clock.Advance(time.Second)
+	if v := g.Rate(); v != expect {
+		t.Fatalf("expect %v, got: %v", expect, v)
+	}
+
+	// A new ramp starts from the current effective rate.
+	g.RampTo(RateOpts{Interval: 100 * time.Millisecond, Size: 110}, time.Second)
+	if v := g.Rate().Size; v != 10 {
+		t.Fatalf("expect 10, got: %d", v)
+	}
+}
+
+func TestReaderWriterRampTo(t *testing.T) {
+	target := RateOpts{Interval: time.Second, Size: 10}
+
+	// Ramps to or from Unlimited take effect immediately.
+	r := NewReader(nil, Unlimited)
+	r.RampTo(target, time.Hour)
+	if v := r.Rate(); v != target {
+		t.Fatalf("expect %v, got: %v", target, v)
+	}
+
+	w := NewWriter(nil, target)
+	w.RampTo(Unlimited, time.Hour)
+	if v := w.Rate(); v != Unlimited {
+		t.Fatalf("expect %v, got: %v", Unlimited, v)
+	}
+}
+
+func TestGroupRampTo_Overhead(t *testing.T) {
+	clock := newFakeClock()
+	g := NewGroup(RateOpts{Interval: 100 * time.Millisecond, Size: 100})
+	g.SetClock(clock)
+
+	target := RateOpts{Interval: 100 * time.Millisecond, Size: 1100, Overhead: 10, Weight: 2, Jitter: 0.5, StartFull: true}
+	g.RampTo(target, time.Second)
+	clock.Advance(500 * time.Millisecond)
+
+	// The options of the target other than the size apply mid-ramp.
+	w := g.NewWriter(ioutil.Discard)
+	w.Write(make([]byte, 10))
+	v := g.Rate()
+	if v.Size == 100 || v.Size == target.Size {
+		t.Fatalf("expect intermediate rate, got: %d", v.Size)
+	}
+	v.Size = target.Size
+	if v != target {
+		t.Fatalf("expect %v, got: %v", target, v)
+	}
+
+	// Each write is charged its overhead along with twice its bytes.
+	if n := g.Snapshot().Tokens; n != 30 {
+		t.Fatalf("expect 30 tokens, got: %d", n)
+	}
+}
+
+func TestGroupRampTo_PostCharge(t *testing.T) {
+	clock := newFakeClock()
+	g := NewGroup(RateOpts{Interval: 100 * time.Millisecond, Size: 100, PostCharge: true})
+	g.SetClock(clock)
+	g.RampTo(RateOpts{Interval: 100 * time.Millisecond, Size: 1100, PostCharge: true}, time.Second)
+	clock.Advance(500 * time.Millisecond)
+	size := g.Rate().Size
+
+	// Mid-ramp, reads are still charged after the fact, so no quota is
+	// held while the source is read.
+	avail := -1
+	r := g.NewReader(readerFunc(func(p []byte) (int, error) {
+		if avail < 0 {
+			avail = g.Available()
+		}
+		return 10, nil
+	}))
+	if n, err := r.Read(make([]byte, 100)); n != 100 || err != nil {
+		t.Fatalf("bad: %d, %v", n, err)
+	}
+	if avail != size {
+		t.Fatalf("expect %d available during the read, got: %d", size, avail)
+	}
+	if n := g.Snapshot().Tokens; n != 100 {
+		t.Fatalf("expect 100 tokens, got: %d", n)
+	}
+}
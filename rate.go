@@ -0,0 +1,514 @@
+package iocap
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// unitPrefixes maps the prefixes of rate units to their multiplier. Prefixes
+// are powers of 1024, like the KB and Kb constants, in either case.
+var unitPrefixes = map[byte]float64{
+	'k': 1 << 10, 'K': 1 << 10,
+	'm': 1 << 20, 'M': 1 << 20,
+	'g': 1 << 30, 'G': 1 << 30,
+}
+
+// ParseRate parses a human-readable rate, such as those found in
+// configuration files. A rate is a decimal number followed by a unit of
+// bytes ("B", "KB", "MB", "GB") or bits ("b", "Kb", "Mbit", ...), with an
+// upper-case B for bytes and a lower-case b for bits. Prefixes may be of
+// either case. The interval defaults to a second, and may be given after a
+// slash as "s", "min", "h" or any duration, such as "100MB/min" or
+// "64KB/100ms". Units ending in "ps", such as "Mbps" or "MBps", are always
+// per second. The value "unlimited" or "0" means no limit.
+func ParseRate(s string) (RateOpts, error) {
+	if strings.EqualFold(s, "unlimited") || s == "0" {
+		return Unlimited, nil
+	}
+
+	v, interval, hasInterval := s, time.Second, false
+	if i := strings.LastIndexByte(s, '/'); i >= 0 {
+		d, err := parseInterval(s[i+1:])
+		if err != nil {
+			return RateOpts{}, fmt.Errorf("iocap: invalid rate %q: %v", s, err)
+		}
+		v, interval, hasInterval = s[:i], d, true
+	}
+
+	i := strings.IndexFunc(v, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	switch {
+	case i == 0 || v == "":
+		return RateOpts{}, fmt.Errorf("iocap: invalid rate %q: missing number", s)
+	case i < 0:
+		return RateOpts{}, fmt.Errorf("iocap: invalid rate %q: missing unit", s)
+	}
+
+	n, err := strconv.ParseFloat(v[:i], 64)
+	if err != nil {
+		return RateOpts{}, fmt.Errorf("iocap: invalid rate %q: bad number %q", s, v[:i])
+	}
+	unit := strings.TrimSpace(v[i:])
+	size, perSecond, ok := parseUnit(unit)
+	switch {
+	case !ok:
+		return RateOpts{}, fmt.Errorf("iocap: invalid rate %q: unknown unit %q", s, unit)
+	case perSecond && hasInterval:
+		return RateOpts{}, fmt.Errorf("iocap: invalid rate %q: unit %q is already per second", s, unit)
+	}
+
+	ro, err := PerDuration(clampSize(n*size), interval)
+	if err != nil {
+		return RateOpts{}, fmt.Errorf("iocap: invalid rate %q: too small", s)
+	}
+	return ro, nil
+}
+
+// parseUnit returns the size in bytes of a rate unit, and whether the unit
+// is per second.
+func parseUnit(u string) (size float64, perSecond bool, ok bool) {
+	size = 1
+	if len(u) > 1 {
+		if p, ok := unitPrefixes[u[0]]; ok {
+			size, u = p, u[1:]
+		}
+	}
+
+	switch u {
+	case "B", "byte", "bytes":
+		return size, false, true
+	case "Bps":
+		return size, true, true
+	case "b", "bit", "bits":
+		return size / 8, false, true
+	case "bps":
+		return size / 8, true, true
+	}
+	return 0, false, false
+}
+
+// parseInterval parses the interval of a rate, which is either the name of
+// a unit of time or a duration.
+func parseInterval(s string) (time.Duration, error) {
+	switch s {
+	case "s", "sec", "second":
+		return time.Second, nil
+	case "m", "min", "minute":
+		return time.Minute, nil
+	case "h", "hour":
+		return time.Hour, nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("unknown interval %q", s)
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("interval %q is not positive", s)
+	}
+	return d, nil
+}
+
+// String returns the rate in a form meant for people, such as in logs:
+// "512.0 Kbit/s", "64 KiB per 100ms" or "unlimited". Rates per second are
+// given in bits, as network rates usually are, and others in bytes per
+// interval, each in the largest unit the size reaches. Use Spec for a form
+// which can be parsed back. Options beyond the interval and size, such as
+// Burst or Coarse, are not included.
+func (o RateOpts) String() string {
+	if o.IsUnlimited() {
+		return "unlimited"
+	}
+
+	if o.Interval == time.Second {
+		bits := float64(o.Size) * 8
+		units := []struct {
+			size float64
+			name string
+		}{{Gb * 8, "Gbit"}, {Mb * 8, "Mbit"}, {Kb * 8, "Kbit"}, {1, "bit"}}
+		for _, u := range units {
+			if bits >= u.size {
+				return fmt.Sprintf("%.1f %s/s", bits/u.size, u.name)
+			}
+		}
+	}
+
+	var size string
+	units := []struct {
+		size int
+		name string
+	}{{GB, "GiB"}, {MB, "MiB"}, {KB, "KiB"}, {1, "B"}}
+	for _, u := range units {
+		if o.Size < u.size {
+			continue
+		}
+		if o.Size%u.size == 0 {
+			size = fmt.Sprintf("%d %s", o.Size/u.size, u.name)
+		} else {
+			size = fmt.Sprintf("%.1f %s", float64(o.Size)/float64(u.size), u.name)
+		}
+		break
+	}
+
+	switch o.Interval {
+	case time.Minute:
+		return size + " per minute"
+	case time.Hour:
+		return size + " per hour"
+	}
+	return size + " per " + o.Interval.String()
+}
+
+// Spec returns the rate in the format understood by ParseRate, such as
+// "64KB/s", "10Mbit/s" or "1KB/100ms", so that it can be stored and parsed
+// back. The size is given in the largest byte unit which represents it
+// exactly, or in bits if that takes a number of 1024 or more while a larger
+// bit unit fits. Options beyond the interval and size, such as Burst or
+// Coarse, are not included.
+func (o RateOpts) Spec() string {
+	if o.IsUnlimited() {
+		return "unlimited"
+	}
+
+	units := []struct {
+		size   int
+		prefix string
+	}{{GB, "G"}, {MB, "M"}, {KB, "K"}, {1, ""}}
+
+	size, unit := o.Size, "B"
+	for i, u := range units {
+		if o.Size < u.size || o.Size%u.size != 0 {
+			continue
+		}
+		size, unit = o.Size/u.size, u.prefix+"B"
+
+		// Look for a larger bit unit.
+		if size < 1024 {
+			break
+		}
+		for _, b := range units[:i] {
+			if bit := b.size / 8; o.Size%bit == 0 {
+				size, unit = o.Size/bit, b.prefix+"bit"
+				break
+			}
+		}
+		break
+	}
+
+	var per string
+	switch o.Interval {
+	case time.Second:
+		per = "s"
+	case time.Minute:
+		per = "min"
+	case time.Hour:
+		per = "h"
+	default:
+		per = o.Interval.String()
+	}
+	return fmt.Sprintf("%d%s/%s", size, unit, per)
+}
+
+// Scale returns the rate multiplied by f, such as a share of 1/n of a rate
+// for each of n workers. Size, Burst and MaxBank are scaled and rounded to
+// the nearest byte. A rate which would drop below one byte per interval
+// keeps one byte over a longer interval instead, so that a limit is never
+// rounded down to zero, which would lift it; factors of zero or less give
+// one byte per interval. Unlimited rates stay unlimited.
+func (o RateOpts) Scale(f float64) RateOpts {
+	if o.IsUnlimited() {
+		return o
+	}
+
+	switch size := float64(o.Size) * f; {
+	case size >= 1:
+		o.Size = clampSize(size + 0.5)
+	case size > 0:
+		o.Interval = clampDuration(float64(o.Interval) / size)
+		o.Size = 1
+	default:
+		o.Size = 1
+	}
+	o.Burst = scaleCount(o.Burst, f)
+	o.MaxBank = scaleCount(o.MaxBank, f)
+	return o
+}
+
+// Add returns the sum of the rate and other, such as the aggregate of the
+// rates of several streams. The result is expressed over the shorter of the
+// two intervals, with the size rounded to the nearest byte, and takes its
+// other options from o. If either rate is unlimited, so is the sum.
+func (o RateOpts) Add(other RateOpts) RateOpts {
+	if o.IsUnlimited() || other.IsUnlimited() {
+		return Unlimited
+	}
+
+	interval := o.Interval
+	if other.Interval < interval {
+		interval = other.Interval
+	}
+	size := float64(o.Size)*float64(interval)/float64(o.Interval) +
+		float64(other.Size)*float64(interval)/float64(other.Interval)
+
+	o.Interval = interval
+	o.Size = clampSize(size + 0.5)
+	return o
+}
+
+// BytesPerSecond returns the average number of bytes per second allowed by
+// the rate, regardless of its interval. It is positive infinity if the rate
+// is unlimited.
+func (o RateOpts) BytesPerSecond() float64 {
+	if o.IsUnlimited() {
+		return math.Inf(1)
+	}
+	return float64(o.Size) / o.Interval.Seconds()
+}
+
+// Normalize returns the rate rewritten over an interval of a second, with
+// the size rounded to the nearest byte, so that rates expressed in
+// different ways can be compared. Rates below a byte per second keep one
+// byte over a longer interval instead, as with Scale. Other options are
+// kept, and unlimited rates normalize to Unlimited.
+func (o RateOpts) Normalize() RateOpts {
+	if o.IsUnlimited() {
+		return Unlimited
+	}
+	n := RateOpts{Interval: time.Second, Size: 1}.Scale(o.BytesPerSecond())
+	o.Interval, o.Size = n.Interval, n.Size
+	return o
+}
+
+// Equal returns whether the rate allows the same number of bytes per second
+// as other, however their intervals are expressed. Rates within half a byte
+// per second or 0.1% of each other, whichever is larger, are equal, which
+// absorbs the rounding of Normalize and of intervals such as 333ms. Options
+// other than Interval and Size are not compared. Unlimited rates are only
+// equal to other unlimited rates.
+func (o RateOpts) Equal(other RateOpts) bool {
+	if o.IsUnlimited() || other.IsUnlimited() {
+		return o.IsUnlimited() == other.IsUnlimited()
+	}
+	a, b := o.BytesPerSecond(), other.BytesPerSecond()
+	return math.Abs(a-b) <= math.Max(0.5, 0.001*math.Max(a, b))
+}
+
+// EstimateDuration returns roughly how long a new limiter with the rate
+// takes to transfer n bytes, such as to tell users how long an upload will
+// take. The initial burst of the rate goes out right away, and the rest
+// continuously for smooth rates, or over as many intervals as it takes for
+// coarse ones. The Weight of the rate and its Overhead for a single
+// operation are included. The estimate is within an interval of the actual
+// time, not counting any Jitter, and is zero for unlimited rates.
+func (o RateOpts) EstimateDuration(n int64) time.Duration {
+	if o.IsUnlimited() || n <= 0 {
+		return 0
+	}
+
+	charged := float64(n)
+	if o.Weight > 1 {
+		charged *= o.Weight
+	}
+	if o.Overhead > 0 {
+		charged += float64(o.Overhead)
+	}
+
+	burst := 0
+	if !o.StartFull {
+		burst = o.Size
+		if o.Burst > burst {
+			burst = o.Burst
+		}
+	}
+	rest := charged - float64(burst)
+	if rest <= 0 {
+		return 0
+	}
+
+	if o.smooth() {
+		return clampDuration(rest * float64(o.Interval) / float64(o.Size))
+	}
+	return clampDuration(math.Ceil(rest/float64(o.Size)) * float64(o.Interval))
+}
+
+// scaleCount scales a number of bytes by f, rounding to the nearest byte but
+// not down to zero.
+func scaleCount(n int, f float64) int {
+	if n <= 0 {
+		return n
+	}
+	if v := float64(n) * f; v >= 1 {
+		return clampSize(v + 0.5)
+	}
+	return 1
+}
+
+// clampDuration converts a number of nanoseconds to a duration, clamping it
+// to the longest duration.
+func clampDuration(n float64) time.Duration {
+	if n >= math.MaxInt64 {
+		return math.MaxInt64
+	}
+	return time.Duration(n)
+}
+
+// rateJSON is the JSON form of RateOpts. Field names match those of
+// RateOpts case-insensitively, so that rates encoded without MarshalJSON
+// still decode.
+type rateJSON struct {
+	Interval   jsonDuration `json:"interval"`
+	Size       int          `json:"size"`
+	MaxBank    int          `json:"maxBank,omitempty"`
+	Coarse     bool         `json:"coarse,omitempty"`
+	Burst      int          `json:"burst,omitempty"`
+	Jitter     float64      `json:"jitter,omitempty"`
+	StartFull  bool         `json:"startFull,omitempty"`
+	Overhead   int          `json:"overhead,omitempty"`
+	Weight     float64      `json:"weight,omitempty"`
+	PostCharge bool         `json:"postCharge,omitempty"`
+}
+
+// jsonDuration is a duration encoded as a string such as "100ms". Numbers
+// of nanoseconds are also accepted.
+type jsonDuration time.Duration
+
+func (d jsonDuration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *jsonDuration) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] != '"' {
+		var n int64
+		if err := json.Unmarshal(data, &n); err != nil {
+			return fmt.Errorf("bad interval %s", data)
+		}
+		*d = jsonDuration(n)
+		return nil
+	}
+
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("bad interval %q", s)
+	}
+	*d = jsonDuration(v)
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler. Rates are encoded as objects with
+// the interval as a duration string, such as {"interval":"100ms","size":512}.
+// Options left at zero are omitted.
+func (o RateOpts) MarshalJSON() ([]byte, error) {
+	return json.Marshal(rateJSON{
+		Interval:   jsonDuration(o.Interval),
+		Size:       o.Size,
+		MaxBank:    o.MaxBank,
+		Coarse:     o.Coarse,
+		Burst:      o.Burst,
+		Jitter:     o.Jitter,
+		StartFull:  o.StartFull,
+		Overhead:   o.Overhead,
+		Weight:     o.Weight,
+		PostCharge: o.PostCharge,
+	})
+}
+
+// UnmarshalJSON implements json.Unmarshaler. It accepts the objects written
+// by MarshalJSON, with the interval as a duration string or a number of
+// nanoseconds, as well as strings in the format understood by ParseRate,
+// such as "512kbps" or "unlimited".
+func (o *RateOpts) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		return nil
+	}
+
+	if len(data) > 0 && data[0] == '"' {
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		ro, err := ParseRate(s)
+		if err != nil {
+			return err
+		}
+		*o = ro
+		return nil
+	}
+
+	var v rateJSON
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&v); err != nil {
+		return fmt.Errorf("iocap: invalid rate %s: %v", data, err)
+	}
+	if v.Interval < 0 || v.Size < 0 {
+		return fmt.Errorf("iocap: invalid rate %s: negative interval or size", data)
+	}
+
+	*o = RateOpts{
+		Interval:   time.Duration(v.Interval),
+		Size:       v.Size,
+		MaxBank:    v.MaxBank,
+		Coarse:     v.Coarse,
+		Burst:      v.Burst,
+		Jitter:     v.Jitter,
+		StartFull:  v.StartFull,
+		Overhead:   v.Overhead,
+		Weight:     v.Weight,
+		PostCharge: v.PostCharge,
+	}
+	return nil
+}
+
+// RateFlag is a rate which implements flag.Value, as well as
+// encoding.TextMarshaler and encoding.TextUnmarshaler for use with
+// configuration loaders. Rates are given in the format understood by
+// ParseRate.
+type RateFlag RateOpts
+
+// RateVar defines a rate flag with the given name, default value and usage
+// string on fs, or on flag.CommandLine if fs is nil. The rate is stored in
+// p.
+func RateVar(fs *flag.FlagSet, p *RateOpts, name string, value RateOpts, usage string) {
+	if fs == nil {
+		fs = flag.CommandLine
+	}
+	*p = value
+	fs.Var((*RateFlag)(p), name, usage)
+}
+
+// Set implements flag.Value.
+func (f *RateFlag) Set(s string) error {
+	ro, err := ParseRate(s)
+	if err != nil {
+		return err
+	}
+	*f = RateFlag(ro)
+	return nil
+}
+
+// String implements flag.Value. The rate is given in the format understood
+// by ParseRate.
+func (f RateFlag) String() string {
+	return RateOpts(f).Spec()
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (f RateFlag) MarshalText() ([]byte, error) {
+	return []byte(f.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (f *RateFlag) UnmarshalText(text []byte) error {
+	return f.Set(string(text))
+}
@@ -0,0 +1,420 @@
+package iocap
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRate(t *testing.T) {
+	cases := map[string]RateOpts{
+		"unlimited":  Unlimited,
+		"Unlimited":  Unlimited,
+		"0":          Unlimited,
+		"512B/s":     {Interval: time.Second, Size: 512},
+		"2MB/s":      {Interval: time.Second, Size: 2 << 20},
+		"1.5KB":      {Interval: time.Second, Size: 1536},
+		"10Mbps":     Mbps(10),
+		"512kbps":    Kbps(512),
+		"1.5Gbit":    Gbps(1.5),
+		"8 kb/s":     KBps(1),
+		"5MBps":      MBps(5),
+		"1gB":        GBps(1),
+		"100MB/min":  {Interval: time.Minute, Size: 100 << 20},
+		"1GB/h":      {Interval: time.Hour, Size: 1 << 30},
+		"64KB/100ms": {Interval: 100 * time.Millisecond, Size: 64 << 10},
+		"10bytes/2s": {Interval: 2 * time.Second, Size: 10},
+	}
+	for in, expect := range cases {
+		ro, err := ParseRate(in)
+		if err != nil {
+			t.Fatalf("%s: err: %v", in, err)
+		}
+		if ro != expect {
+			t.Fatalf("%s: expect %v, got: %v", in, expect, ro)
+		}
+	}
+}
+
+func TestParseRate_Errors(t *testing.T) {
+	cases := map[string]string{
+		"":           "missing number",
+		"MB/s":       "missing number",
+		"512":        "missing unit",
+		"2XB/s":      `unknown unit "XB"`,
+		"1..5MB":     `bad number "1..5"`,
+		"0.1B/s":     "too small",
+		"10MB/week":  `unknown interval "week"`,
+		"10MB/-1s":   "not positive",
+		"10Mbps/min": "already per second",
+	}
+	for in, expect := range cases {
+		_, err := ParseRate(in)
+		if err == nil {
+			t.Fatalf("%s: expect error", in)
+		}
+		if !strings.Contains(err.Error(), expect) {
+			t.Fatalf("%s: expect %q in error, got: %v", in, expect, err)
+		}
+	}
+}
+
+func TestRateOptsString(t *testing.T) {
+	cases := map[string]RateOpts{
+		"unlimited":          Unlimited,
+		"512.0 Kbit/s":       Kbps(512),
+		"10.0 Mbit/s":        Mbps(10),
+		"1.5 Kbit/s":         Kbps(1.5),
+		"16.0 Gbit/s":        GBps(2),
+		"8.0 bit/s":          {Interval: time.Second, Size: 1},
+		"64 KiB per 100ms":   {Interval: 100 * time.Millisecond, Size: 64 << 10},
+		"1.5 KiB per 250ms":  {Interval: 250 * time.Millisecond, Size: 1536},
+		"384 B per 1ms":      {Interval: time.Millisecond, Size: 384},
+		"100 MiB per minute": {Interval: time.Minute, Size: 100 << 20},
+		"1 GiB per hour":     {Interval: time.Hour, Size: 1 << 30},
+	}
+	for expect, ro := range cases {
+		if s := ro.String(); s != expect {
+			t.Fatalf("expect %q, got: %q", expect, s)
+		}
+	}
+}
+
+func TestRateOptsSpec(t *testing.T) {
+	cases := map[string]RateOpts{
+		"unlimited":  Unlimited,
+		"512B/s":     {Interval: time.Second, Size: 512},
+		"12Kbit/s":   {Interval: time.Second, Size: 1536},
+		"64KB/s":     Kbps(512),
+		"5MB/s":      MBps(5),
+		"2GB/s":      GBps(2),
+		"100MB/min":  {Interval: time.Minute, Size: 100 << 20},
+		"1KB/h":      {Interval: time.Hour, Size: 1 << 10},
+		"64KB/100ms": {Interval: 100 * time.Millisecond, Size: 64 << 10},
+		"10Mbit/s":   Mbps(10),
+		"10Gbit/s":   Gbps(10),
+		"128MB/s":    MBps(128),
+		"128B/s":     Kbps(1),
+		"384B/1ms":   {Interval: time.Millisecond, Size: 384},
+		"192B/s":     Kbps(1.5),
+		"1B/1m30s":   {Interval: 90 * time.Second, Size: 1},
+	}
+	for expect, ro := range cases {
+		if s := ro.Spec(); s != expect {
+			t.Fatalf("expect %q, got: %q", expect, s)
+		}
+
+		// Rates survive a round trip through ParseRate.
+		v, err := ParseRate(ro.Spec())
+		if err != nil {
+			t.Fatalf("%s: err: %v", expect, err)
+		}
+		if v != ro {
+			t.Fatalf("%s: expect %v, got: %v", expect, ro, v)
+		}
+	}
+}
+
+func TestRateOptsJSON(t *testing.T) {
+	cases := map[string]RateOpts{
+		`{"interval":"0s","size":0}`:                   Unlimited,
+		`{"interval":"100ms","size":65536}`:            {Interval: 100 * time.Millisecond, Size: 65536},
+		`{"interval":"1s","size":10,"coarse":true}`:    {Interval: time.Second, Size: 10, Coarse: true},
+		`{"interval":"1m0s","size":1,"burst":5}`:       {Interval: time.Minute, Size: 1, Burst: 5},
+		`{"interval":"1s","size":1,"postCharge":true}`: {Interval: time.Second, Size: 1, PostCharge: true},
+	}
+	for expect, ro := range cases {
+		// Rates encode to objects with duration strings.
+		raw, err := json.Marshal(ro)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if string(raw) != expect {
+			t.Fatalf("expect %s, got: %s", expect, raw)
+		}
+
+		// And survive a round trip.
+		var v RateOpts
+		if err := json.Unmarshal(raw, &v); err != nil {
+			t.Fatalf("%s: err: %v", raw, err)
+		}
+		if v != ro {
+			t.Fatalf("%s: expect %#v, got: %#v", raw, ro, v)
+		}
+	}
+}
+
+func TestRateOptsJSON_Unmarshal(t *testing.T) {
+	cases := map[string]RateOpts{
+		`"512kbps"`:   Kbps(512),
+		`"100MB/min"`: {Interval: time.Minute, Size: 100 << 20},
+		`"unlimited"`: Unlimited,
+		`{"Interval":1000000000,"Size":5,"MaxBank":10,"Coarse":false}`: {Interval: time.Second, Size: 5, MaxBank: 10},
+		`{"size":5,"interval":"250ms"}`:                                {Interval: 250 * time.Millisecond, Size: 5},
+	}
+	for in, expect := range cases {
+		var v RateOpts
+		if err := json.Unmarshal([]byte(in), &v); err != nil {
+			t.Fatalf("%s: err: %v", in, err)
+		}
+		if v != expect {
+			t.Fatalf("%s: expect %#v, got: %#v", in, expect, v)
+		}
+	}
+
+	// Null leaves the rate alone.
+	v := Kbps(1)
+	if err := json.Unmarshal([]byte("null"), &v); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if v != Kbps(1) {
+		t.Fatalf("expect %v, got: %v", Kbps(1), v)
+	}
+}
+
+func TestRateOptsJSON_Invalid(t *testing.T) {
+	cases := map[string]string{
+		`"fast"`:                              "missing number",
+		`{"interval":"1 sec","size":1}`:       `bad interval "1 sec"`,
+		`{"interval":true,"size":1}`:          "bad interval true",
+		`{"interval":"1s","size":"1"}`:        "cannot unmarshal",
+		`{"interval":"1s","size":-1}`:         "negative",
+		`{"interval":"-1s","size":1}`:         "negative",
+		`{"interval":"1s","size":1,"rate":1}`: "unknown field",
+		`[]`:                                  "cannot unmarshal",
+	}
+	for in, expect := range cases {
+		var v RateOpts
+		err := json.Unmarshal([]byte(in), &v)
+		if err == nil {
+			t.Fatalf("%s: expect error", in)
+		}
+		if !strings.Contains(err.Error(), expect) {
+			t.Fatalf("%s: expect %q in error, got: %v", in, expect, err)
+		}
+	}
+}
+
+func TestRateVar(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	var in, out RateOpts
+	RateVar(fs, &in, "in", Unlimited, "")
+	RateVar(fs, &out, "out", MBps(1), "")
+
+	// Defaults apply to flags which are not given.
+	if err := fs.Parse([]string{"-in", "512kbps"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if in != Kbps(512) {
+		t.Fatalf("expect %v, got: %v", Kbps(512), in)
+	}
+	if out != MBps(1) {
+		t.Fatalf("expect %v, got: %v", MBps(1), out)
+	}
+	if v := fs.Lookup("out").Value.String(); v != "1MB/s" {
+		t.Fatalf("expect 1MB/s, got: %s", v)
+	}
+
+	// Bad values are rejected.
+	for _, v := range []string{"fast", "10MB/week", ""} {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		fs.SetOutput(ioutil.Discard)
+		RateVar(fs, &in, "in", Unlimited, "")
+		if err := fs.Parse([]string{"-in", v}); err == nil {
+			t.Fatalf("%q: expect error", v)
+		}
+	}
+}
+
+func TestRateFlag_Text(t *testing.T) {
+	// Rate flags in configuration structs decode from strings.
+	var conf struct {
+		Max RateFlag
+	}
+	if err := json.Unmarshal([]byte(`{"Max":"100MB/min"}`), &conf); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if expect := (RateOpts{Interval: time.Minute, Size: 100 << 20}); RateOpts(conf.Max) != expect {
+		t.Fatalf("expect %v, got: %v", expect, RateOpts(conf.Max))
+	}
+
+	raw, err := json.Marshal(conf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(raw) != `{"Max":"100MB/min"}` {
+		t.Fatalf("bad: %s", raw)
+	}
+
+	if err := conf.Max.UnmarshalText([]byte("1.2.3")); err == nil {
+		t.Fatal("expect error")
+	}
+}
+
+func TestRateOptsScale(t *testing.T) {
+	cases := []struct {
+		ro     RateOpts
+		f      float64
+		expect RateOpts
+	}{
+		{MBps(1), 0.5, KBps(512)},
+		{MBps(1), 2, MBps(2)},
+		{RateOpts{Interval: time.Second, Size: 10}, 1.0 / 3, RateOpts{Interval: time.Second, Size: 3}},
+		{RateOpts{Interval: time.Second, Size: 10}, 0.25, RateOpts{Interval: time.Second, Size: 3}},
+		{RateOpts{Interval: time.Second, Size: 10, Burst: 100, MaxBank: 1}, 0.5,
+			RateOpts{Interval: time.Second, Size: 5, Burst: 50, MaxBank: 1}},
+
+		// Rates below a byte per interval stretch the interval.
+		{RateOpts{Interval: time.Second, Size: 1}, 0.5, RateOpts{Interval: 2 * time.Second, Size: 1}},
+		{RateOpts{Interval: time.Second, Size: 4}, 0.1, RateOpts{Interval: 2500 * time.Millisecond, Size: 1}},
+		{RateOpts{Interval: time.Second, Size: 4}, 0, RateOpts{Interval: time.Second, Size: 1}},
+		{RateOpts{Interval: time.Second, Size: 4}, -1, RateOpts{Interval: time.Second, Size: 1}},
+
+		// Unlimited rates stay unlimited.
+		{Unlimited, 0.5, Unlimited},
+		{RateOpts{Interval: time.Second}, 10, RateOpts{Interval: time.Second}},
+	}
+	for _, c := range cases {
+		if v := c.ro.Scale(c.f); v != c.expect {
+			t.Fatalf("%v * %v: expect %#v, got: %#v", c.ro, c.f, c.expect, v)
+		}
+	}
+}
+
+func TestRateOptsAdd(t *testing.T) {
+	cases := []struct {
+		a, b   RateOpts
+		expect RateOpts
+	}{
+		{KBps(1), KBps(2), KBps(3)},
+		{KBps(1), RateOpts{Interval: 100 * time.Millisecond, Size: 100},
+			RateOpts{Interval: 100 * time.Millisecond, Size: 202}},
+		{RateOpts{Interval: time.Minute, Size: 60}, RateOpts{Interval: time.Second, Size: 1},
+			RateOpts{Interval: time.Second, Size: 2}},
+		{RateOpts{Interval: time.Second, Size: 10, Coarse: true}, RateOpts{Interval: 2 * time.Second, Size: 5},
+			RateOpts{Interval: time.Second, Size: 13, Coarse: true}},
+
+		// Anything plus unlimited is unlimited.
+		{Unlimited, KBps(1), Unlimited},
+		{KBps(1), Unlimited, Unlimited},
+		{KBps(1), RateOpts{Interval: time.Second}, Unlimited},
+	}
+	for _, c := range cases {
+		if v := c.a.Add(c.b); v != c.expect {
+			t.Fatalf("%v + %v: expect %#v, got: %#v", c.a, c.b, c.expect, v)
+		}
+	}
+
+	// Scaling and adding back up gives the original rate.
+	ro := MBps(3)
+	share := ro.Scale(1.0 / 3)
+	if v := share.Add(share).Add(share); v != ro {
+		t.Fatalf("expect %v, got: %v", ro, v)
+	}
+}
+
+func TestRateOptsNormalize(t *testing.T) {
+	cases := []struct {
+		ro     RateOpts
+		bps    float64
+		expect RateOpts
+	}{
+		{KBps(512), 512 << 10, KBps(512)},
+		{RateOpts{Interval: 125 * time.Millisecond, Size: 64 << 10}, 512 << 10, KBps(512)},
+		{RateOpts{Interval: 333 * time.Millisecond, Size: 1000}, 1000 / 0.333, RateOpts{Interval: time.Second, Size: 3003}},
+		{RateOpts{Interval: time.Minute, Size: 6000, Burst: 10}, 100, RateOpts{Interval: time.Second, Size: 100, Burst: 10}},
+		{RateOpts{Interval: 4 * time.Second, Size: 1}, 0.25, RateOpts{Interval: 4 * time.Second, Size: 1}},
+		{RateOpts{Interval: time.Hour, Size: 1800}, 0.5, RateOpts{Interval: 2 * time.Second, Size: 1}},
+	}
+	for _, c := range cases {
+		if v := c.ro.BytesPerSecond(); math.Abs(v-c.bps) > 1e-6 {
+			t.Fatalf("%v: expect %f bytes/s, got: %f", c.ro, c.bps, v)
+		}
+		v := c.ro.Normalize()
+		if v != c.expect {
+			t.Fatalf("%v: expect %#v, got: %#v", c.ro, c.expect, v)
+		}
+		if !v.Equal(c.ro) {
+			t.Fatalf("%v: expect equal to %v", c.ro, v)
+		}
+	}
+
+	// Unlimited rates stay unlimited.
+	if v := (RateOpts{Interval: time.Second}).Normalize(); v != Unlimited {
+		t.Fatalf("expect unlimited, got: %#v", v)
+	}
+	if v := Unlimited.BytesPerSecond(); !math.IsInf(v, 1) {
+		t.Fatalf("expect +Inf, got: %f", v)
+	}
+}
+
+func TestRateOptsEqual(t *testing.T) {
+	cases := []struct {
+		a, b  RateOpts
+		equal bool
+	}{
+		{KBps(512), RateOpts{Interval: 125 * time.Millisecond, Size: 64 << 10}, true},
+		{RateOpts{Interval: 333 * time.Millisecond, Size: 1000}, RateOpts{Interval: time.Second, Size: 3000}, true},
+		{RateOpts{Interval: 333 * time.Millisecond, Size: 1000}, RateOpts{Interval: time.Second, Size: 2990}, false},
+		{RateOpts{Interval: time.Second, Size: 1}, RateOpts{Interval: 2 * time.Second, Size: 3}, true},
+		{RateOpts{Interval: time.Second, Size: 1}, RateOpts{Interval: time.Second, Size: 2}, false},
+		{MBps(1), MBps(1.01), false},
+		{Unlimited, RateOpts{Size: 10}, true},
+		{Unlimited, KBps(1), false},
+		{KBps(1), Unlimited, false},
+	}
+	for _, c := range cases {
+		if v := c.a.Equal(c.b); v != c.equal {
+			t.Fatalf("%v == %v: expect %v, got: %v", c.a, c.b, c.equal, v)
+		}
+		if v := c.b.Equal(c.a); v != c.equal {
+			t.Fatalf("%v == %v: expect %v, got: %v", c.b, c.a, c.equal, v)
+		}
+	}
+}
+
+func TestRateOptsEstimateDuration(t *testing.T) {
+	base := RateOpts{Interval: 100 * time.Millisecond, Size: 1000, Coarse: true}
+	cases := []struct {
+		ro     RateOpts
+		n      int64
+		expect time.Duration
+	}{
+		{base, 0, 0},
+		{base, 1000, 0},
+		{base, 1001, 100 * time.Millisecond},
+		{base, 10000, 900 * time.Millisecond},
+		{RateOpts{Interval: 100 * time.Millisecond, Size: 1000, Burst: 3000, Coarse: true}, 10000, 700 * time.Millisecond},
+		{RateOpts{Interval: 100 * time.Millisecond, Size: 1000, StartFull: true, Coarse: true}, 10000, time.Second},
+		{RateOpts{Interval: 100 * time.Millisecond, Size: 1000}, 10000, 900 * time.Millisecond},
+		{RateOpts{Interval: 100 * time.Millisecond, Size: 1000}, 1500, 50 * time.Millisecond},
+		{RateOpts{Interval: 100 * time.Millisecond, Size: 1000, Weight: 2, Coarse: true}, 5000, 900 * time.Millisecond},
+		{RateOpts{Interval: 100 * time.Millisecond, Size: 1000, Overhead: 1, Coarse: true}, 1000, 100 * time.Millisecond},
+		{RateOpts{Interval: time.Second, Size: KB, Coarse: true}, 23 * MB / 10, 2355 * time.Second},
+		{Unlimited, 1 << 20, 0},
+	}
+	for _, c := range cases {
+		d := c.ro.EstimateDuration(c.n)
+		if d != c.expect {
+			t.Fatalf("%#v, %d: expect %s, got: %s", c.ro, c.n, c.expect, d)
+		}
+
+		// The estimate agrees with an actual transfer within an interval.
+		clock := newFakeClock()
+		w := NewWriter(ioutil.Discard, c.ro)
+		w.SetClock(clock)
+		start := clock.Now()
+		if _, err := w.Write(make([]byte, c.n)); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		actual := clock.Now().Sub(start)
+		if diff := actual - d; diff < -c.ro.Interval || diff > c.ro.Interval {
+			t.Fatalf("%#v, %d: estimated %s, took %s", c.ro, c.n, d, actual)
+		}
+	}
+}
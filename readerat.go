@@ -0,0 +1,96 @@
+package iocap
+
+import (
+	"io"
+	"time"
+)
+
+// ReaderAt implements the io.ReaderAt interface and limits the rate at
+// which bytes are read from the underlying io.ReaderAt. Like any
+// io.ReaderAt, it may be used by multiple goroutines at once, in which
+// case they share its rate.
+type ReaderAt struct {
+	ra     io.ReaderAt
+	bucket *bucket
+}
+
+// NewReaderAt wraps ra in a new rate limited io.ReaderAt.
+func NewReaderAt(ra io.ReaderAt, opts RateOpts) *ReaderAt {
+	return &ReaderAt{
+		ra:     ra,
+		bucket: newBucket(opts),
+	}
+}
+
+// ReadAt reads len(p) bytes from the underlying io.ReaderAt starting at
+// offset off, with rate limiting. Only the bytes actually read are charged,
+// along with the Overhead and Weight of the rate.
+func (r *ReaderAt) ReadAt(p []byte, off int64) (n int, err error) {
+	var s schedule
+	for n < len(p) {
+		// Ask for enough space to fit all remaining bytes.
+		want, _ := r.bucket.pace(len(p)-n, &s, nil)
+
+		// Read the next range of bytes into p.
+		var v int
+		v, err = r.ra.ReadAt(p[n:n+want], off+int64(n))
+
+		// Give back the tokens of a short read, such as at EOF.
+		if v < want {
+			r.bucket.refund(want - v)
+			s.valid = false
+		}
+		r.bucket.chargeOverhead(v, &s, nil)
+		n += v
+
+		// Return any errors from the underlying reader, including EOF.
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// SetRate is used to dynamically set the rate options on the reader.
+func (r *ReaderAt) SetRate(opts RateOpts) {
+	r.bucket.setRate(opts)
+}
+
+// RampTo gradually changes the rate of the reader to opts over the given
+// duration, stepping the rate once per interval. A subsequent SetRate or
+// RampTo cancels the ramp.
+func (r *ReaderAt) RampTo(opts RateOpts, over time.Duration) {
+	r.bucket.rampTo(opts, over)
+}
+
+// Rate returns the rate options currently in effect on the reader.
+func (r *ReaderAt) Rate() RateOpts {
+	return r.bucket.rate()
+}
+
+// SetClock replaces the source of time of the reader, which is shared by
+// any other members of its group. It must be called before the reader is
+// used.
+func (r *ReaderAt) SetClock(c Clock) {
+	r.bucket.setClock(c)
+}
+
+// NewReaderAt creates and returns a new io.ReaderAt in the group.
+func (g *Group) NewReaderAt(ra io.ReaderAt) *ReaderAt {
+	if g.parent != nil {
+		// Reads are pulled through the parent's reader.
+		ra = g.parent.NewReaderAt(ra)
+	}
+	return &ReaderAt{
+		ra:     ra,
+		bucket: g.bucket,
+	}
+}
+
+// NewSectionReader returns an io.SectionReader reading n bytes of ra from
+// offset off, with reads charged to the group. Each section keeps its own
+// offset, so sections of the same file can be read and seeked in parallel
+// while sharing the bandwidth of the group.
+func (g *Group) NewSectionReader(ra io.ReaderAt, off, n int64) *io.SectionReader {
+	return io.NewSectionReader(g.NewReaderAt(ra), off, n)
+}
@@ -0,0 +1,122 @@
+package iocap
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReaderAt(t *testing.T) {
+	data := make([]byte, 512)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	r := NewReaderAt(bytes.NewReader(data), RateOpts{Interval: 100 * time.Millisecond, Size: 128})
+	out := make([]byte, 384)
+
+	// 384 bytes need two drains.
+	start := time.Now()
+	n, err := r.ReadAt(out, 128)
+	if d := time.Since(start); d < 200*time.Millisecond {
+		t.Fatalf("read returned too quickly in %s", d)
+	}
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if n != 384 {
+		t.Fatalf("expect 384, got: %d", n)
+	}
+	if !bytes.Equal(out, data[128:]) {
+		t.Fatal("unexpected data read")
+	}
+
+	// Reading past the end returns EOF.
+	if _, err := r.ReadAt(out, 256); err != io.EOF {
+		t.Fatalf("expect EOF, got: %v", err)
+	}
+}
+
+func TestReaderAt_Short(t *testing.T) {
+	r := NewReaderAt(bytes.NewReader(make([]byte, 100)), RateOpts{Interval: time.Second, Size: 100})
+
+	// A short read at EOF only charges the bytes read.
+	if n, err := r.ReadAt(make([]byte, 80), 60); n != 40 || err != io.EOF {
+		t.Fatalf("expect 40/EOF, got: %d/%v", n, err)
+	}
+	if n := r.bucket.available(); n != 60 {
+		t.Fatalf("expect 60 available, got: %d", n)
+	}
+}
+
+func TestReaderAt_Overhead(t *testing.T) {
+	rate := RateOpts{Interval: time.Second, Size: 100, Overhead: 5, Weight: 2}
+	r := NewReaderAt(bytes.NewReader(make([]byte, 100)), rate)
+
+	// Reads are charged twice their bytes, plus the overhead.
+	if _, err := r.ReadAt(make([]byte, 10), 0); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if n := r.bucket.available(); n != 75 {
+		t.Fatalf("expect 75 available, got: %d", n)
+	}
+}
+
+func TestGroupNewSectionReader(t *testing.T) {
+	data := make([]byte, 1024)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	f, err := ioutil.TempFile("", "iocap")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Read four sections of the file concurrently, sharing one group.
+	g := NewGroup(RateOpts{Interval: 100 * time.Millisecond, Size: 256})
+	out := make([]byte, len(data))
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			off := int64(i * 256)
+			sr := g.NewSectionReader(f, off, 256)
+
+			// Sections seek independently of each other.
+			if _, err := sr.Seek(128, io.SeekStart); err != nil {
+				t.Errorf("err: %v", err)
+				return
+			}
+			if _, err := io.ReadFull(sr, out[off+128:off+256]); err != nil {
+				t.Errorf("err: %v", err)
+				return
+			}
+			sr.Seek(0, io.SeekStart)
+			if _, err := io.ReadFull(sr, out[off:off+128]); err != nil {
+				t.Errorf("err: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// 1024 bytes at 256 per interval need three drains.
+	if d := time.Since(start); d < 300*time.Millisecond {
+		t.Fatalf("reads returned too quickly in %s", d)
+	}
+	if !bytes.Equal(out, data) {
+		t.Fatal("unexpected data read")
+	}
+}
@@ -0,0 +1,73 @@
+package iocap
+
+import (
+	"io"
+)
+
+// ReadWriter limits the rate of both directions of a stream, such as a
+// connection, with an independent rate for each. Like bufio.ReadWriter, it
+// embeds the Reader and Writer of the two directions, whose other methods,
+// such as Stats and SetDeadline, are reached through them.
+type ReadWriter struct {
+	*Reader
+	*Writer
+
+	rw io.ReadWriter
+}
+
+// NewReadWriter wraps rw in a new rate limited io.ReadWriter, which reads
+// at the rate readOpts and writes at the rate writeOpts. The two directions
+// don't share any quota.
+func NewReadWriter(rw io.ReadWriter, readOpts, writeOpts RateOpts) *ReadWriter {
+	return &ReadWriter{
+		Reader: NewReader(rw, readOpts),
+		Writer: NewWriter(rw, writeOpts),
+		rw:     rw,
+	}
+}
+
+// NewGroupReadWriter is like NewReadWriter, but reads at the rate of the
+// group rg and writes at that of wg, shared with the other members of each.
+// The same group may be given for both, in which case both directions share
+// its rate.
+func NewGroupReadWriter(rw io.ReadWriter, rg, wg *Group) *ReadWriter {
+	return &ReadWriter{
+		Reader: rg.NewReader(rw),
+		Writer: wg.NewWriter(rw),
+		rw:     rw,
+	}
+}
+
+// SetReadRate sets the rate options of the read direction.
+func (rw *ReadWriter) SetReadRate(opts RateOpts) {
+	rw.Reader.SetRate(opts)
+}
+
+// SetWriteRate sets the rate options of the write direction.
+func (rw *ReadWriter) SetWriteRate(opts RateOpts) {
+	rw.Writer.SetRate(opts)
+}
+
+// Cancel aborts any read or write blocked on the rate limit, and makes
+// every later one fail with ErrCanceled, as with Reader.Cancel and
+// Writer.Cancel.
+func (rw *ReadWriter) Cancel() {
+	rw.Reader.Cancel()
+	rw.Writer.Cancel()
+}
+
+// Close cancels both directions as with Cancel, and then closes the
+// underlying stream if it is an io.Closer.
+func (rw *ReadWriter) Close() error {
+	rw.Cancel()
+	if c, ok := rw.rw.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// Unwrap returns the underlying stream. Reading from or writing to it
+// directly bypasses the rate limits.
+func (rw *ReadWriter) Unwrap() io.ReadWriter {
+	return rw.rw
+}
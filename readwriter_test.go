@@ -0,0 +1,112 @@
+package iocap
+
+import (
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestReadWriter(t *testing.T) {
+	clock := newFakeClock()
+	stream := struct {
+		io.Reader
+		io.Writer
+	}{zeroReader{}, ioutil.Discard}
+	rw := NewReadWriter(stream,
+		RateOpts{Interval: time.Second, Size: 100},
+		RateOpts{Interval: time.Second, Size: 50})
+	rw.Reader.SetClock(clock)
+	rw.Writer.SetClock(clock)
+
+	// Exhausting the quota of reads leaves that of writes alone.
+	if n, err := rw.Read(make([]byte, 100)); n != 100 || err != nil {
+		t.Fatalf("bad: %d, %v", n, err)
+	}
+	if n, err := rw.Write(make([]byte, 50)); n != 50 || err != nil {
+		t.Fatalf("bad: %d, %v", n, err)
+	}
+	if clock.Now() != newFakeClock().Now() {
+		t.Fatal("should not wait")
+	}
+	if _, err := rw.TryRead(make([]byte, 1)); err != ErrWouldBlock {
+		t.Fatalf("expect %v, got: %v", ErrWouldBlock, err)
+	}
+
+	// Each direction waits on its own rate.
+	if n, err := rw.Write(make([]byte, 100)); n != 100 || err != nil {
+		t.Fatalf("bad: %d, %v", n, err)
+	}
+	if d := clock.Now().Sub(newFakeClock().Now()); d != 2*time.Second {
+		t.Fatalf("expect 2s, took %s", d)
+	}
+
+	// The rates are set independently.
+	rw.SetReadRate(Unlimited)
+	rw.SetWriteRate(RateOpts{Interval: time.Second, Size: 10})
+	if !rw.Reader.Rate().IsUnlimited() || rw.Writer.Rate().Size != 10 {
+		t.Fatalf("bad rates: %v, %v", rw.Reader.Rate(), rw.Writer.Rate())
+	}
+	if rw.Unwrap() != io.ReadWriter(stream) {
+		t.Fatal("should unwrap to the stream")
+	}
+}
+
+func TestReadWriterClose(t *testing.T) {
+	c := new(closeCounter)
+	stream := struct {
+		io.Reader
+		io.Writer
+		*closeCounter
+	}{zeroReader{}, ioutil.Discard, c}
+	rate := RateOpts{Interval: time.Second, Size: 1}
+	rw := NewReadWriter(stream, rate, rate)
+
+	// Close abandons blocked operations in both directions.
+	errCh := make(chan error, 2)
+	go func() {
+		_, err := rw.Read(make([]byte, 10))
+		errCh <- err
+	}()
+	go func() {
+		_, err := rw.Write(make([]byte, 10))
+		errCh <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if err := rw.Close(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-errCh:
+			if err != ErrCanceled {
+				t.Fatalf("expect %v, got: %v", ErrCanceled, err)
+			}
+		case <-time.After(500 * time.Millisecond):
+			t.Fatal("operation still blocked")
+		}
+	}
+	if c.closed != 1 {
+		t.Fatalf("expect stream closed once, got: %d", c.closed)
+	}
+}
+
+func TestGroupReadWriter(t *testing.T) {
+	rg := NewGroup(RateOpts{Interval: time.Second, Size: 100})
+	wg := NewGroup(RateOpts{Interval: time.Second, Size: 100})
+	stream := struct {
+		io.Reader
+		io.Writer
+	}{zeroReader{}, ioutil.Discard}
+	rw := NewGroupReadWriter(stream, rg, wg)
+
+	// Each direction is charged to its own group.
+	rw.Read(make([]byte, 30))
+	rw.Write(make([]byte, 20))
+	if n := rg.Snapshot().Tokens; n != 30 {
+		t.Fatalf("expect 30 read tokens, got: %d", n)
+	}
+	if n := wg.Snapshot().Tokens; n != 20 {
+		t.Fatalf("expect 20 write tokens, got: %d", n)
+	}
+}
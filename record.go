@@ -0,0 +1,155 @@
+package iocap
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// RecordWriter implements the io.Writer interface and limits the rate at
+// which delimited records (for example, log lines) are written to the
+// underlying writer. The Size of the rate is interpreted as the number of
+// records allowed per Interval, regardless of their length.
+//
+// Partial records are held back until their delimiter arrives, so records
+// are always written to the underlying writer in one piece.
+type RecordWriter struct {
+	dst    io.Writer
+	delim  byte
+	bucket *bucket
+
+	// partial holds the start of a record whose delimiter has not been
+	// written yet.
+	partial []byte
+
+	drop    bool
+	dropped uint64
+
+	l sync.Mutex
+}
+
+// NewRecordWriter wraps dst in a new record rate limited writer. Records
+// are terminated by delim, and opts describes the number of records allowed
+// per interval.
+func NewRecordWriter(dst io.Writer, delim byte, opts RateOpts) *RecordWriter {
+	return &RecordWriter{
+		dst:    dst,
+		delim:  delim,
+		bucket: newBucket(opts),
+	}
+}
+
+// Write writes the complete records in p to the underlying writer,
+// respecting the configured rate. Any trailing partial record is held back
+// until a subsequent Write completes it. If dropping is enabled, records
+// exceeding the rate are discarded rather than blocking.
+func (w *RecordWriter) Write(p []byte) (n int, err error) {
+	w.l.Lock()
+	defer w.l.Unlock()
+
+	for n < len(p) {
+		// Count the complete records in the remainder of p. If there are
+		// none, hold back the partial record until its delimiter arrives.
+		records := bytes.Count(p[n:], []byte{w.delim})
+		if records == 0 {
+			w.partial = append(w.partial, p[n:]...)
+			return len(p), nil
+		}
+
+		// Ask for a token per record.
+		var v int
+		if w.drop {
+			v = w.bucket.tryInsert(records)
+		} else {
+			v = w.bucket.insert(records)
+		}
+
+		// Find the end of the records we are allowed to write.
+		end := n
+		for i := 0; i < v; i++ {
+			end += bytes.IndexByte(p[end:], w.delim) + 1
+		}
+
+		if v > 0 {
+			// Write the records along with any held back partial record.
+			chunk := p[n:end]
+			prefix := len(w.partial)
+			if prefix > 0 {
+				chunk = append(w.partial, chunk...)
+			}
+			w.partial = w.partial[:0]
+
+			var m int
+			m, err = w.dst.Write(chunk)
+
+			// Count the bytes of p which were actually written.
+			if m -= prefix; m > 0 {
+				n += m
+			}
+
+			// Return any errors from the underlying writer. Preserves the
+			// underlying implementation's functionality.
+			if err != nil {
+				return
+			}
+		}
+
+		if v < records && w.drop {
+			// Drop the records exceeding the rate.
+			for i := v; i < records; i++ {
+				end += bytes.IndexByte(p[end:], w.delim) + 1
+			}
+			w.partial = w.partial[:0]
+			atomic.AddUint64(&w.dropped, uint64(records-v))
+			n = end
+		}
+	}
+	return
+}
+
+// Flush writes out any held back partial record, charging it as a full
+// record. In dropping mode, the partial record is discarded if the rate
+// does not allow another record.
+func (w *RecordWriter) Flush() error {
+	w.l.Lock()
+	defer w.l.Unlock()
+
+	if len(w.partial) == 0 {
+		return nil
+	}
+
+	var v int
+	if w.drop {
+		v = w.bucket.tryInsert(1)
+	} else {
+		v = w.bucket.insert(1)
+	}
+
+	var err error
+	if v == 0 {
+		atomic.AddUint64(&w.dropped, 1)
+	} else {
+		_, err = w.dst.Write(w.partial)
+	}
+	w.partial = w.partial[:0]
+	return err
+}
+
+// SetDrop enables or disables dropping mode. In dropping mode, Write never
+// blocks; records exceeding the rate are discarded and counted instead.
+func (w *RecordWriter) SetDrop(drop bool) {
+	w.l.Lock()
+	w.drop = drop
+	w.l.Unlock()
+}
+
+// Dropped returns the number of records discarded in dropping mode.
+func (w *RecordWriter) Dropped() uint64 {
+	return atomic.LoadUint64(&w.dropped)
+}
+
+// SetRate is used to dynamically set the rate options on the writer.
+func (w *RecordWriter) SetRate(opts RateOpts) {
+	w.bucket.setRate(opts)
+}
@@ -0,0 +1,109 @@
+package iocap
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// writeRecorder records each individual write made to it.
+type writeRecorder struct {
+	writes []string
+}
+
+func (w *writeRecorder) Write(p []byte) (int, error) {
+	w.writes = append(w.writes, string(p))
+	return len(p), nil
+}
+
+func TestRecordWriter(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := NewRecordWriter(buf, '\n', RateOpts{Interval: 100 * time.Millisecond, Size: 2})
+
+	// Six records at two records per interval requires two drains,
+	// regardless of the length of the records.
+	data := []byte("a\nbb\nccc\ndddd\neeeee\nffffff\n")
+	start := time.Now()
+	n, err := w.Write(data)
+	if d := time.Since(start); d < 200*time.Millisecond {
+		t.Fatalf("write returned too quickly in %s", d)
+	}
+
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if n != len(data) {
+		t.Fatalf("expect %d, got: %d", len(data), n)
+	}
+	if !bytes.Equal(buf.Bytes(), data) {
+		t.Fatalf("unexpected data written: %q", buf.Bytes())
+	}
+}
+
+func TestRecordWriter_Partial(t *testing.T) {
+	rec := new(writeRecorder)
+	w := NewRecordWriter(rec, '\n', Unlimited)
+
+	// Records split across writes are held back and reassembled.
+	for _, s := range []string{"foo", "bar\nbaz", "\n", "qux"} {
+		if _, err := w.Write([]byte(s)); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	expect := []string{"foobar\n", "baz\n"}
+	if len(rec.writes) != len(expect) {
+		t.Fatalf("expect %q, got: %q", expect, rec.writes)
+	}
+	for i, s := range expect {
+		if rec.writes[i] != s {
+			t.Fatalf("expect %q, got: %q", expect, rec.writes)
+		}
+	}
+
+	// Flushing writes out the trailing partial record.
+	if err := w.Flush(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if v := rec.writes[len(rec.writes)-1]; v != "qux" {
+		t.Fatalf("expect %q, got: %q", "qux", v)
+	}
+}
+
+func TestRecordWriter_Drop(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := NewRecordWriter(buf, '\n', RateOpts{Interval: time.Second, Size: 2})
+	w.SetDrop(true)
+
+	// Records exceeding the rate are dropped without blocking.
+	data := []byte("a\nb\nc\nd\ne\n")
+	start := time.Now()
+	n, err := w.Write(data)
+	if d := time.Since(start); d > 10*time.Millisecond {
+		t.Fatalf("should not block, took %s", d)
+	}
+
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if n != len(data) {
+		t.Fatalf("expect %d, got: %d", len(data), n)
+	}
+	if v := buf.String(); v != "a\nb\n" {
+		t.Fatalf("unexpected data written: %q", v)
+	}
+	if v := w.Dropped(); v != 3 {
+		t.Fatalf("expect 3, got: %d", v)
+	}
+
+	// A partial record completed while the rate is exhausted is dropped
+	// as a whole.
+	w.Write([]byte("f"))
+	w.Write([]byte("g\n"))
+	if v := w.Dropped(); v != 4 {
+		t.Fatalf("expect 4, got: %d", v)
+	}
+	if v := buf.String(); v != "a\nb\n" {
+		t.Fatalf("unexpected data written: %q", v)
+	}
+}
@@ -0,0 +1,96 @@
+package iocap
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestReserve(t *testing.T) {
+	clock := newFakeClock()
+	w := NewWriter(ioutil.Discard, RateOpts{Interval: 100 * time.Millisecond, Size: 100, Coarse: true})
+	w.SetClock(clock)
+
+	// Nothing to wait for with an empty bucket.
+	if d, ok := w.Reserve(100); !ok || d != 0 {
+		t.Fatalf("bad: %s, %v", d, ok)
+	}
+
+	// Reserving consumes nothing.
+	w.Write(make([]byte, 60))
+	clock.Advance(30 * time.Millisecond)
+	for i := 0; i < 2; i++ {
+		if d, ok := w.Reserve(41); !ok || d != 70*time.Millisecond {
+			t.Fatalf("bad: %s, %v", d, ok)
+		}
+	}
+
+	// Larger transfers take several intervals.
+	if d, ok := w.Reserve(340); !ok || d != 270*time.Millisecond {
+		t.Fatalf("bad: %s, %v", d, ok)
+	}
+
+	// Unlimited rates, including those without a size.
+	if d, ok := NewWriter(ioutil.Discard, Unlimited).Reserve(1 << 30); !ok || d != 0 {
+		t.Fatalf("bad: %s, %v", d, ok)
+	}
+	if d, ok := NewWriter(ioutil.Discard, RateOpts{Interval: time.Second}).Reserve(1); !ok || d != 0 {
+		t.Fatalf("bad: %s, %v", d, ok)
+	}
+}
+
+func TestReserve_Smooth(t *testing.T) {
+	clock := newFakeClock()
+	w := NewWriter(ioutil.Discard, RateOpts{Interval: 100 * time.Millisecond, Size: 100})
+	w.SetClock(clock)
+
+	w.Write(make([]byte, 100))
+	if d, ok := w.Reserve(25); !ok || d != 25*time.Millisecond {
+		t.Fatalf("bad: %s, %v", d, ok)
+	}
+}
+
+func TestReserveAndCommit(t *testing.T) {
+	clock := newFakeClock()
+	w := NewWriter(ioutil.Discard, RateOpts{Interval: 100 * time.Millisecond, Size: 100, Coarse: true})
+	w.SetClock(clock)
+
+	// Reserving 250 bytes takes the current quota and two more intervals.
+	if d, ok := w.ReserveAndCommit(250); !ok || d != 200*time.Millisecond {
+		t.Fatalf("bad: %s, %v", d, ok)
+	}
+
+	// Later operations wait behind the reservation.
+	if d, _ := w.Reserve(50); d != 200*time.Millisecond {
+		t.Fatalf("expect 200ms, got: %s", d)
+	}
+	start := clock.Now()
+	w.Write(make([]byte, 50))
+	if d := clock.Now().Sub(start); d != 200*time.Millisecond {
+		t.Fatalf("expect 200ms, took %s", d)
+	}
+}
+
+func TestGroupReserve(t *testing.T) {
+	clock := newFakeClock()
+	parent := NewGroup(RateOpts{Interval: time.Second, Size: 10})
+	parent.SetClock(clock)
+	g := parent.NewSubGroup(RateOpts{Interval: 100 * time.Millisecond, Size: 100})
+	g.SetClock(clock)
+
+	// The slowest group decides.
+	if d, ok := g.Reserve(20); !ok || d != time.Second {
+		t.Fatalf("bad: %s, %v", d, ok)
+	}
+
+	// Commits are made to all groups.
+	if d, ok := g.ReserveAndCommit(10); !ok || d != 0 {
+		t.Fatalf("bad: %s, %v", d, ok)
+	}
+	if s := g.Snapshot(); s.Tokens != 10 {
+		t.Fatalf("expect 10 tokens, got: %d", s.Tokens)
+	}
+	if s := parent.Snapshot(); s.Tokens != 10 {
+		t.Fatalf("expect 10 tokens, got: %d", s.Tokens)
+	}
+}
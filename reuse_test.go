@@ -0,0 +1,107 @@
+package iocap
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReaderReuse(t *testing.T) {
+	clock := newFakeClock()
+	r := NewReader(strings.NewReader("hello"), RateOpts{Interval: time.Second, Size: 10})
+	r.SetClock(clock)
+	buf := make([]byte, 5)
+	if n, err := r.Read(buf); err != nil || string(buf[:n]) != "hello" {
+		t.Fatalf("bad: %q, %v", buf[:n], err)
+	}
+	r.Cancel()
+
+	// The reused reader reads from the new source, and may go on after
+	// the cancelation of the last stream.
+	r.Reuse(strings.NewReader("world"))
+	if s := r.Stats(); s.BytesTransferred != 0 || s.Ops != 0 {
+		t.Fatalf("bad stats after reuse: %+v", s)
+	}
+	if n, err := r.Read(buf); err != nil || string(buf[:n]) != "world" {
+		t.Fatalf("bad: %q, %v", buf[:n], err)
+	}
+
+	// The quota of both streams is charged.
+	if n := r.Available(); n != 0 {
+		t.Fatalf("expect 0 available, got: %d", n)
+	}
+	if clock.Now() != newFakeClock().Now() {
+		t.Fatal("should not wait")
+	}
+	r.Reuse(strings.NewReader("!"))
+	r.Reset()
+	if n := r.Available(); n != 10 {
+		t.Fatalf("expect 10 available, got: %d", n)
+	}
+}
+
+func TestWriterReuse(t *testing.T) {
+	var a, b bytes.Buffer
+	w := NewWriter(&a, RateOpts{Interval: time.Second, Size: 10})
+	w.SetWriteDeadline(time.Now().Add(-time.Second))
+	if _, err := w.Write([]byte("hello")); err == nil {
+		t.Fatal("expect deadline error")
+	}
+
+	// The deadline of the last stream is cleared.
+	w.Reuse(&b)
+	if n, err := w.Write([]byte("world")); n != 5 || err != nil {
+		t.Fatalf("bad: %d, %v", n, err)
+	}
+	if a.Len() != 0 || b.String() != "world" {
+		t.Fatalf("bad: %q, %q", a.String(), b.String())
+	}
+	if w.Unwrap() != &b {
+		t.Fatal("should unwrap to the new destination")
+	}
+}
+
+func TestGroupReuse(t *testing.T) {
+	parent := NewGroup(RateOpts{Interval: time.Second, Size: 100})
+	g := parent.NewSubGroup(RateOpts{Interval: time.Second, Size: 100})
+	var a, b bytes.Buffer
+	w := g.NewWriter(&a)
+	w.Write([]byte("hello"))
+
+	// Writers of sub-groups still write through the parent group.
+	w.Reuse(&b)
+	w.Write([]byte("world"))
+	if a.String() != "hello" || b.String() != "world" {
+		t.Fatalf("bad: %q, %q", a.String(), b.String())
+	}
+	if n := parent.Snapshot().Tokens; n != 10 {
+		t.Fatalf("expect 10 tokens, got: %d", n)
+	}
+}
+
+func BenchmarkReaderReuse(b *testing.B) {
+	// A short-lived reader for each stream, as in a proxy.
+	rate := RateOpts{Interval: time.Millisecond, Size: 1 << 40}
+	p := make([]byte, 64)
+	b.Run("New", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			r := NewReader(zeroReader{}, rate)
+			r.Read(p)
+		}
+	})
+	b.Run("Pool", func(b *testing.B) {
+		pool := sync.Pool{New: func() interface{} {
+			return NewReader(nil, rate)
+		}}
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			r := pool.Get().(*Reader)
+			r.Reuse(zeroReader{})
+			r.Read(p)
+			pool.Put(r)
+		}
+	})
+}
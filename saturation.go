@@ -0,0 +1,103 @@
+package iocap
+
+import (
+	"time"
+)
+
+// Stats describes the utilization of a rate limiter.
+type Stats struct {
+	// Rate is the rate in effect.
+	Rate RateOpts
+
+	// Utilization is the fraction of the quota consumed during the most
+	// recently completed interval.
+	Utilization float64
+
+	// Saturated reports whether utilization has been sustained above the
+	// configured threshold. It is false for recovery notifications.
+	Saturated bool
+}
+
+// saturation tracks how long a bucket's utilization stays above a
+// threshold, notifying once when it has been sustained long enough and once
+// more when it recovers.
+type saturation struct {
+	threshold float64
+	sustain   time.Duration
+	fn        func(Stats)
+
+	// aboveSince is the start of the current run of intervals above the
+	// threshold, or zero if the last interval was below it.
+	aboveSince time.Time
+	saturated  bool
+
+	// Smooth buckets never drain, so their intervals are kept here. start
+	// is the beginning of the current interval, held the tokens in the
+	// bucket at that time and leaked the tokens leaked since. The tokens
+	// consumed during the interval follow from those.
+	start  time.Time
+	held   int
+	leaked int
+}
+
+// leak records n tokens leaked from a smooth bucket at now, which is left
+// holding tokens, observing the interval which ended, if any. Must be called
+// with the bucket lock held.
+func (s *saturation) leak(opts RateOpts, tokens, n int, now time.Time) (func(Stats), Stats) {
+	s.leaked += n
+	if s.start.IsZero() {
+		s.start, s.held, s.leaked = now, tokens, 0
+		return nil, Stats{}
+	}
+	elapsed := now.Sub(s.start)
+	if opts.Interval <= 0 || elapsed < opts.Interval {
+		return nil, Stats{}
+	}
+
+	// Leaks may come later than the end of the interval, so the tokens
+	// consumed are scaled down to a single interval.
+	used := float64(tokens-s.held+s.leaked) * float64(opts.Interval) / float64(elapsed)
+	last := s.start
+	s.start = s.start.Add(elapsed / opts.Interval * opts.Interval)
+	s.held, s.leaked = tokens, 0
+	return s.observe(opts, int(used+0.5), last, now)
+}
+
+// observe records the utilization of the interval which started at last
+// and drained at now, holding tokens. If a notification is due, the
+// callback is returned along with the stats to pass to it. Must be called
+// with the bucket lock held.
+func (s *saturation) observe(opts RateOpts, tokens int, last, now time.Time) (func(Stats), Stats) {
+	if opts.IsUnlimited() {
+		return nil, Stats{}
+	}
+
+	util := float64(tokens) / float64(opts.Size)
+
+	// If more than one interval passed since the last drain, the bucket
+	// sat idle for at least one of them.
+	if now.Sub(last) >= 2*opts.Interval {
+		util = 0
+	}
+
+	stats := Stats{Rate: opts, Utilization: util}
+
+	if util >= s.threshold {
+		if s.aboveSince.IsZero() {
+			s.aboveSince = last
+		}
+		if !s.saturated && now.Sub(s.aboveSince) >= s.sustain {
+			s.saturated = true
+			stats.Saturated = true
+			return s.fn, stats
+		}
+		return nil, stats
+	}
+
+	s.aboveSince = time.Time{}
+	if s.saturated {
+		s.saturated = false
+		return s.fn, stats
+	}
+	return nil, stats
+}
@@ -0,0 +1,74 @@
+package iocap
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestGroupOnSaturation(t *testing.T) {
+	clock := newFakeClock()
+	g := NewGroup(RateOpts{Interval: 100 * time.Millisecond, Size: 100})
+	g.bucket.clock = clock
+
+	var events []Stats
+	g.OnSaturation(0.9, 500*time.Millisecond, func(s Stats) {
+		events = append(events, s)
+	})
+
+	// Push the group at its full rate for 20 intervals.
+	w := g.NewWriter(ioutil.Discard)
+	for i := 0; i < 20; i++ {
+		w.Write(make([]byte, 100))
+	}
+
+	if len(events) != 1 {
+		t.Fatalf("expect 1 event, got: %v", events)
+	}
+	if s := events[0]; !s.Saturated || s.Utilization != 1 {
+		t.Fatalf("bad: %#v", s)
+	}
+
+	// A short period below the threshold does not alert again, but
+	// reports the recovery.
+	w.Write(make([]byte, 10))
+	clock.Advance(100 * time.Millisecond)
+	w.Write(make([]byte, 10))
+
+	if len(events) != 2 {
+		t.Fatalf("expect 2 events, got: %v", events)
+	}
+	if s := events[1]; s.Saturated {
+		t.Fatalf("bad: %#v", s)
+	}
+
+	// Going idle for a while produces no further events.
+	clock.Advance(time.Second)
+	w.Write(make([]byte, 10))
+	if len(events) != 2 {
+		t.Fatalf("expect 2 events, got: %v", events)
+	}
+}
+
+func TestGroupOnSaturation_NotSustained(t *testing.T) {
+	clock := newFakeClock()
+	g := NewGroup(RateOpts{Interval: 100 * time.Millisecond, Size: 100})
+	g.bucket.clock = clock
+
+	var events []Stats
+	g.OnSaturation(0.9, 500*time.Millisecond, func(s Stats) {
+		events = append(events, s)
+	})
+
+	// Alternate between saturated and idle intervals. The threshold is
+	// never exceeded for long enough to alert.
+	w := g.NewWriter(ioutil.Discard)
+	for i := 0; i < 10; i++ {
+		w.Write(make([]byte, 300))
+		clock.Advance(200 * time.Millisecond)
+	}
+
+	if len(events) != 0 {
+		t.Fatalf("expect no events, got: %v", events)
+	}
+}
@@ -0,0 +1,37 @@
+package iocap
+
+import (
+	"io"
+)
+
+// readSeeker is a rate limited reader which passes Seek through to its
+// source.
+type readSeeker struct {
+	*Reader
+	src io.Seeker
+}
+
+// NewReadSeeker wraps src in a new rate limited reader, whose Seek seeks
+// src directly. Seeking neither consumes nor gives back any quota. This
+// allows serving throttled content with http.ServeContent, for example.
+// Like a Reader, it has an Unwrap method returning src.
+func NewReadSeeker(src io.ReadSeeker, opts RateOpts) io.ReadSeeker {
+	return &readSeeker{
+		Reader: NewReader(src, opts),
+		src:    src,
+	}
+}
+
+// NewReadSeeker creates and returns a new reader in the group, which
+// passes Seek through to src as with NewReadSeeker.
+func (g *Group) NewReadSeeker(src io.ReadSeeker) io.ReadSeeker {
+	return &readSeeker{
+		Reader: g.NewReader(src),
+		src:    src,
+	}
+}
+
+// Seek sets the offset of the next Read on the source.
+func (r *readSeeker) Seek(offset int64, whence int) (int64, error) {
+	return r.src.Seek(offset, whence)
+}
@@ -0,0 +1,58 @@
+package iocap
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestReadSeeker(t *testing.T) {
+	data := make([]byte, 5000)
+	rand.Read(data)
+	rs := NewReadSeeker(bytes.NewReader(data), Unlimited)
+
+	// Seeks pass straight through to the source.
+	if off, err := rs.Seek(-100, io.SeekEnd); off != 4900 || err != nil {
+		t.Fatalf("expect 4900/nil, got: %d/%v", off, err)
+	}
+	p := make([]byte, 200)
+	if n, err := rs.Read(p); n != 100 || err != io.EOF {
+		t.Fatalf("expect 100/EOF, got: %d/%v", n, err)
+	}
+	if !bytes.Equal(p[:100], data[4900:]) {
+		t.Fatalf("bad read after seek")
+	}
+}
+
+func TestGroupReadSeeker_ServeContent(t *testing.T) {
+	data := make([]byte, 5000)
+	rand.Read(data)
+
+	clock := newFakeClock()
+	g := NewGroup(RateOpts{Interval: 100 * time.Millisecond, Size: 500})
+	g.SetClock(clock)
+	rs := g.NewReadSeeker(bytes.NewReader(data))
+
+	req := httptest.NewRequest("GET", "/video.mp4", nil)
+	req.Header.Set("Range", "bytes=1000-2999")
+	rec := httptest.NewRecorder()
+	start := clock.Now()
+	http.ServeContent(rec, req, "video.mp4", time.Time{}, rs)
+
+	if rec.Code != http.StatusPartialContent {
+		t.Fatalf("expect %d, got: %d", http.StatusPartialContent, rec.Code)
+	}
+	if !bytes.Equal(rec.Body.Bytes(), data[1000:3000]) {
+		t.Fatalf("bad partial content: %d bytes", rec.Body.Len())
+	}
+
+	// Only the 2000 bytes of the range are charged, without the seeks: the
+	// first 500 go right away, and the rest after three drains.
+	if d := clock.Now().Sub(start); d != 300*time.Millisecond {
+		t.Fatalf("expect 300ms, took %s", d)
+	}
+}
@@ -0,0 +1,200 @@
+package iocap
+
+import (
+	"context"
+	"io"
+)
+
+// TokenSource is a source of quota for readers, writers and groups, which
+// allows backing them with a rate limiter other than the built-in one. A
+// Limiter is itself a TokenSource.
+//
+// Sources may also have any of the following methods, which readers,
+// writers and groups backed by them use where available. A Limiter has all
+// of them.
+//
+//	// WaitContext is like Wait, but gives up once ctx is done, returning
+//	// zero and the error of ctx without taking any tokens.
+//	WaitContext(ctx context.Context, n int) (int, error)
+//
+//	// TryWait is like Wait, but never blocks, returning zero if no
+//	// tokens are available.
+//	TryWait(n int) int
+//
+//	// Available returns the number of tokens available without
+//	// blocking.
+//	Available() int
+//
+// Waits on sources without WaitContext which give up, as for a context,
+// wait timeout, deadline or Cancel, leave Wait running in the background,
+// and the tokens it takes are lost. Without TryWait, TryRead and TryWrite
+// return ErrNotSupported, and without Available, Available reports zero.
+type TokenSource interface {
+	// Wait blocks until at least one of n tokens is available, takes up to
+	// n of them and returns the number taken.
+	Wait(n int) int
+
+	// SetRate changes the rate at which tokens become available.
+	SetRate(opts RateOpts)
+}
+
+// NewReaderWith wraps src in a new reader limited by the quota of ts. Reads,
+// TryRead, SetRate and Available use ts, and reads give up waiting on it as
+// they would on the built-in limiter. Reserve cannot tell the wait of ts,
+// and reports false. The other features of readers, such as Rate, apply to
+// the built-in limiter only and see no limit.
+func NewReaderWith(src io.Reader, ts TokenSource) *Reader {
+	r := NewReader(src, Unlimited)
+	r.source = ts
+	return r
+}
+
+// NewWriterWith wraps dst in a new writer limited by the quota of ts, like
+// NewReaderWith does for readers. Writes, TryWrite, SetRate and Available
+// use ts, and Reserve reports false.
+func NewWriterWith(dst io.Writer, ts TokenSource) *Writer {
+	w := NewWriter(dst, Unlimited)
+	w.source = ts
+	return w
+}
+
+// NewGroupWith creates a new group whose readers and writers are limited by
+// the quota of ts, as with NewReaderWith and NewWriterWith. SetRate and
+// Available of the group use ts, Reserve reports false, and sub-groups may
+// be nested in the group as usual. Other members, such as limiters and
+// section readers, and the other methods of the group apply to the built-in
+// limiter only and see no limit.
+func NewGroupWith(ts TokenSource) *Group {
+	g := NewGroup(Unlimited)
+	g.source = ts
+	return g
+}
+
+// readSource implements Read for readers backed by a TokenSource.
+func (r *Reader) readSource(wt *waitState, p []byte, short bool) (n int, err error) {
+	for n < len(p) {
+		want := len(p) - n
+		if r.chunk > 0 && want > r.chunk {
+			want = r.chunk
+		}
+		start := r.bucket.clock.Now()
+		want, ok := waitSource(r.source, want, wt)
+		r.stats.wait(r.bucket.clock, start)
+		if !ok {
+			return n, r.waitErr()
+		}
+
+		var v int
+		v, err = r.src.Read(p[n : n+want])
+		n += v
+		if err != nil || short {
+			return
+		}
+	}
+	return
+}
+
+// writeSource implements Write for writers backed by a TokenSource.
+func (w *Writer) writeSource(wt *waitState, size int, put func(off, n int) (int, error)) (n int, err error) {
+	for n < size {
+		want := size - n
+		if w.chunk > 0 && want > w.chunk {
+			want = w.chunk
+		}
+		start := w.bucket.clock.Now()
+		want, ok := waitSource(w.source, want, wt)
+		w.stats.wait(w.bucket.clock, start)
+		if !ok {
+			return n, w.waitErr()
+		}
+
+		var v int
+		v, err = put(n, want)
+		n += v
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// waitSource takes up to n tokens from ts, like its Wait method, but gives
+// up once the operation of wt should stop, returning false.
+func waitSource(ts TokenSource, n int, wt *waitState) (int, bool) {
+	if wt.stopped() {
+		return 0, false
+	}
+	done := wt.done()
+
+	if cs, ok := ts.(interface {
+		WaitContext(ctx context.Context, n int) (int, error)
+	}); ok {
+		if done == nil {
+			v, err := cs.WaitContext(context.Background(), n)
+			return v, err == nil
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			select {
+			case <-done:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		v, err := cs.WaitContext(ctx, n)
+		return v, err == nil
+	}
+
+	if done == nil {
+		return ts.Wait(n), true
+	}
+	ch := make(chan int, 1)
+	go func() {
+		ch <- ts.Wait(n)
+	}()
+	select {
+	case v := <-ch:
+		return v, true
+	case <-done:
+		return 0, false
+	}
+}
+
+// tryAcquire takes up to n tokens without blocking, from ts if it is set or
+// else from b, returning ErrWouldBlock if there are none.
+func tryAcquire(b *bucket, ts TokenSource, n int) (int, error) {
+	if ts != nil {
+		return tryWaitSource(ts, n)
+	}
+	if v := b.tryInsert(n); v > 0 {
+		return v, nil
+	}
+	return 0, ErrWouldBlock
+}
+
+// tryWaitSource takes up to n tokens from ts without blocking, returning
+// ErrWouldBlock if there are none, or ErrNotSupported if ts cannot tell.
+func tryWaitSource(ts TokenSource, n int) (int, error) {
+	tw, ok := ts.(interface {
+		TryWait(n int) int
+	})
+	if !ok {
+		return 0, ErrNotSupported
+	}
+	if v := tw.TryWait(n); v > 0 {
+		return v, nil
+	}
+	return 0, ErrWouldBlock
+}
+
+// availableSource returns the number of tokens available from ts without
+// blocking, or zero if ts cannot tell.
+func availableSource(ts TokenSource) int {
+	if a, ok := ts.(interface {
+		Available() int
+	}); ok {
+		return a.Available()
+	}
+	return 0
+}
@@ -0,0 +1,179 @@
+package iocap
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// mockSource is a TokenSource granting up to max tokens per call.
+type mockSource struct {
+	max   int
+	waits []int
+	rates []RateOpts
+}
+
+func (m *mockSource) Wait(n int) int {
+	m.waits = append(m.waits, n)
+	if n > m.max {
+		return m.max
+	}
+	return n
+}
+
+func (m *mockSource) SetRate(opts RateOpts) {
+	m.rates = append(m.rates, opts)
+}
+
+func TestNewReaderWith(t *testing.T) {
+	ts := &mockSource{max: 4}
+	r := NewReaderWith(bytes.NewReader(make([]byte, 10)), ts)
+
+	n, err := io.ReadFull(r, make([]byte, 10))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if n != 10 {
+		t.Fatalf("expect 10, got: %d", n)
+	}
+
+	// Each read was made with the quota granted for it.
+	if len(ts.waits) != 3 || ts.waits[0] != 10 || ts.waits[1] != 6 || ts.waits[2] != 2 {
+		t.Fatalf("bad waits: %v", ts.waits)
+	}
+
+	rate := RateOpts{Size: 1}
+	r.SetRate(rate)
+	if len(ts.rates) != 1 || ts.rates[0] != rate {
+		t.Fatalf("bad rates: %v", ts.rates)
+	}
+}
+
+func TestNewWriterWith(t *testing.T) {
+	ts := &mockSource{max: 4}
+	buf := new(bytes.Buffer)
+	w := NewWriterWith(buf, ts)
+
+	n, err := w.Write(make([]byte, 10))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if n != 10 || buf.Len() != 10 {
+		t.Fatalf("expect 10, got: %d (%d written)", n, buf.Len())
+	}
+	if len(ts.waits) != 3 {
+		t.Fatalf("bad waits: %v", ts.waits)
+	}
+}
+
+func TestNewGroupWith(t *testing.T) {
+	ts := &mockSource{max: 100}
+	g := NewGroupWith(ts)
+
+	// Members of the group and its sub-groups share the source.
+	g.NewWriter(ioutil.Discard).Write(make([]byte, 10))
+	g.NewReader(zeroReader{}).Read(make([]byte, 20))
+	g.NewSubGroup(Unlimited).NewWriter(ioutil.Discard).Write(make([]byte, 30))
+	if len(ts.waits) != 3 || ts.waits[0] != 10 || ts.waits[1] != 20 || ts.waits[2] != 30 {
+		t.Fatalf("bad waits: %v", ts.waits)
+	}
+
+	g.SetRate(Unlimited)
+	if len(ts.rates) != 1 {
+		t.Fatalf("bad rates: %v", ts.rates)
+	}
+}
+
+func TestLimiter_TokenSource(t *testing.T) {
+	var _ TokenSource = NewLimiter(Unlimited)
+}
+
+// blockingSource is a TokenSource whose Wait blocks until release is
+// closed.
+type blockingSource struct {
+	release chan struct{}
+}
+
+func (b blockingSource) Wait(n int) int {
+	<-b.release
+	return n
+}
+
+func (b blockingSource) SetRate(opts RateOpts) {}
+
+func TestNewWriterWith_Wait(t *testing.T) {
+	ts := blockingSource{make(chan struct{})}
+	defer close(ts.release)
+
+	// Waits on the source give up on the wait timeout, the context and
+	// the deadline of the writer.
+	w := NewWriterWith(ioutil.Discard, ts)
+	w.SetWaitTimeout(10 * time.Millisecond)
+	if n, err := w.Write(make([]byte, 10)); n != 0 || err != ErrRateTimeout {
+		t.Fatalf("expect 0/%v, got: %d/%v", ErrRateTimeout, n, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	w = NewWriterWith(ioutil.Discard, ts)
+	w.ctx = ctx
+	if n, err := w.Write(make([]byte, 10)); n != 0 || err != context.DeadlineExceeded {
+		t.Fatalf("expect 0/%v, got: %d/%v", context.DeadlineExceeded, n, err)
+	}
+
+	r := NewReaderWith(zeroReader{}, ts)
+	r.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, err := r.Read(make([]byte, 10)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expect %v, got: %v", os.ErrDeadlineExceeded, err)
+	}
+}
+
+func TestNewWriterWith_Limiter(t *testing.T) {
+	l := NewLimiter(RateOpts{Interval: time.Hour, Size: 10})
+	w := NewWriterWith(ioutil.Discard, l)
+
+	// A waiting Limiter gives up without taking any tokens.
+	l.Wait(10)
+	ctx, cancel := context.WithCancel(context.Background())
+	w.ctx = ctx
+	time.AfterFunc(10*time.Millisecond, cancel)
+	if _, err := w.Write(make([]byte, 10)); err != context.Canceled {
+		t.Fatalf("expect %v, got: %v", context.Canceled, err)
+	}
+	l.Reset()
+
+	// The quota of the limiter is available to TryWrite and Available.
+	w = NewWriterWith(ioutil.Discard, l)
+	if n := w.Available(); n != 10 {
+		t.Fatalf("expect 10, got: %d", n)
+	}
+	if n, err := w.TryWrite(make([]byte, 15)); n != 10 || err != ErrWouldBlock {
+		t.Fatalf("expect 10/%v, got: %d/%v", ErrWouldBlock, n, err)
+	}
+	if n := w.Available(); n != 0 {
+		t.Fatalf("expect 0, got: %d", n)
+	}
+	if _, ok := w.Reserve(10); ok {
+		t.Fatal("expect no reservation")
+	}
+}
+
+func TestNewReaderWith_Try(t *testing.T) {
+	// Sources which can't be waited on without blocking don't support
+	// TryRead, and report no quota available.
+	r := NewReaderWith(zeroReader{}, &mockSource{max: 4})
+	if _, err := r.TryRead(make([]byte, 10)); err != ErrNotSupported {
+		t.Fatalf("expect %v, got: %v", ErrNotSupported, err)
+	}
+	if n := r.Available(); n != 0 {
+		t.Fatalf("expect 0, got: %d", n)
+	}
+	if _, ok := r.Reserve(10); ok {
+		t.Fatal("expect no reservation")
+	}
+}
@@ -0,0 +1,132 @@
+package iocap
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// TransferStats describes the traffic of a single reader or writer, to show
+// how much it is held back by its rate.
+type TransferStats struct {
+	// BytesTransferred is the number of bytes read or written.
+	BytesTransferred int64
+
+	// ThrottledFor is the total time spent blocked on the rate limit, not
+	// counting the time spent in the underlying reader or writer.
+	ThrottledFor time.Duration
+
+	// Ops is the number of reads or writes made.
+	Ops int64
+
+	// Since is the time at which the stats started, when the reader or
+	// writer was created or its stats were last reset.
+	Since time.Time
+}
+
+// transferStats maintains the TransferStats of a reader or writer. Its
+// fields are updated atomically, and must stay 64-bit aligned.
+type transferStats struct {
+	bytes     int64
+	throttled int64
+	ops       int64
+	since     int64
+}
+
+// newTransferStats returns stats starting at now.
+func newTransferStats(now time.Time) transferStats {
+	return transferStats{since: now.UnixNano()}
+}
+
+// count records an operation which transferred *n bytes. It takes a pointer
+// so that it can be deferred on a named result.
+func (s *transferStats) count(n *int) {
+	atomic.AddInt64(&s.ops, 1)
+	atomic.AddInt64(&s.bytes, int64(*n))
+}
+
+// wait records the time spent blocked on the rate limit since start, as
+// measured by c.
+func (s *transferStats) wait(c Clock, start time.Time) {
+	atomic.AddInt64(&s.throttled, int64(c.Now().Sub(start)))
+}
+
+// pace is like the pace of b, recording any time spent blocked on the rate
+// limit. The time is only measured if the bucket has no room right away,
+// so that the common case stays cheap.
+func (s *transferStats) pace(b *bucket, n int, sch *schedule, wt *waitState) (int, bool) {
+	if !sch.valid && b.trace.Load() == nil {
+		if b.windows == nil {
+			if v, ok := b.insertFast(n); ok {
+				return v, true
+			}
+		}
+
+		// Smooth rates and windows need the write lock, but may still have
+		// room without waiting.
+		if v := b.tryInsert(n); v > 0 {
+			return v, true
+		}
+	}
+	start := b.clock.Now()
+	v, ok := b.pace(n, sch, wt.done())
+	s.wait(b.clock, start)
+	return v, ok
+}
+
+// chargeOverhead is like the chargeOverhead of b, recording any time spent
+// blocked on the rate limit. The time is only measured if the rate has an
+// overhead to charge.
+func (s *transferStats) chargeOverhead(b *bucket, n int, sch *schedule, wt *waitState) bool {
+	b.l.RLock()
+	extra := b.opts.overhead(n)
+	b.l.RUnlock()
+	if extra == 0 && b.windows == nil {
+		return true
+	}
+	start := b.clock.Now()
+	ok := b.chargeOverhead(n, sch, wt.done())
+	s.wait(b.clock, start)
+	return ok
+}
+
+// snapshot returns the current stats.
+func (s *transferStats) snapshot() TransferStats {
+	return TransferStats{
+		BytesTransferred: atomic.LoadInt64(&s.bytes),
+		ThrottledFor:     time.Duration(atomic.LoadInt64(&s.throttled)),
+		Ops:              atomic.LoadInt64(&s.ops),
+		Since:            time.Unix(0, atomic.LoadInt64(&s.since)),
+	}
+}
+
+// reset clears the stats, starting them again at now.
+func (s *transferStats) reset(now time.Time) {
+	atomic.StoreInt64(&s.bytes, 0)
+	atomic.StoreInt64(&s.throttled, 0)
+	atomic.StoreInt64(&s.ops, 0)
+	atomic.StoreInt64(&s.since, now.UnixNano())
+}
+
+// Stats returns the traffic stats of the reader. Unlike the rate, they are
+// not shared with other members of its group.
+func (r *Reader) Stats() TransferStats {
+	return r.stats.snapshot()
+}
+
+// ResetStats clears the traffic stats of the reader, starting them again.
+// Reads completing concurrently may or may not be counted.
+func (r *Reader) ResetStats() {
+	r.stats.reset(r.bucket.clock.Now())
+}
+
+// Stats returns the traffic stats of the writer. Unlike the rate, they are
+// not shared with other members of its group.
+func (w *Writer) Stats() TransferStats {
+	return w.stats.snapshot()
+}
+
+// ResetStats clears the traffic stats of the writer, starting them again.
+// Writes completing concurrently may or may not be counted.
+func (w *Writer) ResetStats() {
+	w.stats.reset(w.bucket.clock.Now())
+}
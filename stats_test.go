@@ -0,0 +1,73 @@
+package iocap
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWriterStats(t *testing.T) {
+	clock := newFakeClock()
+
+	// The destination takes 50ms per write, which is not counted as
+	// throttled.
+	dst := writerFunc(func(p []byte) (int, error) {
+		clock.Advance(50 * time.Millisecond)
+		return len(p), nil
+	})
+	w := NewWriter(dst, RateOpts{Interval: 100 * time.Millisecond, Size: 100, Coarse: true})
+	w.SetClock(clock)
+	w.ResetStats()
+	if s := w.Stats(); !s.Since.Equal(clock.Now()) {
+		t.Fatalf("expect stats since %s, got: %s", clock.Now(), s.Since)
+	}
+
+	// Each write of 100 bytes takes 50ms, so the five drains waited for
+	// take another 50ms each.
+	if _, err := w.Write(make([]byte, 500)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := w.Write(make([]byte, 20)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	s := w.Stats()
+	if s.BytesTransferred != 520 || s.Ops != 2 {
+		t.Fatalf("expect 520 bytes in 2 ops, got: %d in %d", s.BytesTransferred, s.Ops)
+	}
+	if s.ThrottledFor != 250*time.Millisecond {
+		t.Fatalf("expect 250ms throttled, got: %s", s.ThrottledFor)
+	}
+
+	// Resetting starts the stats again.
+	clock.Advance(time.Second)
+	w.ResetStats()
+	if s := w.Stats(); s.BytesTransferred != 0 || s.Ops != 0 || s.ThrottledFor != 0 || !s.Since.Equal(clock.Now()) {
+		t.Fatalf("bad stats after reset: %+v", s)
+	}
+}
+
+func TestReaderStats(t *testing.T) {
+	r := NewReader(zeroReader{}, RateOpts{Interval: 50 * time.Millisecond, Size: 100})
+
+	// The second 100 bytes wait for a drain.
+	if _, err := r.Read(make([]byte, 200)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	s := r.Stats()
+	if s.BytesTransferred != 200 || s.Ops != 1 {
+		t.Fatalf("expect 200 bytes in 1 op, got: %d in %d", s.BytesTransferred, s.Ops)
+	}
+	if s.ThrottledFor < 40*time.Millisecond || s.ThrottledFor > 500*time.Millisecond {
+		t.Fatalf("expect about 50ms throttled, got: %s", s.ThrottledFor)
+	}
+
+	// Members of a group keep their own stats.
+	g := NewGroup(RateOpts{Interval: time.Second, Size: 100})
+	a, b := g.NewReader(zeroReader{}), g.NewReader(zeroReader{})
+	a.Read(make([]byte, 30))
+	if n := b.Stats().BytesTransferred; n != 0 {
+		t.Fatalf("expect 0 bytes, got: %d", n)
+	}
+	if n, err := a.TryRead(make([]byte, 10)); err != nil || a.Stats().BytesTransferred != 30+int64(n) {
+		t.Fatalf("bad stats after TryRead: %+v, %v", a.Stats(), err)
+	}
+}
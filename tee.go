@@ -0,0 +1,34 @@
+package iocap
+
+import (
+	"io"
+)
+
+// TeeReader returns a rate limited reader that writes to w what it reads
+// from r, like io.TeeReader. Only the reads from r are charged; the same
+// bytes are then written to w without being charged again. A write error
+// is returned from Read, as with io.TeeReader.
+func TeeReader(r io.Reader, w io.Writer, opts RateOpts) io.Reader {
+	return io.TeeReader(NewReader(r, opts), w)
+}
+
+// NewTeeReader is like TeeReader, but charges the reads from r to the
+// group, once per byte read.
+func (g *Group) NewTeeReader(r io.Reader, w io.Writer) io.Reader {
+	return io.TeeReader(g.NewReader(r), w)
+}
+
+// MultiWriter returns a rate limited writer that duplicates its writes to
+// all of ws, like io.MultiWriter. Each byte written is charged once,
+// however many writers it goes to. The writers are written to in turn, and
+// a write stops at the first error, charging only the bytes the failing
+// writer took.
+func MultiWriter(opts RateOpts, ws ...io.Writer) io.Writer {
+	return NewWriter(io.MultiWriter(ws...), opts)
+}
+
+// NewMultiWriter is like MultiWriter, but charges the writes to the group,
+// once per byte written.
+func (g *Group) NewMultiWriter(ws ...io.Writer) io.Writer {
+	return g.NewWriter(io.MultiWriter(ws...))
+}
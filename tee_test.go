@@ -0,0 +1,110 @@
+package iocap
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestTeeReader(t *testing.T) {
+	data := make([]byte, 1000)
+	rand.Read(data)
+
+	// The hash sees the same bytes as the reader.
+	h := sha256.New()
+	r := TeeReader(bytes.NewReader(data), h, RateOpts{Interval: time.Millisecond, Size: 100})
+	out, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(out, data) {
+		t.Fatalf("bad read")
+	}
+	if sum := sha256.Sum256(data); !bytes.Equal(h.Sum(nil), sum[:]) {
+		t.Fatalf("bad hash")
+	}
+
+	// Write errors surface from Read.
+	r = TeeReader(bytes.NewReader(data), failingWriter{}, Unlimited)
+	if _, err := r.Read(make([]byte, 10)); err != errFailed {
+		t.Fatalf("expect %v, got: %v", errFailed, err)
+	}
+}
+
+func TestGroupNewTeeReader(t *testing.T) {
+	clock := newFakeClock()
+	g := NewGroup(RateOpts{Interval: time.Second, Size: 1000})
+	g.SetClock(clock)
+
+	// Teed bytes are counted once, along with those of another stream
+	// sharing the group.
+	var teed bytes.Buffer
+	r := g.NewTeeReader(bytes.NewReader(make([]byte, 300)), &teed)
+	if n, err := io.Copy(ioutil.Discard, r); n != 300 || err != nil {
+		t.Fatalf("expect 300/nil, got: %d/%v", n, err)
+	}
+	if teed.Len() != 300 {
+		t.Fatalf("expect 300 bytes teed, got: %d", teed.Len())
+	}
+	if _, err := g.NewWriter(ioutil.Discard).Write(make([]byte, 200)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if n := g.Snapshot().Tokens; n != 500 {
+		t.Fatalf("expect 500 tokens, got: %d", n)
+	}
+}
+
+func TestMultiWriter(t *testing.T) {
+	var a, b bytes.Buffer
+	data := make([]byte, 1000)
+	rand.Read(data)
+	w := MultiWriter(RateOpts{Interval: time.Millisecond, Size: 100}, &a, &b)
+	if n, err := w.Write(data); n != 1000 || err != nil {
+		t.Fatalf("expect 1000/nil, got: %d/%v", n, err)
+	}
+	if !bytes.Equal(a.Bytes(), data) || !bytes.Equal(b.Bytes(), data) {
+		t.Fatalf("bad writes")
+	}
+}
+
+func TestGroupNewMultiWriter(t *testing.T) {
+	clock := newFakeClock()
+	g := NewGroup(RateOpts{Interval: time.Second, Size: 4 * KB})
+	g.SetClock(clock)
+
+	// A 1KB write to three sinks takes 1KB of the budget, not 3KB.
+	var sinks [3]bytes.Buffer
+	w := g.NewMultiWriter(&sinks[0], &sinks[1], &sinks[2])
+	if n, err := w.Write(make([]byte, KB)); n != KB || err != nil {
+		t.Fatalf("expect %d/nil, got: %d/%v", KB, n, err)
+	}
+	for i := range sinks {
+		if sinks[i].Len() != KB {
+			t.Fatalf("expect %d bytes in sink %d, got: %d", KB, i, sinks[i].Len())
+		}
+	}
+	if n := g.Snapshot().Tokens; n != KB {
+		t.Fatalf("expect %d tokens, got: %d", KB, n)
+	}
+
+	// A failing sink stops the write, and only the bytes it took are
+	// charged.
+	var last bytes.Buffer
+	failing := writerFunc(func(p []byte) (int, error) {
+		return 100, errFailed
+	})
+	w = g.NewMultiWriter(new(bytes.Buffer), failing, &last)
+	if n, err := w.Write(make([]byte, 300)); n != 100 || err != errFailed {
+		t.Fatalf("expect 100/%v, got: %d/%v", errFailed, n, err)
+	}
+	if last.Len() != 0 {
+		t.Fatalf("expect nothing written after the failure, got: %d", last.Len())
+	}
+	if n := g.Snapshot().Tokens; n != KB+100 {
+		t.Fatalf("expect %d tokens, got: %d", KB+100, n)
+	}
+}
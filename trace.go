@@ -0,0 +1,102 @@
+package iocap
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// TraceEvent records a single acquisition of quota by a read or write.
+type TraceEvent struct {
+	// Time is when the acquisition started.
+	Time time.Time
+
+	// Requested is the number of bytes asked for, and Granted the number
+	// of bytes allowed through.
+	Requested int
+	Granted   int
+
+	// Waited is the time spent blocked on the rate limit.
+	Waited time.Duration
+}
+
+// Trace is a bounded record of the most recent acquisitions of a limiter,
+// useful for debugging stalled transfers. Once full, each new event
+// replaces the oldest one.
+type Trace struct {
+	events []TraceEvent
+	next   int
+	full   bool
+	l      sync.Mutex
+}
+
+// record adds an event to the trace.
+func (t *Trace) record(e TraceEvent) {
+	t.l.Lock()
+	t.events[t.next] = e
+	if t.next++; t.next == len(t.events) {
+		t.next = 0
+		t.full = true
+	}
+	t.l.Unlock()
+}
+
+// Snapshot returns a copy of the recorded events, oldest first.
+func (t *Trace) Snapshot() []TraceEvent {
+	t.l.Lock()
+	defer t.l.Unlock()
+
+	if !t.full {
+		return append([]TraceEvent(nil), t.events[:t.next]...)
+	}
+	out := make([]TraceEvent, 0, len(t.events))
+	out = append(out, t.events[t.next:]...)
+	return append(out, t.events[:t.next]...)
+}
+
+// String returns the recorded events one per line, oldest first.
+func (t *Trace) String() string {
+	var buf bytes.Buffer
+	for _, e := range t.Snapshot() {
+		fmt.Fprintf(&buf, "%s requested=%d granted=%d waited=%s\n",
+			e.Time.Format(time.RFC3339Nano), e.Requested, e.Granted, e.Waited)
+	}
+	return buf.String()
+}
+
+// enableTrace starts recording up to n events on the bucket, replacing any
+// existing trace. If n is zero, tracing is stopped and nil is returned.
+func (b *bucket) enableTrace(n int) *Trace {
+	var t *Trace
+	if n > 0 {
+		t = &Trace{events: make([]TraceEvent, n)}
+	}
+	b.trace.Store(t)
+	return t
+}
+
+// EnableTrace starts recording the last n acquisitions made by the reader,
+// returning the trace. A zero n stops tracing. Tracing adds a small cost to
+// each acquisition; with tracing off, the cost is a single atomic load.
+//
+// The trace belongs to the rate limit of the reader, which a reader in a
+// group shares with the group. Its trace is that of the group, recording
+// the acquisitions of all members, and replaces any trace enabled on the
+// group or another member, as Group.EnableTrace does.
+func (r *Reader) EnableTrace(n int) *Trace {
+	return r.bucket.enableTrace(n)
+}
+
+// EnableTrace starts recording the last n acquisitions made by the writer,
+// returning the trace. As with Reader.EnableTrace, the trace of a writer in
+// a group is that of the whole group.
+func (w *Writer) EnableTrace(n int) *Trace {
+	return w.bucket.enableTrace(n)
+}
+
+// EnableTrace starts recording the last n acquisitions made by all readers
+// and writers of the group, returning the trace.
+func (g *Group) EnableTrace(n int) *Trace {
+	return g.bucket.enableTrace(n)
+}
@@ -0,0 +1,98 @@
+package iocap
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTrace(t *testing.T) {
+	clock := newFakeClock()
+	w := NewWriter(ioutil.Discard, RateOpts{Interval: 100 * time.Millisecond, Size: 100, Coarse: true})
+	w.bucket.clock = clock
+	trace := w.EnableTrace(3)
+
+	// Write 250 bytes, taking three chunks, then a small write which fits
+	// in the current interval.
+	start := clock.Now()
+	w.Write(make([]byte, 250))
+	w.Write(make([]byte, 10))
+
+	// The oldest of the four events is dropped.
+	expect := []TraceEvent{
+		{start, 150, 100, 100 * time.Millisecond},
+		{start.Add(100 * time.Millisecond), 50, 50, 100 * time.Millisecond},
+		{start.Add(200 * time.Millisecond), 10, 10, 0},
+	}
+	events := trace.Snapshot()
+	if len(events) != len(expect) {
+		t.Fatalf("expect %d events, got: %v", len(expect), events)
+	}
+	for i := range expect {
+		if !events[i].Time.Equal(expect[i].Time) ||
+			events[i].Requested != expect[i].Requested ||
+			events[i].Granted != expect[i].Granted ||
+			events[i].Waited != expect[i].Waited {
+			t.Fatalf("expect %v\nactual: %v", expect[i], events[i])
+		}
+	}
+
+	lines := strings.Split(strings.TrimSpace(trace.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expect 3 lines, got: %q", lines)
+	}
+	if !strings.HasSuffix(lines[0], "requested=150 granted=100 waited=100ms") {
+		t.Fatalf("bad line: %q", lines[0])
+	}
+
+	// Tracing can be stopped.
+	if w.EnableTrace(0) != nil {
+		t.Fatal("expect nil trace")
+	}
+	w.Write(make([]byte, 10))
+	if n := len(trace.Snapshot()); n != 3 {
+		t.Fatalf("expect 3 events, got: %d", n)
+	}
+}
+
+func TestTrace_Group(t *testing.T) {
+	g := NewGroup(RateOpts{Interval: time.Second, Size: 100})
+	trace := g.EnableTrace(10)
+
+	// Members of the group share the trace.
+	g.NewWriter(ioutil.Discard).Write(make([]byte, 10))
+	g.NewReader(strings.NewReader("hello")).Read(make([]byte, 5))
+
+	events := trace.Snapshot()
+	if len(events) != 2 {
+		t.Fatalf("expect 2 events, got: %v", events)
+	}
+	if events[0].Granted != 10 || events[1].Granted != 5 {
+		t.Fatalf("bad events: %v", events)
+	}
+}
+
+func TestTrace_Member(t *testing.T) {
+	g := NewGroup(RateOpts{Interval: time.Second, Size: 100})
+	w1 := g.NewWriter(ioutil.Discard)
+	w2 := g.NewWriter(ioutil.Discard)
+
+	// The trace of a member covers the whole group.
+	trace := w1.EnableTrace(10)
+	w1.Write(make([]byte, 10))
+	w2.Write(make([]byte, 20))
+	if events := trace.Snapshot(); len(events) != 2 {
+		t.Fatalf("expect 2 events, got: %v", events)
+	}
+
+	// Enabling the trace of another member replaces it.
+	trace2 := w2.EnableTrace(10)
+	w1.Write(make([]byte, 10))
+	if events := trace.Snapshot(); len(events) != 2 {
+		t.Fatalf("expect 2 events, got: %v", events)
+	}
+	if events := trace2.Snapshot(); len(events) != 1 {
+		t.Fatalf("expect 1 event, got: %v", events)
+	}
+}
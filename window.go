@@ -0,0 +1,45 @@
+package iocap
+
+// newMultiBucket creates a bucket limiting operations by every one of the
+// given rates at once. The bucket itself has the first rate, and its
+// windows have the others. Without any rates, it is unlimited.
+func newMultiBucket(opts []RateOpts) *bucket {
+	if len(opts) == 0 {
+		return newBucket(Unlimited)
+	}
+	b := newBucket(opts[0])
+	for _, o := range opts[1:] {
+		b.windows = append(b.windows, newBucket(o))
+	}
+	return b
+}
+
+// takeWindows takes the n tokens already inserted into the bucket from each
+// of its windows in turn, without blocking. Tokens a window has no room for
+// are given back to the bucket and the windows before it. It returns the
+// number of tokens taken from all of them, or zero along with the first
+// window which had no room at all, in which case nothing is kept.
+func (b *bucket) takeWindows(n int) (int, *bucket) {
+	for i, w := range b.windows {
+		v := w.tryTake(n)
+		if v < n {
+			b.giveBack(n - v)
+			for _, prev := range b.windows[:i] {
+				prev.giveBack(n - v)
+			}
+			n = v
+		}
+		if n == 0 {
+			return 0, w
+		}
+	}
+	return n, nil
+}
+
+// setClock replaces the source of time of the bucket and its windows.
+func (b *bucket) setClock(c Clock) {
+	b.clock = c
+	for _, w := range b.windows {
+		w.clock = c
+	}
+}
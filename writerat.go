@@ -0,0 +1,88 @@
+package iocap
+
+import (
+	"io"
+	"time"
+)
+
+// WriterAt implements the io.WriterAt interface and limits the rate at
+// which bytes are written to the underlying io.WriterAt. Like any
+// io.WriterAt, it may be used by multiple goroutines at once, for example
+// to write disjoint ranges of a file, in which case they share its rate.
+type WriterAt struct {
+	wa     io.WriterAt
+	bucket *bucket
+}
+
+// NewWriterAt wraps wa in a new rate limited io.WriterAt.
+func NewWriterAt(wa io.WriterAt, opts RateOpts) *WriterAt {
+	return &WriterAt{
+		wa:     wa,
+		bucket: newBucket(opts),
+	}
+}
+
+// WriteAt writes len(p) bytes to the underlying io.WriterAt starting at
+// offset off, with rate limiting. Only the bytes actually written are
+// charged, along with the Overhead and Weight of the rate.
+func (w *WriterAt) WriteAt(p []byte, off int64) (n int, err error) {
+	var s schedule
+	for n < len(p) {
+		// Ask for enough space to write all remaining bytes.
+		want, _ := w.bucket.pace(len(p)-n, &s, nil)
+
+		// Write the next range of bytes from p.
+		var v int
+		v, err = w.wa.WriteAt(p[n:n+want], off+int64(n))
+
+		// Give back the tokens of bytes which were not written.
+		if v < want {
+			w.bucket.refund(want - v)
+			s.valid = false
+		}
+		w.bucket.chargeOverhead(v, &s, nil)
+		n += v
+
+		// Return any errors from the underlying writer.
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// SetRate is used to dynamically set the rate options on the writer.
+func (w *WriterAt) SetRate(opts RateOpts) {
+	w.bucket.setRate(opts)
+}
+
+// RampTo gradually changes the rate of the writer to opts over the given
+// duration, stepping the rate once per interval. A subsequent SetRate or
+// RampTo cancels the ramp.
+func (w *WriterAt) RampTo(opts RateOpts, over time.Duration) {
+	w.bucket.rampTo(opts, over)
+}
+
+// Rate returns the rate options currently in effect on the writer.
+func (w *WriterAt) Rate() RateOpts {
+	return w.bucket.rate()
+}
+
+// SetClock replaces the source of time of the writer, which is shared by
+// any other members of its group. It must be called before the writer is
+// used.
+func (w *WriterAt) SetClock(c Clock) {
+	w.bucket.setClock(c)
+}
+
+// NewWriterAt creates and returns a new io.WriterAt in the group.
+func (g *Group) NewWriterAt(wa io.WriterAt) *WriterAt {
+	if g.parent != nil {
+		// Writes pass through the parent's writer on the way out.
+		wa = g.parent.NewWriterAt(wa)
+	}
+	return &WriterAt{
+		wa:     wa,
+		bucket: g.bucket,
+	}
+}
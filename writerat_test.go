@@ -0,0 +1,117 @@
+package iocap
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// writerAtFunc adapts a function to an io.WriterAt.
+type writerAtFunc func(p []byte, off int64) (int, error)
+
+func (f writerAtFunc) WriteAt(p []byte, off int64) (int, error) {
+	return f(p, off)
+}
+
+func TestWriterAt(t *testing.T) {
+	clock := newFakeClock()
+	var written []int64
+	wa := writerAtFunc(func(p []byte, off int64) (int, error) {
+		written = append(written, off)
+		return len(p), nil
+	})
+	w := NewWriterAt(wa, RateOpts{Interval: 100 * time.Millisecond, Size: 128, Coarse: true})
+	w.SetClock(clock)
+
+	// 384 bytes need two drains, written at increasing offsets.
+	start := clock.Now()
+	n, err := w.WriteAt(make([]byte, 384), 1000)
+	if n != 384 || err != nil {
+		t.Fatalf("expect 384/nil, got: %d/%v", n, err)
+	}
+	if d := clock.Now().Sub(start); d != 200*time.Millisecond {
+		t.Fatalf("expect 200ms, took %s", d)
+	}
+	if len(written) != 3 || written[0] != 1000 || written[1] != 1128 || written[2] != 1256 {
+		t.Fatalf("bad offsets: %v", written)
+	}
+}
+
+func TestWriterAt_Error(t *testing.T) {
+	// Partial writes return the count along with the error.
+	wa := writerAtFunc(func(p []byte, off int64) (int, error) {
+		return len(p) / 2, errFailed
+	})
+	w := NewWriterAt(wa, RateOpts{Interval: time.Second, Size: 100})
+	if n, err := w.WriteAt(make([]byte, 80), 0); n != 40 || err != errFailed {
+		t.Fatalf("expect 40/%v, got: %d/%v", errFailed, n, err)
+	}
+
+	// The quota of the bytes not written is given back.
+	if n := w.bucket.available(); n != 60 {
+		t.Fatalf("expect 60 available, got: %d", n)
+	}
+}
+
+func TestWriterAt_Overhead(t *testing.T) {
+	wa := writerAtFunc(func(p []byte, off int64) (int, error) {
+		return len(p), nil
+	})
+	w := NewWriterAt(wa, RateOpts{Interval: time.Second, Size: 100, Overhead: 5, Weight: 2})
+
+	// Writes are charged twice their bytes, plus the overhead.
+	if _, err := w.WriteAt(make([]byte, 10), 0); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if n := w.bucket.available(); n != 75 {
+		t.Fatalf("expect 75 available, got: %d", n)
+	}
+}
+
+func TestGroupNewWriterAt(t *testing.T) {
+	data := make([]byte, 1024)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	f, err := ioutil.TempFile("", "iocap")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	// Write four disjoint ranges of the file concurrently, sharing one
+	// group.
+	g := NewGroup(RateOpts{Interval: 100 * time.Millisecond, Size: 256})
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			off := int64(i * 256)
+			w := g.NewWriterAt(f)
+			if n, err := w.WriteAt(data[off:off+256], off); n != 256 || err != nil {
+				t.Errorf("expect 256/nil, got: %d/%v", n, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// 1024 bytes at 256 per interval need three drains.
+	if d := time.Since(start); d < 300*time.Millisecond {
+		t.Fatalf("writes returned too quickly in %s", d)
+	}
+	out, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(out, data) {
+		t.Fatal("unexpected data written")
+	}
+}
@@ -0,0 +1,81 @@
+/*
+Package xrate adapts limiters with the API of golang.org/x/time/rate to
+iocap.TokenSource, so that iocap readers, writers and groups can be backed
+by them. The package does not depend on x/time/rate itself.
+
+	lim := rate.NewLimiter(rate.Limit(1<<20), 64<<10)
+	ts := xrate.New(lim, func(perSecond float64, burst int) {
+		lim.SetLimit(rate.Limit(perSecond))
+		lim.SetBurst(burst)
+	})
+	w := iocap.NewWriterWith(w, ts)
+*/
+package xrate
+
+import (
+	"context"
+	"math"
+
+	"github.com/ryanuber/iocap"
+)
+
+// Limiter is the part of *rate.Limiter used by the adapter.
+type Limiter interface {
+	WaitN(ctx context.Context, n int) error
+	Burst() int
+}
+
+// source implements iocap.TokenSource on top of a Limiter.
+type source struct {
+	lim     Limiter
+	setRate func(perSecond float64, burst int)
+}
+
+// New returns a TokenSource taking tokens from lim. Each wait takes at most
+// the burst of lim. setRate is called by SetRate with the rate in tokens
+// per second, which is math.MaxFloat64 (rate.Inf) for iocap.Unlimited, and
+// the burst size. It may be nil if the rate is never changed through iocap.
+func New(lim Limiter, setRate func(perSecond float64, burst int)) iocap.TokenSource {
+	return &source{lim: lim, setRate: setRate}
+}
+
+// Wait implements iocap.TokenSource. If lim refuses to wait, such as when
+// its burst is zero, the tokens are granted anyway rather than blocking the
+// caller forever.
+func (s *source) Wait(n int) int {
+	if b := s.lim.Burst(); b > 0 && n > b {
+		n = b
+	}
+	s.lim.WaitN(context.Background(), n)
+	return n
+}
+
+// WaitContext is like Wait, but gives up once ctx is done, so that iocap
+// readers and writers stop waiting on lim when they are canceled or time
+// out.
+func (s *source) WaitContext(ctx context.Context, n int) (int, error) {
+	if b := s.lim.Burst(); b > 0 && n > b {
+		n = b
+	}
+	if err := s.lim.WaitN(ctx, n); err != nil && ctx.Err() != nil {
+		return 0, ctx.Err()
+	}
+	return n, nil
+}
+
+// SetRate implements iocap.TokenSource.
+func (s *source) SetRate(opts iocap.RateOpts) {
+	if s.setRate == nil {
+		return
+	}
+	if opts.IsUnlimited() {
+		s.setRate(math.MaxFloat64, opts.Size)
+		return
+	}
+
+	burst := opts.Size
+	if opts.Burst > burst {
+		burst = opts.Burst
+	}
+	s.setRate(float64(opts.Size)/opts.Interval.Seconds(), burst)
+}
@@ -0,0 +1,92 @@
+package xrate
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/ryanuber/iocap"
+)
+
+// mockLimiter records the waits made on it.
+type mockLimiter struct {
+	burst int
+	waits []int
+}
+
+func (m *mockLimiter) WaitN(ctx context.Context, n int) error {
+	m.waits = append(m.waits, n)
+	if n > m.burst {
+		return errors.New("exceeds burst")
+	}
+	return nil
+}
+
+func (m *mockLimiter) Burst() int {
+	return m.burst
+}
+
+func TestWait(t *testing.T) {
+	lim := &mockLimiter{burst: 4}
+	buf := new(bytes.Buffer)
+	w := iocap.NewWriterWith(buf, New(lim, nil))
+
+	// Writes are split into waits of at most the burst.
+	if _, err := w.Write(make([]byte, 10)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if buf.Len() != 10 {
+		t.Fatalf("expect 10, got: %d", buf.Len())
+	}
+	if len(lim.waits) != 3 || lim.waits[0] != 4 || lim.waits[1] != 4 || lim.waits[2] != 2 {
+		t.Fatalf("bad waits: %v", lim.waits)
+	}
+}
+
+func TestSetRate(t *testing.T) {
+	var perSecond float64
+	var burst int
+	ts := New(&mockLimiter{}, func(r float64, b int) {
+		perSecond, burst = r, b
+	})
+
+	ts.SetRate(iocap.RateOpts{Interval: 100 * time.Millisecond, Size: 10})
+	if perSecond != 100 || burst != 10 {
+		t.Fatalf("bad rate: %f, %d", perSecond, burst)
+	}
+
+	ts.SetRate(iocap.RateOpts{Interval: time.Second, Size: 10, Burst: 50})
+	if perSecond != 10 || burst != 50 {
+		t.Fatalf("bad rate: %f, %d", perSecond, burst)
+	}
+
+	ts.SetRate(iocap.Unlimited)
+	if perSecond != math.MaxFloat64 {
+		t.Fatalf("bad rate: %f", perSecond)
+	}
+}
+
+// blockingLimiter never allows any tokens, waiting until ctx is done.
+type blockingLimiter struct{}
+
+func (blockingLimiter) WaitN(ctx context.Context, n int) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (blockingLimiter) Burst() int {
+	return 1
+}
+
+func TestWait_Timeout(t *testing.T) {
+	w := iocap.NewWriterWith(new(bytes.Buffer), New(blockingLimiter{}, nil))
+	w.SetWaitTimeout(10 * time.Millisecond)
+
+	// The wait on the limiter is abandoned once the timeout passes.
+	if n, err := w.Write(make([]byte, 10)); n != 0 || err != iocap.ErrRateTimeout {
+		t.Fatalf("expect 0/%v, got: %d/%v", iocap.ErrRateTimeout, n, err)
+	}
+}